@@ -0,0 +1,38 @@
+// Package alert implements alert events and the sinks they are sent to.
+package alert
+
+// Event types.
+const (
+	// TypeDeviation is a sudden deviation of a metric from its baseline.
+	TypeDeviation = "deviation"
+	// TypeNewEdge is an edge that has never been seen before.
+	TypeNewEdge = "new_edge"
+	// TypeVanishedEdge is an established edge that is no longer seen.
+	TypeVanishedEdge = "vanished_edge"
+)
+
+// Event is an anomaly event of an edge.
+type Event struct {
+	Type      string `json:"type"`
+	Timestamp int64  `json:"timestamp"`
+
+	Node      string `json:"node,omitempty"`
+	Subject   string `json:"subject,omitempty"`
+	Namespace string `json:"namespace,omitempty"`
+	Workload  string `json:"workload,omitempty"`
+	Remote    string `json:"remote,omitempty"`
+	Port      uint16 `json:"port,omitempty"`
+	Protocol  string `json:"protocol,omitempty"`
+	Direction string `json:"direction,omitempty"`
+
+	// Metric, Value, Baseline and StdDev describe a deviation.
+	Metric   string  `json:"metric,omitempty"`
+	Value    float64 `json:"value,omitempty"`
+	Baseline float64 `json:"baseline,omitempty"`
+	StdDev   float64 `json:"stdDev,omitempty"`
+}
+
+// Sink represents an alert sink.
+type Sink interface {
+	Alert(evs []Event) error
+}
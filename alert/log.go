@@ -0,0 +1,40 @@
+package alert
+
+import (
+	"github.com/hamba/logger"
+)
+
+// LogSink writes alert events to a logger.
+type LogSink struct {
+	log logger.Logger
+}
+
+// NewLogSink returns a log alert sink.
+func NewLogSink(log logger.Logger) *LogSink {
+	return &LogSink{log: log}
+}
+
+// Alert logs the events.
+func (s *LogSink) Alert(evs []Event) error {
+	for _, ev := range evs {
+		ctx := []interface{}{
+			"type", ev.Type,
+			"subject", ev.Subject,
+			"remote", ev.Remote,
+			"port", ev.Port,
+			"protocol", ev.Protocol,
+		}
+		if ev.Direction != "" {
+			ctx = append(ctx, "direction", ev.Direction)
+		}
+		if ev.Node != "" {
+			ctx = append(ctx, "node", ev.Node)
+		}
+		if ev.Type == TypeDeviation {
+			ctx = append(ctx, "metric", ev.Metric, "value", ev.Value, "baseline", ev.Baseline, "stdDev", ev.StdDev)
+		}
+
+		s.log.Warn("Anomaly detected", ctx...)
+	}
+	return nil
+}
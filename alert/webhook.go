@@ -0,0 +1,109 @@
+package alert
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/hamba/logger"
+	"github.com/nrwiersma/ebpf/sink/webhook"
+)
+
+// WebhookOptsFunc represents a configuration function for the webhook sink.
+type WebhookOptsFunc func(s *WebhookSink)
+
+// WithHeader configures a header to be sent with each request.
+func WithHeader(key, value string) WebhookOptsFunc {
+	return func(s *WebhookSink) {
+		s.opts = append(s.opts, webhook.WithHeader(key, value))
+	}
+}
+
+// WithBearerToken configures the sink to use bearer token authentication.
+func WithBearerToken(token string) WebhookOptsFunc {
+	return func(s *WebhookSink) {
+		s.opts = append(s.opts, webhook.WithBearerToken(token))
+	}
+}
+
+// WithTimeout configures the request timeout.
+func WithTimeout(d time.Duration) WebhookOptsFunc {
+	return func(s *WebhookSink) {
+		s.opts = append(s.opts, webhook.WithTimeout(d))
+	}
+}
+
+// WithRetryInterval configures the initial interval between retries
+// when the endpoint is unavailable.
+func WithRetryInterval(d time.Duration) WebhookOptsFunc {
+	return func(s *WebhookSink) {
+		s.opts = append(s.opts, webhook.WithRetryInterval(d))
+	}
+}
+
+// WithMaxSpoolSize configures the maximum size of the spool in bytes.
+// When exceeded, the oldest events are dropped.
+func WithMaxSpoolSize(size int64) WebhookOptsFunc {
+	return func(s *WebhookSink) {
+		s.opts = append(s.opts, webhook.WithMaxSpoolSize(size))
+	}
+}
+
+// WithLogger configures the logger of the sink.
+func WithLogger(log logger.Logger) WebhookOptsFunc {
+	return func(s *WebhookSink) {
+		s.opts = append(s.opts, webhook.WithLogger(log))
+	}
+}
+
+// WebhookSink posts alert events to a HTTP endpoint.
+//
+// Events are spooled to disk and sent in the background by
+// a webhook sink, so alerting does not hold up the metrics,
+// and events are retried until the endpoint accepts them.
+type WebhookSink struct {
+	opts []webhook.OptsFunc
+
+	sink *webhook.Sink
+}
+
+// NewWebhookSink returns a webhook alert sink that posts to the
+// given url, spooling events in the given directory.
+func NewWebhookSink(url, dir string, opts ...WebhookOptsFunc) (*WebhookSink, error) {
+	s := &WebhookSink{}
+
+	for _, opt := range opts {
+		opt(s)
+	}
+
+	sink, err := webhook.New(url, dir, s.opts...)
+	if err != nil {
+		return nil, err
+	}
+	s.sink = sink
+
+	return s, nil
+}
+
+// Alert queues the events to be sent.
+func (s *WebhookSink) Alert(evs []Event) error {
+	if len(evs) == 0 {
+		return nil
+	}
+
+	b, err := json.Marshal(struct {
+		Events []Event `json:"events"`
+	}{Events: evs})
+	if err != nil {
+		return fmt.Errorf("unable to encode alert events: %w", err)
+	}
+
+	return s.sink.WriteBody(b)
+}
+
+// Close stops sending events. Events that have not been
+// sent remain in the spool and are sent once a new sink is
+// created on the same directory.
+func (s *WebhookSink) Close() error {
+	return s.sink.Close()
+}
@@ -0,0 +1,124 @@
+package alert
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestWebhookSink_RetriesEvents(t *testing.T) {
+	var (
+		mu     sync.Mutex
+		calls  int
+		bodies [][]byte
+	)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := io.ReadAll(r.Body)
+
+		mu.Lock()
+		defer mu.Unlock()
+
+		calls++
+		if calls == 1 {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		if r.Header.Get("Authorization") != "Bearer secret" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		bodies = append(bodies, b)
+	}))
+	defer srv.Close()
+
+	s, err := NewWebhookSink(srv.URL, t.TempDir(),
+		WithBearerToken("secret"),
+		WithRetryInterval(10*time.Millisecond),
+	)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer func() { _ = s.Close() }()
+
+	if err = s.Alert([]Event{{Type: "new_edge", Timestamp: 1, Subject: "api"}}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		mu.Lock()
+		n := len(bodies)
+		mu.Unlock()
+		if n > 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("events were not delivered")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+
+	var got struct {
+		Events []Event `json:"events"`
+	}
+	if err = json.Unmarshal(bodies[0], &got); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(got.Events) != 1 || got.Events[0].Subject != "api" || got.Events[0].Type != "new_edge" {
+		t.Errorf("unexpected events %+v", got.Events)
+	}
+	if calls < 2 {
+		t.Errorf("expected a retry, got %d calls", calls)
+	}
+}
+
+func TestWebhookSink_SpoolsUntilRestart(t *testing.T) {
+	dir := t.TempDir()
+
+	s, err := NewWebhookSink("http://127.0.0.1:1", dir, WithRetryInterval(time.Hour))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err = s.Alert([]Event{{Type: "vanished_edge", Timestamp: 1, Subject: "db"}}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	_ = s.Close()
+
+	got := make(chan []byte, 1)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := io.ReadAll(r.Body)
+		select {
+		case got <- b:
+		default:
+		}
+	}))
+	defer srv.Close()
+
+	s, err = NewWebhookSink(srv.URL, dir)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer func() { _ = s.Close() }()
+
+	select {
+	case b := <-got:
+		var body struct {
+			Events []Event `json:"events"`
+		}
+		if err = json.Unmarshal(b, &body); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if len(body.Events) != 1 || body.Events[0].Subject != "db" {
+			t.Errorf("unexpected events %+v", body.Events)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("spooled events were not delivered")
+	}
+}
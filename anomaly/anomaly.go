@@ -0,0 +1,251 @@
+// Package anomaly implements the detection of anomalies in
+// the RTT and throughput of edges against learned baselines.
+package anomaly
+
+import (
+	"math"
+	"time"
+
+	"github.com/hamba/logger"
+	"github.com/nrwiersma/ebpf/alert"
+	"github.com/nrwiersma/ebpf/flow"
+)
+
+// Metrics a baseline is learned for.
+const (
+	MetricRTTP50    = "rtt_p50"
+	MetricRTTP99    = "rtt_p99"
+	MetricBytesRate = "bytes_rate"
+)
+
+// forgetAfter is the time after which an edge that is no longer
+// seen is forgotten, and would be flagged as new when seen again.
+const forgetAfter = 24 * time.Hour
+
+var metrics = [...]string{MetricRTTP50, MetricRTTP99, MetricBytesRate}
+
+// OptsFunc represents a configuration function for the detector.
+type OptsFunc func(d *Detector)
+
+// WithSinks configures the sinks anomaly events are sent to.
+func WithSinks(sinks ...alert.Sink) OptsFunc {
+	return func(d *Detector) {
+		d.sinks = append(d.sinks, sinks...)
+	}
+}
+
+// WithAlpha configures the smoothing factor of the baselines.
+// A larger alpha adapts faster to changes.
+func WithAlpha(alpha float64) OptsFunc {
+	return func(d *Detector) {
+		d.alpha = alpha
+	}
+}
+
+// WithThreshold configures the number of standard deviations a
+// value must deviate from its baseline to be an anomaly, and the
+// minimum relative change, e.g. 0.5 for 50%.
+func WithThreshold(stdDevs, minChange float64) OptsFunc {
+	return func(d *Detector) {
+		d.stdDevs = stdDevs
+		d.minChange = minChange
+	}
+}
+
+// WithWarmup configures the number of intervals a baseline is learned
+// for before deviations are flagged. Edges seen within the first
+// warmup intervals of the detector are not flagged as new.
+func WithWarmup(n int) OptsFunc {
+	return func(d *Detector) {
+		d.warmup = n
+	}
+}
+
+// WithVanishAfter configures the time after which an established
+// edge that is no longer seen is flagged as vanished.
+func WithVanishAfter(dur time.Duration) OptsFunc {
+	return func(d *Detector) {
+		d.vanishAfter = dur
+	}
+}
+
+// WithLogger configures the logger of the detector.
+func WithLogger(log logger.Logger) OptsFunc {
+	return func(d *Detector) {
+		d.log = log
+	}
+}
+
+// ewma is an exponentially weighted moving mean and variance.
+type ewma struct {
+	mean float64
+	vari float64
+	init bool
+}
+
+func (e *ewma) Add(alpha, v float64) {
+	if !e.init {
+		e.mean = v
+		e.init = true
+		return
+	}
+
+	diff := v - e.mean
+	e.mean += alpha * diff
+	e.vari = (1 - alpha) * (e.vari + alpha*diff*diff)
+}
+
+type baseline struct {
+	samples  [len(metrics)]int
+	vals     [len(metrics)]ewma
+	deviated [len(metrics)]bool
+	lastSeen int64
+	vanished bool
+}
+
+// Detector learns baselines per edge from the metrics of every
+// interval, and flags deviations, new edges and vanished edges.
+//
+// It implements a metrics sink, and should receive the
+// metrics of every interval. It is not safe for concurrent use.
+type Detector struct {
+	sinks       []alert.Sink
+	alpha       float64
+	stdDevs     float64
+	minChange   float64
+	warmup      int
+	vanishAfter time.Duration
+
+	intervals int
+	edges     map[flow.Key]*baseline
+
+	log logger.Logger
+}
+
+// New returns an anomaly detector.
+func New(opts ...OptsFunc) *Detector {
+	d := &Detector{
+		alpha:       0.1,
+		stdDevs:     4,
+		minChange:   0.5,
+		warmup:      30,
+		vanishAfter: 5 * time.Minute,
+		edges:       map[flow.Key]*baseline{},
+		log:         logger.New(logger.DiscardHandler()),
+	}
+
+	for _, opt := range opts {
+		opt(d)
+	}
+
+	return d
+}
+
+// Write adds the metrics of an interval to the baselines,
+// sending any detected anomalies to the alert sinks.
+func (d *Detector) Write(ms []flow.Metric) error {
+	ts := time.Now().Unix()
+	if len(ms) > 0 {
+		ts = ms[0].Timestamp
+	}
+	d.intervals++
+
+	var evs []alert.Event
+	for _, m := range ms {
+		// Overflow buckets mix many edges, they have no baseline.
+		if m.Remote == flow.Overflow {
+			continue
+		}
+
+		k := m.Key()
+		b, ok := d.edges[k]
+		if !ok {
+			b = &baseline{}
+			d.edges[k] = b
+
+			if d.intervals > d.warmup {
+				evs = append(evs, newEvent(alert.TypeNewEdge, ts, k))
+			}
+		}
+		b.lastSeen = ts
+		b.vanished = false
+
+		var vals [len(metrics)]float64
+		has := [len(metrics)]bool{false, false, true}
+		if m.RTT != nil && m.RTT.Count() > 0 {
+			vals[0], vals[1] = m.RTT.Quantile(0.5), m.RTT.Quantile(0.99)
+			has[0], has[1] = true, true
+		}
+		vals[2] = m.BytesRate
+
+		for i, v := range vals {
+			if !has[i] {
+				continue
+			}
+
+			e := &b.vals[i]
+			if b.samples[i] >= d.warmup {
+				deviated := d.deviates(e, v)
+				if deviated && !b.deviated[i] {
+					ev := newEvent(alert.TypeDeviation, ts, k)
+					ev.Metric = metrics[i]
+					ev.Value = v
+					ev.Baseline = e.mean
+					ev.StdDev = math.Sqrt(e.vari)
+					evs = append(evs, ev)
+				}
+				b.deviated[i] = deviated
+			}
+
+			e.Add(d.alpha, v)
+			b.samples[i]++
+		}
+	}
+
+	for k, b := range d.edges {
+		unseen := time.Duration(ts-b.lastSeen) * time.Second
+		switch {
+		case unseen >= forgetAfter:
+			delete(d.edges, k)
+		case unseen >= d.vanishAfter && !b.vanished:
+			b.vanished = true
+			if b.samples[2] >= d.warmup {
+				evs = append(evs, newEvent(alert.TypeVanishedEdge, ts, k))
+			}
+		}
+	}
+
+	if len(evs) == 0 {
+		return nil
+	}
+	for _, sink := range d.sinks {
+		if err := sink.Alert(evs); err != nil {
+			d.log.Error("Unable to send alert events", "error", err)
+		}
+	}
+	return nil
+}
+
+// deviates determines if the value deviates from the baseline.
+func (d *Detector) deviates(e *ewma, v float64) bool {
+	diff := math.Abs(v - e.mean)
+	if e.mean != 0 && diff/math.Abs(e.mean) < d.minChange {
+		return false
+	}
+	return diff > d.stdDevs*math.Sqrt(e.vari)
+}
+
+func newEvent(typ string, ts int64, k flow.Key) alert.Event {
+	return alert.Event{
+		Type:      typ,
+		Timestamp: ts,
+		Node:      k.Node,
+		Subject:   k.Subject,
+		Namespace: k.Namespace,
+		Workload:  k.Workload,
+		Remote:    k.Remote,
+		Port:      k.Port,
+		Protocol:  k.Protocol,
+		Direction: k.Direction,
+	}
+}
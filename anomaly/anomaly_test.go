@@ -0,0 +1,171 @@
+package anomaly
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/influxdata/tdigest"
+	"github.com/nrwiersma/ebpf/alert"
+	"github.com/nrwiersma/ebpf/flow"
+)
+
+type sinkFunc func(evs []alert.Event) error
+
+func (f sinkFunc) Alert(evs []alert.Event) error {
+	return f(evs)
+}
+
+// interval is the metrics of an interval, as edges with their bytes rate.
+type interval struct {
+	ts    int64
+	edges map[string]float64
+}
+
+const day = int64(forgetAfter / time.Second)
+
+func TestDetector_Write(t *testing.T) {
+	steady := func(n int, rate float64) []interval {
+		ivs := make([]interval, 0, n)
+		for i := 0; i < n; i++ {
+			ivs = append(ivs, interval{ts: int64(i) * 10, edges: map[string]float64{"a": rate, "b": rate}})
+		}
+		return ivs
+	}
+
+	tests := []struct {
+		name      string
+		intervals []interval
+		want      []string
+	}{
+		{
+			name: "no new edges during warmup",
+			intervals: []interval{
+				{ts: 0, edges: map[string]float64{"a": 100}},
+				{ts: 10, edges: map[string]float64{"a": 100, "b": 100}},
+				{ts: 20, edges: map[string]float64{"a": 100, "b": 100, "c": 100}},
+			},
+			want: []string{"new_edge c"},
+		},
+		{
+			name: "no deviations during warmup",
+			intervals: []interval{
+				{ts: 0, edges: map[string]float64{"a": 100}},
+				{ts: 10, edges: map[string]float64{"a": 10000}},
+			},
+		},
+		{
+			name: "deviations are edge triggered",
+			intervals: append(steady(3, 100),
+				interval{ts: 30, edges: map[string]float64{"a": 1000, "b": 100}},
+				interval{ts: 40, edges: map[string]float64{"a": 1000, "b": 100}},
+				interval{ts: 50, edges: map[string]float64{"a": 100, "b": 100}},
+				interval{ts: 60, edges: map[string]float64{"a": 1000, "b": 100}},
+			),
+			want: []string{"deviation a bytes_rate 1000", "deviation a bytes_rate 1000"},
+		},
+		{
+			name: "small changes are not deviations",
+			intervals: append(steady(3, 100),
+				interval{ts: 30, edges: map[string]float64{"a": 140, "b": 100}},
+			),
+		},
+		{
+			name: "vanished edges are flagged once",
+			intervals: append(steady(3, 100),
+				interval{ts: 40, edges: map[string]float64{"b": 100}},
+				interval{ts: 50, edges: map[string]float64{"b": 100}},
+				interval{ts: 60, edges: map[string]float64{"b": 100}},
+			),
+			want: []string{"vanished_edge a"},
+		},
+		{
+			name: "edges seen during warmup do not vanish",
+			intervals: []interval{
+				{ts: 0, edges: map[string]float64{"a": 100, "b": 100}},
+				{ts: 10, edges: map[string]float64{"b": 100}},
+				{ts: 40, edges: map[string]float64{"b": 100}},
+			},
+		},
+		{
+			name: "returning edges are not new",
+			intervals: append(steady(3, 100),
+				interval{ts: 50, edges: map[string]float64{"b": 100}},
+				interval{ts: 60, edges: map[string]float64{"a": 100, "b": 100}},
+			),
+			want: []string{"vanished_edge a"},
+		},
+		{
+			name: "edges are forgotten after a day",
+			intervals: append(steady(3, 100),
+				interval{ts: 50, edges: map[string]float64{"b": 100}},
+				interval{ts: 20 + day, edges: map[string]float64{"b": 100}},
+				interval{ts: 30 + day, edges: map[string]float64{"a": 100, "b": 100}},
+			),
+			want: []string{"vanished_edge a", "new_edge a"},
+		},
+		{
+			name: "overflow buckets are ignored",
+			intervals: append(steady(3, 100),
+				interval{ts: 30, edges: map[string]float64{flow.Overflow: 100, "a": 100, "b": 100}},
+			),
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var got []string
+			sink := sinkFunc(func(evs []alert.Event) error {
+				for _, ev := range evs {
+					s := ev.Type + " " + ev.Remote
+					if ev.Type == alert.TypeDeviation {
+						s += fmt.Sprintf(" %s %v", ev.Metric, ev.Value)
+					}
+					got = append(got, s)
+				}
+				return nil
+			})
+			d := New(WithSinks(sink), WithAlpha(0.01), WithWarmup(2), WithVanishAfter(30*time.Second))
+
+			for _, iv := range test.intervals {
+				ms := make([]flow.Metric, 0, len(iv.edges))
+				for remote, rate := range iv.edges {
+					ms = append(ms, flow.Metric{Timestamp: iv.ts, Subject: "default/api", Remote: remote, BytesRate: rate})
+				}
+				if err := d.Write(ms); err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+			}
+
+			if fmt.Sprint(got) != fmt.Sprint(test.want) {
+				t.Errorf("expected events %v, got %v", test.want, got)
+			}
+		})
+	}
+}
+
+func TestDetector_WriteRTT(t *testing.T) {
+	var got []alert.Event
+	sink := sinkFunc(func(evs []alert.Event) error {
+		got = append(got, evs...)
+		return nil
+	})
+	d := New(WithSinks(sink), WithWarmup(2))
+
+	for i, rtt := range []float64{100, 100, 100, 5000} {
+		m := flow.Metric{Timestamp: int64(i) * 10, Subject: "default/api", Remote: "default/db", RTT: tdigest.New()}
+		m.RTT.Add(rtt, 1)
+		if err := d.Write([]flow.Metric{m}); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+
+	if len(got) != 2 {
+		t.Fatalf("expected 2 events, got %v", got)
+	}
+	for i, metric := range []string{MetricRTTP50, MetricRTTP99} {
+		if got[i].Type != alert.TypeDeviation || got[i].Metric != metric || got[i].Value != 5000 || got[i].Baseline != 100 {
+			t.Errorf("unexpected event %+v", got[i])
+		}
+	}
+}
@@ -1,10 +1,14 @@
 package ebpf
 
 import (
+	"errors"
+	"fmt"
+	"sync/atomic"
 	"time"
 
 	"github.com/hamba/logger"
 	"github.com/nrwiersma/ebpf/container"
+	"github.com/nrwiersma/ebpf/flow"
 	"github.com/nrwiersma/ebpf/packet"
 )
 
@@ -12,6 +16,7 @@ import (
 type Containers interface {
 	Events() <-chan container.Event
 	Name(ip [16]byte) string
+	Workload(ip [16]byte) string
 	Close() error
 }
 
@@ -21,12 +26,111 @@ type Packets interface {
 	Watch(pktFn func(pkt packet.Packet), lostFn func(cnt uint64))
 }
 
+// Sink represents a metrics sink.
+type Sink interface {
+	Write(ms []flow.Metric) error
+}
+
+// AppOptsFunc represents a configuration function
+// for the application.
+type AppOptsFunc func(a *App)
+
+// WithInterval configures the interval metrics are flushed at.
+func WithInterval(d time.Duration) AppOptsFunc {
+	return func(a *App) {
+		a.inter = d
+	}
+}
+
+// WithSinks configures sinks the application writes its metrics
+// to at the given resolution. Resolutions coarser than the interval
+// receive metrics rolled up into windows aligned to the wall clock.
+// A zero resolution writes the metrics of every interval.
+func WithSinks(res time.Duration, sinks ...Sink) AppOptsFunc {
+	return func(a *App) {
+		a.sinks[res] = append(a.sinks[res], sinks...)
+	}
+}
+
+// WithObservers configures sinks that observe the metrics of every
+// interval. Unlike sinks, observers always receive the deltas of the
+// interval, also in cumulative mode.
+func WithObservers(obs ...Sink) AppOptsFunc {
+	return func(a *App) {
+		a.obs = append(a.obs, obs...)
+	}
+}
+
+// WithNode configures the name of the node the application runs on.
+func WithNode(name string) AppOptsFunc {
+	return func(a *App) {
+		a.node = name
+	}
+}
+
+// WithDimensions configures the dimensions metrics are aggregated by.
+func WithDimensions(dims ...Dimension) AppOptsFunc {
+	return func(a *App) {
+		a.dims = dims
+	}
+}
+
+// WithSeriesLimit configures the maximum number of series per
+// interval. Flows beyond the limit are folded into an overflow
+// bucket per subject, except for the top k heavy hitters by
+// bytes and by peak RTT of the current and previous interval.
+func WithSeriesLimit(limit, topK int) AppOptsFunc {
+	return func(a *App) {
+		a.limit = limit
+		a.topK = topK
+	}
+}
+
+// WithCumulative configures the application to write cumulative
+// counters and digests of the edges seen in an interval, instead of
+// the deltas of the interval. Rollups are not affected. The state is
+// checkpointed to the given path at the given interval, and on close,
+// and is restored from it on start. Edges idle for a day are removed,
+// and start over when seen again, which is flagged by their start time.
+func WithCumulative(path string, checkpoint time.Duration) AppOptsFunc {
+	return func(a *App) {
+		a.cumPath = path
+		a.cumEvery = checkpoint
+	}
+}
+
+// WithAdaptiveSampling configures the application to sample packets
+// in the kernel when samples are lost, raising the 1 in N sampling
+// rate up to the maximum rate, and lowering it again once samples
+// are no longer lost. Sampled packets are scaled back up.
+func WithAdaptiveSampling(maxRate uint32) AppOptsFunc {
+	return func(a *App) {
+		a.smplMax = maxRate
+	}
+}
+
 // App is the core orchestrator.
 type App struct {
-	ctrs Containers
-	pkts Packets
+	ctrs  Containers
+	pkts  Packets
+	sinks map[time.Duration][]Sink
+	obs   []Sink
+	inter time.Duration
+	node  string
+	dims  []Dimension
+	limit int
+	topK  int
+
+	cumPath  string
+	cumEvery time.Duration
+	cum      *cumulative
+	cumLast  time.Time
 
-	mtrs *metricService
+	smplMax uint32
+	smpl    *sampling
+
+	mtrs  *metricService
+	cntrs counters
 
 	doneCh chan struct{}
 
@@ -34,15 +138,66 @@ type App struct {
 }
 
 // NewApp returns an application.
-func NewApp(ctrs Containers, pkts Packets, log logger.Logger) (*App, error) {
+func NewApp(ctrs Containers, pkts Packets, log logger.Logger, opts ...AppOptsFunc) (*App, error) {
 	app := &App{
 		ctrs:   ctrs,
 		pkts:   pkts,
+		sinks:  map[time.Duration][]Sink{},
+		inter:  10 * time.Second,
+		dims:   DefaultDimensions,
 		doneCh: make(chan struct{}),
 		log:    log,
 	}
 
-	app.mtrs = newMetricsService(10*time.Second, app.handleMetrics)
+	for _, opt := range opts {
+		opt(app)
+	}
+
+	if app.inter <= 0 {
+		return nil, errors.New("interval must be positive")
+	}
+	if sinks, ok := app.sinks[0]; ok {
+		delete(app.sinks, 0)
+		app.sinks[app.inter] = append(app.sinks[app.inter], sinks...)
+	}
+
+	if app.smplMax > 1 {
+		if _, ok := pkts.(packetSampler); !ok {
+			return nil, errors.New("packets do not support sampling")
+		}
+		app.smpl = newSampling(app.smplMax)
+		if err := app.setSampleRate(app.smpl.rate); err != nil {
+			return nil, err
+		}
+	}
+
+	if app.cumPath != "" {
+		cum, err := newCumulative(app.cumPath)
+		if err != nil {
+			return nil, err
+		}
+		app.cum = cum
+		app.cumLast = time.Now()
+	}
+
+	var rollups []time.Duration
+	for res := range app.sinks {
+		if res == app.inter {
+			continue
+		}
+		if res < app.inter || res%app.inter != 0 {
+			return nil, fmt.Errorf("resolution %s must be a multiple of the interval %s", res, app.inter)
+		}
+		rollups = append(rollups, res)
+	}
+
+	app.mtrs = newMetricsService(metricConfig{
+		Interval:    app.inter,
+		Dims:        app.dims,
+		Rollups:     rollups,
+		SeriesLimit: app.limit,
+		TopK:        app.topK,
+	}, app.handleMetrics)
 
 	go pkts.Watch(app.handlePacket, app.handleLost)
 
@@ -65,12 +220,18 @@ func (a *App) watchContainers() {
 		switch evnt.Type {
 		case container.Added:
 			if err := a.pkts.AttachContainer(evnt.Name, evnt.CGroupPath); err != nil {
+				atomic.AddUint64(&a.cntrs.attachFailures, 1)
 				a.log.Error("Unable to attach to container", "error", err)
+				continue
 			}
+			atomic.AddUint64(&a.cntrs.attaches, 1)
 		case container.Removed:
 			if err := a.pkts.DetachContainer(evnt.Name); err != nil {
+				atomic.AddUint64(&a.cntrs.detachFailures, 1)
 				a.log.Error("Unable to detach to container", "error", err)
+				continue
 			}
+			atomic.AddUint64(&a.cntrs.detaches, 1)
 		default:
 			a.log.Error("Unable to to handle container event", "event", evnt.Type)
 		}
@@ -78,19 +239,24 @@ func (a *App) watchContainers() {
 }
 
 func (a *App) handlePacket(pkt packet.Packet) {
+	atomic.AddUint64(&a.cntrs.read, 1)
+
 	var (
 		sip, rip  [16]byte
 		bin, bout uint64
+		dir       string
 	)
 	switch {
 	case pkt.Flags&packet.FlagIn == packet.FlagIn:
 		sip = pkt.DestIP
 		rip = pkt.SrcIP
 		bin = uint64(pkt.Len)
+		dir = "in"
 	case pkt.Flags&packet.FlagOut == packet.FlagOut:
 		sip = pkt.SrcIP
 		rip = pkt.DestIP
 		bout = uint64(pkt.Len)
+		dir = "out"
 	default:
 		a.log.Error("Unknown direction", "pkt", pkt)
 	}
@@ -109,21 +275,68 @@ func (a *App) handlePacket(pkt packet.Packet) {
 		proto = "TCP"
 	}
 
+	subj := a.ctrs.Name(sip)
 	rec := record{
 		Timestamp: pkt.Timestamp,
-		Subject:   a.ctrs.Name(sip),
+		Node:      a.node,
+		Subject:   subj,
+		Namespace: flow.Namespace(subj),
+		Workload:  a.ctrs.Workload(sip),
 		Remote:    a.ctrs.Name(rip),
 		Port:      port,
 		Protocol:  proto,
+		Direction: dir,
 		BytesIn:   bin,
 		BytesOut:  bout,
 		RTT:       float64(pkt.RTT) / 1000000, // Convert to ms.
+		Weight:    uint64(pkt.SampleRate),
 	}
 
 	a.mtrs.Add(rec)
 }
 
-func (a *App) handleMetrics(ms []metric) {
+// namespace returns the namespace of a "namespace/name" subject.
+func (a *App) handleMetrics(res time.Duration, ms []flow.Metric) {
+	series := len(ms)
+	if res == a.inter {
+		a.logMetrics(ms)
+
+		for _, o := range a.obs {
+			if err := o.Write(ms); err != nil {
+				a.log.Error("Unable to write metrics to observer", "error", err)
+			}
+		}
+
+		if a.cum != nil {
+			ms = a.cumulate(ms)
+		}
+	}
+
+	for _, sink := range a.sinks[res] {
+		if err := sink.Write(ms); err != nil {
+			a.log.Error("Unable to write metrics to sink", "resolution", res, "error", err)
+		}
+	}
+
+	if res == a.inter {
+		a.writeStats(series)
+	}
+}
+
+func (a *App) cumulate(ms []flow.Metric) []flow.Metric {
+	now := time.Now()
+	ms = a.cum.Add(now.Truncate(a.inter).Unix(), ms)
+
+	if a.cumEvery > 0 && now.Sub(a.cumLast) >= a.cumEvery {
+		a.cumLast = now
+		if err := a.cum.Checkpoint(); err != nil {
+			a.log.Error("Unable to checkpoint cumulative state", "error", err)
+		}
+	}
+	return ms
+}
+
+func (a *App) logMetrics(ms []flow.Metric) {
 	for _, m := range ms {
 		a.log.Info("Got",
 			"time", m.Timestamp,
@@ -133,6 +346,9 @@ func (a *App) handleMetrics(ms []metric) {
 			"proto", m.Protocol,
 			"out", m.BytesOut,
 			"in", m.BytesIn,
+			"pkts out", m.PacketsOut,
+			"pkts in", m.PacketsIn,
+			"bytes/s", m.BytesRate,
 			"rtt p50", m.RTT.Quantile(0.5),
 			"rtt p90", m.RTT.Quantile(0.9),
 			"rtt p95", m.RTT.Quantile(0.95),
@@ -141,12 +357,19 @@ func (a *App) handleMetrics(ms []metric) {
 }
 
 func (a *App) handleLost(cnt uint64) {
-	a.log.Error("Lost events", "count", cnt)
+	atomic.AddUint64(&a.cntrs.lost, cnt)
 }
 
 // Close closes the application.
 func (a *App) Close() error {
 	close(a.doneCh)
 
-	return a.mtrs.Close()
+	if err := a.mtrs.Close(); err != nil {
+		return err
+	}
+
+	if a.cum != nil {
+		return a.cum.Checkpoint()
+	}
+	return nil
 }
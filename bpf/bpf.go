@@ -3,6 +3,13 @@ package bpf
 // Required for embed.
 import _ "embed"
 
+//go:generate go run ./internal/gentypes -obj dist/metrics_sock.o -out types.go pkt_entry stash_tuple lpm_key
+
 // MetricsSock is the eBPF metrics socket program.
 //go:embed dist/metrics_sock.o
 var MetricsSock []byte
+
+// MetricsSockCompat is the eBPF metrics socket program for kernels
+// without bpf_skb_cgroup_id, which cannot filter packets by cgroup.
+//go:embed dist/metrics_sock_compat.o
+var MetricsSockCompat []byte
@@ -0,0 +1,289 @@
+// Package btf implements a minimal reader of the BTF type
+// information in BPF objects, enough to describe the layout
+// of the types shared between the kernel and userspace.
+package btf
+
+import (
+	"bytes"
+	"debug/elf"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+const btfMagic = 0xeb9f
+
+// Kind is the kind of a BTF type.
+type Kind uint8
+
+// BTF kinds.
+const (
+	KindUnknown Kind = iota
+	KindInt
+	KindPtr
+	KindArray
+	KindStruct
+	KindUnion
+	KindEnum
+	KindFwd
+	KindTypedef
+	KindVolatile
+	KindConst
+	KindRestrict
+	KindFunc
+	KindFuncProto
+	KindVar
+	KindDatasec
+	KindFloat
+	KindDeclTag
+	KindTypeTag
+	KindEnum64
+)
+
+// Type is a BTF type.
+type Type struct {
+	Kind Kind
+	Name string
+	// Size is the size in bytes of ints, floats, structs, unions and enums.
+	Size uint32
+	// Signed reports if an int is signed.
+	Signed bool
+	// Target is the pointed to, qualified or aliased type,
+	// or the element type of an array.
+	Target *Type
+	// Len is the number of elements of an array.
+	Len uint32
+	// Members are the members of a struct or union.
+	Members []Member
+}
+
+// ByteSize returns the size of the type in bytes.
+func (t *Type) ByteSize() uint32 {
+	switch t.Kind {
+	case KindInt, KindFloat, KindStruct, KindUnion, KindEnum, KindEnum64:
+		return t.Size
+	case KindTypedef, KindVolatile, KindConst, KindRestrict, KindTypeTag:
+		return t.Target.ByteSize()
+	case KindArray:
+		return t.Len * t.Target.ByteSize()
+	case KindPtr:
+		return 8
+	default:
+		return 0
+	}
+}
+
+// Member is a member of a struct or union.
+type Member struct {
+	Name string
+	// Offset is the offset of the member in bits.
+	Offset uint32
+	// BitSize is the size of a bitfield member, zero otherwise.
+	BitSize uint32
+	Type    *Type
+}
+
+// Spec contains the types of a BPF object.
+type Spec struct {
+	// ByteOrder is the byte order the object was compiled for.
+	ByteOrder binary.ByteOrder
+
+	types []*Type
+}
+
+// Load reads the BTF types of the BPF ELF object.
+func Load(obj io.ReaderAt) (*Spec, error) {
+	f, err := elf.NewFile(obj)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read object: %w", err)
+	}
+	defer func() { _ = f.Close() }()
+
+	sec := f.Section(".BTF")
+	if sec == nil {
+		return nil, errors.New("object has no BTF, it must be compiled with debug information")
+	}
+	b, err := sec.Data()
+	if err != nil {
+		return nil, fmt.Errorf("unable to read BTF: %w", err)
+	}
+
+	return Parse(b, f.ByteOrder)
+}
+
+// Parse reads raw BTF, as found in the .BTF section of
+// an object or in /sys/kernel/btf/vmlinux.
+func Parse(b []byte, bo binary.ByteOrder) (*Spec, error) {
+	types, err := parse(b, bo)
+	if err != nil {
+		return nil, err
+	}
+	return &Spec{ByteOrder: bo, types: types}, nil
+}
+
+// Struct returns the struct with the given name.
+func (s *Spec) Struct(name string) (*Type, error) {
+	for _, t := range s.types {
+		if t.Kind == KindStruct && t.Name == name {
+			return t, nil
+		}
+	}
+	return nil, fmt.Errorf("struct %s not found", name)
+}
+
+type header struct {
+	Magic   uint16
+	Version uint8
+	Flags   uint8
+	HdrLen  uint32
+	TypeOff uint32
+	TypeLen uint32
+	StrOff  uint32
+	StrLen  uint32
+}
+
+type rawType struct {
+	NameOff uint32
+	Info    uint32
+	// SizeType is the size, or the referenced type id.
+	SizeType uint32
+	data     []uint32
+}
+
+func (t rawType) kind() Kind     { return Kind((t.Info >> 24) & 0x1f) }
+func (t rawType) vlen() int      { return int(t.Info & 0xffff) }
+func (t rawType) kindFlag() bool { return t.Info>>31 == 1 }
+
+func parse(b []byte, bo binary.ByteOrder) ([]*Type, error) {
+	var hdr header
+	if err := binary.Read(bytes.NewReader(b), bo, &hdr); err != nil {
+		return nil, fmt.Errorf("unable to read BTF header: %w", err)
+	}
+	if hdr.Magic != btfMagic {
+		return nil, fmt.Errorf("invalid BTF magic %#x", hdr.Magic)
+	}
+
+	typeStart, strStart := uint64(hdr.HdrLen)+uint64(hdr.TypeOff), uint64(hdr.HdrLen)+uint64(hdr.StrOff)
+	if typeStart+uint64(hdr.TypeLen) > uint64(len(b)) || strStart+uint64(hdr.StrLen) > uint64(len(b)) {
+		return nil, errors.New("BTF sections out of bounds")
+	}
+	strs := b[strStart : strStart+uint64(hdr.StrLen)]
+	raws, err := readTypes(b[typeStart:typeStart+uint64(hdr.TypeLen)], bo)
+	if err != nil {
+		return nil, err
+	}
+
+	str := func(off uint32) (string, error) {
+		if int(off) >= len(strs) {
+			return "", fmt.Errorf("BTF string offset %d out of bounds", off)
+		}
+		end := bytes.IndexByte(strs[off:], 0)
+		if end == -1 {
+			return "", errors.New("unterminated BTF string")
+		}
+		return string(strs[off : int(off)+end]), nil
+	}
+
+	// Type ids start at 1, id 0 is void. Types are allocated
+	// up front, so references can be resolved in any order.
+	types := make([]*Type, len(raws)+1)
+	types[0] = &Type{}
+	for i := range raws {
+		types[i+1] = &Type{Kind: raws[i].kind()}
+	}
+	ref := func(id uint32) (*Type, error) {
+		if int(id) >= len(types) {
+			return nil, fmt.Errorf("BTF type id %d out of bounds", id)
+		}
+		return types[id], nil
+	}
+
+	for i, raw := range raws {
+		t := types[i+1]
+		if t.Name, err = str(raw.NameOff); err != nil {
+			return nil, err
+		}
+
+		switch t.Kind {
+		case KindInt:
+			t.Size = raw.SizeType
+			t.Signed = (raw.data[0]>>24)&0x1 == 1
+		case KindFloat, KindEnum, KindEnum64:
+			t.Size = raw.SizeType
+		case KindPtr, KindTypedef, KindVolatile, KindConst, KindRestrict, KindTypeTag:
+			if t.Target, err = ref(raw.SizeType); err != nil {
+				return nil, err
+			}
+		case KindArray:
+			if t.Target, err = ref(raw.data[0]); err != nil {
+				return nil, err
+			}
+			t.Len = raw.data[2]
+		case KindStruct, KindUnion:
+			t.Size = raw.SizeType
+			t.Members = make([]Member, raw.vlen())
+			for j := range t.Members {
+				m := &t.Members[j]
+				if m.Name, err = str(raw.data[3*j]); err != nil {
+					return nil, err
+				}
+				if m.Type, err = ref(raw.data[3*j+1]); err != nil {
+					return nil, err
+				}
+				m.Offset = raw.data[3*j+2]
+				if raw.kindFlag() {
+					m.BitSize = m.Offset >> 24
+					m.Offset &= 0xffffff
+				}
+			}
+		}
+	}
+	return types, nil
+}
+
+// readTypes splits the type section into its types, each
+// with the kind specific data following it.
+func readTypes(b []byte, bo binary.ByteOrder) ([]rawType, error) {
+	words := func(n int) ([]uint32, error) {
+		if len(b) < 4*n {
+			return nil, errors.New("BTF type section truncated")
+		}
+		ws := make([]uint32, n)
+		for i := range ws {
+			ws[i] = bo.Uint32(b[4*i:])
+		}
+		b = b[4*n:]
+		return ws, nil
+	}
+
+	var raws []rawType
+	for len(b) > 0 {
+		ws, err := words(3)
+		if err != nil {
+			return nil, err
+		}
+		raw := rawType{NameOff: ws[0], Info: ws[1], SizeType: ws[2]}
+
+		var n int
+		switch raw.kind() {
+		case KindInt, KindVar, KindDeclTag:
+			n = 1
+		case KindArray:
+			n = 3
+		case KindStruct, KindUnion, KindDatasec, KindEnum64:
+			n = 3 * raw.vlen()
+		case KindEnum, KindFuncProto:
+			n = 2 * raw.vlen()
+		case KindPtr, KindFwd, KindTypedef, KindVolatile, KindConst,
+			KindRestrict, KindFunc, KindFloat, KindTypeTag:
+		default:
+			return nil, fmt.Errorf("unknown BTF kind %d", raw.kind())
+		}
+		if raw.data, err = words(n); err != nil {
+			return nil, err
+		}
+		raws = append(raws, raw)
+	}
+	return raws, nil
+}
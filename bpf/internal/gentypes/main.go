@@ -0,0 +1,216 @@
+// Command gentypes generates Go types from the BTF of a BPF object,
+// with assertions that fail the build if their layouts diverge.
+//
+// Values of big endian typedefs, e.g. __be32, are kept as bytes
+// in network order.
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"go/format"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/nrwiersma/ebpf/bpf/btf"
+)
+
+func main() {
+	obj := flag.String("obj", "", "The BPF object to read the types from.")
+	out := flag.String("out", "types.go", "The file to write the Go types to.")
+	pkg := flag.String("pkg", "bpf", "The package of the Go types.")
+	flag.Parse()
+
+	if *obj == "" || flag.NArg() == 0 {
+		log.Fatal("usage: gentypes -obj <object> [-out <file>] <struct>...")
+	}
+
+	f, err := os.Open(*obj)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer func() { _ = f.Close() }()
+
+	spec, err := btf.Load(f)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	b, err := generate(spec, *pkg, filepath.ToSlash(*obj), flag.Args())
+	if err != nil {
+		log.Fatal(err)
+	}
+	if err = os.WriteFile(*out, b, 0644); err != nil {
+		log.Fatal(err)
+	}
+}
+
+type generator struct {
+	spec *btf.Spec
+
+	types   bytes.Buffer
+	layouts bytes.Buffer
+	asserts bytes.Buffer
+
+	done  map[string]bool
+	queue []string
+}
+
+func generate(spec *btf.Spec, pkg, src string, names []string) ([]byte, error) {
+	g := &generator{
+		spec:  spec,
+		done:  map[string]bool{},
+		queue: names,
+	}
+
+	for len(g.queue) > 0 {
+		name := g.queue[0]
+		g.queue = g.queue[1:]
+		if g.done[name] {
+			continue
+		}
+		g.done[name] = true
+
+		if err := g.writeStruct(name); err != nil {
+			return nil, err
+		}
+	}
+
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "// Code generated by gentypes from %s. DO NOT EDIT.\n\n", src)
+	fmt.Fprintf(&buf, "package %s\n\n", pkg)
+	buf.WriteString("import \"unsafe\"\n\n")
+	buf.Write(g.types.Bytes())
+	buf.WriteString("// layouts are the layouts of the types in the object they were generated from.\n")
+	buf.WriteString("var layouts = []layout{\n")
+	buf.Write(g.layouts.Bytes())
+	buf.WriteString("}\n\n")
+	buf.WriteString("// Fail the build if the layouts of the Go types diverge.\n")
+	buf.WriteString("var (\n")
+	buf.Write(g.asserts.Bytes())
+	buf.WriteString(")\n")
+
+	b, err := format.Source(buf.Bytes())
+	if err != nil {
+		return nil, fmt.Errorf("unable to format types: %w", err)
+	}
+	return b, nil
+}
+
+func (g *generator) writeStruct(name string) error {
+	t, err := g.spec.Struct(name)
+	if err != nil {
+		return err
+	}
+	goName := goIdent(name)
+
+	members := append([]btf.Member(nil), t.Members...)
+	sort.SliceStable(members, func(i, j int) bool { return members[i].Offset < members[j].Offset })
+
+	fmt.Fprintf(&g.types, "// %s is struct %s.\n", goName, name)
+	fmt.Fprintf(&g.types, "type %s struct {\n", goName)
+	fmt.Fprintf(&g.layouts, "{name: %q, size: %d, fields: []field{\n", name, t.Size)
+	fmt.Fprintf(&g.asserts, "_ = [1]struct{}{}[unsafe.Sizeof(%s{})-%d]\n", goName, t.Size)
+
+	var pos uint32
+	for _, m := range members {
+		if m.BitSize != 0 || m.Offset%8 != 0 {
+			return fmt.Errorf("struct %s: bitfield %s is not supported", name, m.Name)
+		}
+		if m.Name == "" {
+			return fmt.Errorf("struct %s: anonymous members are not supported", name)
+		}
+
+		off := m.Offset / 8
+		if off > pos {
+			fmt.Fprintf(&g.types, "\t_ [%d]byte\n", off-pos)
+		}
+
+		typ, err := g.goType(m.Type)
+		if err != nil {
+			return fmt.Errorf("struct %s: member %s: %w", name, m.Name, err)
+		}
+		field := goIdent(m.Name)
+		fmt.Fprintf(&g.types, "\t%s %s\n", field, typ)
+		fmt.Fprintf(&g.layouts, "{name: %q, offset: %d},\n", m.Name, off)
+		fmt.Fprintf(&g.asserts, "_ = [1]struct{}{}[unsafe.Offsetof(%s{}.%s)-%d]\n", goName, field, off)
+
+		pos = off + m.Type.ByteSize()
+	}
+	if t.Size > pos {
+		fmt.Fprintf(&g.types, "\t_ [%d]byte\n", t.Size-pos)
+	}
+
+	g.types.WriteString("}\n\n")
+	g.layouts.WriteString("}},\n")
+	return nil
+}
+
+func (g *generator) goType(t *btf.Type) (string, error) {
+	switch t.Kind {
+	case btf.KindInt:
+		if t.Signed {
+			return fmt.Sprintf("int%d", 8*t.Size), nil
+		}
+		return fmt.Sprintf("uint%d", 8*t.Size), nil
+
+	case btf.KindEnum:
+		return fmt.Sprintf("uint%d", 8*t.Size), nil
+
+	case btf.KindTypedef:
+		if isBigEndian(t) {
+			return fmt.Sprintf("[%d]byte", t.ByteSize()), nil
+		}
+		return g.goType(t.Target)
+
+	case btf.KindVolatile, btf.KindConst:
+		return g.goType(t.Target)
+
+	case btf.KindArray:
+		if isBigEndian(t.Target) {
+			return fmt.Sprintf("[%d]byte", t.ByteSize()), nil
+		}
+		elem, err := g.goType(t.Target)
+		if err != nil {
+			return "", err
+		}
+		return fmt.Sprintf("[%d]%s", t.Len, elem), nil
+
+	case btf.KindStruct:
+		if t.Name == "" {
+			return "", fmt.Errorf("anonymous structs are not supported")
+		}
+		g.queue = append(g.queue, t.Name)
+		return goIdent(t.Name), nil
+
+	default:
+		return "", fmt.Errorf("kind %d is not supported", t.Kind)
+	}
+}
+
+// isBigEndian reports if the type is a big endian typedef, e.g. __be32.
+func isBigEndian(t *btf.Type) bool {
+	return t.Kind == btf.KindTypedef && strings.HasPrefix(t.Name, "__be")
+}
+
+var initialisms = map[string]bool{"ip": true, "id": true, "rtt": true, "tcp": true, "udp": true}
+
+// goIdent returns the exported Go identifier of a C identifier.
+func goIdent(name string) string {
+	var sb strings.Builder
+	for _, part := range strings.Split(name, "_") {
+		if part == "" {
+			continue
+		}
+		if initialisms[part] {
+			sb.WriteString(strings.ToUpper(part))
+			continue
+		}
+		sb.WriteString(strings.ToUpper(part[:1]) + part[1:])
+	}
+	return sb.String()
+}
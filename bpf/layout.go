@@ -0,0 +1,65 @@
+package bpf
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"unsafe"
+
+	"github.com/nrwiersma/ebpf/bpf/btf"
+)
+
+type field struct {
+	name   string
+	offset uint32
+}
+
+type layout struct {
+	name   string
+	size   uint32
+	fields []field
+}
+
+// NativeEndian is the byte order of the host.
+var NativeEndian binary.ByteOrder = func() binary.ByteOrder {
+	x := uint16(1)
+	if *(*byte)(unsafe.Pointer(&x)) == 1 {
+		return binary.LittleEndian
+	}
+	return binary.BigEndian
+}()
+
+// VerifyLayout verifies that the generated types match the layouts
+// of the types in the metrics socket program object, and that the
+// program was compiled for the byte order of the host. It fails when
+// the program was rebuilt without regenerating the types.
+func VerifyLayout(obj []byte) error {
+	spec, err := btf.Load(bytes.NewReader(obj))
+	if err != nil {
+		return fmt.Errorf("unable to load program types: %w", err)
+	}
+	if spec.ByteOrder != NativeEndian {
+		return fmt.Errorf("program is compiled for %s, the host is %s", spec.ByteOrder, NativeEndian)
+	}
+
+	for _, l := range layouts {
+		t, err := spec.Struct(l.name)
+		if err != nil {
+			return err
+		}
+		if t.Size != l.size {
+			return fmt.Errorf("struct %s has size %d, the generated type %d", l.name, t.Size, l.size)
+		}
+		if len(t.Members) != len(l.fields) {
+			return fmt.Errorf("struct %s has %d members, the generated type %d", l.name, len(t.Members), len(l.fields))
+		}
+		for i, m := range t.Members {
+			f := l.fields[i]
+			if m.Name != f.name || m.Offset/8 != f.offset {
+				return fmt.Errorf("struct %s has member %s at offset %d, the generated type %s at %d",
+					l.name, m.Name, m.Offset/8, f.name, f.offset)
+			}
+		}
+	}
+	return nil
+}
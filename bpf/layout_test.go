@@ -0,0 +1,67 @@
+package bpf
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestVerifyLayout(t *testing.T) {
+	tests := []struct {
+		name string
+		obj  []byte
+	}{
+		{name: "metrics sock", obj: MetricsSock},
+		{name: "metrics sock compat", obj: MetricsSockCompat},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if len(test.obj) == 0 {
+				t.Skip("program object is not built")
+			}
+
+			if err := VerifyLayout(test.obj); err != nil {
+				t.Errorf("unexpected error: %v", err)
+			}
+		})
+	}
+}
+
+func TestLayouts_MatchGeneratedTypes(t *testing.T) {
+	types := map[string]reflect.Type{
+		"pkt_entry":   reflect.TypeOf(PktEntry{}),
+		"stash_tuple": reflect.TypeOf(StashTuple{}),
+		"lpm_key":     reflect.TypeOf(LpmKey{}),
+	}
+
+	for _, l := range layouts {
+		typ, ok := types[l.name]
+		if !ok {
+			t.Errorf("no generated type for struct %s", l.name)
+			continue
+		}
+		if uint32(typ.Size()) != l.size {
+			t.Errorf("struct %s has size %d, the generated type %d", l.name, l.size, typ.Size())
+		}
+
+		var fields []reflect.StructField
+		for i := 0; i < typ.NumField(); i++ {
+			if f := typ.Field(i); f.Name != "_" {
+				fields = append(fields, f)
+			}
+		}
+		if len(fields) != len(l.fields) {
+			t.Errorf("struct %s has %d members, the generated type %d", l.name, len(l.fields), len(fields))
+			continue
+		}
+		for i, f := range l.fields {
+			if !strings.EqualFold(strings.ReplaceAll(f.name, "_", ""), fields[i].Name) {
+				t.Errorf("struct %s has member %s, the generated type %s", l.name, f.name, fields[i].Name)
+			}
+			if uint32(fields[i].Offset) != f.offset {
+				t.Errorf("struct %s has member %s at offset %d, the generated type at %d", l.name, f.name, f.offset, fields[i].Offset)
+			}
+		}
+	}
+}
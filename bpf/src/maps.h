@@ -15,6 +15,11 @@ struct stash_tuple {
     __u32 seq;
 };
 
+struct lpm_key {
+    __u32 prefixlen;
+    __be32 ip[4];
+};
+
 struct pkt_entry {
     __u64 ts;
     __be32 src_ip[4];
@@ -25,6 +30,8 @@ struct pkt_entry {
     __u32 rtt;
     __u16 protocol;
     __u16 flags;
+    // The 1 in N sampling rate the packet was sampled at.
+    __u32 sample_rate;
 };
 
 #endif
\ No newline at end of file
@@ -27,6 +27,44 @@ struct bpf_map_def SEC("maps") packets = {
     .value_size = sizeof(__u32),
 };
 
+// sampling holds the 1 in N sampling rate per direction,
+// indexed by DIR_IN and DIR_OUT. A rate of 0 or 1 samples
+// every packet.
+struct bpf_map_def SEC("maps") sampling = {
+	.type = BPF_MAP_TYPE_ARRAY,
+    .key_size = sizeof(__u32),
+    .value_size = sizeof(__u32),
+    .max_entries = DIR_OUT + 1,
+};
+
+// filter_ports holds the ports of which packets are ignored,
+// matching either the source or the destination port.
+struct bpf_map_def SEC("maps") filter_ports = {
+	.type = BPF_MAP_TYPE_HASH,
+    .key_size = sizeof(__u16),
+    .value_size = sizeof(__u8),
+    .max_entries = 256,
+};
+
+// filter_cidrs holds the CIDRs of which packets are ignored,
+// matching either the source or the destination ip. IPv4 CIDRs
+// are stored as IPv4-mapped IPv6 CIDRs.
+struct bpf_map_def SEC("maps") filter_cidrs = {
+	.type = BPF_MAP_TYPE_LPM_TRIE,
+    .key_size = sizeof(struct lpm_key),
+    .value_size = sizeof(__u8),
+    .max_entries = 1024,
+    .map_flags = BPF_F_NO_PREALLOC,
+};
+
+// filter_cgroups holds the ids of the cgroups of which packets are ignored.
+struct bpf_map_def SEC("maps") filter_cgroups = {
+	.type = BPF_MAP_TYPE_HASH,
+    .key_size = sizeof(__u64),
+    .value_size = sizeof(__u8),
+    .max_entries = 1024,
+};
+
 #define advance(skb, var_off, hdr)                      \
 ({                                                      \
     __u32 len = sizeof(*hdr);                           \
@@ -45,6 +83,55 @@ void ipv4tov6(__be32 ipv6[4], __be32 ip) {
     ipv6[3] = ip;
 }
 
+static __always_inline
+bool filtered_ip(__be32 ip[4]) {
+    struct lpm_key key = {
+        .prefixlen = 128,
+    };
+    memcpy(key.ip, ip, sizeof(key.ip));
+
+    return bpf_map_lookup_elem(&filter_cidrs, &key) != NULL;
+}
+
+static __always_inline
+bool filtered(struct pkt_entry *pkt) {
+    __u16 port = pkt->src_port;
+    if (bpf_map_lookup_elem(&filter_ports, &port) != NULL)
+        return true;
+    port = pkt->dest_port;
+    if (bpf_map_lookup_elem(&filter_ports, &port) != NULL)
+        return true;
+
+    return filtered_ip(pkt->src_ip) || filtered_ip(pkt->dest_ip);
+}
+
+// filtered_cgroup reports if the packets of the cgroup of the socket are
+// ignored. Kernels without bpf_skb_cgroup_id load the program compiled
+// with NO_SKB_CGROUP_ID, which does not filter by cgroup.
+static __always_inline
+bool filtered_cgroup(struct __sk_buff *skb) {
+#ifdef NO_SKB_CGROUP_ID
+    return false;
+#else
+    __u64 cgroup_id = bpf_skb_cgroup_id(skb);
+    return bpf_map_lookup_elem(&filter_cgroups, &cgroup_id) != NULL;
+#endif
+}
+
+static __always_inline
+__u32 sample_rate(__u16 direction) {
+    __u32 key = direction;
+    __u32 *rate = bpf_map_lookup_elem(&sampling, &key);
+    if (rate == NULL || *rate <= 1)
+        return 1;
+    return *rate;
+}
+
+static __always_inline
+bool sampled(__u32 rate) {
+    return rate == 1 || bpf_get_prandom_u32() % rate == 0;
+}
+
 static __always_inline
 int process(struct __sk_buff *skb, __u16 direction) {
     __u32 len = skb->len;
@@ -59,6 +146,9 @@ int process(struct __sk_buff *skb, __u16 direction) {
         return KEEP;
     }
 
+    if (filtered_cgroup(skb))
+        return KEEP;
+
     advance(skb, 0, ip4);
 
     pkt.ts = bpf_ktime_get_ns();
@@ -87,7 +177,13 @@ int process(struct __sk_buff *skb, __u16 direction) {
     pkt.protocol = PROTO_TCP;
     pkt.len = len;
 
-    if (len != 0) {
+    if (filtered(&pkt))
+        return KEEP;
+
+    // Sample before stashing, so unsampled packets
+    // do not take up room waiting for their ACK.
+    pkt.sample_rate = sample_rate(direction);
+    if (len != 0 && sampled(pkt.sample_rate)) {
         switch (direction) {
         case DIR_OUT:
         {
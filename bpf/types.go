@@ -0,0 +1,81 @@
+// Code generated by gentypes from dist/metrics_sock.o. DO NOT EDIT.
+
+package bpf
+
+import "unsafe"
+
+// PktEntry is struct pkt_entry.
+type PktEntry struct {
+	Ts         uint64
+	SrcIP      [16]byte
+	DestIP     [16]byte
+	SrcPort    uint16
+	DestPort   uint16
+	Len        uint32
+	RTT        uint32
+	Protocol   uint16
+	Flags      uint16
+	SampleRate uint32
+	_          [4]byte
+}
+
+// StashTuple is struct stash_tuple.
+type StashTuple struct {
+	IP   [16]byte
+	Port uint16
+	_    [2]byte
+	Seq  uint32
+}
+
+// LpmKey is struct lpm_key.
+type LpmKey struct {
+	Prefixlen uint32
+	IP        [16]byte
+}
+
+// layouts are the layouts of the types in the object they were generated from.
+var layouts = []layout{
+	{name: "pkt_entry", size: 64, fields: []field{
+		{name: "ts", offset: 0},
+		{name: "src_ip", offset: 8},
+		{name: "dest_ip", offset: 24},
+		{name: "src_port", offset: 40},
+		{name: "dest_port", offset: 42},
+		{name: "len", offset: 44},
+		{name: "rtt", offset: 48},
+		{name: "protocol", offset: 52},
+		{name: "flags", offset: 54},
+		{name: "sample_rate", offset: 56},
+	}},
+	{name: "stash_tuple", size: 24, fields: []field{
+		{name: "ip", offset: 0},
+		{name: "port", offset: 16},
+		{name: "seq", offset: 20},
+	}},
+	{name: "lpm_key", size: 20, fields: []field{
+		{name: "prefixlen", offset: 0},
+		{name: "ip", offset: 4},
+	}},
+}
+
+// Fail the build if the layouts of the Go types diverge.
+var (
+	_ = [1]struct{}{}[unsafe.Sizeof(PktEntry{})-64]
+	_ = [1]struct{}{}[unsafe.Offsetof(PktEntry{}.Ts)-0]
+	_ = [1]struct{}{}[unsafe.Offsetof(PktEntry{}.SrcIP)-8]
+	_ = [1]struct{}{}[unsafe.Offsetof(PktEntry{}.DestIP)-24]
+	_ = [1]struct{}{}[unsafe.Offsetof(PktEntry{}.SrcPort)-40]
+	_ = [1]struct{}{}[unsafe.Offsetof(PktEntry{}.DestPort)-42]
+	_ = [1]struct{}{}[unsafe.Offsetof(PktEntry{}.Len)-44]
+	_ = [1]struct{}{}[unsafe.Offsetof(PktEntry{}.RTT)-48]
+	_ = [1]struct{}{}[unsafe.Offsetof(PktEntry{}.Protocol)-52]
+	_ = [1]struct{}{}[unsafe.Offsetof(PktEntry{}.Flags)-54]
+	_ = [1]struct{}{}[unsafe.Offsetof(PktEntry{}.SampleRate)-56]
+	_ = [1]struct{}{}[unsafe.Sizeof(StashTuple{})-24]
+	_ = [1]struct{}{}[unsafe.Offsetof(StashTuple{}.IP)-0]
+	_ = [1]struct{}{}[unsafe.Offsetof(StashTuple{}.Port)-16]
+	_ = [1]struct{}{}[unsafe.Offsetof(StashTuple{}.Seq)-20]
+	_ = [1]struct{}{}[unsafe.Sizeof(LpmKey{})-20]
+	_ = [1]struct{}{}[unsafe.Offsetof(LpmKey{}.Prefixlen)-0]
+	_ = [1]struct{}{}[unsafe.Offsetof(LpmKey{}.IP)-4]
+)
@@ -2,12 +2,22 @@ package main
 
 import (
 	"context"
+	"errors"
+	"fmt"
+	"net/http"
 	"os"
 	"os/signal"
+	"time"
 
+	"github.com/hamba/logger"
 	"github.com/nrwiersma/ebpf"
+	"github.com/nrwiersma/ebpf/cmd/internal/factory"
+	"github.com/nrwiersma/ebpf/graph"
 	"github.com/nrwiersma/ebpf/packet"
+	"github.com/nrwiersma/ebpf/packet/pcap"
 	"github.com/nrwiersma/ebpf/pkg/cgroups"
+	"github.com/nrwiersma/ebpf/query"
+	"github.com/nrwiersma/ebpf/store"
 	"github.com/urfave/cli/v2"
 	"golang.org/x/sys/unix"
 )
@@ -16,11 +26,15 @@ func runAgent(c *cli.Context) error {
 	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt, os.Kill)
 	defer cancel()
 
-	log, err := newLogger(c)
+	log, err := factory.NewLogger(c)
 	if err != nil {
 		return err
 	}
 
+	if c.String(flagNode) == "" || c.String(flagNs) == "" {
+		return fmt.Errorf("flags %q and %q are required", flagNode, flagNs)
+	}
+
 	memlockLimit := &unix.Rlimit{
 		Cur: unix.RLIM_INFINITY,
 		Max: unix.RLIM_INFINITY,
@@ -40,19 +54,233 @@ func runAgent(c *cli.Context) error {
 	}
 	defer ctrs.Close()
 
-	pkts, err := packet.NewCGroup()
+	pktOpts := []packet.OptsFunc{
+		packet.WithWorkers(c.Int(flagPacketWorkers)),
+		packet.WithQueueSize(c.Int(flagPacketQueueSize)),
+		packet.WithPerfBuffer(c.Int(flagPerfPages)),
+		packet.WithWatermark(c.Int(flagPerfWatermark)),
+	}
+	if n := c.Uint(flagStashEntries); n > 0 {
+		pktOpts = append(pktOpts, packet.WithMapSize("stash", uint32(n)))
+	}
+	if dir := c.String(flagPinPath); dir != "" {
+		pktOpts = append(pktOpts, packet.WithPinPath(dir))
+	}
+	pkts, err := packet.NewCGroup(pktOpts...)
 	if err != nil {
 		return err
 	}
 	defer pkts.Close()
 
-	app, err := ebpf.NewApp(ctrs, pkts, log)
+	features := pkts.Features()
+	log.Info("Detected kernel features", features.Fields()...)
+	if !features.CGroupFilter() {
+		log.Warn("Kernel is missing bpf_skb_cgroup_id, loaded program without cgroup filtering")
+	}
+
+	if c.String(flagPinPath) != "" {
+		t := time.AfterFunc(c.Duration(flagPinAdoptTimeout), func() {
+			n, err := pkts.PruneUnadopted()
+			if err != nil {
+				log.Error("Unable to detach pinned containers", "error", err)
+			}
+			if n > 0 {
+				log.Info("Detached pinned containers that were not adopted", "count", n)
+			}
+		})
+		defer t.Stop()
+	}
+
+	filter, err := newFilter(c)
+	if err != nil {
+		return err
+	}
+	if err = pkts.SetFilter(filter); err != nil {
+		return err
+	}
+	go reloadFilter(ctx, c, pkts, log)
+
+	dims, err := ebpf.ParseDimensions(c.StringSlice(flagAggregateBy))
+	if err != nil {
+		return err
+	}
+
+	opts := []ebpf.AppOptsFunc{
+		ebpf.WithNode(c.String(flagNode)),
+		ebpf.WithInterval(c.Duration(flagInterval)),
+		ebpf.WithDimensions(dims...),
+		ebpf.WithSeriesLimit(c.Int(flagSeriesLimit), c.Int(flagSeriesTopK)),
+	}
+	if rate := c.Uint(flagSamplingMaxRate); rate > 1 {
+		opts = append(opts, ebpf.WithAdaptiveSampling(uint32(rate)))
+	}
+	if c.Bool(flagCumulative) {
+		opts = append(opts, ebpf.WithCumulative(c.String(flagCumulativeState), c.Duration(flagCumulativeCheckpoint)))
+	}
+	sinkOpts, closeSinks, err := newSinks(c, log)
+	if err != nil {
+		return err
+	}
+	defer closeSinks()
+	opts = append(opts, sinkOpts...)
+
+	mux := http.NewServeMux()
+	g := graph.New(graph.WithTTL(c.Duration(flagGraphTTL)))
+	mux.Handle("/v1/graph", g)
+	ring := query.New(c.Int(flagQueryWindows))
+	mux.Handle("/v1/flows", ring)
+	opts = append(opts, ebpf.WithObservers(g, ring))
+	if c.Bool(flagAnomaly) {
+		det, closeFn, err := newAnomalyDetector(c, log)
+		if err != nil {
+			return err
+		}
+		defer closeFn()
+
+		opts = append(opts, ebpf.WithObservers(det))
+	}
+	if dir := c.String(flagStoreDir); dir != "" {
+		st, err := store.New(dir,
+			store.WithRetention(c.Duration(flagStoreRetention)),
+			store.WithCompaction(c.Duration(flagStoreCompaction)),
+			store.WithLogger(log),
+		)
+		if err != nil {
+			return err
+		}
+		defer func() { _ = st.Close() }()
+
+		mux.Handle("/v1/history", st)
+		opts = append(opts, ebpf.WithObservers(st))
+	}
+
+	app, err := ebpf.NewApp(ctrs, pkts, log, opts...)
 	if err != nil {
 		return err
 	}
 	defer func() { _ = app.Close() }()
 
+	if addr := c.String(flagHTTPAddr); addr != "" {
+		srv := http.Server{
+			Addr:    addr,
+			Handler: mux,
+		}
+		log.Info("Listening", "addr", addr)
+		go func() {
+			err := srv.ListenAndServe()
+			if err != nil && !errors.Is(err, http.ErrServerClosed) {
+				log.Error("Server closed", "error", err)
+				cancel()
+			}
+		}()
+		defer func() { _ = srv.Close() }()
+	}
+
 	<-ctx.Done()
 
 	return nil
 }
+
+func runCleanup(c *cli.Context) error {
+	dir := c.String(flagPinPath)
+	if dir == "" {
+		return fmt.Errorf("flag %q is required", flagPinPath)
+	}
+
+	return packet.Cleanup(dir)
+}
+
+func runReplay(c *cli.Context) error {
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt, os.Kill)
+	defer cancel()
+
+	log, err := factory.NewLogger(c)
+	if err != nil {
+		return err
+	}
+
+	ctrs, ips, err := newStaticContainers(c.StringSlice(flagReplayLocal))
+	if err != nil {
+		return err
+	}
+	defer func() { _ = ctrs.Close() }()
+
+	speed := c.Float64(flagReplaySpeed)
+	if speed != 1 {
+		log.Warn("Replaying faster or slower than real-time, rates and intervals are not accurate", "speed", speed)
+	}
+	pkts, err := pcap.New(c.String(flagReplayFile), ips, pcap.WithSpeed(speed))
+	if err != nil {
+		return err
+	}
+	defer func() { _ = pkts.Close() }()
+
+	dims, err := ebpf.ParseDimensions(c.StringSlice(flagAggregateBy))
+	if err != nil {
+		return err
+	}
+
+	inter := c.Duration(flagInterval)
+	opts := []ebpf.AppOptsFunc{
+		ebpf.WithNode(c.String(flagNode)),
+		ebpf.WithInterval(inter),
+		ebpf.WithDimensions(dims...),
+		ebpf.WithSeriesLimit(c.Int(flagSeriesLimit), c.Int(flagSeriesTopK)),
+	}
+	sinkOpts, closeSinks, err := newSinks(c, log)
+	if err != nil {
+		return err
+	}
+	defer closeSinks()
+	opts = append(opts, sinkOpts...)
+
+	app, err := ebpf.NewApp(ctrs, pkts, log, opts...)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = app.Close() }()
+
+	select {
+	case <-ctx.Done():
+		return nil
+	case <-pkts.Done():
+	}
+	if err = pkts.Err(); err != nil {
+		return err
+	}
+
+	// Metrics are flushed at interval boundaries, wait
+	// for the last replayed packets to be flushed.
+	select {
+	case <-ctx.Done():
+	case <-time.After(time.Until(time.Now().Truncate(inter).Add(inter)) + time.Second):
+	}
+	log.Info("Replay finished")
+	return nil
+}
+
+// reloadFilter reloads the in-kernel filter on SIGHUP.
+func reloadFilter(ctx context.Context, c *cli.Context, pkts *packet.CGroup, log logger.Logger) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, unix.SIGHUP)
+	defer signal.Stop(hup)
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-hup:
+		}
+
+		filter, err := newFilter(c)
+		if err != nil {
+			log.Error("Unable to load filter", "error", err)
+			continue
+		}
+		if err = pkts.SetFilter(filter); err != nil {
+			log.Error("Unable to set filter", "error", err)
+			continue
+		}
+		log.Info("Reloaded filter", "ports", len(filter.Ports), "cidrs", len(filter.CIDRs), "cgroups", len(filter.CGroups))
+	}
+}
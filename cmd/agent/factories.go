@@ -1,40 +1,249 @@
 package main
 
 import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
 	"os"
-	"time"
+	"path/filepath"
+	"strings"
 
 	"github.com/hamba/logger"
 	"github.com/nrwiersma/ebpf"
+	"github.com/nrwiersma/ebpf/alert"
+	"github.com/nrwiersma/ebpf/anomaly"
+	"github.com/nrwiersma/ebpf/cmd/internal/factory"
+	"github.com/nrwiersma/ebpf/collector"
 	"github.com/nrwiersma/ebpf/container/k8s"
+	"github.com/nrwiersma/ebpf/container/static"
+	"github.com/nrwiersma/ebpf/packet"
+	"github.com/nrwiersma/ebpf/pkg/cgroups"
+	"github.com/nrwiersma/ebpf/sink/parquet"
+	"github.com/nrwiersma/ebpf/sink/webhook"
 	"github.com/urfave/cli/v2"
+	"inet.af/netaddr"
 )
 
-func newLogger(c *cli.Context) (logger.Logger, error) {
-	str := c.String(flagLogLevel)
-	if str == "" {
-		str = "info"
+func newContainersProvider(c *cli.Context, cgroupRoot string, log logger.Logger) (ebpf.Containers, error) {
+	node := c.String(flagNode)
+	ns := []string{"kube-system", c.String(flagNs)}
+
+	return k8s.New(node, cgroupRoot, ns,
+		k8s.WithContainers(c.Bool(flagContainers)),
+		k8s.WithDebug(log.Debug),
+	)
+}
+
+// newStaticContainers returns the containers of the local addresses,
+// given as an address, or a name and address, e.g. "default/api=10.0.0.1".
+// Unnamed addresses are named by their address.
+func newStaticContainers(locals []string) (*static.Service, []net.IP, error) {
+	var (
+		ctrs []static.Container
+		ips  []net.IP
+	)
+	for _, local := range locals {
+		name, addr := "", local
+		if idx := strings.LastIndexByte(local, '='); idx != -1 {
+			name, addr = local[:idx], local[idx+1:]
+		}
+
+		ip, err := netaddr.ParseIP(addr)
+		if err != nil {
+			return nil, nil, fmt.Errorf("invalid local address %q: %w", local, err)
+		}
+		ips = append(ips, net.ParseIP(addr))
+		if name != "" {
+			ctrs = append(ctrs, static.Container{Name: name, IPs: []netaddr.IP{ip}})
+		}
 	}
 
-	lvl, err := logger.LevelFromString(str)
-	if err != nil {
-		return nil, err
+	return static.New(ctrs...), ips, nil
+}
+
+func newCollectorExporter(c *cli.Context, log logger.Logger) (*webhook.Sink, error) {
+	opts := []webhook.OptsFunc{
+		webhook.WithEncoder(collector.Encoder(c.String(flagNode), c.Duration(flagInterval))),
+		// The collector only accepts flow metrics.
+		webhook.WithStatsEncoder(nil),
+		webhook.WithLogger(log),
 	}
+	if token := c.String(flagCollectorToken); token != "" {
+		opts = append(opts, webhook.WithBearerToken(token))
+	}
+
+	return webhook.New(c.String(flagCollectorURL), c.String(flagCollectorSpoolDir), opts...)
+}
 
-	h := logger.LevelFilterHandler(
-		lvl,
-		logger.BufferedStreamHandler(os.Stdout, 1024, time.Second, logger.ConsoleFormat()),
+// newSinks returns the options of the configured sinks, and a
+// function closing them.
+func newSinks(c *cli.Context, log logger.Logger) ([]ebpf.AppOptsFunc, func(), error) {
+	var (
+		opts    []ebpf.AppOptsFunc
+		closers []io.Closer
 	)
+	closeFn := func() {
+		for i := len(closers) - 1; i >= 0; i-- {
+			_ = closers[i].Close()
+		}
+	}
+
+	if c.String(flagWebhookURL) != "" {
+		wh, err := factory.NewWebhookSink(c, log)
+		if err != nil {
+			closeFn()
+			return nil, nil, err
+		}
+		closers = append(closers, wh)
+
+		opts = append(opts, ebpf.WithSinks(c.Duration(flagWebhookRes), wh))
+	}
+	if c.String(flagClickHouseURL) != "" {
+		ch, err := factory.NewClickHouseSink(c)
+		if err != nil {
+			closeFn()
+			return nil, nil, err
+		}
+		closers = append(closers, ch)
 
-	return logger.New(h), nil
+		opts = append(opts, ebpf.WithSinks(c.Duration(flagClickHouseRes), ch))
+	}
+	if dir := c.String(flagParquetDir); dir != "" {
+		pq, err := parquet.New(dir)
+		if err != nil {
+			closeFn()
+			return nil, nil, err
+		}
+		closers = append(closers, pq)
+
+		opts = append(opts, ebpf.WithSinks(c.Duration(flagParquetRes), pq))
+	}
+
+	if c.String(flagCollectorURL) != "" {
+		if c.Bool(flagCumulative) {
+			closeFn()
+			return nil, nil, errors.New("the collector exporter requires interval deltas and cannot be used in cumulative mode")
+		}
+
+		exp, err := newCollectorExporter(c, log)
+		if err != nil {
+			closeFn()
+			return nil, nil, err
+		}
+		closers = append(closers, exp)
+
+		opts = append(opts, ebpf.WithSinks(0, exp))
+	}
+
+	return opts, closeFn, nil
 }
 
-func newContainersProvider(c *cli.Context, cgroupRoot string, log logger.Logger) (ebpf.Containers, error) {
-	node := c.String(flagNode)
-	ns := []string{"kube-system", c.String(flagNs)}
+func newAnomalyDetector(c *cli.Context, log logger.Logger) (*anomaly.Detector, func(), error) {
+	sinks := []alert.Sink{alert.NewLogSink(log)}
+	closeFn := func() {}
+	if uri := c.String(flagAlertWebhookURL); uri != "" {
+		opts := []alert.WebhookOptsFunc{alert.WithLogger(log)}
+		if token := c.String(flagAlertWebhookToken); token != "" {
+			opts = append(opts, alert.WithBearerToken(token))
+		}
+		wh, err := alert.NewWebhookSink(uri, c.String(flagAlertWebhookSpool), opts...)
+		if err != nil {
+			return nil, nil, err
+		}
+		sinks = append(sinks, wh)
+		closeFn = func() { _ = wh.Close() }
+	}
 
-	return k8s.New(node, cgroupRoot, ns,
-		k8s.WithContainers(c.Bool(flagContainers)),
-		k8s.WithDebug(log.Debug),
-	)
+	return anomaly.New(
+		anomaly.WithSinks(sinks...),
+		anomaly.WithWarmup(c.Int(flagAnomalyWarmup)),
+		anomaly.WithThreshold(c.Float64(flagAnomalyThreshold), c.Float64(flagAnomalyMinChange)),
+		anomaly.WithVanishAfter(c.Duration(flagAnomalyVanishAfter)),
+		anomaly.WithLogger(log),
+	), closeFn, nil
+}
+
+// filterFile is the format of the filter file.
+type filterFile struct {
+	Ports   []uint16 `json:"ports"`
+	CIDRs   []string `json:"cidrs"`
+	CGroups []string `json:"cgroups"`
+}
+
+// newFilter returns the in-kernel filter from the flags and the filter file.
+// Cgroup paths are relative to the cgroup root, unless they are absolute.
+func newFilter(c *cli.Context) (packet.Filter, error) {
+	ff := filterFile{CIDRs: c.StringSlice(flagFilterCIDRs), CGroups: c.StringSlice(flagFilterCGroups)}
+	for _, port := range c.IntSlice(flagFilterPorts) {
+		if port <= 0 || port > 65535 {
+			return packet.Filter{}, fmt.Errorf("invalid filter port %d", port)
+		}
+		ff.Ports = append(ff.Ports, uint16(port))
+	}
+
+	if path := c.String(flagFilterFile); path != "" {
+		b, err := os.ReadFile(path)
+		if err != nil {
+			return packet.Filter{}, fmt.Errorf("unable to read filter file: %w", err)
+		}
+		var fileFF filterFile
+		if err = json.Unmarshal(b, &fileFF); err != nil {
+			return packet.Filter{}, fmt.Errorf("unable to decode filter file: %w", err)
+		}
+		ff.Ports = append(ff.Ports, fileFF.Ports...)
+		ff.CIDRs = append(ff.CIDRs, fileFF.CIDRs...)
+		ff.CGroups = append(ff.CGroups, fileFF.CGroups...)
+	}
+
+	f := packet.Filter{Ports: ff.Ports}
+	for _, str := range ff.CIDRs {
+		_, n, err := net.ParseCIDR(str)
+		if err != nil {
+			return packet.Filter{}, fmt.Errorf("invalid filter cidr: %w", err)
+		}
+		f.CIDRs = append(f.CIDRs, n)
+	}
+	for _, path := range ff.CGroups {
+		if !filepath.IsAbs(path) {
+			path = filepath.Join(cgroups.CgroupRoot(), path)
+		}
+		f.CGroups = append(f.CGroups, path)
+	}
+
+	if c.Bool(flagFilterNodeLocal) {
+		nets, err := nodeLocalNets()
+		if err != nil {
+			return packet.Filter{}, err
+		}
+		f.CIDRs = append(f.CIDRs, nets...)
+	}
+	return f, nil
+}
+
+// nodeLocalNets returns the loopback networks and the
+// addresses of the node, as single address networks.
+func nodeLocalNets() ([]*net.IPNet, error) {
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return nil, fmt.Errorf("unable to get node addresses: %w", err)
+	}
+
+	nets := []*net.IPNet{
+		{IP: net.IPv4(127, 0, 0, 0), Mask: net.CIDRMask(8, 32)},
+		{IP: net.IPv6loopback, Mask: net.CIDRMask(128, 128)},
+	}
+	for _, addr := range addrs {
+		ipn, ok := addr.(*net.IPNet)
+		if !ok {
+			continue
+		}
+		bits := 8 * net.IPv6len
+		if ipn.IP.To4() != nil {
+			bits = 8 * net.IPv4len
+		}
+		nets = append(nets, &net.IPNet{IP: ipn.IP, Mask: net.CIDRMask(bits, bits)})
+	}
+	return nets, nil
 }
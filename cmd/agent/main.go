@@ -3,19 +3,95 @@ package main
 import (
 	"log"
 	"os"
+	"runtime"
+	"time"
 
 	_ "github.com/joho/godotenv/autoload"
+	"github.com/nrwiersma/ebpf/cmd/internal/factory"
+	"github.com/nrwiersma/ebpf/sink/webhook"
 	"github.com/urfave/cli/v2"
 )
 
 var version = "¯\\_(ツ)_/¯"
 
 const (
-	flagLogLevel = "log.level"
+	flagLogLevel = factory.FlagLogLevel
 
 	flagNode       = "node"
 	flagNs         = "namespace"
 	flagContainers = "containers"
+
+	flagHTTPAddr = "http.addr"
+	flagGraphTTL = "graph.ttl"
+
+	flagQueryWindows = "query.windows"
+
+	flagStoreDir        = "store.dir"
+	flagStoreRetention  = "store.retention"
+	flagStoreCompaction = "store.compaction"
+
+	flagAnomaly            = "anomaly"
+	flagAnomalyWarmup      = "anomaly.warmup"
+	flagAnomalyThreshold   = "anomaly.threshold"
+	flagAnomalyMinChange   = "anomaly.min-change"
+	flagAnomalyVanishAfter = "anomaly.vanish-after"
+	flagAlertWebhookURL    = "alert.webhook.url"
+	flagAlertWebhookToken  = "alert.webhook.token"
+	flagAlertWebhookSpool  = "alert.webhook.spool.dir"
+
+	flagInterval    = "interval"
+	flagAggregateBy = "aggregate.by"
+	flagSeriesLimit = "series.limit"
+	flagSeriesTopK  = "series.top-k"
+
+	flagPinPath         = "pin.path"
+	flagPinAdoptTimeout = "pin.adopt-timeout"
+
+	flagPacketWorkers   = "packet.workers"
+	flagPacketQueueSize = "packet.queue-size"
+	flagStashEntries    = "bpf.stash-entries"
+	flagPerfPages       = "bpf.perf-pages"
+	flagPerfWatermark   = "bpf.perf-watermark"
+
+	flagSamplingMaxRate = "sampling.max-rate"
+
+	flagReplayFile  = "replay.file"
+	flagReplayLocal = "replay.local"
+	flagReplaySpeed = "replay.speed"
+
+	flagFilterPorts     = "filter.port"
+	flagFilterCIDRs     = "filter.cidr"
+	flagFilterCGroups   = "filter.cgroup"
+	flagFilterNodeLocal = "filter.node-local"
+	flagFilterFile      = "filter.file"
+
+	flagCumulative           = "cumulative"
+	flagCumulativeState      = "cumulative.state"
+	flagCumulativeCheckpoint = "cumulative.checkpoint"
+
+	flagWebhookURL       = factory.FlagWebhookURL
+	flagWebhookHeaders   = factory.FlagWebhookHeaders
+	flagWebhookUser      = factory.FlagWebhookUser
+	flagWebhookPass      = factory.FlagWebhookPass
+	flagWebhookToken     = factory.FlagWebhookToken
+	flagWebhookSpoolDir  = factory.FlagWebhookSpoolDir
+	flagWebhookSpoolSize = factory.FlagWebhookSpoolSize
+	flagWebhookRes       = "webhook.resolution"
+
+	flagClickHouseURL   = factory.FlagClickHouseURL
+	flagClickHouseDB    = factory.FlagClickHouseDB
+	flagClickHouseTable = factory.FlagClickHouseTable
+	flagClickHouseUser  = factory.FlagClickHouseUser
+	flagClickHousePass  = factory.FlagClickHousePass
+	flagClickHouseTTL   = factory.FlagClickHouseTTL
+	flagClickHouseRes   = "clickhouse.resolution"
+
+	flagParquetDir = "parquet.dir"
+	flagParquetRes = "parquet.resolution"
+
+	flagCollectorURL      = "collector.url"
+	flagCollectorToken    = "collector.token"
+	flagCollectorSpoolDir = "collector.spool.dir"
 )
 
 func main() {
@@ -31,26 +107,357 @@ func main() {
 			},
 
 			&cli.StringFlag{
-				Name:     flagNode,
-				Aliases:  []string{"n"},
-				Usage:    "The current kubernetes node name.",
-				EnvVars:  []string{"NODE"},
-				Required: true,
+				Name:    flagNode,
+				Aliases: []string{"n"},
+				Usage:   "The current kubernetes node name. Required to run the agent.",
+				EnvVars: []string{"NODE"},
 			},
 			&cli.StringFlag{
-				Name:     flagNs,
-				Aliases:  []string{"ns"},
-				Usage:    "The current kubernetes namespace of the pod.",
-				EnvVars:  []string{"NAMESPACE"},
-				Required: true,
+				Name:    flagNs,
+				Aliases: []string{"ns"},
+				Usage:   "The current kubernetes namespace of the pod. Required to run the agent.",
+				EnvVars: []string{"NAMESPACE"},
 			},
 			&cli.BoolFlag{
 				Name:    flagContainers,
 				Usage:   "Monitor containers instead of pods.",
 				EnvVars: []string{"CONTAINERS"},
 			},
+
+			&cli.StringFlag{
+				Name:    flagHTTPAddr,
+				Usage:   "The address to serve the agent HTTP API on. E.g. ':8080'. Disabled if empty.",
+				EnvVars: []string{"HTTP_ADDR"},
+			},
+			&cli.DurationFlag{
+				Name:    flagGraphTTL,
+				Value:   15 * time.Minute,
+				Usage:   "The time after which an unseen edge is removed from the dependency graph.",
+				EnvVars: []string{"GRAPH_TTL"},
+			},
+			&cli.IntFlag{
+				Name:    flagQueryWindows,
+				Value:   30,
+				Usage:   "The number of recent intervals kept in memory for live flow queries.",
+				EnvVars: []string{"QUERY_WINDOWS"},
+			},
+			&cli.StringFlag{
+				Name:    flagStoreDir,
+				Usage:   "The directory of the embedded metrics store, served for range queries. Disabled if empty.",
+				EnvVars: []string{"STORE_DIR"},
+			},
+			&cli.DurationFlag{
+				Name:    flagStoreRetention,
+				Value:   24 * time.Hour,
+				Usage:   "How long the embedded store keeps metrics.",
+				EnvVars: []string{"STORE_RETENTION"},
+			},
+			&cli.DurationFlag{
+				Name:    flagStoreCompaction,
+				Value:   time.Minute,
+				Usage:   "The resolution metrics are compacted to once their hour in the embedded store has passed.",
+				EnvVars: []string{"STORE_COMPACTION"},
+			},
+
+			&cli.BoolFlag{
+				Name:    flagAnomaly,
+				Usage:   "Detect RTT and throughput deviations, new edges and vanished edges, logging them as alerts.",
+				EnvVars: []string{"ANOMALY"},
+			},
+			&cli.IntFlag{
+				Name:    flagAnomalyWarmup,
+				Value:   30,
+				Usage:   "The number of intervals a baseline is learned for before deviations are flagged.",
+				EnvVars: []string{"ANOMALY_WARMUP"},
+			},
+			&cli.Float64Flag{
+				Name:    flagAnomalyThreshold,
+				Value:   4,
+				Usage:   "The number of standard deviations from the baseline that is a deviation.",
+				EnvVars: []string{"ANOMALY_THRESHOLD"},
+			},
+			&cli.Float64Flag{
+				Name:    flagAnomalyMinChange,
+				Value:   0.5,
+				Usage:   "The minimum relative change from the baseline that is a deviation.",
+				EnvVars: []string{"ANOMALY_MIN_CHANGE"},
+			},
+			&cli.DurationFlag{
+				Name:    flagAnomalyVanishAfter,
+				Value:   5 * time.Minute,
+				Usage:   "The time after which an unseen established edge is flagged as vanished.",
+				EnvVars: []string{"ANOMALY_VANISH_AFTER"},
+			},
+			&cli.StringFlag{
+				Name:    flagAlertWebhookURL,
+				Usage:   "The URL to post alert events to. Disabled if empty.",
+				EnvVars: []string{"ALERT_WEBHOOK_URL"},
+			},
+			&cli.StringFlag{
+				Name:    flagAlertWebhookToken,
+				Usage:   "The alert webhook bearer token.",
+				EnvVars: []string{"ALERT_WEBHOOK_TOKEN"},
+			},
+			&cli.StringFlag{
+				Name:    flagAlertWebhookSpool,
+				Value:   "/var/run/ebpf/spool/alert",
+				Usage:   "The directory to spool undelivered alert events to.",
+				EnvVars: []string{"ALERT_WEBHOOK_SPOOL_DIR"},
+			},
+
+			&cli.DurationFlag{
+				Name:    flagInterval,
+				Value:   10 * time.Second,
+				Usage:   "The interval metrics are aggregated and flushed at.",
+				EnvVars: []string{"INTERVAL"},
+			},
+			&cli.StringSliceFlag{
+				Name:    flagAggregateBy,
+				Value:   cli.NewStringSlice("subject", "remote", "port", "protocol"),
+				Usage:   "The dimensions to aggregate metrics by. One of 'subject', 'namespace', 'workload', 'remote', 'port', 'protocol', 'direction', 'node'.",
+				EnvVars: []string{"AGGREGATE_BY"},
+			},
+			&cli.IntFlag{
+				Name:    flagSeriesLimit,
+				Usage:   "The maximum number of series per interval. Flows beyond it are folded into an 'other' bucket per subject. Zero means no limit.",
+				EnvVars: []string{"SERIES_LIMIT"},
+			},
+			&cli.IntFlag{
+				Name:    flagSeriesTopK,
+				Value:   100,
+				Usage:   "The number of heavy hitter edges, by bytes and by peak RTT, exempt from the series limit.",
+				EnvVars: []string{"SERIES_TOP_K"},
+			},
+			&cli.StringFlag{
+				Name:    flagPinPath,
+				Usage:   "A bpffs directory to pin maps and container links in, so they survive restarts, e.g. '/sys/fs/bpf/ebpf'. Requires Linux 5.7 or later.",
+				EnvVars: []string{"PIN_PATH"},
+			},
+			&cli.DurationFlag{
+				Name:    flagPinAdoptTimeout,
+				Value:   time.Minute,
+				Usage:   "The time after which pinned containers that were not re-adopted are detached.",
+				EnvVars: []string{"PIN_ADOPT_TIMEOUT"},
+			},
+			&cli.IntFlag{
+				Name:    flagPacketWorkers,
+				Value:   runtime.GOMAXPROCS(0),
+				Usage:   "The number of goroutines packets are handled on.",
+				EnvVars: []string{"PACKET_WORKERS"},
+			},
+			&cli.IntFlag{
+				Name:    flagPacketQueueSize,
+				Value:   4096,
+				Usage:   "The number of read packets that can wait for the workers, split over their queues. Once full, the kernel drops samples.",
+				EnvVars: []string{"PACKET_QUEUE_SIZE"},
+			},
+			&cli.UintFlag{
+				Name:    flagStashEntries,
+				Usage:   "The number of packets that can be stashed in the kernel awaiting their ACK. Zero sizes it from the CPUs and memory.",
+				EnvVars: []string{"BPF_STASH_ENTRIES"},
+			},
+			&cli.IntFlag{
+				Name:    flagPerfPages,
+				Usage:   "The number of pages of the per-CPU perf buffer, rounded up to a power of two. Zero sizes it from the CPUs and memory.",
+				EnvVars: []string{"BPF_PERF_PAGES"},
+			},
+			&cli.IntFlag{
+				Name:    flagPerfWatermark,
+				Usage:   "The number of bytes written to a per-CPU perf buffer before it is read. Zero reads as soon as data is available.",
+				EnvVars: []string{"BPF_PERF_WATERMARK"},
+			},
+			&cli.UintFlag{
+				Name:    flagSamplingMaxRate,
+				Usage:   "The maximum 1 in N rate packets are sampled at in the kernel when samples are lost. Zero or one disables sampling.",
+				EnvVars: []string{"SAMPLING_MAX_RATE"},
+			},
+
+			&cli.IntSliceFlag{
+				Name:    flagFilterPorts,
+				Usage:   "The ports of which packets are ignored in the kernel, e.g. health check ports.",
+				EnvVars: []string{"FILTER_PORTS"},
+			},
+			&cli.StringSliceFlag{
+				Name:    flagFilterCIDRs,
+				Usage:   "The CIDRs of which packets are ignored in the kernel.",
+				EnvVars: []string{"FILTER_CIDRS"},
+			},
+			&cli.StringSliceFlag{
+				Name:    flagFilterCGroups,
+				Usage:   "The cgroup paths, relative to the cgroup root, of which packets are ignored in the kernel.",
+				EnvVars: []string{"FILTER_CGROUPS"},
+			},
+			&cli.BoolFlag{
+				Name:    flagFilterNodeLocal,
+				Usage:   "Ignore packets from or to the addresses of the node and loopback in the kernel.",
+				EnvVars: []string{"FILTER_NODE_LOCAL"},
+			},
+			&cli.StringFlag{
+				Name:    flagFilterFile,
+				Usage:   "A JSON file with 'ports', 'cidrs' and 'cgroups' to ignore in addition to the flags. It is reloaded on SIGHUP.",
+				EnvVars: []string{"FILTER_FILE"},
+			},
+
+			&cli.BoolFlag{
+				Name:    flagCumulative,
+				Usage:   "Write cumulative counters per edge instead of per interval deltas.",
+				EnvVars: []string{"CUMULATIVE"},
+			},
+			&cli.StringFlag{
+				Name:    flagCumulativeState,
+				Value:   "/var/run/ebpf/cumulative.json",
+				Usage:   "The file the cumulative state is checkpointed to and restored from.",
+				EnvVars: []string{"CUMULATIVE_STATE"},
+			},
+			&cli.DurationFlag{
+				Name:    flagCumulativeCheckpoint,
+				Value:   time.Minute,
+				Usage:   "The interval the cumulative state is checkpointed at.",
+				EnvVars: []string{"CUMULATIVE_CHECKPOINT"},
+			},
+
+			&cli.StringFlag{
+				Name:    flagWebhookURL,
+				Usage:   "The URL to push metric batches to. Disabled if empty.",
+				EnvVars: []string{"WEBHOOK_URL"},
+			},
+			&cli.StringSliceFlag{
+				Name:    flagWebhookHeaders,
+				Usage:   "A header to send with each webhook request. E.g. 'X-Key: value'.",
+				EnvVars: []string{"WEBHOOK_HEADERS"},
+			},
+			&cli.StringFlag{
+				Name:    flagWebhookUser,
+				Usage:   "The webhook basic auth username.",
+				EnvVars: []string{"WEBHOOK_USERNAME"},
+			},
+			&cli.StringFlag{
+				Name:    flagWebhookPass,
+				Usage:   "The webhook basic auth password.",
+				EnvVars: []string{"WEBHOOK_PASSWORD"},
+			},
+			&cli.StringFlag{
+				Name:    flagWebhookToken,
+				Usage:   "The webhook bearer token.",
+				EnvVars: []string{"WEBHOOK_TOKEN"},
+			},
+			&cli.StringFlag{
+				Name:    flagWebhookSpoolDir,
+				Value:   "/var/run/ebpf/spool/webhook",
+				Usage:   "The directory to spool undelivered webhook batches to.",
+				EnvVars: []string{"WEBHOOK_SPOOL_DIR"},
+			},
+			&cli.Int64Flag{
+				Name:    flagWebhookSpoolSize,
+				Value:   webhook.DefaultMaxSpoolSize,
+				Usage:   "The maximum size of the webhook spool in bytes.",
+				EnvVars: []string{"WEBHOOK_SPOOL_SIZE"},
+			},
+			&cli.DurationFlag{
+				Name:    flagWebhookRes,
+				Usage:   "The resolution of the metrics pushed to the webhook. E.g. '1m', '1h'. Defaults to the interval.",
+				EnvVars: []string{"WEBHOOK_RESOLUTION"},
+			},
+
+			&cli.StringFlag{
+				Name:    flagClickHouseURL,
+				Usage:   "The ClickHouse HTTP interface URL to insert metrics into. Disabled if empty.",
+				EnvVars: []string{"CLICKHOUSE_URL"},
+			},
+			&cli.StringFlag{
+				Name:    flagClickHouseDB,
+				Value:   "default",
+				Usage:   "The ClickHouse database.",
+				EnvVars: []string{"CLICKHOUSE_DATABASE"},
+			},
+			&cli.StringFlag{
+				Name:    flagClickHouseTable,
+				Value:   "flows",
+				Usage:   "The ClickHouse table. It is created if it does not exist.",
+				EnvVars: []string{"CLICKHOUSE_TABLE"},
+			},
+			&cli.StringFlag{
+				Name:    flagClickHouseUser,
+				Usage:   "The ClickHouse username.",
+				EnvVars: []string{"CLICKHOUSE_USERNAME"},
+			},
+			&cli.StringFlag{
+				Name:    flagClickHousePass,
+				Usage:   "The ClickHouse password.",
+				EnvVars: []string{"CLICKHOUSE_PASSWORD"},
+			},
+			&cli.DurationFlag{
+				Name:    flagClickHouseTTL,
+				Usage:   "The retention of the ClickHouse tables, also applied to existing tables. Zero leaves the retention unchanged.",
+				EnvVars: []string{"CLICKHOUSE_TTL"},
+			},
+			&cli.DurationFlag{
+				Name:    flagClickHouseRes,
+				Usage:   "The resolution of the metrics inserted into ClickHouse. E.g. '1m', '1h'. Defaults to the interval.",
+				EnvVars: []string{"CLICKHOUSE_RESOLUTION"},
+			},
+
+			&cli.StringFlag{
+				Name:    flagParquetDir,
+				Usage:   "The directory to write hourly parquet files to. Disabled if empty.",
+				EnvVars: []string{"PARQUET_DIR"},
+			},
+			&cli.DurationFlag{
+				Name:    flagParquetRes,
+				Usage:   "The resolution of the metrics written to parquet. E.g. '1m', '1h'. Defaults to the interval.",
+				EnvVars: []string{"PARQUET_RESOLUTION"},
+			},
+
+			&cli.StringFlag{
+				Name:    flagCollectorURL,
+				Usage:   "The collector URL to export metrics to. E.g. 'http://collector:8080/v1/metrics'. Disabled if empty.",
+				EnvVars: []string{"COLLECTOR_URL"},
+			},
+			&cli.StringFlag{
+				Name:    flagCollectorToken,
+				Usage:   "The collector bearer token.",
+				EnvVars: []string{"COLLECTOR_TOKEN"},
+			},
+			&cli.StringFlag{
+				Name:    flagCollectorSpoolDir,
+				Value:   "/var/run/ebpf/spool/collector",
+				Usage:   "The directory to spool undelivered collector batches to.",
+				EnvVars: []string{"COLLECTOR_SPOOL_DIR"},
+			},
 		},
 		Action: runAgent,
+		Commands: []*cli.Command{
+			{
+				Name:   "cleanup",
+				Usage:  "Detach the pinned containers and remove the pinned maps, e.g. to uninstall.",
+				Action: runCleanup,
+			},
+			{
+				Name:  "replay",
+				Usage: "Replay a pcap or pcapng capture into the sinks, without root or BPF.",
+				Flags: []cli.Flag{
+					&cli.StringFlag{
+						Name:     flagReplayFile,
+						Usage:    "The pcap or pcapng capture to replay.",
+						Required: true,
+						EnvVars:  []string{"REPLAY_FILE"},
+					},
+					&cli.StringSliceFlag{
+						Name:     flagReplayLocal,
+						Usage:    "The local addresses packets are sent from and received on, optionally named. E.g. '10.0.0.1' or 'default/api=10.0.0.1'.",
+						Required: true,
+						EnvVars:  []string{"REPLAY_LOCAL"},
+					},
+					&cli.Float64Flag{
+						Name:    flagReplaySpeed,
+						Usage:   "The speed relative to the capture to replay at. Zero replays as fast as possible. Only a speed of 1 gives accurate rates.",
+						Value:   1,
+						EnvVars: []string{"REPLAY_SPEED"},
+					},
+				},
+				Action: runReplay,
+			},
+		},
 	}
 
 	if err := app.Run(os.Args); err != nil {
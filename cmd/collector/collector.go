@@ -0,0 +1,89 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"os"
+	"os/signal"
+
+	"github.com/nrwiersma/ebpf/cmd/internal/factory"
+	"github.com/nrwiersma/ebpf/collector"
+	"github.com/nrwiersma/ebpf/graph"
+	"github.com/nrwiersma/ebpf/sink/parquet"
+	"github.com/urfave/cli/v2"
+)
+
+func runCollector(c *cli.Context) error {
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt, os.Kill)
+	defer cancel()
+
+	log, err := factory.NewLogger(c)
+	if err != nil {
+		return err
+	}
+
+	g := graph.New(graph.WithTTL(c.Duration(flagGraphTTL)))
+
+	opts := []collector.OptsFunc{
+		collector.WithDelay(c.Duration(flagDelay)),
+		collector.WithPerNode(c.Bool(flagPerNode)),
+		collector.WithToken(c.String(flagToken)),
+		collector.WithMaxBatchSize(c.Int64(flagMaxSize)),
+		collector.WithSinks(g),
+	}
+	if c.String(flagWebhookURL) != "" {
+		wh, err := factory.NewWebhookSink(c, log)
+		if err != nil {
+			return err
+		}
+		defer func() { _ = wh.Close() }()
+
+		opts = append(opts, collector.WithSinks(wh))
+	}
+	if c.String(flagClickHouseURL) != "" {
+		ch, err := factory.NewClickHouseSink(c)
+		if err != nil {
+			return err
+		}
+		defer func() { _ = ch.Close() }()
+
+		opts = append(opts, collector.WithSinks(ch))
+	}
+	if dir := c.String(flagParquetDir); dir != "" {
+		pq, err := parquet.New(dir)
+		if err != nil {
+			return err
+		}
+		defer func() { _ = pq.Close() }()
+
+		opts = append(opts, collector.WithSinks(pq))
+	}
+
+	col := collector.New(log, opts...)
+	defer func() { _ = col.Close() }()
+
+	mux := http.NewServeMux()
+	mux.Handle("/v1/metrics", col)
+	mux.Handle("/v1/graph", g)
+
+	addr := c.String(flagAddr)
+	srv := http.Server{
+		Addr:    addr,
+		Handler: mux,
+	}
+	log.Info("Listening", "addr", addr)
+	go func() {
+		err := srv.ListenAndServe()
+		if err != nil && !errors.Is(err, http.ErrServerClosed) {
+			log.Error("Server closed", "error", err)
+			cancel()
+		}
+	}()
+
+	<-ctx.Done()
+
+	_ = srv.Close()
+
+	return nil
+}
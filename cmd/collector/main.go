@@ -0,0 +1,177 @@
+package main
+
+import (
+	"log"
+	"os"
+	"time"
+
+	_ "github.com/joho/godotenv/autoload"
+	"github.com/nrwiersma/ebpf/cmd/internal/factory"
+	"github.com/nrwiersma/ebpf/collector"
+	"github.com/nrwiersma/ebpf/sink/webhook"
+	"github.com/urfave/cli/v2"
+)
+
+var version = "¯\\_(ツ)_/¯"
+
+const (
+	flagLogLevel = factory.FlagLogLevel
+
+	flagAddr    = "addr"
+	flagToken   = "token"
+	flagDelay   = "delay"
+	flagPerNode = "per-node"
+	flagMaxSize = "max-batch-size"
+
+	flagGraphTTL = "graph.ttl"
+
+	flagWebhookURL       = factory.FlagWebhookURL
+	flagWebhookHeaders   = factory.FlagWebhookHeaders
+	flagWebhookUser      = factory.FlagWebhookUser
+	flagWebhookPass      = factory.FlagWebhookPass
+	flagWebhookToken     = factory.FlagWebhookToken
+	flagWebhookSpoolDir  = factory.FlagWebhookSpoolDir
+	flagWebhookSpoolSize = factory.FlagWebhookSpoolSize
+
+	flagClickHouseURL   = factory.FlagClickHouseURL
+	flagClickHouseDB    = factory.FlagClickHouseDB
+	flagClickHouseTable = factory.FlagClickHouseTable
+	flagClickHouseUser  = factory.FlagClickHouseUser
+	flagClickHousePass  = factory.FlagClickHousePass
+	flagClickHouseTTL   = factory.FlagClickHouseTTL
+
+	flagParquetDir = "parquet.dir"
+)
+
+func main() {
+	app := &cli.App{
+		Name:    "collector",
+		Version: version,
+		Flags: []cli.Flag{
+			&cli.StringFlag{
+				Name:    flagLogLevel,
+				Value:   "info",
+				Usage:   "Specify the log level. E.g. 'debug', 'info', 'error'.",
+				EnvVars: []string{"LOG_LEVEL"},
+			},
+
+			&cli.StringFlag{
+				Name:    flagAddr,
+				Value:   ":8080",
+				Usage:   "The address to receive agent metrics on.",
+				EnvVars: []string{"ADDR"},
+			},
+			&cli.StringFlag{
+				Name:    flagToken,
+				Usage:   "The bearer token agents must present. Disabled if empty.",
+				EnvVars: []string{"TOKEN"},
+			},
+			&cli.DurationFlag{
+				Name:    flagDelay,
+				Value:   5 * time.Second,
+				Usage:   "How long to wait for the metrics of all agents for an interval. Later metrics are dropped.",
+				EnvVars: []string{"DELAY"},
+			},
+			&cli.BoolFlag{
+				Name:    flagPerNode,
+				Usage:   "Keep the node dimension instead of merging the metrics of all nodes.",
+				EnvVars: []string{"PER_NODE"},
+			},
+			&cli.Int64Flag{
+				Name:    flagMaxSize,
+				Value:   collector.DefaultMaxBatchSize,
+				Usage:   "The maximum size of an agent batch in bytes. Larger batches are rejected.",
+				EnvVars: []string{"MAX_BATCH_SIZE"},
+			},
+
+			&cli.DurationFlag{
+				Name:    flagGraphTTL,
+				Value:   15 * time.Minute,
+				Usage:   "The time after which an unseen edge is removed from the dependency graph.",
+				EnvVars: []string{"GRAPH_TTL"},
+			},
+
+			&cli.StringFlag{
+				Name:    flagWebhookURL,
+				Usage:   "The URL to push metric batches to. Disabled if empty.",
+				EnvVars: []string{"WEBHOOK_URL"},
+			},
+			&cli.StringSliceFlag{
+				Name:    flagWebhookHeaders,
+				Usage:   "A header to send with each webhook request. E.g. 'X-Key: value'.",
+				EnvVars: []string{"WEBHOOK_HEADERS"},
+			},
+			&cli.StringFlag{
+				Name:    flagWebhookUser,
+				Usage:   "The webhook basic auth username.",
+				EnvVars: []string{"WEBHOOK_USERNAME"},
+			},
+			&cli.StringFlag{
+				Name:    flagWebhookPass,
+				Usage:   "The webhook basic auth password.",
+				EnvVars: []string{"WEBHOOK_PASSWORD"},
+			},
+			&cli.StringFlag{
+				Name:    flagWebhookToken,
+				Usage:   "The webhook bearer token.",
+				EnvVars: []string{"WEBHOOK_TOKEN"},
+			},
+			&cli.StringFlag{
+				Name:    flagWebhookSpoolDir,
+				Value:   "/var/run/ebpf/spool/webhook",
+				Usage:   "The directory to spool undelivered webhook batches to.",
+				EnvVars: []string{"WEBHOOK_SPOOL_DIR"},
+			},
+			&cli.Int64Flag{
+				Name:    flagWebhookSpoolSize,
+				Value:   webhook.DefaultMaxSpoolSize,
+				Usage:   "The maximum size of the webhook spool in bytes.",
+				EnvVars: []string{"WEBHOOK_SPOOL_SIZE"},
+			},
+
+			&cli.StringFlag{
+				Name:    flagClickHouseURL,
+				Usage:   "The ClickHouse HTTP interface URL to insert metrics into. Disabled if empty.",
+				EnvVars: []string{"CLICKHOUSE_URL"},
+			},
+			&cli.StringFlag{
+				Name:    flagClickHouseDB,
+				Value:   "default",
+				Usage:   "The ClickHouse database.",
+				EnvVars: []string{"CLICKHOUSE_DATABASE"},
+			},
+			&cli.StringFlag{
+				Name:    flagClickHouseTable,
+				Value:   "flows",
+				Usage:   "The ClickHouse table. It is created if it does not exist.",
+				EnvVars: []string{"CLICKHOUSE_TABLE"},
+			},
+			&cli.StringFlag{
+				Name:    flagClickHouseUser,
+				Usage:   "The ClickHouse username.",
+				EnvVars: []string{"CLICKHOUSE_USERNAME"},
+			},
+			&cli.StringFlag{
+				Name:    flagClickHousePass,
+				Usage:   "The ClickHouse password.",
+				EnvVars: []string{"CLICKHOUSE_PASSWORD"},
+			},
+			&cli.DurationFlag{
+				Name:    flagClickHouseTTL,
+				Usage:   "The retention of the ClickHouse tables, also applied to existing tables. Zero leaves the retention unchanged.",
+				EnvVars: []string{"CLICKHOUSE_TTL"},
+			},
+
+			&cli.StringFlag{
+				Name:    flagParquetDir,
+				Usage:   "The directory to write hourly parquet files to. Disabled if empty.",
+				EnvVars: []string{"PARQUET_DIR"},
+			},
+		},
+		Action: runCollector,
+	}
+
+	if err := app.Run(os.Args); err != nil {
+		log.Fatal(err)
+	}
+}
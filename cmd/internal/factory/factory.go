@@ -0,0 +1,91 @@
+// Package factory creates the logger and sinks shared by the commands
+// from their command line flags.
+package factory
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/hamba/logger"
+	"github.com/nrwiersma/ebpf/sink/clickhouse"
+	"github.com/nrwiersma/ebpf/sink/webhook"
+	"github.com/urfave/cli/v2"
+)
+
+// Flag names read by the factories.
+const (
+	FlagLogLevel = "log.level"
+
+	FlagWebhookURL       = "webhook.url"
+	FlagWebhookHeaders   = "webhook.header"
+	FlagWebhookUser      = "webhook.username"
+	FlagWebhookPass      = "webhook.password"
+	FlagWebhookToken     = "webhook.token"
+	FlagWebhookSpoolDir  = "webhook.spool.dir"
+	FlagWebhookSpoolSize = "webhook.spool.size"
+
+	FlagClickHouseURL   = "clickhouse.url"
+	FlagClickHouseDB    = "clickhouse.database"
+	FlagClickHouseTable = "clickhouse.table"
+	FlagClickHouseUser  = "clickhouse.username"
+	FlagClickHousePass  = "clickhouse.password"
+	FlagClickHouseTTL   = "clickhouse.ttl"
+)
+
+// NewLogger returns a console logger at the configured level.
+func NewLogger(c *cli.Context) (logger.Logger, error) {
+	str := c.String(FlagLogLevel)
+	if str == "" {
+		str = "info"
+	}
+
+	lvl, err := logger.LevelFromString(str)
+	if err != nil {
+		return nil, err
+	}
+
+	h := logger.LevelFilterHandler(
+		lvl,
+		logger.BufferedStreamHandler(os.Stdout, 1024, time.Second, logger.ConsoleFormat()),
+	)
+
+	return logger.New(h), nil
+}
+
+// NewWebhookSink returns the configured webhook sink.
+func NewWebhookSink(c *cli.Context, log logger.Logger) (*webhook.Sink, error) {
+	opts := []webhook.OptsFunc{
+		webhook.WithMaxSpoolSize(c.Int64(FlagWebhookSpoolSize)),
+		webhook.WithLogger(log),
+	}
+	for _, hdr := range c.StringSlice(FlagWebhookHeaders) {
+		parts := strings.SplitN(hdr, ":", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("invalid webhook header %q", hdr)
+		}
+		opts = append(opts, webhook.WithHeader(strings.TrimSpace(parts[0]), strings.TrimSpace(parts[1])))
+	}
+	if user := c.String(FlagWebhookUser); user != "" {
+		opts = append(opts, webhook.WithBasicAuth(user, c.String(FlagWebhookPass)))
+	}
+	if token := c.String(FlagWebhookToken); token != "" {
+		opts = append(opts, webhook.WithBearerToken(token))
+	}
+
+	return webhook.New(c.String(FlagWebhookURL), c.String(FlagWebhookSpoolDir), opts...)
+}
+
+// NewClickHouseSink returns the configured ClickHouse sink.
+func NewClickHouseSink(c *cli.Context) (*clickhouse.Sink, error) {
+	opts := []clickhouse.OptsFunc{
+		clickhouse.WithDatabase(c.String(FlagClickHouseDB)),
+		clickhouse.WithTTL(c.Duration(FlagClickHouseTTL)),
+	}
+	if user := c.String(FlagClickHouseUser); user != "" {
+		opts = append(opts, clickhouse.WithCredentials(user, c.String(FlagClickHousePass)))
+	}
+
+	return clickhouse.New(c.String(FlagClickHouseURL), c.String(FlagClickHouseTable), opts...)
+}
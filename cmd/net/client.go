@@ -31,6 +31,7 @@ func runClient(c *cli.Context) error {
 			res, err := http.Post(uri, "text/plain", bytes.NewReader([]byte("test")))
 			if err != nil {
 				fmt.Println("Error", err)
+				continue
 			}
 			_ = res.Body.Close()
 
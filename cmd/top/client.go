@@ -0,0 +1,71 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/nrwiersma/ebpf/query"
+)
+
+type client struct {
+	url    string
+	client *http.Client
+}
+
+func newClient(uri string) *client {
+	return &client{
+		url:    strings.TrimSuffix(uri, "/") + "/v1/flows",
+		client: &http.Client{Timeout: 5 * time.Second},
+	}
+}
+
+func (c *client) Flows(q query.Query) (query.Result, error) {
+	v := url.Values{}
+	if q.Subject != "" {
+		v.Set("subject", q.Subject)
+	}
+	if q.Remote != "" {
+		v.Set("remote", q.Remote)
+	}
+	if q.Namespace != "" {
+		v.Set("namespace", q.Namespace)
+	}
+	if q.Port != 0 {
+		v.Set("port", strconv.Itoa(int(q.Port)))
+	}
+	if q.Exact {
+		v.Set("exact", "true")
+	}
+	if q.Distribution {
+		v.Set("distribution", "true")
+	}
+	v.Set("sort", q.Sort)
+	v.Set("windows", strconv.Itoa(q.Windows))
+	v.Set("limit", strconv.Itoa(q.Limit))
+
+	resp, err := c.client.Get(c.url + "?" + v.Encode())
+	if err != nil {
+		return query.Result{}, fmt.Errorf("unable to query agent: %w", err)
+	}
+	defer func() {
+		_, _ = io.Copy(io.Discard, resp.Body)
+		_ = resp.Body.Close()
+	}()
+
+	if resp.StatusCode != http.StatusOK {
+		b, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return query.Result{}, fmt.Errorf("agent returned %d: %s", resp.StatusCode, strings.TrimSpace(string(b)))
+	}
+
+	var res query.Result
+	if err = json.NewDecoder(resp.Body).Decode(&res); err != nil {
+		return query.Result{}, fmt.Errorf("unable to decode flows: %w", err)
+	}
+	return res, nil
+}
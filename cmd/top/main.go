@@ -0,0 +1,70 @@
+package main
+
+import (
+	"log"
+	"os"
+	"time"
+
+	_ "github.com/joho/godotenv/autoload"
+	"github.com/urfave/cli/v2"
+)
+
+var version = "¯\\_(ツ)_/¯"
+
+const (
+	flagURL       = "url"
+	flagRefresh   = "refresh"
+	flagSort      = "sort"
+	flagNamespace = "namespace"
+	flagPod       = "pod"
+	flagWindows   = "windows"
+)
+
+func main() {
+	app := &cli.App{
+		Name:    "top",
+		Usage:   "Show the flows of a running agent, ranked by throughput or latency",
+		Version: version,
+		Flags: []cli.Flag{
+			&cli.StringFlag{
+				Name:    flagURL,
+				Value:   "http://localhost:8080",
+				Usage:   "The agent HTTP API URL.",
+				EnvVars: []string{"AGENT_URL"},
+			},
+			&cli.DurationFlag{
+				Name:    flagRefresh,
+				Value:   2 * time.Second,
+				Usage:   "The refresh interval.",
+				EnvVars: []string{"REFRESH"},
+			},
+			&cli.StringFlag{
+				Name:    flagSort,
+				Value:   "rate",
+				Usage:   "The initial sort order. One of 'rate', 'bytes', 'packets', 'rtt'.",
+				EnvVars: []string{"SORT"},
+			},
+			&cli.StringFlag{
+				Name:    flagNamespace,
+				Usage:   "Only show flows with an end in the namespace.",
+				EnvVars: []string{"NAMESPACE"},
+			},
+			&cli.StringFlag{
+				Name:    flagPod,
+				Usage:   "Only show flows of subjects containing the pod name.",
+				EnvVars: []string{"POD"},
+			},
+			&cli.IntFlag{
+				Name:    flagWindows,
+				Value:   1,
+				Usage:   "The number of recent agent intervals to aggregate.",
+				EnvVars: []string{"WINDOWS"},
+			},
+		},
+		Action: runTop,
+	}
+
+	if err := app.Run(os.Args); err != nil {
+		log.Fatal(err)
+	}
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"strings"
+	"time"
+
+	"github.com/nrwiersma/ebpf/query"
+)
+
+// headerLines is the number of lines above the flow table rows.
+const headerLines = 4
+
+const (
+	clearScreen = "\x1b[H\x1b[2J"
+	reverse     = "\x1b[7m"
+	bold        = "\x1b[1m"
+	reset       = "\x1b[0m"
+)
+
+func render(w io.Writer, v *view, width, height int) {
+	var lines []string
+	if v.edge != nil {
+		lines = renderEdge(v, width)
+	} else {
+		lines = renderFlows(v, width)
+	}
+
+	if len(lines) > height-1 {
+		lines = lines[:height-1]
+	}
+	_, _ = io.WriteString(w, clearScreen)
+	for _, l := range lines {
+		_, _ = io.WriteString(w, l+"\r\n")
+	}
+
+	// The status line is always at the bottom.
+	_, _ = fmt.Fprintf(w, "\x1b[%d;1H", height)
+	_, _ = io.WriteString(w, statusLine(v, width))
+}
+
+func renderFlows(v *view, width int) []string {
+	lines := []string{
+		title(v, width),
+		fmt.Sprintf("sort: %s  namespace: %s  pod: %s", v.q.Sort, orAll(v.q.Namespace), orAll(v.q.Subject)),
+		errorLine(v.err),
+	}
+
+	// Fixed columns take 70 characters, the rest is shared by subject and remote.
+	nameW := (width - 70) / 2
+	if nameW < 12 {
+		nameW = 12
+	}
+	hdr := fmt.Sprintf("%-*s %-*s %5s %-5s %-3s %10s %10s %10s %9s %9s",
+		nameW, "SUBJECT", nameW, "REMOTE", "PORT", "PROTO", "DIR", "RATE", "IN", "OUT", "RTT P50", "RTT P99")
+	lines = append(lines, bold+fit(hdr, width)+reset)
+
+	for i, f := range v.res.Flows {
+		row := fmt.Sprintf("%-*s %-*s %5d %-5s %-3s %10s %10s %10s %9s %9s",
+			nameW, fit(f.Subject, nameW), nameW, fit(f.Remote, nameW), f.Port, f.Protocol, f.Direction,
+			formatBytes(f.BytesRate)+"/s", formatBytes(float64(f.BytesIn)), formatBytes(float64(f.BytesOut)),
+			formatMillis(f.RTT.P50), formatMillis(f.RTT.P99))
+		row = fit(row, width)
+		if i == v.sel {
+			row = reverse + row + strings.Repeat(" ", width-len([]rune(row))) + reset
+		}
+		lines = append(lines, row)
+	}
+	return lines
+}
+
+func renderEdge(v *view, width int) []string {
+	e := v.edge
+	lines := []string{
+		title(v, width),
+		fit(fmt.Sprintf("%s -> %s:%d/%s %s", e.Subject, e.Remote, e.Port, e.Protocol, e.Direction), width),
+		errorLine(v.err),
+		fmt.Sprintf("rate: %s/s  in: %s  out: %s  packets in: %d  packets out: %d",
+			formatBytes(e.BytesRate), formatBytes(float64(e.BytesIn)), formatBytes(float64(e.BytesOut)), e.PacketsIn, e.PacketsOut),
+		"",
+		bold + "RTT distribution" + reset,
+	}
+
+	if len(e.RTTDistribution) == 0 {
+		return append(lines, "no RTT samples in the queried windows")
+	}
+
+	var max float64
+	for _, q := range e.RTTDistribution {
+		if q.Value > max {
+			max = q.Value
+		}
+	}
+	barW := width - 22
+	if barW < 10 {
+		barW = 10
+	}
+	for _, q := range e.RTTDistribution {
+		n := 0
+		if max > 0 {
+			n = int(q.Value / max * float64(barW))
+		}
+		lines = append(lines, fmt.Sprintf("%7s %10s %s", formatQuantile(q), formatMillis(q.Value), strings.Repeat("█", n)))
+	}
+	return lines
+}
+
+func title(v *view, width int) string {
+	to := "-"
+	if v.res.To > 0 {
+		to = time.Unix(v.res.To, 0).Format("15:04:05")
+	}
+	return bold + fit(fmt.Sprintf("flows at %s, %d interval(s)", to, v.q.Windows), width) + reset
+}
+
+func statusLine(v *view, width int) string {
+	if v.prompt != "" {
+		return fit(fmt.Sprintf("%s: %s", v.prompt, v.input), width) + "\x1b[?25h"
+	}
+	if v.edge != nil {
+		return "\x1b[?25l" + fit("b/esc back  q quit", width)
+	}
+	return "\x1b[?25l" + fit("↑/↓ select  enter drill down  s sort  n namespace  p pod  q quit", width)
+}
+
+func errorLine(err error) string {
+	if err == nil {
+		return ""
+	}
+	return "error: " + err.Error()
+}
+
+func orAll(s string) string {
+	if s == "" {
+		return "*"
+	}
+	return s
+}
+
+// fit truncates s to at most n runes.
+func fit(s string, n int) string {
+	r := []rune(s)
+	if len(r) <= n {
+		return s
+	}
+	if n <= 1 {
+		return string(r[:n])
+	}
+	return string(r[:n-1]) + "…"
+}
+
+func formatBytes(b float64) string {
+	const unit = 1024
+	if b < unit {
+		return fmt.Sprintf("%.0fB", b)
+	}
+	div, exp := float64(unit), 0
+	for n := b / unit; n >= unit; n /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f%ciB", b/div, "KMGTPE"[exp])
+}
+
+func formatMillis(ms float64) string {
+	if ms == 0 {
+		return "-"
+	}
+	return (time.Duration(ms * float64(time.Millisecond))).Round(time.Microsecond).String()
+}
+
+func formatQuantile(q query.Quantile) string {
+	return fmt.Sprintf("p%g", math.Round(q.Q*1000)/10)
+}
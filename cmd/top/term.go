@@ -0,0 +1,45 @@
+package main
+
+import (
+	"golang.org/x/sys/unix"
+)
+
+// terminal is a terminal in raw mode.
+type terminal struct {
+	fd   int
+	prev *unix.Termios
+}
+
+func newTerminal(fd int) (*terminal, error) {
+	prev, err := unix.IoctlGetTermios(fd, unix.TCGETS)
+	if err != nil {
+		return nil, err
+	}
+
+	raw := *prev
+	raw.Iflag &^= unix.IGNBRK | unix.BRKINT | unix.PARMRK | unix.ISTRIP | unix.INLCR | unix.IGNCR | unix.ICRNL | unix.IXON
+	raw.Lflag &^= unix.ECHO | unix.ECHONL | unix.ICANON | unix.ISIG | unix.IEXTEN
+	raw.Cflag &^= unix.CSIZE | unix.PARENB
+	raw.Cflag |= unix.CS8
+	raw.Cc[unix.VMIN] = 1
+	raw.Cc[unix.VTIME] = 0
+	if err = unix.IoctlSetTermios(fd, unix.TCSETS, &raw); err != nil {
+		return nil, err
+	}
+
+	return &terminal{fd: fd, prev: prev}, nil
+}
+
+// Size returns the width and height of the terminal.
+func (t *terminal) Size() (int, int) {
+	ws, err := unix.IoctlGetWinsize(t.fd, unix.TIOCGWINSZ)
+	if err != nil || ws.Col == 0 || ws.Row == 0 {
+		return 80, 24
+	}
+	return int(ws.Col), int(ws.Row)
+}
+
+// Restore restores the terminal to its previous mode.
+func (t *terminal) Restore() error {
+	return unix.IoctlSetTermios(t.fd, unix.TCSETS, t.prev)
+}
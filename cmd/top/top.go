@@ -0,0 +1,266 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"os"
+	"os/signal"
+	"strings"
+	"time"
+
+	"github.com/nrwiersma/ebpf/query"
+	"github.com/urfave/cli/v2"
+	"golang.org/x/sys/unix"
+)
+
+var sorts = []string{query.SortRate, query.SortBytes, query.SortPackets, query.SortRTT}
+
+// Keys.
+const (
+	keyUp = iota + 256
+	keyDown
+	keyEnter
+	keyBack
+	keyEsc
+)
+
+// view is the state of the top screen.
+type view struct {
+	q   query.Query
+	res query.Result
+	err error
+	sel int
+
+	// edge is the flow being drilled into, if any.
+	edge *query.Flow
+
+	// prompt is the filter being edited, if any.
+	prompt string
+	input  string
+}
+
+func runTop(c *cli.Context) error {
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt, unix.SIGTERM)
+	defer cancel()
+
+	sort := c.String(flagSort)
+	if sortIndex(sort) == -1 {
+		return errors.New("unknown sort " + sort)
+	}
+
+	term, err := newTerminal(int(os.Stdin.Fd()))
+	if err != nil {
+		return err
+	}
+	defer func() { _ = term.Restore() }()
+
+	out := bufio.NewWriter(os.Stdout)
+	_, _ = out.WriteString("\x1b[?1049h\x1b[?25l")
+	defer func() {
+		_, _ = out.WriteString("\x1b[?25h\x1b[?1049l")
+		_ = out.Flush()
+	}()
+
+	cl := newClient(c.String(flagURL))
+	v := &view{
+		q: query.Query{
+			Namespace: c.String(flagNamespace),
+			Subject:   c.String(flagPod),
+			Sort:      sort,
+			Windows:   c.Int(flagWindows),
+		},
+	}
+
+	keys := make(chan int)
+	go readKeys(os.Stdin, keys)
+
+	tick := time.NewTicker(c.Duration(flagRefresh))
+	defer tick.Stop()
+
+	refresh := true
+	for {
+		w, h := term.Size()
+		if refresh {
+			v.fetch(cl, h)
+		}
+		render(out, v, w, h)
+		_ = out.Flush()
+
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-tick.C:
+			refresh = true
+		case k, ok := <-keys:
+			if !ok {
+				return nil
+			}
+			var quit bool
+			refresh, quit = v.handleKey(k)
+			if quit {
+				return nil
+			}
+		}
+	}
+}
+
+func (v *view) fetch(cl *client, h int) {
+	if v.edge != nil {
+		res, err := cl.Flows(query.Query{
+			Subject:      v.edge.Subject,
+			Remote:       v.edge.Remote,
+			Port:         v.edge.Port,
+			Exact:        true,
+			Sort:         v.q.Sort,
+			Windows:      v.q.Windows,
+			Distribution: true,
+		})
+		v.err = err
+		if err != nil {
+			return
+		}
+
+		v.res.From, v.res.To = res.From, res.To
+		for _, f := range res.Flows {
+			if sameEdge(f, *v.edge) {
+				f := f
+				v.edge = &f
+				return
+			}
+		}
+		// The edge had no traffic in the queried windows.
+		v.edge.RTTDistribution = nil
+		return
+	}
+
+	q := v.q
+	q.Limit = h - headerLines - 1
+	if q.Limit < 1 {
+		q.Limit = 1
+	}
+	v.res, v.err = cl.Flows(q)
+	if v.sel >= len(v.res.Flows) {
+		v.sel = len(v.res.Flows) - 1
+	}
+	if v.sel < 0 {
+		v.sel = 0
+	}
+}
+
+// handleKey handles a key press, returning if the flows
+// should be refreshed and if the program should quit.
+func (v *view) handleKey(k int) (refresh, quit bool) {
+	if v.prompt != "" {
+		switch k {
+		case keyEnter:
+			switch v.prompt {
+			case flagNamespace:
+				v.q.Namespace = v.input
+			case flagPod:
+				v.q.Subject = v.input
+			}
+			v.prompt = ""
+			return true, false
+		case keyEsc:
+			v.prompt = ""
+		case keyBack:
+			if len(v.input) > 0 {
+				v.input = v.input[:len(v.input)-1]
+			}
+		default:
+			if k >= ' ' && k < 127 {
+				v.input += string(rune(k))
+			}
+		}
+		return false, false
+	}
+
+	switch k {
+	case 'q', 3: // Ctrl-C.
+		return false, true
+	case 's':
+		v.q.Sort = sorts[(sortIndex(v.q.Sort)+1)%len(sorts)]
+		return true, false
+	case 'n':
+		v.prompt, v.input = flagNamespace, v.q.Namespace
+	case 'p':
+		v.prompt, v.input = flagPod, v.q.Subject
+	case keyUp, 'k':
+		if v.sel > 0 {
+			v.sel--
+		}
+	case keyDown, 'j':
+		if v.sel < len(v.res.Flows)-1 {
+			v.sel++
+		}
+	case keyEnter:
+		if v.edge == nil && v.sel < len(v.res.Flows) {
+			f := v.res.Flows[v.sel]
+			v.edge = &f
+			return true, false
+		}
+	case keyBack, keyEsc, 'b':
+		if v.edge != nil {
+			v.edge = nil
+			return true, false
+		}
+	}
+	return false, false
+}
+
+func sortIndex(sort string) int {
+	for i, s := range sorts {
+		if s == sort {
+			return i
+		}
+	}
+	return -1
+}
+
+func sameEdge(a, b query.Flow) bool {
+	return a.Node == b.Node && a.Subject == b.Subject && a.Remote == b.Remote && a.Port == b.Port &&
+		a.Protocol == b.Protocol && a.Direction == b.Direction && a.Namespace == b.Namespace && a.Workload == b.Workload
+}
+
+// readKeys reads key presses from the terminal, decoding escape sequences.
+func readKeys(f *os.File, keys chan<- int) {
+	defer close(keys)
+
+	buf := make([]byte, 64)
+	for {
+		n, err := f.Read(buf)
+		if err != nil {
+			return
+		}
+
+		in := string(buf[:n])
+		for len(in) > 0 {
+			switch {
+			case strings.HasPrefix(in, "\x1b[A"), strings.HasPrefix(in, "\x1bOA"):
+				keys <- keyUp
+				in = in[3:]
+			case strings.HasPrefix(in, "\x1b[B"), strings.HasPrefix(in, "\x1bOB"):
+				keys <- keyDown
+				in = in[3:]
+			case in[0] == '\x1b':
+				// Ignore other escape sequences.
+				if len(in) > 1 && (in[1] == '[' || in[1] == 'O') {
+					in = ""
+					continue
+				}
+				keys <- keyEsc
+				in = in[1:]
+			case in[0] == '\r', in[0] == '\n':
+				keys <- keyEnter
+				in = in[1:]
+			case in[0] == 127, in[0] == '\b':
+				keys <- keyBack
+				in = in[1:]
+			default:
+				keys <- int(in[0])
+				in = in[1:]
+			}
+		}
+	}
+}
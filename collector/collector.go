@@ -0,0 +1,278 @@
+// Package collector implements a service that merges the
+// metric batches of node agents into cluster-wide metrics.
+package collector
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/hamba/logger"
+	"github.com/nrwiersma/ebpf/flow"
+)
+
+// DefaultMaxBatchSize is the default maximum size of a batch in bytes.
+const DefaultMaxBatchSize = 32 << 20
+
+// Batch is a batch of metrics sent by an agent.
+type Batch struct {
+	Node     string        `json:"node"`
+	Interval time.Duration `json:"interval"`
+	Metrics  []flow.Metric `json:"metrics"`
+}
+
+// Encoder returns a function that encodes metrics as
+// a batch for the given node and interval.
+func Encoder(node string, inter time.Duration) func(ms []flow.Metric) ([]byte, error) {
+	return func(ms []flow.Metric) ([]byte, error) {
+		return json.Marshal(Batch{
+			Node:     node,
+			Interval: inter,
+			Metrics:  ms,
+		})
+	}
+}
+
+// Sink represents a metrics sink.
+type Sink interface {
+	Write(ms []flow.Metric) error
+}
+
+// OptsFunc represents a configuration function for the collector.
+type OptsFunc func(c *Collector)
+
+// WithSinks configures the sinks merged metrics are written to.
+func WithSinks(sinks ...Sink) OptsFunc {
+	return func(c *Collector) {
+		c.sinks = append(c.sinks, sinks...)
+	}
+}
+
+// WithDelay configures how long the collector waits for the batches
+// of an interval before writing it. Batches arriving later are dropped.
+func WithDelay(d time.Duration) OptsFunc {
+	return func(c *Collector) {
+		c.delay = d
+	}
+}
+
+// WithPerNode configures the collector to keep the node dimension,
+// instead of merging the metrics of all nodes.
+func WithPerNode(perNode bool) OptsFunc {
+	return func(c *Collector) {
+		c.perNode = perNode
+	}
+}
+
+// WithMaxBatchSize configures the maximum size of a batch in bytes.
+// Larger batches are rejected.
+func WithMaxBatchSize(size int64) OptsFunc {
+	return func(c *Collector) {
+		c.maxSize = size
+	}
+}
+
+// WithToken configures the bearer token agents must present.
+func WithToken(token string) OptsFunc {
+	return func(c *Collector) {
+		c.token = token
+	}
+}
+
+// Collector merges metric batches from agents into per-edge
+// aggregates per interval.
+type Collector struct {
+	sinks   []Sink
+	delay   time.Duration
+	perNode bool
+	token   string
+	maxSize int64
+
+	mu      sync.Mutex
+	windows map[int64]*window
+	emitted int64
+
+	doneCh  chan struct{}
+	stopped chan struct{}
+
+	log logger.Logger
+}
+
+// New returns a collector.
+func New(log logger.Logger, opts ...OptsFunc) *Collector {
+	c := &Collector{
+		delay:   5 * time.Second,
+		maxSize: DefaultMaxBatchSize,
+		windows: map[int64]*window{},
+		doneCh:  make(chan struct{}),
+		stopped: make(chan struct{}),
+		log:     log,
+	}
+
+	for _, opt := range opts {
+		opt(c)
+	}
+
+	go c.runFlush()
+
+	return c
+}
+
+// ServeHTTP receives metric batches.
+func (c *Collector) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPost {
+		rw.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	if c.token != "" {
+		want := "Bearer " + c.token
+		if subtle.ConstantTimeCompare([]byte(req.Header.Get("Authorization")), []byte(want)) != 1 {
+			rw.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+	}
+
+	var b Batch
+	body := http.MaxBytesReader(rw, req.Body, c.maxSize)
+	if err := json.NewDecoder(body).Decode(&b); err != nil {
+		if isTooLarge(err) {
+			http.Error(rw, "batch too large", http.StatusRequestEntityTooLarge)
+			return
+		}
+		http.Error(rw, "invalid batch: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if dropped := c.Add(b); dropped > 0 {
+		c.log.Warn("Dropped late metrics", "node", b.Node, "count", dropped)
+	}
+
+	rw.WriteHeader(http.StatusAccepted)
+}
+
+// isTooLarge determines if the error is from reading past the
+// limit of a http.MaxBytesReader, which has no error type to match.
+func isTooLarge(err error) bool {
+	return err != nil && err.Error() == "http: request body too large"
+}
+
+// Add merges a batch into its intervals, returning the number
+// of metrics dropped because their interval was already written.
+func (c *Collector) Add(b Batch) int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	var dropped int
+	for _, m := range b.Metrics {
+		if m.Timestamp <= c.emitted {
+			dropped++
+			continue
+		}
+
+		w, ok := c.windows[m.Timestamp]
+		if !ok {
+			w = &window{
+				ts:       m.Timestamp,
+				interval: b.Interval,
+				seen:     time.Now(),
+				agg:      map[flow.Key]*flow.Metric{},
+			}
+			c.windows[m.Timestamp] = w
+		}
+
+		if !c.perNode {
+			m.Node = ""
+		}
+		w.Add(m)
+	}
+	return dropped
+}
+
+func (c *Collector) runFlush() {
+	defer close(c.stopped)
+
+	t := time.NewTicker(time.Second)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-c.doneCh:
+			return
+		case <-t.C:
+		}
+
+		for _, ms := range c.due(time.Now()) {
+			c.write(ms)
+		}
+	}
+}
+
+// due removes and returns the windows that waited long enough, oldest first.
+func (c *Collector) due(now time.Time) [][]flow.Metric {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	var due []*window
+	for ts, w := range c.windows {
+		if now.Sub(w.seen) < c.delay {
+			continue
+		}
+		due = append(due, w)
+		delete(c.windows, ts)
+	}
+	sort.Slice(due, func(i, j int) bool {
+		return due[i].ts < due[j].ts
+	})
+
+	out := make([][]flow.Metric, 0, len(due))
+	for _, w := range due {
+		if w.ts > c.emitted {
+			c.emitted = w.ts
+		}
+		out = append(out, w.Metrics())
+	}
+	return out
+}
+
+func (c *Collector) write(ms []flow.Metric) {
+	for _, sink := range c.sinks {
+		if err := sink.Write(ms); err != nil {
+			c.log.Error("Unable to write metrics to sink", "error", err)
+		}
+	}
+}
+
+// Close writes the pending intervals and stops the collector.
+func (c *Collector) Close() error {
+	close(c.doneCh)
+	<-c.stopped
+
+	for _, ms := range c.due(time.Now().Add(c.delay)) {
+		c.write(ms)
+	}
+	return nil
+}
+
+type window struct {
+	ts       int64
+	interval time.Duration
+	seen     time.Time
+
+	agg map[flow.Key]*flow.Metric
+}
+
+func (w *window) Add(m flow.Metric) {
+	flow.MergeInto(w.agg, w.ts, m)
+}
+
+func (w *window) Metrics() []flow.Metric {
+	ms := make([]flow.Metric, 0, len(w.agg))
+	for _, m := range w.agg {
+		m.UpdateRates(w.interval)
+		ms = append(ms, *m)
+	}
+	return ms
+}
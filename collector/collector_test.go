@@ -0,0 +1,135 @@
+package collector
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/hamba/logger"
+	"github.com/influxdata/tdigest"
+	"github.com/nrwiersma/ebpf/flow"
+)
+
+func TestCollector_ServeHTTP(t *testing.T) {
+	enc := Encoder("node", time.Second)
+	b, err := enc([]flow.Metric{{Timestamp: time.Now().Unix() + 60, Subject: "default/a", Remote: "default/b", BytesIn: 1}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		body    []byte
+		maxSize int64
+		want    int
+	}{
+		{name: "accepts batch", body: b, maxSize: DefaultMaxBatchSize, want: http.StatusAccepted},
+		{name: "rejects invalid batch", body: []byte("{"), maxSize: DefaultMaxBatchSize, want: http.StatusBadRequest},
+		{name: "rejects large batch", body: b, maxSize: int64(len(b) / 2), want: http.StatusRequestEntityTooLarge},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			c := New(logger.New(logger.DiscardHandler()), WithMaxBatchSize(test.maxSize))
+			defer func() { _ = c.Close() }()
+
+			req := httptest.NewRequest(http.MethodPost, "/v1/metrics", bytes.NewReader(test.body))
+			rec := httptest.NewRecorder()
+			c.ServeHTTP(rec, req)
+
+			if rec.Code != test.want {
+				t.Errorf("expected status %d, got %d: %s", test.want, rec.Code, strings.TrimSpace(rec.Body.String()))
+			}
+		})
+	}
+}
+
+type sinkFunc func(ms []flow.Metric) error
+
+func (f sinkFunc) Write(ms []flow.Metric) error {
+	return f(ms)
+}
+
+func TestCollector_MergesNodes(t *testing.T) {
+	ts := time.Now().Unix()
+	batch := func(node string, bytesIn uint64, rtt float64, n int) []byte {
+		td := tdigest.New()
+		td.Add(rtt, float64(n))
+		b, err := Encoder(node, 10*time.Second)([]flow.Metric{{
+			Timestamp: ts,
+			Node:      node,
+			Subject:   "default/a",
+			Remote:    "default/b",
+			Port:      8080,
+			Protocol:  "tcp",
+			BytesIn:   bytesIn,
+			RTT:       td,
+		}})
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		return b
+	}
+
+	tests := []struct {
+		name    string
+		perNode bool
+		want    int
+	}{
+		{name: "merges nodes", want: 1},
+		{name: "keeps nodes", perNode: true, want: 2},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var got []flow.Metric
+			sink := sinkFunc(func(ms []flow.Metric) error {
+				got = append(got, ms...)
+				return nil
+			})
+			c := New(logger.New(logger.DiscardHandler()), WithSinks(sink), WithPerNode(test.perNode), WithDelay(time.Hour))
+
+			for _, b := range [][]byte{batch("node-a", 100, 10, 100), batch("node-b", 300, 1000, 300)} {
+				req := httptest.NewRequest(http.MethodPost, "/v1/metrics", bytes.NewReader(b))
+				rec := httptest.NewRecorder()
+				c.ServeHTTP(rec, req)
+				if rec.Code != http.StatusAccepted {
+					t.Fatalf("expected status %d, got %d", http.StatusAccepted, rec.Code)
+				}
+			}
+			if err := c.Close(); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			if len(got) != test.want {
+				t.Fatalf("expected %d metrics, got %d", test.want, len(got))
+			}
+			if test.perNode {
+				return
+			}
+
+			m := got[0]
+			if m.Node != "" || m.Timestamp != ts {
+				t.Errorf("expected no node at %d, got %q at %d", ts, m.Node, m.Timestamp)
+			}
+			if m.BytesIn != 400 {
+				t.Errorf("expected 400 bytes in, got %d", m.BytesIn)
+			}
+			if m.BytesRate != 40 {
+				t.Errorf("expected bytes rate 40, got %v", m.BytesRate)
+			}
+			if n := m.RTT.Count(); n != 400 {
+				t.Fatalf("expected 400 rtt samples, got %v", n)
+			}
+			if p := m.RTT.Quantile(0.1); p != 10 {
+				t.Errorf("expected rtt p10 of node-a, got %v", p)
+			}
+			if p := m.RTT.Quantile(0.9); p != 1000 {
+				t.Errorf("expected rtt p90 of node-b, got %v", p)
+			}
+		})
+	}
+}
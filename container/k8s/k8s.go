@@ -4,6 +4,7 @@ import (
 	"context"
 	"fmt"
 	"os"
+	"strings"
 	"sync"
 	"time"
 
@@ -54,7 +55,7 @@ type Service struct {
 	// TODO: This should be switched for something with a faster
 	//		 read path. Perhaps iradix.
 	mu    sync.RWMutex
-	names map[[16]byte]string
+	names map[[16]byte]endpoint
 
 	doneCh chan struct{}
 
@@ -90,7 +91,7 @@ func NewWithClient(
 		cgroupRoot: cgroupRoot,
 		eventFac:   podEvents{cgroupRoot: cgroupRoot},
 		events:     make(chan container.Event, 100),
-		names:      map[[16]byte]string{},
+		names:      map[[16]byte]endpoint{},
 		doneCh:     make(chan struct{}),
 	}
 
@@ -143,7 +144,7 @@ func (s *Service) onAdd() func(obj interface{}) {
 			pod := v
 			name := pod.Namespace + "/" + pod.Name
 
-			s.addName(pod.Status.PodIP, name)
+			s.addName(pod.Status.PodIP, name, podWorkload(pod))
 
 			if !s.shouldEmit(pod) {
 				return
@@ -161,7 +162,7 @@ func (s *Service) onAdd() func(obj interface{}) {
 			svc := v
 			name := svc.Namespace + "/" + svc.Name
 
-			s.addName(svc.Spec.ClusterIP, name)
+			s.addName(svc.Spec.ClusterIP, name, name)
 		}
 	}
 }
@@ -176,7 +177,7 @@ func (s *Service) onUpdate() func(oldObj, newObj interface{}) {
 
 			if newPod.Status.PodIP != oldPod.Status.PodIP {
 				s.removeName(oldPod.Status.PodIP)
-				s.addName(newPod.Status.PodIP, name)
+				s.addName(newPod.Status.PodIP, name, podWorkload(newPod))
 			}
 
 			if !s.shouldEmit(newPod) {
@@ -201,7 +202,7 @@ func (s *Service) onUpdate() func(oldObj, newObj interface{}) {
 			}
 
 			s.removeName(oldSvc.Spec.ClusterIP)
-			s.addName(newSvc.Spec.ClusterIP, name)
+			s.addName(newSvc.Spec.ClusterIP, name, name)
 		}
 	}
 }
@@ -248,7 +249,7 @@ func (s *Service) shouldEmit(pod *corev1.Pod) bool {
 	return true
 }
 
-func (s *Service) addName(ip, name string) {
+func (s *Service) addName(ip, name, workload string) {
 	if ip == "" {
 		return
 	}
@@ -256,7 +257,7 @@ func (s *Service) addName(ip, name string) {
 	ipb := ipToBytes(ip)
 	s.mu.Lock()
 	defer s.mu.Unlock()
-	s.names[ipb] = name
+	s.names[ipb] = endpoint{name: name, workload: workload}
 }
 
 func (s *Service) removeName(ip string) {
@@ -270,6 +271,29 @@ func (s *Service) removeName(ip string) {
 	delete(s.names, ipb)
 }
 
+type endpoint struct {
+	name     string
+	workload string
+}
+
+// podWorkload returns the name of the controller owning the pod.
+// For pods owned by a replica set, the deployment name is returned.
+func podWorkload(pod *corev1.Pod) string {
+	for _, ref := range pod.OwnerReferences {
+		if ref.Controller == nil || !*ref.Controller {
+			continue
+		}
+
+		name := ref.Name
+		if hash, ok := pod.Labels["pod-template-hash"]; ok && ref.Kind == "ReplicaSet" {
+			name = strings.TrimSuffix(name, "-"+hash)
+		}
+		return pod.Namespace + "/" + name
+	}
+
+	return pod.Namespace + "/" + pod.Name
+}
+
 func ipToBytes(v string) [16]byte {
 	ip, err := netaddr.ParseIP(v)
 	if err != nil {
@@ -289,8 +313,21 @@ func (s *Service) Name(ip [16]byte) string {
 	s.mu.RLock()
 	defer s.mu.RUnlock()
 
-	if name, ok := s.names[ip]; ok {
-		return name
+	if ep, ok := s.names[ip]; ok {
+		return ep.name
+	}
+
+	return netaddr.IPFrom16(ip).String()
+}
+
+// Workload resolves an IP into the name of the workload
+// owning it, e.g. the deployment of a pod.
+func (s *Service) Workload(ip [16]byte) string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if ep, ok := s.names[ip]; ok {
+		return ep.workload
 	}
 
 	return netaddr.IPFrom16(ip).String()
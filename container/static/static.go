@@ -0,0 +1,116 @@
+// Package static implements a container service of a fixed set
+// of containers, standing in for kubernetes, e.g. in tests.
+package static
+
+import (
+	"sync"
+
+	"github.com/nrwiersma/ebpf/container"
+	"inet.af/netaddr"
+)
+
+// Container is a container with its addresses.
+type Container struct {
+	// Name is the "namespace/name" of the container.
+	Name string
+	// Workload is the name of the workload owning the container.
+	// It defaults to the name.
+	Workload   string
+	CGroupPath string
+	IPs        []netaddr.IP
+}
+
+// Service is a static container service.
+type Service struct {
+	events chan container.Event
+
+	mu    sync.RWMutex
+	names map[[16]byte]Container
+}
+
+// New returns a static container service, emitting an
+// added event for each of the containers.
+func New(ctrs ...Container) *Service {
+	svc := &Service{
+		events: make(chan container.Event, 100),
+		names:  map[[16]byte]Container{},
+	}
+
+	for _, ctr := range ctrs {
+		svc.Add(ctr)
+	}
+
+	return svc
+}
+
+// Add adds the container, emitting an added event.
+func (s *Service) Add(ctr Container) {
+	if ctr.Workload == "" {
+		ctr.Workload = ctr.Name
+	}
+
+	s.mu.Lock()
+	for _, ip := range ctr.IPs {
+		s.names[ip.As16()] = ctr
+	}
+	s.mu.Unlock()
+
+	s.events <- container.Event{
+		Type:       container.Added,
+		Name:       ctr.Name,
+		CGroupPath: ctr.CGroupPath,
+	}
+}
+
+// Remove removes the container, emitting a removed event.
+func (s *Service) Remove(name string) {
+	s.mu.Lock()
+	for ip, ctr := range s.names {
+		if ctr.Name == name {
+			delete(s.names, ip)
+		}
+	}
+	s.mu.Unlock()
+
+	s.events <- container.Event{
+		Type: container.Removed,
+		Name: name,
+	}
+}
+
+// Events returns a channel of container events.
+func (s *Service) Events() <-chan container.Event {
+	return s.events
+}
+
+// Name resolves an IP into a container name.
+func (s *Service) Name(ip [16]byte) string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if ctr, ok := s.names[ip]; ok {
+		return ctr.Name
+	}
+
+	return netaddr.IPFrom16(ip).String()
+}
+
+// Workload resolves an IP into the name of the workload
+// owning it.
+func (s *Service) Workload(ip [16]byte) string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if ctr, ok := s.names[ip]; ok {
+		return ctr.Workload
+	}
+
+	return netaddr.IPFrom16(ip).String()
+}
+
+// Close closes the container service.
+func (s *Service) Close() error {
+	close(s.events)
+
+	return nil
+}
@@ -0,0 +1,161 @@
+package ebpf
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/nrwiersma/ebpf/flow"
+)
+
+// cumulativeTTL is the time after which an idle edge
+// is removed from the cumulative state. If the edge is seen
+// again, its counters start over with a new start time.
+const cumulativeTTL = 24 * time.Hour
+
+type cumulativeEntry struct {
+	Metric   flow.Metric `json:"metric"`
+	LastSeen int64       `json:"lastSeen"`
+}
+
+type cumulativeState struct {
+	Version int                `json:"version"`
+	Entries []*cumulativeEntry `json:"entries"`
+}
+
+// cumulative keeps monotonically increasing counters and
+// merged digests per edge, which can be checkpointed to disk
+// and restored on startup.
+//
+// It is not safe for concurrent use.
+type cumulative struct {
+	path string
+
+	agg map[flow.Key]*cumulativeEntry
+}
+
+// newCumulative returns cumulative state, restored from
+// the checkpoint at path if it exists.
+func newCumulative(path string) (*cumulative, error) {
+	c := &cumulative{
+		path: path,
+		agg:  map[flow.Key]*cumulativeEntry{},
+	}
+
+	b, err := os.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return c, nil
+		}
+		return nil, fmt.Errorf("unable to read checkpoint: %w", err)
+	}
+
+	var state cumulativeState
+	if err = json.Unmarshal(b, &state); err != nil {
+		return nil, fmt.Errorf("unable to decode checkpoint: %w", err)
+	}
+	for _, e := range state.Entries {
+		c.agg[e.Metric.Key()] = e
+	}
+
+	return c, nil
+}
+
+// Add merges the metrics of an interval into the state, returning
+// the cumulative metrics of the edges seen in the interval. Idle
+// edges keep their state, but are not written until seen again,
+// so the series written per interval stay within the series limit.
+func (c *cumulative) Add(ts int64, ms []flow.Metric) []flow.Metric {
+	out := make([]flow.Metric, 0, len(ms))
+	for _, m := range ms {
+		k := m.Key()
+		e, ok := c.agg[k]
+		if !ok {
+			e = &cumulativeEntry{Metric: *newMetric(k)}
+			e.Metric.Start = ts
+			c.agg[k] = e
+		}
+
+		e.Metric.Merge(m)
+		e.Metric.BytesRate = m.BytesRate
+		e.Metric.PacketsRate = m.PacketsRate
+		e.LastSeen = ts
+		e.Metric.Timestamp = ts
+
+		// The digests keep being merged into, so sinks
+		// must not share them.
+		out = append(out, e.Metric.Clone())
+	}
+
+	for k, e := range c.agg {
+		if time.Duration(ts-e.LastSeen)*time.Second > cumulativeTTL {
+			delete(c.agg, k)
+		}
+	}
+	return out
+}
+
+// Checkpoint writes the state to disk.
+func (c *cumulative) Checkpoint() error {
+	state := cumulativeState{
+		Version: 1,
+		Entries: make([]*cumulativeEntry, 0, len(c.agg)),
+	}
+	for _, e := range c.agg {
+		state.Entries = append(state.Entries, e)
+	}
+
+	b, err := json.Marshal(state)
+	if err != nil {
+		return fmt.Errorf("unable to encode checkpoint: %w", err)
+	}
+
+	if err = os.MkdirAll(filepath.Dir(c.path), 0750); err != nil {
+		return fmt.Errorf("unable to create checkpoint directory: %w", err)
+	}
+	tmp := c.path + ".tmp"
+	if err = writeFileSync(tmp, b); err != nil {
+		_ = os.Remove(tmp)
+		return fmt.Errorf("unable to write checkpoint: %w", err)
+	}
+	if err = os.Rename(tmp, c.path); err != nil {
+		return fmt.Errorf("unable to commit checkpoint: %w", err)
+	}
+	// The rename is only durable once the directory is synced.
+	if err = syncDir(filepath.Dir(c.path)); err != nil {
+		return fmt.Errorf("unable to commit checkpoint: %w", err)
+	}
+	return nil
+}
+
+// writeFileSync writes the data to the file, syncing it
+// to disk before it is closed.
+func writeFileSync(path string, b []byte) error {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0640)
+	if err != nil {
+		return err
+	}
+	if _, err = f.Write(b); err != nil {
+		_ = f.Close()
+		return err
+	}
+	if err = f.Sync(); err != nil {
+		_ = f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	if err = d.Sync(); err != nil {
+		_ = d.Close()
+		return err
+	}
+	return d.Close()
+}
@@ -0,0 +1,117 @@
+package ebpf
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/influxdata/tdigest"
+	"github.com/nrwiersma/ebpf/flow"
+)
+
+func TestCumulative_AddDoesNotShareDigests(t *testing.T) {
+	c, err := newCumulative(filepath.Join(t.TempDir(), "state.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rtt := tdigest.New()
+	rtt.Add(100, 1)
+	out := c.Add(10, []flow.Metric{{Subject: "a", Remote: "b", BytesOut: 1, RTT: rtt}})
+	if len(out) != 1 {
+		t.Fatalf("expected 1 metric, got %d", len(out))
+	}
+
+	// A sink holding on to the metric must not see later intervals.
+	got := out[0].RTT
+	c.Add(20, []flow.Metric{{Subject: "a", Remote: "b", BytesOut: 1, RTT: rtt}})
+	if got.Count() != 1 {
+		t.Errorf("expected the written digest to keep 1 sample, got %v", got.Count())
+	}
+
+	// And a sink modifying it must not change the state.
+	got.Add(1, 10)
+	out = c.Add(30, []flow.Metric{{Subject: "a", Remote: "b", BytesOut: 1}})
+	if n := out[0].RTT.Count(); n != 2 {
+		t.Errorf("expected 2 samples in the state, got %v", n)
+	}
+}
+
+func TestCumulative_FlagsResetAfterTTL(t *testing.T) {
+	c, err := newCumulative(filepath.Join(t.TempDir(), "state.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	m := flow.Metric{Subject: "a", Remote: "b", BytesOut: 10}
+	out := c.Add(100, []flow.Metric{m})
+	if out[0].Start != 100 {
+		t.Fatalf("expected start 100, got %d", out[0].Start)
+	}
+	out = c.Add(200, []flow.Metric{m})
+	if out[0].Start != 100 || out[0].BytesOut != 20 {
+		t.Fatalf("expected start 100 and 20 bytes, got %d and %d", out[0].Start, out[0].BytesOut)
+	}
+
+	// The edge is removed once idle for longer than the TTL.
+	ts := 200 + int64(cumulativeTTL.Seconds()) + 1
+	if out = c.Add(ts, nil); len(out) != 0 {
+		t.Fatalf("expected the idle edge to be removed, got %d metrics", len(out))
+	}
+
+	out = c.Add(ts+10, []flow.Metric{m})
+	if out[0].Start != ts+10 || out[0].BytesOut != 10 {
+		t.Errorf("expected a reset with start %d and 10 bytes, got %d and %d", ts+10, out[0].Start, out[0].BytesOut)
+	}
+}
+
+func TestCumulative_CheckpointRestoresStart(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "state.json")
+
+	c, err := newCumulative(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Add(100, []flow.Metric{{Subject: "a", Remote: "b", BytesOut: 10}})
+	if err = c.Checkpoint(); err != nil {
+		t.Fatal(err)
+	}
+
+	c, err = newCumulative(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	out := c.Add(110, []flow.Metric{{Subject: "a", Remote: "b", BytesOut: 10}})
+	if out[0].Start != 100 || out[0].BytesOut != 20 {
+		t.Errorf("expected start 100 and 20 bytes, got %d and %d", out[0].Start, out[0].BytesOut)
+	}
+}
+
+func TestCumulative_AddOnlyWritesSeenEdges(t *testing.T) {
+	c, err := newCumulative(filepath.Join(t.TempDir(), "state.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	a := flow.Metric{Subject: "a", Remote: "b", BytesOut: 10, BytesRate: 1}
+	b := flow.Metric{Subject: "b", Remote: "a", BytesOut: 5, BytesRate: 1}
+	if out := c.Add(100, []flow.Metric{a, b}); len(out) != 2 {
+		t.Fatalf("expected 2 metrics, got %d", len(out))
+	}
+
+	out := c.Add(110, []flow.Metric{a})
+	if len(out) != 1 || out[0].Subject != "a" {
+		t.Fatalf("expected only the seen edge, got %+v", out)
+	}
+	if out[0].Timestamp != 110 || out[0].BytesOut != 20 {
+		t.Errorf("expected timestamp 110 and 20 bytes, got %d and %d", out[0].Timestamp, out[0].BytesOut)
+	}
+	if out = c.Add(120, nil); len(out) != 0 {
+		t.Fatalf("expected no metrics, got %d", len(out))
+	}
+
+	// The idle edge keeps its counters until the TTL.
+	out = c.Add(130, []flow.Metric{b})
+	if len(out) != 1 || out[0].Start != 100 || out[0].BytesOut != 10 {
+		t.Errorf("expected the edge to continue from start 100 with 10 bytes, got %+v", out)
+	}
+}
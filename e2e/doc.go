@@ -0,0 +1,8 @@
+// Package e2e contains the end-to-end test of the agent pipeline,
+// run against traffic between network namespaces on the local
+// machine, without a kubernetes cluster.
+//
+// The test is behind the e2e build tag and requires root:
+//
+//	go test -tags e2e ./e2e
+package e2e
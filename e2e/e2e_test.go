@@ -0,0 +1,227 @@
+//go:build e2e
+// +build e2e
+
+package e2e
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/hamba/logger"
+	"github.com/nrwiersma/ebpf"
+	"github.com/nrwiersma/ebpf/bpf"
+	"github.com/nrwiersma/ebpf/container/static"
+	"github.com/nrwiersma/ebpf/flow"
+	"github.com/nrwiersma/ebpf/packet"
+	"github.com/nrwiersma/ebpf/pkg/cgroups"
+	"golang.org/x/sys/unix"
+	"inet.af/netaddr"
+)
+
+const namespace = "e2e"
+
+var (
+	netBin   = flag.String("e2e.net-bin", "", "The path of the net binary generating the traffic. Built from cmd/net if empty.")
+	interval = flag.Duration("e2e.interval", 2*time.Second, "The interval metrics are aggregated over.")
+	timeout  = flag.Duration("e2e.timeout", 30*time.Second, "The time to wait for the expected metrics.")
+	keep     = flag.Bool("e2e.keep", false, "Keep the namespaces and cgroups after the test, for debugging.")
+)
+
+func TestAgent(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("requires root")
+	}
+	if len(bpf.MetricsSock) == 0 {
+		t.Skip("program objects are not built")
+	}
+
+	bin := *netBin
+	if bin == "" {
+		bin = filepath.Join(t.TempDir(), "net")
+		out, err := exec.Command("go", "build", "-o", bin, "github.com/nrwiersma/ebpf/cmd/net").CombinedOutput()
+		if err != nil {
+			t.Fatalf("unable to build net binary: %v: %s", err, out)
+		}
+	}
+
+	memlockLimit := &unix.Rlimit{
+		Cur: unix.RLIM_INFINITY,
+		Max: unix.RLIM_INFINITY,
+	}
+	if err := unix.Setrlimit(unix.RLIMIT_MEMLOCK, memlockLimit); err != nil {
+		t.Fatalf("unable to raise memlock limit: %v", err)
+	}
+	if err := cgroups.EnsureCgroupFS(""); err != nil {
+		t.Fatalf("unable to mount cgroup fs: %v", err)
+	}
+
+	e := newEnv(cgroups.CgroupRoot())
+	t.Cleanup(func() {
+		e.Stop()
+		if *keep {
+			return
+		}
+		if err := e.Teardown(); err != nil {
+			t.Errorf("unable to tear down: %v", err)
+		}
+	})
+	if err := e.Setup(); err != nil {
+		t.Fatalf("unable to set up: %v", err)
+	}
+
+	pkts, err := packet.NewCGroup()
+	if err != nil {
+		t.Fatalf("unable to load packet module: %v", err)
+	}
+	defer func() { _ = pkts.Close() }()
+
+	ctrs := static.New(
+		static.Container{
+			Name:       namespace + "/" + e.server.name,
+			CGroupPath: e.server.cgroup,
+			IPs:        []netaddr.IP{netaddr.MustParseIP(e.server.addr)},
+		},
+		static.Container{
+			Name:       namespace + "/" + e.client.name,
+			CGroupPath: e.client.cgroup,
+			IPs:        []netaddr.IP{netaddr.MustParseIP(e.client.addr)},
+		},
+	)
+	defer func() { _ = ctrs.Close() }()
+
+	log := logger.New(logger.StreamHandler(os.Stdout, logger.ConsoleFormat()))
+	sink := &collectSink{}
+	app, err := ebpf.NewApp(ctrs, pkts, log,
+		ebpf.WithInterval(*interval),
+		ebpf.WithSinks(0, sink),
+	)
+	if err != nil {
+		t.Fatalf("unable to create app: %v", err)
+	}
+	defer func() { _ = app.Close() }()
+
+	ctx := context.Background()
+
+	// The containers are attached before the traffic starts,
+	// so its first packets are not missed.
+	if err = waitFor(ctx, 10*time.Second, func() bool { return pkts.Attached() == 2 }); err != nil {
+		t.Fatalf("containers were not attached: %v", err)
+	}
+
+	if err = e.Start(e.server, bin, "server", "--addr", ":"+strconv.Itoa(serverPort)); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	uri := fmt.Sprintf("http://%s:%d/", e.server.addr, serverPort)
+	if err = e.Start(e.client, bin, "client", "--uri", uri); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	exps := []expectation{
+		{subject: namespace + "/" + e.client.name, remote: namespace + "/" + e.server.name},
+		{subject: namespace + "/" + e.server.name, remote: namespace + "/" + e.client.name},
+	}
+	var failed []string
+	err = waitFor(ctx, *timeout, func() bool {
+		failed = check(sink.Metrics(), exps)
+		return len(failed) == 0
+	})
+	if err != nil {
+		t.Fatalf("expected metrics not written: %s", strings.Join(failed, "; "))
+	}
+}
+
+// expectation is a flow expected between containers.
+type expectation struct {
+	subject string
+	remote  string
+}
+
+// check returns the unmet expectations. Flows must have bytes in
+// both directions on the server port, with RTTs of the sent bytes.
+func check(ms []flow.Metric, exps []expectation) []string {
+	var failed []string
+	for _, exp := range exps {
+		var (
+			port      uint16
+			in, out   uint64
+			rtts      float64
+			wrongPort bool
+		)
+		for _, m := range ms {
+			if m.Subject != exp.subject || m.Remote != exp.remote {
+				continue
+			}
+			if m.Port != serverPort {
+				wrongPort = true
+				port = m.Port
+			}
+			in += m.BytesIn
+			out += m.BytesOut
+			if m.RTT != nil {
+				rtts += m.RTT.Count()
+			}
+		}
+
+		switch {
+		case wrongPort:
+			failed = append(failed, fmt.Sprintf("%s -> %s: unexpected port %d", exp.subject, exp.remote, port))
+		case in == 0 || out == 0:
+			failed = append(failed, fmt.Sprintf("%s -> %s: got %d bytes in and %d bytes out", exp.subject, exp.remote, in, out))
+		case rtts == 0:
+			failed = append(failed, fmt.Sprintf("%s -> %s: got no rtts", exp.subject, exp.remote))
+		}
+	}
+	return failed
+}
+
+// waitFor polls the condition until it is met or the timeout expires.
+func waitFor(ctx context.Context, timeout time.Duration, cond func() bool) error {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	tick := time.NewTicker(100 * time.Millisecond)
+	defer tick.Stop()
+
+	for {
+		if cond() {
+			return nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-tick.C:
+		}
+	}
+}
+
+// collectSink collects the written metrics.
+type collectSink struct {
+	mu sync.Mutex
+	ms []flow.Metric
+}
+
+func (s *collectSink) Write(ms []flow.Metric) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.ms = append(s.ms, ms...)
+	return nil
+}
+
+// Metrics returns the collected metrics.
+func (s *collectSink) Metrics() []flow.Metric {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return append([]flow.Metric(nil), s.ms...)
+}
@@ -0,0 +1,192 @@
+//go:build e2e
+// +build e2e
+
+package e2e
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"syscall"
+	"time"
+
+	"github.com/hashicorp/go-multierror"
+)
+
+// node is a network namespace in its own cgroup, with one
+// end of the veth pair connecting it to the other node.
+type node struct {
+	name   string
+	netns  string
+	veth   string
+	addr   string
+	cgroup string
+}
+
+// env is the network namespaces and cgroups of the test.
+type env struct {
+	server node
+	client node
+
+	procs []*exec.Cmd
+}
+
+const (
+	serverPort = 8080
+
+	envPrefix = "ebpf-e2e"
+)
+
+func newEnv(cgroupRoot string) *env {
+	dir := filepath.Join(cgroupRoot, envPrefix)
+	return &env{
+		server: node{
+			name:   "server",
+			netns:  envPrefix + "-server",
+			veth:   "e2e-server",
+			addr:   "10.254.0.1",
+			cgroup: filepath.Join(dir, "server"),
+		},
+		client: node{
+			name:   "client",
+			netns:  envPrefix + "-client",
+			veth:   "e2e-client",
+			addr:   "10.254.0.2",
+			cgroup: filepath.Join(dir, "client"),
+		},
+	}
+}
+
+// Setup creates the namespaces, connected by a veth pair, and the cgroups.
+// Leftovers of previous runs are removed first.
+func (e *env) Setup() error {
+	_ = e.Teardown()
+
+	for _, n := range []node{e.server, e.client} {
+		if err := ip("netns", "add", n.netns); err != nil {
+			return err
+		}
+		if err := ip("-n", n.netns, "link", "set", "lo", "up"); err != nil {
+			return err
+		}
+		if err := os.MkdirAll(n.cgroup, 0755); err != nil {
+			return fmt.Errorf("unable to create cgroup: %w", err)
+		}
+	}
+
+	err := ip("link", "add", e.server.veth, "netns", e.server.netns,
+		"type", "veth", "peer", "name", e.client.veth, "netns", e.client.netns)
+	if err != nil {
+		return err
+	}
+	for _, n := range []node{e.server, e.client} {
+		if err = ip("-n", n.netns, "addr", "add", n.addr+"/24", "dev", n.veth); err != nil {
+			return err
+		}
+		if err = ip("-n", n.netns, "link", "set", n.veth, "up"); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Start starts the command in the namespace and cgroup of the node.
+// The process joins the cgroup before it execs the command, so all
+// its sockets belong to the cgroup.
+func (e *env) Start(n node, args ...string) error {
+	procs := filepath.Join(n.cgroup, "cgroup.procs")
+	args = append([]string{"-c", `echo $$ > "$0" && exec "$@"`, procs, "ip", "netns", "exec", n.netns}, args...)
+
+	cmd := exec.Command("sh", args...)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	if err := cmd.Start(); err != nil {
+		return fmt.Errorf("unable to start %s: %w", n.name, err)
+	}
+	e.procs = append(e.procs, cmd)
+	return nil
+}
+
+// Stop interrupts the started commands, killing them if they do not exit.
+func (e *env) Stop() {
+	for _, cmd := range e.procs {
+		_ = cmd.Process.Signal(os.Interrupt)
+
+		done := make(chan struct{})
+		go func() {
+			_ = cmd.Wait()
+			close(done)
+		}()
+
+		select {
+		case <-done:
+		case <-time.After(5 * time.Second):
+			_ = cmd.Process.Signal(syscall.SIGKILL)
+			<-done
+		}
+	}
+	e.procs = nil
+}
+
+// Teardown removes the namespaces and cgroups. Removing
+// a namespace removes the veth pair with it.
+func (e *env) Teardown() error {
+	var errs error
+	for _, n := range []node{e.server, e.client} {
+		if _, err := os.Stat(filepath.Join("/var/run/netns", n.netns)); err == nil {
+			if err = ip("netns", "del", n.netns); err != nil {
+				errs = multierror.Append(errs, err)
+			}
+		}
+		if err := killCgroup(n.cgroup); err != nil {
+			errs = multierror.Append(errs, err)
+		}
+		if err := os.Remove(n.cgroup); err != nil && !os.IsNotExist(err) {
+			errs = multierror.Append(errs, fmt.Errorf("unable to remove cgroup: %w", err))
+		}
+	}
+	if err := os.Remove(filepath.Dir(e.server.cgroup)); err != nil && !os.IsNotExist(err) {
+		errs = multierror.Append(errs, fmt.Errorf("unable to remove cgroup: %w", err))
+	}
+	return errs
+}
+
+// killCgroup kills the processes left in the cgroup.
+func killCgroup(path string) error {
+	b, err := os.ReadFile(filepath.Join(path, "cgroup.procs"))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return fmt.Errorf("unable to read cgroup processes: %w", err)
+	}
+
+	for _, f := range bytes.Fields(b) {
+		pid, err := strconv.Atoi(string(f))
+		if err != nil {
+			continue
+		}
+		_ = syscall.Kill(pid, syscall.SIGKILL)
+	}
+
+	// Killed processes leave the cgroup once they have exited.
+	for i := 0; i < 50; i++ {
+		b, err = os.ReadFile(filepath.Join(path, "cgroup.procs"))
+		if err != nil || len(bytes.TrimSpace(b)) == 0 {
+			return nil
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	return fmt.Errorf("processes of cgroup %s did not exit", path)
+}
+
+func ip(args ...string) error {
+	out, err := exec.Command("ip", args...).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("ip %v: %w: %s", args, err, bytes.TrimSpace(out))
+	}
+	return nil
+}
@@ -0,0 +1,107 @@
+package flow
+
+import (
+	"encoding/json"
+
+	"github.com/influxdata/tdigest"
+)
+
+// centroid is a t-digest centroid encoded as a mean and weight pair.
+type centroid [2]float64
+
+type jsonMetric struct {
+	Timestamp   int64      `json:"timestamp"`
+	Node        string     `json:"node,omitempty"`
+	Subject     string     `json:"subject,omitempty"`
+	Namespace   string     `json:"namespace,omitempty"`
+	Workload    string     `json:"workload,omitempty"`
+	Remote      string     `json:"remote,omitempty"`
+	Port        uint16     `json:"port,omitempty"`
+	Protocol    string     `json:"protocol,omitempty"`
+	Direction   string     `json:"direction,omitempty"`
+	BytesIn     uint64     `json:"bytesIn"`
+	BytesOut    uint64     `json:"bytesOut"`
+	PacketsIn   uint64     `json:"packetsIn"`
+	PacketsOut  uint64     `json:"packetsOut"`
+	RTT         []centroid `json:"rtt,omitempty"`
+	Size        []centroid `json:"size,omitempty"`
+	BytesRate   float64    `json:"bytesRate"`
+	PacketsRate float64    `json:"packetsRate"`
+	Start       int64      `json:"start,omitempty"`
+}
+
+// MarshalJSON encodes the metric as JSON, including the
+// centroids of its digests so they can be merged after decoding.
+func (m Metric) MarshalJSON() ([]byte, error) {
+	return json.Marshal(jsonMetric{
+		Timestamp:   m.Timestamp,
+		Node:        m.Node,
+		Subject:     m.Subject,
+		Namespace:   m.Namespace,
+		Workload:    m.Workload,
+		Remote:      m.Remote,
+		Port:        m.Port,
+		Protocol:    m.Protocol,
+		Direction:   m.Direction,
+		BytesIn:     m.BytesIn,
+		BytesOut:    m.BytesOut,
+		PacketsIn:   m.PacketsIn,
+		PacketsOut:  m.PacketsOut,
+		RTT:         encodeDigest(m.RTT),
+		Size:        encodeDigest(m.Size),
+		BytesRate:   m.BytesRate,
+		PacketsRate: m.PacketsRate,
+		Start:       m.Start,
+	})
+}
+
+// UnmarshalJSON decodes the metric from JSON.
+func (m *Metric) UnmarshalJSON(b []byte) error {
+	var jm jsonMetric
+	if err := json.Unmarshal(b, &jm); err != nil {
+		return err
+	}
+
+	*m = Metric{
+		Timestamp:   jm.Timestamp,
+		Node:        jm.Node,
+		Subject:     jm.Subject,
+		Namespace:   jm.Namespace,
+		Workload:    jm.Workload,
+		Remote:      jm.Remote,
+		Port:        jm.Port,
+		Protocol:    jm.Protocol,
+		Direction:   jm.Direction,
+		BytesIn:     jm.BytesIn,
+		BytesOut:    jm.BytesOut,
+		PacketsIn:   jm.PacketsIn,
+		PacketsOut:  jm.PacketsOut,
+		RTT:         decodeDigest(jm.RTT),
+		Size:        decodeDigest(jm.Size),
+		BytesRate:   jm.BytesRate,
+		PacketsRate: jm.PacketsRate,
+		Start:       jm.Start,
+	}
+	return nil
+}
+
+func encodeDigest(td *tdigest.TDigest) []centroid {
+	if td == nil || td.Count() == 0 {
+		return nil
+	}
+
+	cs := td.Centroids()
+	out := make([]centroid, len(cs))
+	for i, c := range cs {
+		out[i] = centroid{c.Mean, c.Weight}
+	}
+	return out
+}
+
+func decodeDigest(cs []centroid) *tdigest.TDigest {
+	td := tdigest.New()
+	for _, c := range cs {
+		td.Add(c[0], c[1])
+	}
+	return td
+}
@@ -0,0 +1,116 @@
+// Package flow contains the aggregated network flow types.
+package flow
+
+import (
+	"time"
+
+	"github.com/influxdata/tdigest"
+)
+
+// Overflow is the remote of the bucket that flows of a subject
+// are folded into once the series limit is reached.
+const Overflow = "other"
+
+// Metric contains the aggregated flow data between a
+// subject and a remote over an interval.
+//
+// Dimensions that are not part of the aggregation key
+// are left empty.
+type Metric struct {
+	Timestamp int64
+	Node      string
+	Subject   string
+	Namespace string
+	Workload  string
+	Remote    string
+	Port      uint16
+	Protocol  string
+	Direction string
+	BytesIn   uint64
+	BytesOut  uint64
+	// PacketsIn and PacketsOut count the packets carrying payload.
+	PacketsIn  uint64
+	PacketsOut uint64
+	RTT        *tdigest.TDigest
+	// Size is the distribution of the payload size per packet.
+	Size *tdigest.TDigest
+
+	// BytesRate and PacketsRate are the per second rates
+	// in both directions over the interval of the metric.
+	BytesRate   float64
+	PacketsRate float64
+
+	// Start is the time the counters and digests of a cumulative
+	// metric started at. A later start than seen before means they
+	// were reset. It is zero for the metrics of an interval.
+	Start int64
+}
+
+// Merge merges the counters and digests of o into m.
+// Rates are not merged, they must be updated for the
+// interval of the merged metric.
+func (m *Metric) Merge(o Metric) {
+	m.BytesIn += o.BytesIn
+	m.BytesOut += o.BytesOut
+	m.PacketsIn += o.PacketsIn
+	m.PacketsOut += o.PacketsOut
+	m.RTT = mergeDigest(m.RTT, o.RTT)
+	m.Size = mergeDigest(m.Size, o.Size)
+}
+
+// Clone returns a copy of the metric that does not share its digests.
+func (m Metric) Clone() Metric {
+	m.RTT = mergeDigest(nil, m.RTT)
+	m.Size = mergeDigest(nil, m.Size)
+	return m
+}
+
+func mergeDigest(dst, src *tdigest.TDigest) *tdigest.TDigest {
+	if dst == nil {
+		dst = tdigest.New()
+	}
+	if src != nil && src.Count() > 0 {
+		dst.AddCentroidList(src.Centroids())
+	}
+	return dst
+}
+
+// UpdateRates computes the rates of the metric over the interval d.
+func (m *Metric) UpdateRates(d time.Duration) {
+	secs := d.Seconds()
+	if secs <= 0 {
+		return
+	}
+
+	m.BytesRate = float64(m.BytesIn+m.BytesOut) / secs
+	m.PacketsRate = float64(m.PacketsIn+m.PacketsOut) / secs
+}
+
+// Quantiles are the summary quantiles of a distribution.
+type Quantiles struct {
+	P50 float64 `json:"p50"`
+	P90 float64 `json:"p90"`
+	P99 float64 `json:"p99"`
+}
+
+// NewQuantiles returns the summary quantiles of the digest.
+// The quantiles of an empty digest are zero.
+func NewQuantiles(td *tdigest.TDigest) Quantiles {
+	if td == nil || td.Count() == 0 {
+		return Quantiles{}
+	}
+	return Quantiles{
+		P50: td.Quantile(0.5),
+		P90: td.Quantile(0.9),
+		P99: td.Quantile(0.99),
+	}
+}
+
+// Quantile returns the q quantile of the digest, and false
+// if the digest is empty.
+func Quantile(td *tdigest.TDigest, q float64) (float64, bool) {
+	if td == nil || td.Count() == 0 {
+		return 0, false
+	}
+	return td.Quantile(q), true
+}
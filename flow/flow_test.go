@@ -0,0 +1,93 @@
+package flow
+
+import (
+	"testing"
+	"time"
+
+	"github.com/influxdata/tdigest"
+)
+
+func TestMetric_UpdateRates(t *testing.T) {
+	tests := []struct {
+		name        string
+		m           Metric
+		d           time.Duration
+		wantBytes   float64
+		wantPackets float64
+	}{
+		{
+			name:        "both directions",
+			m:           Metric{BytesIn: 100, BytesOut: 200, PacketsIn: 3, PacketsOut: 7},
+			d:           10 * time.Second,
+			wantBytes:   30,
+			wantPackets: 1,
+		},
+		{
+			name:        "sub second interval",
+			m:           Metric{BytesOut: 50, PacketsOut: 1},
+			d:           500 * time.Millisecond,
+			wantBytes:   100,
+			wantPackets: 2,
+		},
+		{
+			name:        "no traffic",
+			m:           Metric{BytesRate: 5, PacketsRate: 5},
+			d:           time.Minute,
+			wantBytes:   0,
+			wantPackets: 0,
+		},
+		{
+			name:        "zero interval keeps rates",
+			m:           Metric{BytesIn: 100, BytesRate: 5, PacketsRate: 1},
+			d:           0,
+			wantBytes:   5,
+			wantPackets: 1,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			m := test.m
+
+			m.UpdateRates(test.d)
+
+			if m.BytesRate != test.wantBytes {
+				t.Errorf("expected bytes rate %v, got %v", test.wantBytes, m.BytesRate)
+			}
+			if m.PacketsRate != test.wantPackets {
+				t.Errorf("expected packets rate %v, got %v", test.wantPackets, m.PacketsRate)
+			}
+		})
+	}
+}
+
+func TestQuantile(t *testing.T) {
+	td := tdigest.New()
+	for i := 1; i <= 100; i++ {
+		td.Add(float64(i), 1)
+	}
+
+	tests := []struct {
+		name   string
+		td     *tdigest.TDigest
+		want   Quantiles
+		wantOK bool
+	}{
+		{name: "nil digest"},
+		{name: "empty digest", td: tdigest.New()},
+		{name: "digest", td: td, want: Quantiles{P50: td.Quantile(0.5), P90: td.Quantile(0.9), P99: td.Quantile(0.99)}, wantOK: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := NewQuantiles(test.td); got != test.want {
+				t.Errorf("expected quantiles %+v, got %+v", test.want, got)
+			}
+
+			got, ok := Quantile(test.td, 0.9)
+			if ok != test.wantOK || got != test.want.P90 {
+				t.Errorf("expected %v and %t, got %v and %t", test.want.P90, test.wantOK, got, ok)
+			}
+		})
+	}
+}
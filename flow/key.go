@@ -0,0 +1,71 @@
+package flow
+
+import "strings"
+
+// Key is the aggregation key of a metric, the edge it
+// describes. Dimensions that are not part of the
+// aggregation are left empty.
+type Key struct {
+	Node      string
+	Subject   string
+	Namespace string
+	Workload  string
+	Remote    string
+	Port      uint16
+	Protocol  string
+	Direction string
+}
+
+// Key returns the key of the metric.
+func (m Metric) Key() Key {
+	return Key{
+		Node:      m.Node,
+		Subject:   m.Subject,
+		Namespace: m.Namespace,
+		Workload:  m.Workload,
+		Remote:    m.Remote,
+		Port:      m.Port,
+		Protocol:  m.Protocol,
+		Direction: m.Direction,
+	}
+}
+
+// Metric returns an empty metric of the key.
+func (k Key) Metric() Metric {
+	return Metric{
+		Node:      k.Node,
+		Subject:   k.Subject,
+		Namespace: k.Namespace,
+		Workload:  k.Workload,
+		Remote:    k.Remote,
+		Port:      k.Port,
+		Protocol:  k.Protocol,
+		Direction: k.Direction,
+	}
+}
+
+// MergeInto merges the metric into the metric of its key in agg,
+// which is created with the timestamp if it does not exist yet.
+// The merged metric is returned.
+func MergeInto(agg map[Key]*Metric, ts int64, m Metric) *Metric {
+	k := m.Key()
+	a, ok := agg[k]
+	if !ok {
+		km := k.Metric()
+		km.Timestamp = ts
+		a = &km
+		agg[k] = a
+	}
+	a.Merge(m)
+	return a
+}
+
+// Namespace returns the namespace of a "namespace/name"
+// formatted name, or an empty string if it has none.
+func Namespace(name string) string {
+	idx := strings.IndexByte(name, '/')
+	if idx == -1 {
+		return ""
+	}
+	return name[:idx]
+}
@@ -0,0 +1,50 @@
+package flow
+
+import "testing"
+
+func TestMergeInto(t *testing.T) {
+	agg := map[Key]*Metric{}
+
+	a := Metric{Timestamp: 10, Subject: "default/a", Remote: "default/b", Port: 80, BytesIn: 1, BytesOut: 2}
+	b := Metric{Timestamp: 20, Subject: "default/a", Remote: "default/b", Port: 80, BytesIn: 3, BytesOut: 4}
+	c := Metric{Timestamp: 20, Subject: "default/a", Remote: "default/c", Port: 80, BytesIn: 5}
+
+	MergeInto(agg, 30, a)
+	MergeInto(agg, 30, b)
+	got := MergeInto(agg, 30, c)
+
+	if len(agg) != 2 {
+		t.Fatalf("expected 2 edges, got %d", len(agg))
+	}
+	if got != agg[c.Key()] {
+		t.Error("expected the merged metric to be returned")
+	}
+
+	m := agg[a.Key()]
+	if m.Timestamp != 30 || m.Subject != "default/a" || m.Remote != "default/b" || m.Port != 80 {
+		t.Errorf("unexpected edge %+v", m)
+	}
+	if m.BytesIn != 4 || m.BytesOut != 6 {
+		t.Errorf("expected 4 bytes in and 6 bytes out, got %d and %d", m.BytesIn, m.BytesOut)
+	}
+}
+
+func TestNamespace(t *testing.T) {
+	tests := []struct {
+		name string
+		want string
+	}{
+		{name: "default/api", want: "default"},
+		{name: "kube-system/coredns/extra", want: "kube-system"},
+		{name: "10.0.0.1", want: ""},
+		{name: "", want: ""},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := Namespace(test.name); got != test.want {
+				t.Errorf("expected %q, got %q", test.want, got)
+			}
+		})
+	}
+}
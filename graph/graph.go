@@ -0,0 +1,226 @@
+// Package graph implements a live service dependency graph
+// built from flushed metrics.
+package graph
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/influxdata/tdigest"
+	"github.com/nrwiersma/ebpf/flow"
+)
+
+// OptsFunc represents a configuration function for the graph.
+type OptsFunc func(g *Graph)
+
+// WithTTL configures the time after which an edge that has not
+// been seen is removed from the graph.
+func WithTTL(d time.Duration) OptsFunc {
+	return func(g *Graph) {
+		g.ttl = d
+	}
+}
+
+// Node is a service in the graph.
+type Node struct {
+	Name      string
+	Namespace string
+}
+
+// Edge is a dependency between a subject and a remote port.
+type Edge struct {
+	Source   string
+	Target   string
+	Port     uint16
+	Protocol string
+
+	BytesIn    uint64
+	BytesOut   uint64
+	PacketsIn  uint64
+	PacketsOut uint64
+	BytesRate  float64
+	// RTT is the distribution of the current and previous interval,
+	// so it follows changes in latency.
+	RTT      *tdigest.TDigest
+	LastSeen time.Time
+}
+
+// edge is an edge with the RTT digests of its last two intervals.
+type edge struct {
+	Edge
+
+	// rtt is the digest of the interval the edge was last seen in,
+	// prevRTT of the interval before it, if the edge was seen in it.
+	rtt     *tdigest.TDigest
+	prevRTT *tdigest.TDigest
+}
+
+type edgeKey struct {
+	Source   string
+	Target   string
+	Port     uint16
+	Protocol string
+}
+
+// Graph is a live graph of subject to remote port edges.
+//
+// It implements a metrics sink, and should receive the
+// metrics of every interval.
+type Graph struct {
+	ttl time.Duration
+
+	mu    sync.Mutex
+	edges map[edgeKey]*edge
+	// cur and prev are the last two intervals seen.
+	cur  time.Time
+	prev time.Time
+}
+
+// New returns a graph.
+func New(opts ...OptsFunc) *Graph {
+	g := &Graph{
+		ttl:   15 * time.Minute,
+		edges: map[edgeKey]*edge{},
+	}
+
+	for _, opt := range opts {
+		opt(g)
+	}
+
+	return g
+}
+
+// Write adds the metrics of an interval to the graph.
+func (g *Graph) Write(ms []flow.Metric) error {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	var now time.Time
+	for _, m := range ms {
+		// Edges are only known when both ends are. Overflow buckets
+		// are not a dependency.
+		if m.Subject == "" || m.Remote == "" || m.Remote == flow.Overflow {
+			continue
+		}
+
+		ts := time.Unix(m.Timestamp, 0)
+		if ts.After(now) {
+			now = ts
+		}
+		if ts.After(g.cur) {
+			g.prev, g.cur = g.cur, ts
+		}
+
+		k := edgeKey{
+			Source:   m.Subject,
+			Target:   m.Remote,
+			Port:     m.Port,
+			Protocol: m.Protocol,
+		}
+		e, ok := g.edges[k]
+		if !ok {
+			e = &edge{
+				Edge: Edge{
+					Source:   k.Source,
+					Target:   k.Target,
+					Port:     k.Port,
+					Protocol: k.Protocol,
+				},
+				rtt: tdigest.New(),
+			}
+			g.edges[k] = e
+		}
+
+		if !ts.Equal(e.LastSeen) {
+			e.BytesRate = 0
+
+			// The digest of the interval is kept as the previous one,
+			// unless the edge was not seen in the interval before.
+			e.prevRTT = nil
+			if e.LastSeen.Equal(g.prev) && ts.Equal(g.cur) {
+				e.prevRTT = e.rtt
+			}
+			e.rtt = tdigest.New()
+		}
+		e.BytesIn += m.BytesIn
+		e.BytesOut += m.BytesOut
+		e.PacketsIn += m.PacketsIn
+		e.PacketsOut += m.PacketsOut
+		e.BytesRate += m.BytesRate
+		if m.RTT != nil && m.RTT.Count() > 0 {
+			e.rtt.AddCentroidList(m.RTT.Centroids())
+		}
+		e.LastSeen = ts
+	}
+
+	if g.ttl > 0 && !now.IsZero() {
+		for k, e := range g.edges {
+			if now.Sub(e.LastSeen) > g.ttl {
+				delete(g.edges, k)
+			}
+		}
+	}
+	return nil
+}
+
+// Snapshot returns the nodes and edges of the graph. If namespaces are
+// given, only edges with an end in one of the namespaces are returned.
+func (g *Graph) Snapshot(namespaces ...string) ([]Node, []Edge) {
+	nsSet := make(map[string]bool, len(namespaces))
+	for _, ns := range namespaces {
+		nsSet[ns] = true
+	}
+
+	// Reading the centroids of a digest compresses it, so even
+	// reading requires an exclusive lock.
+	g.mu.Lock()
+	edges := make([]Edge, 0, len(g.edges))
+	for _, e := range g.edges {
+		if len(nsSet) > 0 && !nsSet[flow.Namespace(e.Source)] && !nsSet[flow.Namespace(e.Target)] {
+			continue
+		}
+
+		cpy := e.Edge
+		cpy.RTT = tdigest.New()
+		if e.LastSeen.Equal(g.cur) || e.LastSeen.Equal(g.prev) {
+			cpy.RTT.AddCentroidList(e.rtt.Centroids())
+		}
+		if e.LastSeen.Equal(g.cur) && e.prevRTT != nil {
+			cpy.RTT.AddCentroidList(e.prevRTT.Centroids())
+		}
+		edges = append(edges, cpy)
+	}
+	g.mu.Unlock()
+
+	sort.Slice(edges, func(i, j int) bool {
+		a, b := edges[i], edges[j]
+		if a.Source != b.Source {
+			return a.Source < b.Source
+		}
+		if a.Target != b.Target {
+			return a.Target < b.Target
+		}
+		if a.Port != b.Port {
+			return a.Port < b.Port
+		}
+		return a.Protocol < b.Protocol
+	})
+
+	seen := map[string]bool{}
+	var nodes []Node
+	for _, e := range edges {
+		for _, name := range []string{e.Source, e.Target} {
+			if seen[name] {
+				continue
+			}
+			seen[name] = true
+			nodes = append(nodes, Node{Name: name, Namespace: flow.Namespace(name)})
+		}
+	}
+	sort.Slice(nodes, func(i, j int) bool {
+		return nodes[i].Name < nodes[j].Name
+	})
+
+	return nodes, edges
+}
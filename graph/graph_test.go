@@ -0,0 +1,60 @@
+package graph
+
+import (
+	"testing"
+
+	"github.com/influxdata/tdigest"
+	"github.com/nrwiersma/ebpf/flow"
+)
+
+func TestGraph_RTTWindow(t *testing.T) {
+	metric := func(ts int64, remote string, rtt float64) flow.Metric {
+		td := tdigest.New()
+		td.Add(rtt, 1)
+		return flow.Metric{Timestamp: ts, Subject: "default/a", Remote: remote, Port: 80, Protocol: "tcp", RTT: td}
+	}
+
+	g := New()
+	steps := [][]flow.Metric{
+		{metric(10, "default/b", 100), metric(10, "default/c", 100), metric(10, "default/d", 100)},
+		{metric(20, "default/b", 200), metric(20, "default/d", 200)},
+		{metric(30, "default/b", 300), metric(30, "default/c", 300)},
+	}
+	for _, ms := range steps {
+		if err := g.Write(ms); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	_, edges := g.Snapshot()
+	got := map[string]*tdigest.TDigest{}
+	for _, e := range edges {
+		got[e.Target] = e.RTT
+	}
+
+	tests := []struct {
+		target string
+		count  float64
+		min    float64
+	}{
+		// Seen in the current and previous interval.
+		{target: "default/b", count: 2, min: 200},
+		// Not seen in the previous interval.
+		{target: "default/c", count: 1, min: 300},
+		// Only seen in the previous interval.
+		{target: "default/d", count: 1, min: 200},
+	}
+	for _, test := range tests {
+		td, ok := got[test.target]
+		if !ok {
+			t.Errorf("%s: edge not found", test.target)
+			continue
+		}
+		if td.Count() != test.count {
+			t.Errorf("%s: expected %v samples, got %v", test.target, test.count, td.Count())
+		}
+		if q := td.Quantile(0); q != test.min {
+			t.Errorf("%s: expected a minimum of %v, got %v", test.target, test.min, q)
+		}
+	}
+}
@@ -0,0 +1,239 @@
+package graph
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/nrwiersma/ebpf/flow"
+)
+
+// ServeHTTP serves the graph.
+//
+// The format query parameter selects the encoding, one of "json"
+// (the default), "dot" or "graphml". The namespace query parameter
+// filters the edges, and can be given multiple times or as a comma
+// separated list.
+func (g *Graph) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet {
+		rw.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	q := req.URL.Query()
+	var namespaces []string
+	for _, v := range q["namespace"] {
+		for _, ns := range strings.Split(v, ",") {
+			if ns = strings.TrimSpace(ns); ns != "" {
+				namespaces = append(namespaces, ns)
+			}
+		}
+	}
+
+	var (
+		contentType string
+		enc         func(w io.Writer, nodes []Node, edges []Edge) error
+	)
+	switch format := q.Get("format"); format {
+	case "", "json":
+		contentType, enc = "application/json", writeJSON
+	case "dot":
+		contentType, enc = "text/vnd.graphviz", writeDOT
+	case "graphml":
+		contentType, enc = "application/graphml+xml", writeGraphML
+	default:
+		http.Error(rw, fmt.Sprintf("unknown format %q", format), http.StatusBadRequest)
+		return
+	}
+
+	nodes, edges := g.Snapshot(namespaces...)
+
+	rw.Header().Set("Content-Type", contentType)
+	_ = enc(rw, nodes, edges)
+}
+
+type jsonGraph struct {
+	Nodes []jsonNode `json:"nodes"`
+	Edges []jsonEdge `json:"edges"`
+}
+
+type jsonNode struct {
+	Name      string `json:"name"`
+	Namespace string `json:"namespace,omitempty"`
+}
+
+type jsonEdge struct {
+	Source     string         `json:"source"`
+	Target     string         `json:"target"`
+	Port       uint16         `json:"port"`
+	Protocol   string         `json:"protocol,omitempty"`
+	BytesIn    uint64         `json:"bytesIn"`
+	BytesOut   uint64         `json:"bytesOut"`
+	PacketsIn  uint64         `json:"packetsIn"`
+	PacketsOut uint64         `json:"packetsOut"`
+	BytesRate  float64        `json:"bytesRate"`
+	RTT        flow.Quantiles `json:"rtt"`
+	LastSeen   time.Time      `json:"lastSeen"`
+}
+
+func writeJSON(w io.Writer, nodes []Node, edges []Edge) error {
+	g := jsonGraph{
+		Nodes: make([]jsonNode, 0, len(nodes)),
+		Edges: make([]jsonEdge, 0, len(edges)),
+	}
+	for _, n := range nodes {
+		g.Nodes = append(g.Nodes, jsonNode{Name: n.Name, Namespace: n.Namespace})
+	}
+	for _, e := range edges {
+		g.Edges = append(g.Edges, jsonEdge{
+			Source:     e.Source,
+			Target:     e.Target,
+			Port:       e.Port,
+			Protocol:   e.Protocol,
+			BytesIn:    e.BytesIn,
+			BytesOut:   e.BytesOut,
+			PacketsIn:  e.PacketsIn,
+			PacketsOut: e.PacketsOut,
+			BytesRate:  e.BytesRate,
+			RTT:        flow.NewQuantiles(e.RTT),
+			LastSeen:   e.LastSeen.UTC(),
+		})
+	}
+
+	return json.NewEncoder(w).Encode(g)
+}
+
+func writeDOT(w io.Writer, nodes []Node, edges []Edge) error {
+	var sb strings.Builder
+	sb.WriteString("digraph dependencies {\n")
+	sb.WriteString("  rankdir=LR;\n")
+	sb.WriteString("  node [shape=box];\n")
+	for _, n := range nodes {
+		fmt.Fprintf(&sb, "  %s;\n", strconv.Quote(n.Name))
+	}
+	for _, e := range edges {
+		q := flow.NewQuantiles(e.RTT)
+		label := fmt.Sprintf("%d/%s\n%s\np99 %.2fms", e.Port, e.Protocol, formatBytes(e.BytesIn+e.BytesOut), q.P99)
+		fmt.Fprintf(&sb, "  %s -> %s [label=%s];\n", strconv.Quote(e.Source), strconv.Quote(e.Target), strconv.Quote(label))
+	}
+	sb.WriteString("}\n")
+
+	_, err := io.WriteString(w, sb.String())
+	return err
+}
+
+func formatBytes(b uint64) string {
+	const unit = 1024
+	if b < unit {
+		return fmt.Sprintf("%dB", b)
+	}
+	div, exp := uint64(unit), 0
+	for n := b / unit; n >= unit; n /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f%ciB", float64(b)/float64(div), "KMGTPE"[exp])
+}
+
+type graphML struct {
+	XMLName xml.Name     `xml:"graphml"`
+	XMLNS   string       `xml:"xmlns,attr"`
+	Keys    []graphMLKey `xml:"key"`
+	Graph   graphMLGraph `xml:"graph"`
+}
+
+type graphMLKey struct {
+	ID   string `xml:"id,attr"`
+	For  string `xml:"for,attr"`
+	Name string `xml:"attr.name,attr"`
+	Type string `xml:"attr.type,attr"`
+}
+
+type graphMLGraph struct {
+	ID          string        `xml:"id,attr"`
+	EdgeDefault string        `xml:"edgedefault,attr"`
+	Nodes       []graphMLNode `xml:"node"`
+	Edges       []graphMLEdge `xml:"edge"`
+}
+
+type graphMLNode struct {
+	ID   string        `xml:"id,attr"`
+	Data []graphMLData `xml:"data"`
+}
+
+type graphMLEdge struct {
+	Source string        `xml:"source,attr"`
+	Target string        `xml:"target,attr"`
+	Data   []graphMLData `xml:"data"`
+}
+
+type graphMLData struct {
+	Key   string `xml:"key,attr"`
+	Value string `xml:",chardata"`
+}
+
+var graphMLKeys = []graphMLKey{
+	{ID: "namespace", For: "node", Name: "namespace", Type: "string"},
+	{ID: "port", For: "edge", Name: "port", Type: "int"},
+	{ID: "protocol", For: "edge", Name: "protocol", Type: "string"},
+	{ID: "bytesIn", For: "edge", Name: "bytesIn", Type: "long"},
+	{ID: "bytesOut", For: "edge", Name: "bytesOut", Type: "long"},
+	{ID: "bytesRate", For: "edge", Name: "bytesRate", Type: "double"},
+	{ID: "rttP50", For: "edge", Name: "rttP50", Type: "double"},
+	{ID: "rttP90", For: "edge", Name: "rttP90", Type: "double"},
+	{ID: "rttP99", For: "edge", Name: "rttP99", Type: "double"},
+	{ID: "lastSeen", For: "edge", Name: "lastSeen", Type: "string"},
+}
+
+func writeGraphML(w io.Writer, nodes []Node, edges []Edge) error {
+	doc := graphML{
+		XMLNS: "http://graphml.graphdrawing.org/xmlns",
+		Keys:  graphMLKeys,
+		Graph: graphMLGraph{
+			ID:          "dependencies",
+			EdgeDefault: "directed",
+			Nodes:       make([]graphMLNode, 0, len(nodes)),
+			Edges:       make([]graphMLEdge, 0, len(edges)),
+		},
+	}
+	for _, n := range nodes {
+		doc.Graph.Nodes = append(doc.Graph.Nodes, graphMLNode{
+			ID:   n.Name,
+			Data: []graphMLData{{Key: "namespace", Value: n.Namespace}},
+		})
+	}
+	for _, e := range edges {
+		q := flow.NewQuantiles(e.RTT)
+		doc.Graph.Edges = append(doc.Graph.Edges, graphMLEdge{
+			Source: e.Source,
+			Target: e.Target,
+			Data: []graphMLData{
+				{Key: "port", Value: strconv.Itoa(int(e.Port))},
+				{Key: "protocol", Value: e.Protocol},
+				{Key: "bytesIn", Value: strconv.FormatUint(e.BytesIn, 10)},
+				{Key: "bytesOut", Value: strconv.FormatUint(e.BytesOut, 10)},
+				{Key: "bytesRate", Value: strconv.FormatFloat(e.BytesRate, 'f', -1, 64)},
+				{Key: "rttP50", Value: strconv.FormatFloat(q.P50, 'f', -1, 64)},
+				{Key: "rttP90", Value: strconv.FormatFloat(q.P90, 'f', -1, 64)},
+				{Key: "rttP99", Value: strconv.FormatFloat(q.P99, 'f', -1, 64)},
+				{Key: "lastSeen", Value: e.LastSeen.UTC().Format(time.RFC3339)},
+			},
+		})
+	}
+
+	if _, err := io.WriteString(w, xml.Header); err != nil {
+		return err
+	}
+	enc := xml.NewEncoder(w)
+	enc.Indent("", "  ")
+	if err := enc.Encode(doc); err != nil {
+		return err
+	}
+	_, err := io.WriteString(w, "\n")
+	return err
+}
@@ -0,0 +1,137 @@
+package ebpf
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/OneOfOne/xxhash"
+	"github.com/influxdata/tdigest"
+	"github.com/nrwiersma/ebpf/flow"
+)
+
+// Dimension is a dimension metrics can be aggregated by.
+type Dimension string
+
+// Dimensions.
+const (
+	DimSubject   Dimension = "subject"
+	DimNamespace Dimension = "namespace"
+	DimWorkload  Dimension = "workload"
+	DimRemote    Dimension = "remote"
+	DimPort      Dimension = "port"
+	DimProtocol  Dimension = "protocol"
+	DimDirection Dimension = "direction"
+	DimNode      Dimension = "node"
+)
+
+// DefaultDimensions are the dimensions metrics are aggregated by when none are configured.
+var DefaultDimensions = []Dimension{DimSubject, DimRemote, DimPort, DimProtocol}
+
+var dimBits = map[Dimension]keySpec{
+	DimSubject:   keySubject,
+	DimNamespace: keyNamespace,
+	DimWorkload:  keyWorkload,
+	DimRemote:    keyRemote,
+	DimPort:      keyPort,
+	DimProtocol:  keyProtocol,
+	DimDirection: keyDirection,
+	DimNode:      keyNode,
+}
+
+// ParseDimensions parses a list of dimension names.
+func ParseDimensions(names []string) ([]Dimension, error) {
+	dims := make([]Dimension, 0, len(names))
+	for _, name := range names {
+		dim := Dimension(strings.ToLower(strings.TrimSpace(name)))
+		if _, ok := dimBits[dim]; !ok {
+			return nil, fmt.Errorf("unknown dimension %q", name)
+		}
+		dims = append(dims, dim)
+	}
+	return dims, nil
+}
+
+type keySpec uint8
+
+const (
+	keySubject keySpec = 1 << iota
+	keyNamespace
+	keyWorkload
+	keyRemote
+	keyPort
+	keyProtocol
+	keyDirection
+	keyNode
+)
+
+func newKeySpec(dims []Dimension) keySpec {
+	var spec keySpec
+	for _, dim := range dims {
+		spec |= dimBits[dim]
+	}
+	return spec
+}
+
+// key returns the exact aggregation key of a record.
+// Dimensions not in the key spec are left empty.
+func (k keySpec) key(r record) flow.Key {
+	var key flow.Key
+	if k&keyNode != 0 {
+		key.Node = r.Node
+	}
+	if k&keySubject != 0 {
+		key.Subject = r.Subject
+	}
+	if k&keyNamespace != 0 {
+		key.Namespace = r.Namespace
+	}
+	if k&keyWorkload != 0 {
+		key.Workload = r.Workload
+	}
+	if k&keyRemote != 0 {
+		key.Remote = r.Remote
+	}
+	if k&keyPort != 0 {
+		key.Port = r.Port
+	}
+	if k&keyProtocol != 0 {
+		key.Protocol = r.Protocol
+	}
+	if k&keyDirection != 0 {
+		key.Direction = r.Direction
+	}
+	return key
+}
+
+// overflowKey returns the key of the overflow bucket of the subject.
+func overflowKey(k flow.Key) flow.Key {
+	return flow.Key{
+		Node:      k.Node,
+		Subject:   k.Subject,
+		Namespace: k.Namespace,
+		Workload:  k.Workload,
+		Remote:    flow.Overflow,
+		Direction: k.Direction,
+	}
+}
+
+// hashKey returns the hash of the key. It is only used to spread
+// keys over shards, the key itself is used to aggregate.
+func hashKey(k flow.Key, h *xxhash.XXHash64) uint64 {
+	h.Reset()
+	for _, s := range [...]string{k.Node, k.Subject, k.Namespace, k.Workload, k.Remote, k.Protocol, k.Direction} {
+		_, _ = h.WriteString(s)
+		_, _ = h.Write([]byte{0})
+	}
+	_, _ = h.Write([]byte{byte(k.Port >> 8), byte(k.Port)})
+
+	return h.Sum64()
+}
+
+// newMetric returns an empty metric of the key with its digests.
+func newMetric(k flow.Key) *flow.Metric {
+	m := k.Metric()
+	m.RTT = tdigest.New()
+	m.Size = tdigest.New()
+	return &m
+}
@@ -0,0 +1,145 @@
+package ebpf
+
+import (
+	"testing"
+	"time"
+
+	"github.com/OneOfOne/xxhash"
+	"github.com/nrwiersma/ebpf/flow"
+)
+
+func TestKeySpec_Key(t *testing.T) {
+	base := record{
+		Node:      "node-a",
+		Subject:   "default/api",
+		Namespace: "default",
+		Workload:  "api",
+		Remote:    "default/db",
+		Port:      5432,
+		Protocol:  "tcp",
+		Direction: "out",
+	}
+
+	tests := []struct {
+		name  string
+		dims  []Dimension
+		other func(r record) record
+		merge bool
+	}{
+		{
+			name:  "node not aggregated",
+			dims:  DefaultDimensions,
+			other: func(r record) record { r.Node = "node-b"; return r },
+			merge: true,
+		},
+		{
+			name:  "direction not aggregated",
+			dims:  DefaultDimensions,
+			other: func(r record) record { r.Direction = "in"; return r },
+			merge: true,
+		},
+		{
+			name:  "subject not aggregated",
+			dims:  []Dimension{DimNamespace, DimRemote},
+			other: func(r record) record { r.Subject = "default/web"; return r },
+			merge: true,
+		},
+		{
+			name:  "node aggregated",
+			dims:  append([]Dimension{DimNode}, DefaultDimensions...),
+			other: func(r record) record { r.Node = "node-b"; return r },
+			merge: false,
+		},
+		{
+			name:  "port aggregated",
+			dims:  DefaultDimensions,
+			other: func(r record) record { r.Port = 5433; return r },
+			merge: false,
+		},
+		{
+			name:  "workload aggregated",
+			dims:  []Dimension{DimWorkload},
+			other: func(r record) record { r.Workload = "web"; return r },
+			merge: false,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			spec := newKeySpec(test.dims)
+
+			a, b := spec.key(base), spec.key(test.other(base))
+
+			if got := a == b; got != test.merge {
+				t.Errorf("expected merge %t, got %t: %+v and %+v", test.merge, got, a, b)
+			}
+			h := xxhash.New64()
+			if test.merge && hashKey(a, h) != hashKey(b, h) {
+				t.Error("expected merged keys to hash the same")
+			}
+		})
+	}
+}
+
+func TestHashKey_SeparatesFields(t *testing.T) {
+	tests := []struct {
+		name string
+		a, b flow.Key
+	}{
+		{
+			name: "shifted between fields",
+			a:    flow.Key{Subject: "default/ab", Remote: "c"},
+			b:    flow.Key{Subject: "default/a", Remote: "bc"},
+		},
+		{
+			name: "moved to another field",
+			a:    flow.Key{Subject: "api"},
+			b:    flow.Key{Remote: "api"},
+		},
+		{
+			name: "port bytes",
+			a:    flow.Key{Port: 0x0100},
+			b:    flow.Key{Port: 0x0001},
+		},
+	}
+
+	h := xxhash.New64()
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if hashKey(test.a, h) == hashKey(test.b, h) {
+				t.Errorf("expected %+v and %+v to hash differently", test.a, test.b)
+			}
+		})
+	}
+}
+
+func TestMetricService_AggregatesByDimensions(t *testing.T) {
+	svc := newMetricsService(metricConfig{
+		Interval: time.Hour,
+		Dims:     DefaultDimensions,
+	}, func(time.Duration, []flow.Metric) {})
+	defer func() { _ = svc.Close() }()
+
+	for _, r := range []record{
+		{Node: "node-a", Subject: "default/api", Remote: "default/db", Port: 5432, Protocol: "tcp", BytesOut: 1},
+		{Node: "node-b", Subject: "default/api", Remote: "default/db", Port: 5432, Protocol: "tcp", BytesOut: 2},
+		{Node: "node-a", Subject: "default/api", Remote: "default/db", Port: 5433, Protocol: "tcp", BytesOut: 4},
+	} {
+		svc.Add(r)
+	}
+
+	ms := svc.flush(time.Now().Unix())
+	if len(ms) != 2 {
+		t.Fatalf("expected 2 metrics, got %d", len(ms))
+	}
+	got := map[uint16]uint64{}
+	for _, m := range ms {
+		if m.Node != "" {
+			t.Errorf("expected the node not to be set, got %q", m.Node)
+		}
+		got[m.Port] = m.BytesOut
+	}
+	if got[5432] != 3 || got[5433] != 4 {
+		t.Errorf("unexpected bytes out per port %v", got)
+	}
+}
@@ -1,135 +1,429 @@
 package ebpf
 
 import (
-	"encoding/binary"
+	"runtime"
+	"sync"
 	"sync/atomic"
 	"time"
-	"unsafe"
 
 	"github.com/OneOfOne/xxhash"
-	"github.com/hamba/timex"
-	"github.com/influxdata/tdigest"
+	"github.com/nrwiersma/ebpf/flow"
 )
 
 type record struct {
 	Timestamp uint64
+	Node      string
 	Subject   string
+	Namespace string
+	Workload  string
 	Remote    string
 	Port      uint16
 	Protocol  string
+	Direction string
 	BytesIn   uint64
 	BytesOut  uint64
 	RTT       float64
+
+	// Weight is the number of packets the record stands for,
+	// the rate it was sampled at. A zero weight counts as one.
+	Weight uint64
 }
 
-type metric struct {
-	Timestamp int64
-	Subject   string
-	Remote    string
-	Port      uint16
-	Protocol  string
-	BytesIn   uint64
-	BytesOut  uint64
-	RTT       *tdigest.TDigest
+type metricConfig struct {
+	Interval time.Duration
+	Dims     []Dimension
+	Rollups  []time.Duration
+
+	// SeriesLimit is the maximum number of series per interval.
+	// Flows beyond the limit are folded into an overflow bucket
+	// per subject. Zero means no limit.
+	SeriesLimit int
+	// TopK is the number of heavy hitter edges, by bytes and by
+	// peak RTT, that are exempt from the series limit. The heavy
+	// hitters of an interval keep exact series, even when they
+	// first appear after the limit is reached.
+	TopK int
+}
+
+// shard aggregates the records of a subset of the keys.
+type shard struct {
+	mu       sync.Mutex
+	agg      map[flow.Key]*flow.Metric
+	overflow map[flow.Key]*flow.Metric
+	records  uint64
+
+	// hot contains the heavy hitters of the previous interval.
+	hot      map[flow.Key]struct{}
+	topBytes *topK
+	topRTT   *topK
+
+	// spill contains the exact metrics of keys beyond the series
+	// limit that are heavy hitter candidates of this interval.
+	// They are folded into their overflow bucket once they are no
+	// longer candidates, or at flush unless they made the top.
+	spill map[flow.Key]*flow.Metric
 }
 
 type metricService struct {
-	active *[]record
-	proc   []record
+	shards []shard
+	mask   uint64
+	spec   keySpec
 
-	hasher *xxhash.XXHash64
-	fn     func(m []metric)
+	inter   time.Duration
+	rollups []*rollup
 
-	doneCh chan struct{}
+	limit  int64
+	topK   int
+	series int64
+
+	hashers sync.Pool
+	fn      func(res time.Duration, ms []flow.Metric)
+
+	// records and flushDur describe the last flush. They are
+	// only accessed from the flush goroutine, including fn.
+	records  uint64
+	flushDur time.Duration
+
+	doneCh  chan struct{}
+	stopped chan struct{}
 }
 
-func newMetricsService(inter time.Duration, fn func([]metric)) *metricService {
-	active := make([]record, 0, 512)
+func newMetricsService(cfg metricConfig, fn func(res time.Duration, ms []flow.Metric)) *metricService {
+	n := 1
+	for n < runtime.NumCPU() {
+		n <<= 1
+	}
 
 	svc := &metricService{
-		active: &active,
-		proc:   make([]record, 0, 512),
-		hasher: xxhash.New64(),
-		fn:     fn,
-		doneCh: make(chan struct{}),
+		shards: make([]shard, n),
+		mask:   uint64(n - 1),
+		spec:   newKeySpec(cfg.Dims),
+		inter:  cfg.Interval,
+		limit:  int64(cfg.SeriesLimit),
+		topK:   cfg.TopK,
+		hashers: sync.Pool{
+			New: func() interface{} { return xxhash.New64() },
+		},
+		fn:      fn,
+		doneCh:  make(chan struct{}),
+		stopped: make(chan struct{}),
+	}
+	for i := range svc.shards {
+		sh := &svc.shards[i]
+		sh.agg = map[flow.Key]*flow.Metric{}
+		sh.overflow = map[flow.Key]*flow.Metric{}
+		sh.spill = map[flow.Key]*flow.Metric{}
+		if svc.limit > 0 && svc.topK > 0 {
+			sh.topBytes = newTopK(svc.topK, true)
+			sh.topRTT = newTopK(svc.topK, false)
+		}
+	}
+	for _, res := range cfg.Rollups {
+		svc.rollups = append(svc.rollups, newRollup(res))
 	}
 
-	go svc.runProcess(inter)
+	go svc.runProcess()
 
 	return svc
 }
 
-func (s *metricService) runProcess(inter time.Duration) {
-	t := time.NewTicker(inter)
+// runProcess flushes the metrics at every interval boundary,
+// aligned to the wall clock.
+func (s *metricService) runProcess() {
+	defer close(s.stopped)
+
+	t := time.NewTimer(time.Until(nextBoundary(time.Now(), s.inter)))
 	defer t.Stop()
 
 	for {
+		var now time.Time
 		select {
 		case <-s.doneCh:
 			return
-		case <-t.C:
-		}
-
-		ptr := (*unsafe.Pointer)(unsafe.Pointer(&s.active))
-		old := atomic.SwapPointer(ptr, unsafe.Pointer(&s.proc))
-		s.proc = *(*[]record)(old)
-
-		// TODO: Try reuse memory here.
-		agg := map[uint64]metric{}
-		for _, r := range s.proc {
-			h := s.getHash(r)
-			m, ok := agg[h]
-			if !ok {
-				m = metric{
-					Subject:  r.Subject,
-					Remote:   r.Remote,
-					Port:     r.Port,
-					Protocol: r.Protocol,
-					RTT:      tdigest.New(),
-				}
-			}
+		case now = <-t.C:
+		}
+		t.Reset(time.Until(nextBoundary(now, s.inter)))
 
-			m.BytesOut += r.BytesOut
-			m.BytesIn += r.BytesIn
-			if r.RTT > 0 {
-				m.RTT.Add(r.RTT, 1)
-			}
-			agg[h] = m
+		end := now.Truncate(s.inter)
+		start := time.Now()
+		ms := s.flush(end.Unix())
+		s.flushDur = time.Since(start)
+		s.fn(s.inter, ms)
+
+		for _, r := range s.rollups {
+			r.Add(end, s.inter, ms, func(rms []flow.Metric) {
+				s.fn(r.res, rms)
+			})
 		}
+	}
+}
+
+func nextBoundary(t time.Time, inter time.Duration) time.Time {
+	return t.Truncate(inter).Add(inter)
+}
+
+// flush hands over the aggregated metrics of all shards.
+//
+// Each shard is swapped for an empty one under its lock, so every
+// record lands in exactly one interval. Shards are swapped one
+// after the other, which can skew the boundary between shards
+// by the time it takes to swap them.
+func (s *metricService) flush(ts int64) []flow.Metric {
+	var (
+		ms               []flow.Metric
+		overflow         map[flow.Key]*flow.Metric
+		spill            []map[flow.Key]*flow.Metric
+		topBytes, topRTT []topKItem
+		records          uint64
+	)
+	for i := range s.shards {
+		sh := &s.shards[i]
 
-		s.proc = s.proc[:0]
+		sh.mu.Lock()
+		agg, ovr := sh.agg, sh.overflow
+		sh.agg = make(map[flow.Key]*flow.Metric, len(agg))
+		sh.overflow = map[flow.Key]*flow.Metric{}
+		if len(sh.spill) > 0 {
+			spill = append(spill, sh.spill)
+			sh.spill = map[flow.Key]*flow.Metric{}
+		}
+		records += sh.records
+		sh.records = 0
+		// The series are released with the shard locked, so a record
+		// of the next interval cannot be refused against a count that
+		// still holds the series of this one.
+		atomic.AddInt64(&s.series, -int64(len(agg)))
+		if sh.topBytes != nil {
+			topBytes = append(topBytes, sh.topBytes.Items()...)
+			topRTT = append(topRTT, sh.topRTT.Items()...)
+			sh.topBytes.Reset()
+			sh.topRTT.Reset()
+		}
+		sh.mu.Unlock()
 
-		ts := timex.Unix()
-		ms := make([]metric, 0, len(agg))
+		if ms == nil {
+			ms = make([]flow.Metric, 0, len(agg)*len(s.shards))
+		}
 		for _, m := range agg {
 			m.Timestamp = ts
-			ms = append(ms, m)
+			m.UpdateRates(s.inter)
+			ms = append(ms, *m)
+		}
+
+		// Overflow buckets are keyed by subject, so the same
+		// bucket can exist in several shards.
+		for k, m := range ovr {
+			if overflow == nil {
+				overflow = map[flow.Key]*flow.Metric{}
+			}
+			if o, ok := overflow[k]; ok {
+				o.Merge(*m)
+				continue
+			}
+			overflow[k] = m
+		}
+	}
+
+	var top map[flow.Key]struct{}
+	if s.topK > 0 && s.limit > 0 {
+		top = make(map[flow.Key]struct{}, 2*s.topK)
+		for _, k := range topKeys(topBytes, s.topK) {
+			top[k] = struct{}{}
+		}
+		for _, k := range topKeys(topRTT, s.topK) {
+			top[k] = struct{}{}
+		}
+	}
+
+	// Spilled keys that made the top of the interval keep their
+	// exact series, the others are folded into their overflow bucket.
+	for _, sp := range spill {
+		for k, m := range sp {
+			if _, ok := top[k]; ok {
+				m.Timestamp = ts
+				m.UpdateRates(s.inter)
+				ms = append(ms, *m)
+				continue
+			}
+
+			if overflow == nil {
+				overflow = map[flow.Key]*flow.Metric{}
+			}
+			ovk := overflowKey(k)
+			o, found := overflow[ovk]
+			if !found {
+				o = newMetric(ovk)
+				overflow[ovk] = o
+			}
+			o.Merge(*m)
+		}
+	}
+
+	for _, m := range overflow {
+		m.Timestamp = ts
+		m.UpdateRates(s.inter)
+		ms = append(ms, *m)
+	}
+
+	if top != nil {
+		s.updateHot(top)
+	}
+	s.records = records
+	return ms
+}
+
+// updateHot distributes the heavy hitters of the interval
+// over the shards, exempting them from the series limit
+// in the next interval.
+func (s *metricService) updateHot(top map[flow.Key]struct{}) {
+	hot := make([]map[flow.Key]struct{}, len(s.shards))
+	for k := range top {
+		idx := s.getHash(k) & s.mask
+		if hot[idx] == nil {
+			hot[idx] = map[flow.Key]struct{}{}
 		}
-		s.fn(ms)
+		hot[idx][k] = struct{}{}
+	}
+
+	for i := range s.shards {
+		sh := &s.shards[i]
+
+		sh.mu.Lock()
+		sh.hot = hot[i]
+		sh.mu.Unlock()
 	}
 }
 
-func (s *metricService) getHash(r record) uint64 {
-	s.hasher.Reset()
-	_, _ = s.hasher.WriteString(r.Subject)
-	_, _ = s.hasher.WriteString(r.Remote)
-	var pb [4]byte
-	binary.BigEndian.PutUint16(pb[:], r.Port)
-	_, _ = s.hasher.Write(pb[:])
+func (s *metricService) getHash(k flow.Key) uint64 {
+	hasher := s.hashers.Get().(*xxhash.XXHash64)
+	defer s.hashers.Put(hasher)
 
-	return s.hasher.Sum64()
+	return hashKey(k, hasher)
 }
 
-// Add adds a record to be processed.
-// This is not thread-safe.
+// Add aggregates a record into the current interval.
+// This is safe for concurrent use.
 func (s *metricService) Add(r record) {
-	active := s.active
-	*active = append(*active, r)
+	k := s.spec.key(r)
+	sh := &s.shards[s.getHash(k)&s.mask]
+
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+
+	// Sampled records are scaled back up by their weight,
+	// so the totals and distributions stay unbiased.
+	w := r.Weight
+	if w == 0 {
+		w = 1
+	}
+
+	sh.records++
+	if sh.topBytes != nil {
+		if ev, ok := sh.topBytes.Add(k, float64((r.BytesIn+r.BytesOut)*w)); ok {
+			sh.fold(ev)
+		}
+		if r.RTT > 0 {
+			if ev, ok := sh.topRTT.Add(k, r.RTT); ok {
+				sh.fold(ev)
+			}
+		}
+	}
+
+	m, ok := sh.agg[k]
+	if !ok {
+		m, ok = sh.spill[k]
+	}
+	if !ok {
+		m = s.newSeries(sh, k)
+	}
+
+	m.BytesOut += r.BytesOut * w
+	m.BytesIn += r.BytesIn * w
+	switch r.Direction {
+	case "in":
+		m.PacketsIn += w
+		m.Size.Add(float64(r.BytesIn), float64(w))
+	case "out":
+		m.PacketsOut += w
+		m.Size.Add(float64(r.BytesOut), float64(w))
+	}
+	if r.RTT > 0 {
+		m.RTT.Add(r.RTT, float64(w))
+	}
+}
+
+// newSeries returns the metric for a key not yet seen in this
+// interval. If the series limit is reached, the overflow bucket
+// of the subject is returned instead, unless the key is a heavy
+// hitter candidate, which is spilled until it is known if it
+// made the top of the interval.
+func (s *metricService) newSeries(sh *shard, k flow.Key) *flow.Metric {
+	_, isHot := sh.hot[k]
+	if !s.reserveSeries(isHot) {
+		if sh.candidate(k) {
+			m := newMetric(k)
+			sh.spill[k] = m
+			return m
+		}
+		return sh.overflowOf(k)
+	}
+
+	m := newMetric(k)
+	sh.agg[k] = m
+	return m
+}
+
+// candidate determines if the key is tracked as a heavy hitter.
+func (sh *shard) candidate(k flow.Key) bool {
+	return sh.topBytes != nil && (sh.topBytes.Has(k) || sh.topRTT.Has(k))
+}
+
+// fold folds the spilled metric of a key that is no longer a heavy
+// hitter candidate into its overflow bucket. Space saving never evicts
+// keys with more than 1/k of the bytes of the shard, so the heavy
+// hitters of the interval are not folded and their series stay exact.
+func (sh *shard) fold(k flow.Key) {
+	m, ok := sh.spill[k]
+	if !ok || sh.candidate(k) {
+		return
+	}
+	delete(sh.spill, k)
+
+	sh.overflowOf(k).Merge(*m)
+}
+
+// overflowOf returns the overflow bucket of the key.
+func (sh *shard) overflowOf(k flow.Key) *flow.Metric {
+	k = overflowKey(k)
+	m, ok := sh.overflow[k]
+	if !ok {
+		m = newMetric(k)
+		sh.overflow[k] = m
+	}
+	return m
+}
+
+// reserveSeries reserves a series under the limit, returning false
+// if the limit is reached. Shards reserve concurrently, so the
+// count is compared and incremented in one step to never exceed
+// the limit. Hot series are exempt.
+func (s *metricService) reserveSeries(hot bool) bool {
+	for {
+		n := atomic.LoadInt64(&s.series)
+		if s.limit > 0 && !hot && n >= s.limit {
+			return false
+		}
+		if atomic.CompareAndSwapInt64(&s.series, n, n+1) {
+			return true
+		}
+	}
 }
 
-// Close closes the metrics service.
+// Close closes the metrics service, waiting for
+// a running flush to complete.
 func (s *metricService) Close() error {
 	close(s.doneCh)
+	<-s.stopped
 
 	return nil
 }
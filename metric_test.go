@@ -0,0 +1,182 @@
+package ebpf
+
+import (
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/nrwiersma/ebpf/flow"
+)
+
+func TestMetricService_SeriesLimitUnderConcurrency(t *testing.T) {
+	const (
+		limit   = 50
+		workers = 8
+		keys    = 200
+		records = 2000
+	)
+
+	svc := newMetricsService(metricConfig{
+		Interval:    time.Hour,
+		Dims:        DefaultDimensions,
+		SeriesLimit: limit,
+	}, func(time.Duration, []flow.Metric) {})
+	defer func() { _ = svc.Close() }()
+
+	var (
+		mu       sync.Mutex
+		bytesOut uint64
+		maxSeen  int
+	)
+	collect := func(ms []flow.Metric) {
+		var series int
+		for _, m := range ms {
+			if m.Remote != flow.Overflow {
+				series++
+			}
+			bytesOut += m.BytesOut
+		}
+		if series > maxSeen {
+			maxSeen = series
+		}
+	}
+
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+
+			for i := 0; i < records; i++ {
+				svc.Add(record{
+					Subject:   "default/subject-" + strconv.Itoa(w),
+					Remote:    "default/remote-" + strconv.Itoa(i%keys),
+					Port:      8080,
+					Protocol:  "tcp",
+					Direction: "out",
+					BytesOut:  1,
+				})
+			}
+		}(w)
+	}
+
+	done := make(chan struct{})
+	flushed := make(chan struct{})
+	go func() {
+		defer close(flushed)
+
+		for {
+			select {
+			case <-done:
+				return
+			default:
+			}
+
+			ms := svc.flush(time.Now().Unix())
+			mu.Lock()
+			collect(ms)
+			mu.Unlock()
+		}
+	}()
+
+	wg.Wait()
+	close(done)
+	<-flushed
+
+	mu.Lock()
+	defer mu.Unlock()
+	collect(svc.flush(time.Now().Unix()))
+
+	if maxSeen > limit {
+		t.Errorf("expected at most %d series per interval, got %d", limit, maxSeen)
+	}
+	if want := uint64(workers * records); bytesOut != want {
+		t.Errorf("expected %d bytes out, got %d", want, bytesOut)
+	}
+	if svc.series != 0 {
+		t.Errorf("expected no series after the last flush, got %d", svc.series)
+	}
+}
+
+func TestMetricService_TopKExactBeyondLimit(t *testing.T) {
+	svc := newMetricsService(metricConfig{
+		Interval:    time.Hour,
+		Dims:        DefaultDimensions,
+		SeriesLimit: 2,
+		TopK:        2,
+	}, func(time.Duration, []flow.Metric) {})
+	defer func() { _ = svc.Close() }()
+
+	add := func(remote string, bytes uint64, rtt float64) {
+		svc.Add(record{
+			Subject:   "default/a",
+			Remote:    remote,
+			Port:      8080,
+			Protocol:  "tcp",
+			Direction: "out",
+			BytesOut:  bytes,
+			RTT:       rtt,
+		})
+	}
+
+	// The series limit is reached before the heavy hitter appears.
+	add("default/b", 1, 0)
+	add("default/c", 1, 0)
+	for i := 0; i < 10; i++ {
+		add("default/heavy", 100, 0)
+		add("default/d"+strconv.Itoa(i), 1, 0)
+	}
+	add("default/slow", 1, 5000)
+
+	ms := svc.flush(time.Now().Unix())
+
+	got := map[string]flow.Metric{}
+	for _, m := range ms {
+		got[m.Remote] = m
+	}
+	if m, ok := got["default/heavy"]; !ok || m.BytesOut != 1000 || m.PacketsOut != 10 {
+		t.Errorf("expected an exact heavy hitter series, got %+v", m)
+	}
+	if m, ok := got["default/slow"]; !ok || m.RTT.Count() != 1 {
+		t.Errorf("expected an exact rtt heavy hitter series, got %+v", m)
+	}
+	if m, ok := got[flow.Overflow]; !ok || m.BytesOut == 0 {
+		t.Errorf("expected an overflow bucket, got %+v", m)
+	}
+
+	var total uint64
+	for _, m := range ms {
+		total += m.BytesOut
+	}
+	if total != 1013 {
+		t.Errorf("expected 1013 bytes, got %d", total)
+	}
+}
+
+func TestMetricService_FlushComputesRates(t *testing.T) {
+	svc := newMetricsService(metricConfig{
+		Interval: 10 * time.Second,
+		Dims:     DefaultDimensions,
+	}, func(time.Duration, []flow.Metric) {})
+	defer func() { _ = svc.Close() }()
+
+	svc.Add(record{Subject: "a", Remote: "b", Direction: "out", BytesOut: 100, Weight: 4})
+	svc.Add(record{Subject: "a", Remote: "b", Direction: "in", BytesIn: 50})
+	svc.Add(record{Subject: "a", Remote: "b", Direction: "in", BytesIn: 50})
+
+	ms := svc.flush(time.Now().Unix())
+	if len(ms) != 1 {
+		t.Fatalf("expected 1 metric, got %d", len(ms))
+	}
+	m := ms[0]
+	if m.PacketsOut != 4 || m.PacketsIn != 2 {
+		t.Errorf("expected 4 packets out and 2 in, got %d and %d", m.PacketsOut, m.PacketsIn)
+	}
+	if m.BytesRate != 50 {
+		t.Errorf("expected bytes rate 50, got %v", m.BytesRate)
+	}
+	if m.PacketsRate != 0.6 {
+		t.Errorf("expected packets rate 0.6, got %v", m.PacketsRate)
+	}
+}
@@ -0,0 +1,226 @@
+package packet
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"unsafe"
+
+	"github.com/cilium/ebpf"
+	"github.com/cilium/ebpf/asm"
+	"golang.org/x/sys/unix"
+)
+
+const (
+	// ringBufMap is the ring buffer map type, unknown to the ebpf library.
+	ringBufMap ebpf.MapType = 27
+
+	// bpfLinkCreate is the bpf command creating a bpf_link.
+	bpfLinkCreate = 28
+
+	vmlinuxBTF = "/sys/kernel/btf/vmlinux"
+)
+
+// Features are the BPF capabilities of the kernel.
+type Features struct {
+	// CGroupSKB reports if cgroup_skb programs can be loaded.
+	CGroupSKB bool
+	// Helpers reports the availability of the helpers used by the program.
+	Helpers map[asm.BuiltinFunc]bool
+	// Maps reports the availability of the map types used by the program.
+	Maps map[ebpf.MapType]bool
+	// RingBuf reports if ring buffer maps are available.
+	RingBuf bool
+	// Link reports if programs can be attached to cgroups with a bpf_link.
+	Link bool
+	// BTF reports if the kernel exposes its BTF, required for CO-RE.
+	BTF bool
+}
+
+// requiredHelpers are the helpers every variant of the program calls.
+var requiredHelpers = []asm.BuiltinFunc{
+	asm.FnMapLookupElem,
+	asm.FnMapUpdateElem,
+	asm.FnMapDeleteElem,
+	asm.FnKtimeGetNs,
+	asm.FnGetPrandomU32,
+	asm.FnPerfEventOutput,
+}
+
+// requiredMaps are the map types of the program.
+var requiredMaps = []ebpf.MapType{
+	ebpf.Hash,
+	ebpf.LRUHash,
+	ebpf.Array,
+	ebpf.PerfEventArray,
+	ebpf.LPMTrie,
+}
+
+// ProbeFeatures probes the BPF capabilities of the kernel.
+func ProbeFeatures() (Features, error) {
+	err := probeProgram(ebpf.CGroupSKB, nil)
+	if errors.Is(err, unix.EPERM) {
+		return Features{}, fmt.Errorf("unable to probe BPF features, missing privileges: %w", err)
+	}
+
+	f := Features{
+		CGroupSKB: err == nil,
+		Helpers:   map[asm.BuiltinFunc]bool{},
+		Maps:      map[ebpf.MapType]bool{},
+		RingBuf:   probeMap(ringBufMap) == nil,
+		Link:      probeLink(),
+	}
+	if f.CGroupSKB {
+		for _, fn := range append(requiredHelpers, asm.FnSkbCgroupId) {
+			f.Helpers[fn] = probeHelper(fn)
+		}
+	}
+	for _, typ := range requiredMaps {
+		f.Maps[typ] = probeMap(typ) == nil
+	}
+	if _, err := os.Stat(vmlinuxBTF); err == nil {
+		f.BTF = true
+	}
+	return f, nil
+}
+
+// Check returns an error naming the missing capabilities
+// required to load the program.
+func (f Features) Check() error {
+	var missing []string
+	if !f.CGroupSKB {
+		missing = append(missing, "cgroup_skb programs")
+	}
+	for _, fn := range requiredHelpers {
+		if f.CGroupSKB && !f.Helpers[fn] {
+			missing = append(missing, "helper "+helperName(fn))
+		}
+	}
+	for _, typ := range requiredMaps {
+		if !f.Maps[typ] {
+			missing = append(missing, "map type "+mapName(typ))
+		}
+	}
+	if len(missing) > 0 {
+		return fmt.Errorf("kernel is missing required BPF capabilities: %s", strings.Join(missing, ", "))
+	}
+	return nil
+}
+
+// CGroupFilter reports if packets can be filtered by cgroup.
+func (f Features) CGroupFilter() bool {
+	return f.Helpers[asm.FnSkbCgroupId]
+}
+
+// Fields returns the features as logger key-value pairs.
+func (f Features) Fields() []interface{} {
+	ctx := []interface{}{"cgroup_skb", f.CGroupSKB}
+	for _, fn := range append(requiredHelpers, asm.FnSkbCgroupId) {
+		ctx = append(ctx, helperName(fn), f.Helpers[fn])
+	}
+	for _, typ := range requiredMaps {
+		ctx = append(ctx, mapName(typ), f.Maps[typ])
+	}
+	return append(ctx, "ringbuf", f.RingBuf, "bpf_link", f.Link, "btf", f.BTF)
+}
+
+func helperName(fn asm.BuiltinFunc) string {
+	return "bpf_" + toSnake(strings.TrimPrefix(fn.String(), "Fn"))
+}
+
+func mapName(typ ebpf.MapType) string {
+	return toSnake(typ.String())
+}
+
+// toSnake converts a camel case name to snake case,
+// keeping initialisms, e.g. LPMTrie, together.
+func toSnake(s string) string {
+	var sb strings.Builder
+	for i, r := range s {
+		upper := r >= 'A' && r <= 'Z'
+		if upper && i > 0 {
+			prevLower := s[i-1] >= 'a' && s[i-1] <= 'z'
+			nextLower := i+1 < len(s) && s[i+1] >= 'a' && s[i+1] <= 'z'
+			if prevLower || (nextLower && s[i-1] >= 'A' && s[i-1] <= 'Z') {
+				sb.WriteByte('_')
+			}
+		}
+		if upper {
+			r += 'a' - 'A'
+		}
+		sb.WriteRune(r)
+	}
+	return sb.String()
+}
+
+// probeProgram loads a program of the type, running the
+// instructions before returning.
+func probeProgram(typ ebpf.ProgramType, insns asm.Instructions) error {
+	insns = append(insns,
+		asm.Mov.Imm(asm.R0, 1),
+		asm.Return(),
+	)
+	prog, err := ebpf.NewProgramWithOptions(&ebpf.ProgramSpec{
+		Type:         typ,
+		Instructions: insns,
+		License:      "GPL",
+	}, ebpf.ProgramOptions{LogLevel: 1})
+	if err != nil {
+		return err
+	}
+	return prog.Close()
+}
+
+// probeHelper reports if a cgroup_skb program may call the helper.
+// The arguments of the helper are not set up, so the verifier rejects
+// most calls, but only unavailable helpers are rejected as unknown.
+func probeHelper(fn asm.BuiltinFunc) bool {
+	err := probeProgram(ebpf.CGroupSKB, asm.Instructions{fn.Call()})
+	if err == nil {
+		return true
+	}
+	for _, msg := range []string{"invalid func", "unknown func", "cannot use helper"} {
+		if strings.Contains(err.Error(), msg) {
+			return false
+		}
+	}
+	return true
+}
+
+func probeMap(typ ebpf.MapType) error {
+	spec := &ebpf.MapSpec{
+		Type:       typ,
+		KeySize:    4,
+		ValueSize:  4,
+		MaxEntries: 1,
+	}
+	switch typ {
+	case ebpf.LPMTrie:
+		spec.KeySize = 8
+		spec.Flags = unix.BPF_F_NO_PREALLOC
+	case ringBufMap:
+		spec.KeySize, spec.ValueSize = 0, 0
+		spec.MaxEntries = uint32(os.Getpagesize())
+	}
+
+	m, err := ebpf.NewMap(spec)
+	if err != nil {
+		return err
+	}
+	return m.Close()
+}
+
+// probeLink reports if bpf_links can be created. The command is
+// given an invalid program, which a kernel without links does not get to.
+func probeLink() bool {
+	attr := struct {
+		progFD     uint32
+		targetFD   uint32
+		attachType uint32
+		flags      uint32
+	}{progFD: ^uint32(0), targetFD: ^uint32(0)}
+
+	_, _, errno := unix.Syscall(unix.SYS_BPF, bpfLinkCreate, uintptr(unsafe.Pointer(&attr)), unsafe.Sizeof(attr))
+	return errors.Is(errno, unix.EBADF)
+}
@@ -0,0 +1,105 @@
+package packet
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/cilium/ebpf"
+	"github.com/cilium/ebpf/asm"
+)
+
+func TestFeatures_Check(t *testing.T) {
+	all := func() Features {
+		f := Features{
+			CGroupSKB: true,
+			Helpers:   map[asm.BuiltinFunc]bool{},
+			Maps:      map[ebpf.MapType]bool{},
+		}
+		for _, fn := range requiredHelpers {
+			f.Helpers[fn] = true
+		}
+		for _, typ := range requiredMaps {
+			f.Maps[typ] = true
+		}
+		return f
+	}
+
+	tests := []struct {
+		name    string
+		f       func() Features
+		wantErr string
+	}{
+		{name: "all features", f: all},
+		{
+			name: "missing lru hash",
+			f: func() Features {
+				f := all()
+				f.Maps[ebpf.LRUHash] = false
+				return f
+			},
+			wantErr: "map type lru_hash",
+		},
+		{
+			name: "missing map update",
+			f: func() Features {
+				f := all()
+				f.Helpers[asm.FnMapUpdateElem] = false
+				return f
+			},
+			wantErr: "helper bpf_map_update_elem",
+		},
+		{
+			name: "missing map delete",
+			f: func() Features {
+				f := all()
+				f.Helpers[asm.FnMapDeleteElem] = false
+				return f
+			},
+			wantErr: "helper bpf_map_delete_elem",
+		},
+		{
+			name: "missing cgroup skb",
+			f: func() Features {
+				f := all()
+				f.CGroupSKB = false
+				return f
+			},
+			wantErr: "cgroup_skb programs",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			err := test.f().Check()
+
+			if test.wantErr == "" {
+				if err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), test.wantErr) {
+				t.Errorf("expected error containing %q, got %v", test.wantErr, err)
+			}
+		})
+	}
+}
+
+func TestFeatures_Fields(t *testing.T) {
+	f := Features{BTF: true}
+
+	fields := f.Fields()
+
+	got := map[string]interface{}{}
+	for i := 0; i < len(fields); i += 2 {
+		got[fields[i].(string)] = fields[i+1]
+	}
+	for _, name := range []string{"bpf_map_update_elem", "bpf_map_delete_elem", "lru_hash", "bpf_link"} {
+		if _, ok := got[name]; !ok {
+			t.Errorf("expected field %q, got %v", name, fields)
+		}
+	}
+	if got["btf"] != true {
+		t.Errorf("expected btf to be true, got %v", got["btf"])
+	}
+}
@@ -0,0 +1,125 @@
+package packet
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"reflect"
+
+	"github.com/cilium/ebpf"
+	"github.com/nrwiersma/ebpf/bpf"
+	"golang.org/x/sys/unix"
+)
+
+// Filter describes the packets that are ignored in the kernel,
+// before they are sent to userspace.
+type Filter struct {
+	// Ports ignores packets from or to the ports.
+	Ports []uint16
+	// CIDRs ignores packets from or to the networks.
+	CIDRs []*net.IPNet
+	// CGroups ignores packets of the cgroups, given by their path.
+	// It requires the bpf_skb_cgroup_id helper.
+	CGroups []string
+}
+
+func toLPMKey(n *net.IPNet) (bpf.LpmKey, error) {
+	ones, bits := n.Mask.Size()
+	ip := n.IP.Mask(n.Mask).To16()
+	if ip == nil || bits == 0 {
+		return bpf.LpmKey{}, fmt.Errorf("invalid cidr %q", n.String())
+	}
+	if bits == 8*net.IPv4len {
+		// IPv4 addresses are stored IPv4-mapped.
+		ones += 8 * (net.IPv6len - net.IPv4len)
+	}
+
+	k := bpf.LpmKey{Prefixlen: uint32(ones)}
+	copy(k.IP[:], ip)
+	return k, nil
+}
+
+// cgroupID returns the id of the cgroup v2 at the path.
+func cgroupID(path string) (uint64, error) {
+	var st unix.Stat_t
+	if err := unix.Stat(path, &st); err != nil {
+		return 0, fmt.Errorf("unable to stat cgroup %q: %w", path, err)
+	}
+	return st.Ino, nil
+}
+
+// SetFilter replaces the filter applied in the kernel. The
+// filter is updated in place, without reloading the programs.
+func (s *CGroup) SetFilter(f Filter) error {
+	if len(f.CGroups) > 0 && !s.features.CGroupFilter() {
+		return errors.New("cgroup filtering requires the bpf_skb_cgroup_id helper, which the kernel is missing")
+	}
+
+	ports := make(map[interface{}]struct{}, len(f.Ports))
+	for _, port := range f.Ports {
+		ports[port] = struct{}{}
+	}
+
+	cidrs := make(map[interface{}]struct{}, len(f.CIDRs))
+	for _, n := range f.CIDRs {
+		k, err := toLPMKey(n)
+		if err != nil {
+			return err
+		}
+		cidrs[k] = struct{}{}
+	}
+
+	cgroups := make(map[interface{}]struct{}, len(f.CGroups))
+	for _, path := range f.CGroups {
+		id, err := cgroupID(path)
+		if err != nil {
+			return err
+		}
+		cgroups[id] = struct{}{}
+	}
+
+	s.fmu.Lock()
+	defer s.fmu.Unlock()
+
+	if err := syncMap(s.objs.FilterPorts, ports, new(uint16)); err != nil {
+		return fmt.Errorf("unable to update port filter: %w", err)
+	}
+	if err := syncMap(s.objs.FilterCIDRs, cidrs, new(bpf.LpmKey)); err != nil {
+		return fmt.Errorf("unable to update cidr filter: %w", err)
+	}
+	if err := syncMap(s.objs.FilterCGroups, cgroups, new(uint64)); err != nil {
+		return fmt.Errorf("unable to update cgroup filter: %w", err)
+	}
+	return nil
+}
+
+// syncMap makes the keys of the map the wanted keys. The
+// key pointer is used to read the current keys of the map.
+func syncMap(m *ebpf.Map, want map[interface{}]struct{}, key interface{}) error {
+	var (
+		stale []interface{}
+		val   uint8
+	)
+	it := m.Iterate()
+	for it.Next(key, &val) {
+		k := reflect.ValueOf(key).Elem().Interface()
+		if _, ok := want[k]; !ok {
+			stale = append(stale, k)
+		}
+	}
+	if err := it.Err(); err != nil {
+		return err
+	}
+
+	for _, k := range stale {
+		if err := m.Delete(k); err != nil && !errors.Is(err, ebpf.ErrKeyNotExist) {
+			return err
+		}
+	}
+	for k := range want {
+		if err := m.Put(k, uint8(1)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,168 @@
+package packet
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"sort"
+	"testing"
+
+	"github.com/cilium/ebpf"
+	"github.com/nrwiersma/ebpf/bpf"
+	"golang.org/x/sys/unix"
+)
+
+func TestToLPMKey(t *testing.T) {
+	mustCIDR := func(s string) *net.IPNet {
+		_, n, err := net.ParseCIDR(s)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		return n
+	}
+
+	tests := []struct {
+		name    string
+		n       *net.IPNet
+		wantLen uint32
+		wantIP  string
+		wantErr bool
+	}{
+		{name: "ipv4 network", n: mustCIDR("10.0.0.0/8"), wantLen: 104, wantIP: "10.0.0.0"},
+		{name: "ipv4 host", n: mustCIDR("10.1.2.3/32"), wantLen: 128, wantIP: "10.1.2.3"},
+		{name: "ipv4 any", n: mustCIDR("0.0.0.0/0"), wantLen: 96, wantIP: "0.0.0.0"},
+		{name: "ipv4 host bits", n: &net.IPNet{IP: net.ParseIP("192.168.1.1"), Mask: net.CIDRMask(16, 32)}, wantLen: 112, wantIP: "192.168.0.0"},
+		{name: "ipv6 network", n: mustCIDR("2001:db8::/32"), wantLen: 32, wantIP: "2001:db8::"},
+		{name: "ipv6 mapped ipv4", n: mustCIDR("::ffff:10.0.0.0/104"), wantLen: 104, wantIP: "10.0.0.0"},
+		{name: "non canonical mask", n: &net.IPNet{IP: net.ParseIP("10.0.0.0").To4(), Mask: net.IPMask{255, 0, 255, 0}}, wantErr: true},
+		{name: "mismatched mask", n: &net.IPNet{IP: net.IP{10, 0, 0, 0}, Mask: net.CIDRMask(8, 128)}, wantErr: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			k, err := toLPMKey(test.n)
+
+			if test.wantErr {
+				if err == nil {
+					t.Fatal("expected error, got none")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if k.Prefixlen != test.wantLen {
+				t.Errorf("expected prefix length %d, got %d", test.wantLen, k.Prefixlen)
+			}
+			if want := net.ParseIP(test.wantIP).To16(); !bytes.Equal(k.IP[:], want) {
+				t.Errorf("expected ip %s, got %s", want, net.IP(k.IP[:]))
+			}
+		})
+	}
+}
+
+func TestSyncMap(t *testing.T) {
+	tests := []struct {
+		name string
+		have []uint16
+		want []uint16
+	}{
+		{name: "empty map", want: []uint16{80, 443}},
+		{name: "adds and removes keys", have: []uint16{80, 443}, want: []uint16{443, 8080}},
+		{name: "unchanged", have: []uint16{80, 443}, want: []uint16{80, 443}},
+		{name: "clears map", have: []uint16{80, 443}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			m := newTestMap(t, &ebpf.MapSpec{Type: ebpf.Hash, KeySize: 2, ValueSize: 1, MaxEntries: 16})
+			for _, k := range test.have {
+				if err := m.Put(k, uint8(1)); err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+			}
+
+			want := make(map[interface{}]struct{}, len(test.want))
+			for _, k := range test.want {
+				want[k] = struct{}{}
+			}
+			if err := syncMap(m, want, new(uint16)); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			var (
+				got []uint16
+				k   uint16
+				v   uint8
+			)
+			it := m.Iterate()
+			for it.Next(&k, &v) {
+				got = append(got, k)
+			}
+			if err := it.Err(); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			sort.Slice(got, func(i, j int) bool { return got[i] < got[j] })
+			if fmt.Sprint(got) != fmt.Sprint(test.want) {
+				t.Errorf("expected keys %v, got %v", test.want, got)
+			}
+		})
+	}
+}
+
+func TestSyncMap_LPMTrie(t *testing.T) {
+	m := newTestMap(t, &ebpf.MapSpec{
+		Type:       ebpf.LPMTrie,
+		KeySize:    20,
+		ValueSize:  1,
+		MaxEntries: 16,
+		Flags:      unix.BPF_F_NO_PREALLOC,
+	})
+
+	key := func(cidr string) bpf.LpmKey {
+		_, n, err := net.ParseCIDR(cidr)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		k, err := toLPMKey(n)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		return k
+	}
+	if err := m.Put(key("10.0.0.0/8"), uint8(1)); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	want := map[interface{}]struct{}{key("10.0.0.0/16"): {}}
+	if err := syncMap(m, want, new(bpf.LpmKey)); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	var v uint8
+	if err := m.Lookup(key("10.0.0.0/8"), &v); !errors.Is(err, ebpf.ErrKeyNotExist) {
+		t.Errorf("expected the stale prefix to be removed, got %v", err)
+	}
+	if err := m.Lookup(key("10.0.0.0/16"), &v); err != nil {
+		t.Errorf("expected the wanted prefix, got %v", err)
+	}
+}
+
+func newTestMap(t *testing.T, spec *ebpf.MapSpec) *ebpf.Map {
+	t.Helper()
+
+	if !canLoadBPF() {
+		t.Skip("requires root or CAP_BPF")
+	}
+	m, err := ebpf.NewMap(spec)
+	if errors.Is(err, os.ErrPermission) {
+		t.Skip("requires permission to create maps")
+	}
+	if err != nil {
+		t.Fatalf("unable to create map: %v", err)
+	}
+	t.Cleanup(func() { _ = m.Close() })
+	return m
+}
@@ -2,7 +2,10 @@ package packet
 
 import (
 	"bytes"
+	"errors"
 	"fmt"
+	"os"
+	"runtime"
 	"sync"
 	"unsafe"
 
@@ -26,8 +29,6 @@ const (
 )
 
 // Packet contains network packet data.
-//
-// Must stay in sync with bpf/maps.h pkt_entry.
 type Packet struct {
 	Timestamp uint64
 	SrcIP     [16]byte
@@ -38,47 +39,238 @@ type Packet struct {
 	RTT       uint32
 	Proto     uint16
 	Flags     uint16
+
+	// SampleRate is the 1 in N rate the packet was sampled at.
+	SampleRate uint32
+}
+
+// decodePacket decodes a packet from a raw pkt_entry sample,
+// which is written in the byte order of the host.
+func decodePacket(raw []byte) (Packet, error) {
+	var e bpf.PktEntry
+	size := int(unsafe.Sizeof(e))
+	if len(raw) < size {
+		return Packet{}, fmt.Errorf("sample of %d bytes is shorter than a packet of %d bytes", len(raw), size)
+	}
+	// Copy the sample, as it is not aligned for the entry.
+	copy((*[unsafe.Sizeof(bpf.PktEntry{})]byte)(unsafe.Pointer(&e))[:], raw)
+
+	return fromEntry(e), nil
 }
 
-func toPacket(raw []byte) Packet {
-	return *(*Packet)(unsafe.Pointer(&raw[0]))
+// fromEntry returns the packet of a pkt_entry.
+func fromEntry(e bpf.PktEntry) Packet {
+	return Packet{
+		Timestamp:  e.Ts,
+		SrcIP:      e.SrcIP,
+		DestIP:     e.DestIP,
+		SrcPort:    e.SrcPort,
+		DestPort:   e.DestPort,
+		Len:        e.Len,
+		RTT:        e.RTT,
+		Proto:      e.Protocol,
+		Flags:      e.Flags,
+		SampleRate: e.SampleRate,
+	}
 }
 
 type objects struct {
-	Ingress *ebpf.Program `ebpf:"metrics_ingress"`
-	Egress  *ebpf.Program `ebpf:"metrics_egress"`
-	PktsMap *ebpf.Map     `ebpf:"packets"`
+	Ingress  *ebpf.Program `ebpf:"metrics_ingress"`
+	Egress   *ebpf.Program `ebpf:"metrics_egress"`
+	PktsMap  *ebpf.Map     `ebpf:"packets"`
+	Stash    *ebpf.Map     `ebpf:"stash"`
+	Sampling *ebpf.Map     `ebpf:"sampling"`
+
+	FilterPorts   *ebpf.Map `ebpf:"filter_ports"`
+	FilterCIDRs   *ebpf.Map `ebpf:"filter_cidrs"`
+	FilterCGroups *ebpf.Map `ebpf:"filter_cgroups"`
+}
+
+// OptsFunc represents a configuration function for the packet module.
+type OptsFunc func(s *CGroup)
+
+// WithWorkers configures the number of goroutines packets are
+// handled on. It defaults to the number of usable CPUs.
+func WithWorkers(n int) OptsFunc {
+	return func(s *CGroup) {
+		s.workers = n
+	}
+}
+
+// WithQueueSize configures the number of read packets that can
+// wait for the workers before reading blocks. It is split evenly
+// over the queues of the workers.
+func WithQueueSize(n int) OptsFunc {
+	return func(s *CGroup) {
+		s.queueSize = n
+	}
+}
+
+// WithMapSize configures the maximum number of entries of the named map,
+// e.g. "stash". The stash map is sized from the CPUs and memory by default.
+func WithMapSize(name string, entries uint32) OptsFunc {
+	return func(s *CGroup) {
+		s.mapSizes[name] = entries
+	}
+}
+
+// WithPerfBuffer configures the number of pages of the per-CPU perf buffer.
+// It is sized from the CPUs and memory by default.
+func WithPerfBuffer(pages int) OptsFunc {
+	return func(s *CGroup) {
+		s.perfPages = pages
+	}
+}
+
+// WithWatermark configures the number of bytes that must be written to
+// a per-CPU perf buffer before it is read. It must be smaller than the
+// perf buffer. Zero reads as soon as data is available.
+func WithWatermark(bytes int) OptsFunc {
+	return func(s *CGroup) {
+		s.watermark = bytes
+	}
+}
+
+// recordReader reads the records of the perf rings.
+type recordReader interface {
+	Read() (perf.Record, error)
+	Close() error
 }
 
 type CGroup struct {
 	objs objects
-	pkts *perf.Reader
+	pkts recordReader
+
+	mapSizes  map[string]uint32
+	perfPages int
+	watermark int
+	pinPath   string
+	features  Features
+
+	workers   int
+	queueSize int
 
-	mu   sync.Mutex
-	atch map[string][]link.Link
+	mu     sync.Mutex
+	atch   map[string][]link.Link
+	pinned map[string][]link.Link
+
+	fmu sync.Mutex
 }
 
-func NewCGroup() (*CGroup, error) {
-	spec, err := ebpf.LoadCollectionSpecFromReader(bytes.NewReader(bpf.MetricsSock))
+func NewCGroup(opts ...OptsFunc) (*CGroup, error) {
+	s := &CGroup{
+		mapSizes:  map[string]uint32{},
+		workers:   runtime.GOMAXPROCS(0),
+		queueSize: 4096,
+		atch:      map[string][]link.Link{},
+	}
+
+	for _, opt := range opts {
+		opt(s)
+	}
+	if _, ok := s.mapSizes["stash"]; !ok || s.perfPages == 0 {
+		stash, pages := AutoSize()
+		if !ok {
+			s.mapSizes["stash"] = stash
+		}
+		if s.perfPages == 0 {
+			s.perfPages = pages
+		}
+	}
+	if s.perfPages < 1 {
+		return nil, errors.New("perf buffer pages must be positive")
+	}
+	if s.watermark < 0 || s.watermark >= s.perfPages*os.Getpagesize() {
+		return nil, errors.New("watermark must be smaller than the perf buffer")
+	}
+	if s.workers < 1 {
+		return nil, errors.New("workers must be positive")
+	}
+	if s.queueSize < 0 {
+		return nil, errors.New("queue size must not be negative")
+	}
+
+	features, err := ProbeFeatures()
+	if err != nil {
+		return nil, err
+	}
+	if err = features.Check(); err != nil {
+		return nil, err
+	}
+	if s.pinPath != "" && !features.Link {
+		return nil, errors.New("kernel is missing bpf_link support, required for pinning")
+	}
+	s.features = features
+
+	obj := bpf.MetricsSock
+	if !features.CGroupFilter() {
+		obj = bpf.MetricsSockCompat
+	}
+	if err = bpf.VerifyLayout(obj); err != nil {
+		return nil, fmt.Errorf("unable to verify packet module: %w", err)
+	}
+
+	spec, err := ebpf.LoadCollectionSpecFromReader(bytes.NewReader(obj))
 	if err != nil {
 		return nil, fmt.Errorf("unable to load packet module: %w", err)
 	}
 
+	for name, entries := range s.mapSizes {
+		ms, ok := spec.Maps[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown map %q", name)
+		}
+		if ms.Type == ebpf.PerfEventArray || ms.Type == ebpf.Array {
+			return nil, fmt.Errorf("map %q cannot be resized", name)
+		}
+		if entries == 0 {
+			return nil, fmt.Errorf("map %q must have entries", name)
+		}
+		ms.MaxEntries = entries
+	}
+
+	var colOpts *ebpf.CollectionOptions
+	if s.pinPath != "" {
+		if err = preparePinning(s.pinPath, spec); err != nil {
+			return nil, err
+		}
+		colOpts = &ebpf.CollectionOptions{Maps: ebpf.MapOptions{PinPath: s.pinPath}}
+	}
+
 	var objs objects
-	if err := spec.LoadAndAssign(&objs, nil); err != nil {
+	if err := spec.LoadAndAssign(&objs, colOpts); err != nil {
+		if s.pinPath != "" {
+			// Pinned maps of another size or version cannot be reused.
+			return nil, fmt.Errorf("unable to find required objects, the pinned objects may need to be cleaned up: %w", err)
+		}
 		return nil, fmt.Errorf("unable to find required objects: %w", err)
 	}
 
-	pkts, err := perf.NewReader(objs.PktsMap, 8*1024)
+	if s.pinPath != "" {
+		// The sampling rate is owned by the running process.
+		for _, dir := range []uint16{FlagIn, FlagOut} {
+			if err = objs.Sampling.Put(uint32(dir), uint32(1)); err != nil {
+				return nil, fmt.Errorf("unable to reset sample rate: %w", err)
+			}
+		}
+
+		s.pinned, err = loadPinnedLinks(s.pinPath)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	pkts, err := perf.NewReaderWithOptions(objs.PktsMap, s.perfPages*os.Getpagesize(), perf.ReaderOptions{
+		Watermark: s.watermark,
+	})
 	if err != nil {
 		return nil, fmt.Errorf("unable to create map: %w", err)
 	}
 
-	return &CGroup{
-		objs: objs,
-		pkts: pkts,
-		atch: map[string][]link.Link{},
-	}, nil
+	s.objs = objs
+	s.pkts = pkts
+
+	return s, nil
 }
 
 // AttachContainer attaches to the container.
@@ -89,6 +281,9 @@ func (s *CGroup) AttachContainer(name, path string) error {
 	if _, ok := s.atch[name]; ok {
 		return nil
 	}
+	if s.pinPath != "" && s.adopt(name) {
+		return nil
+	}
 
 	var links [2]link.Link
 	l, err := link.AttachCgroup(link.CgroupOptions{
@@ -112,6 +307,15 @@ func (s *CGroup) AttachContainer(name, path string) error {
 	}
 	links[1] = l
 
+	if s.pinPath != "" {
+		for i, path := range s.linkPaths(name) {
+			if err = links[i].Pin(path); err != nil {
+				_ = s.unpin(name, links[:])
+				return fmt.Errorf("pin container %s: %w", name, err)
+			}
+		}
+	}
+
 	s.atch[name] = links[:]
 
 	return nil
@@ -128,9 +332,13 @@ func (s *CGroup) DetachContainer(name string) error {
 	}
 
 	var errs error
-	for _, l := range links {
-		if err := l.Close(); err != nil {
-			errs = multierror.Append(errs, fmt.Errorf("detach to container %s: %w", name, err))
+	if s.pinPath != "" {
+		errs = s.unpin(name, links)
+	} else {
+		for _, l := range links {
+			if err := l.Close(); err != nil {
+				errs = multierror.Append(errs, fmt.Errorf("detach to container %s: %w", name, err))
+			}
 		}
 	}
 
@@ -139,9 +347,81 @@ func (s *CGroup) DetachContainer(name string) error {
 	return errs
 }
 
-// Watch reads packets from perf events.
+// Features returns the BPF capabilities of the kernel
+// the module was loaded with.
+func (s *CGroup) Features() Features {
+	return s.features
+}
+
+// Attached returns the number of attached containers.
+func (s *CGroup) Attached() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return len(s.atch)
+}
+
+// StashUsage returns the number of entries and the capacity
+// of the map stashing packets awaiting their ACK.
+func (s *CGroup) StashUsage() (int, int, error) {
+	capacity := int(s.objs.Stash.MaxEntries())
+
+	// The map is modified while iterating, which can restart
+	// the iteration. Bound it to avoid iterating forever.
+	var (
+		n   int
+		key []byte
+	)
+	for i := 0; i < 2*capacity; i++ {
+		next, err := s.objs.Stash.NextKeyBytes(key)
+		if err != nil {
+			return 0, capacity, fmt.Errorf("unable to iterate stash: %w", err)
+		}
+		if next == nil {
+			break
+		}
+		n++
+		key = next
+	}
+	if n > capacity {
+		n = capacity
+	}
+	return n, capacity, nil
+}
+
+// SetSampleRate sets the 1 in N rate packets of the direction,
+// either FlagIn or FlagOut, are sampled at in the kernel.
+func (s *CGroup) SetSampleRate(dir uint16, rate uint32) error {
+	if dir != FlagIn && dir != FlagOut {
+		return fmt.Errorf("unknown direction %d", dir)
+	}
+	if rate == 0 {
+		rate = 1
+	}
+
+	if err := s.objs.Sampling.Put(uint32(dir), rate); err != nil {
+		return fmt.Errorf("unable to set sample rate: %w", err)
+	}
+	return nil
+}
+
+// Watch reads packets from perf events until the module is closed.
+//
+// The per-CPU rings are drained by a single reader, as the perf reader
+// owns all rings of the map and serialises reads. The reader only decodes
+// the samples, and hands the packets off to the workers, sharded by the
+// CPU ring they were read from. Each worker has its own bounded queue, so
+// the packets of a CPU are handled in order, and pktFn is called
+// concurrently and must be safe for concurrent use.
+//
+// When the queue of a worker is full, reading blocks until it catches
+// up. The rings then fill up and the kernel drops samples, which are
+// reported to lostFn, so loss is accounted for in one place. lostFn is
+// only called from the reader.
 func (s *CGroup) Watch(pktFn func(pkt Packet), lostFn func(cnt uint64)) {
-	// This may need to be scaled up to keep up with full load.
+	d := newDispatcher(s.workers, s.queueSize, pktFn)
+	defer d.Close()
+
 	for {
 		rec, err := s.pkts.Read()
 		if err != nil {
@@ -153,14 +433,67 @@ func (s *CGroup) Watch(pktFn func(pkt Packet), lostFn func(cnt uint64)) {
 			continue
 		}
 
-		pktFn(toPacket(rec.RawSample))
+		pkt, err := decodePacket(rec.RawSample)
+		if err != nil {
+			// Samples that cannot be decoded are as good as lost.
+			lostFn(1)
+			continue
+		}
+		d.Dispatch(rec.CPU, pkt)
+	}
+}
+
+// dispatcher hands packets off to workers, with a queue per worker.
+type dispatcher struct {
+	queues []chan Packet
+	wg     sync.WaitGroup
+}
+
+func newDispatcher(workers, queueSize int, fn func(pkt Packet)) *dispatcher {
+	d := &dispatcher{queues: make([]chan Packet, workers)}
+
+	d.wg.Add(workers)
+	for i := range d.queues {
+		queue := make(chan Packet, queueSize/workers)
+		d.queues[i] = queue
+
+		go func() {
+			defer d.wg.Done()
+
+			for pkt := range queue {
+				fn(pkt)
+			}
+		}()
 	}
+	return d
+}
+
+// Dispatch queues the packet read from the CPU ring on its worker,
+// blocking while the queue is full.
+func (d *dispatcher) Dispatch(cpu int, pkt Packet) {
+	d.queues[cpu%len(d.queues)] <- pkt
+}
+
+// Close waits for the workers to handle the queued packets.
+func (d *dispatcher) Close() {
+	for _, queue := range d.queues {
+		close(queue)
+	}
+	d.wg.Wait()
 }
 
 // Close detaches all containers and closes the packet module.
+// When pinning, the containers stay attached to the pinned links.
 func (s *CGroup) Close() error {
 	var errs error
 
+	if s.pinPath != "" {
+		s.mu.Lock()
+		closeLinks(s.atch)
+		closeLinks(s.pinned)
+		s.atch, s.pinned = map[string][]link.Link{}, nil
+		s.mu.Unlock()
+	}
 	for name := range s.atch {
 		err := s.DetachContainer(name)
 		if err != nil {
@@ -176,6 +509,19 @@ func (s *CGroup) Close() error {
 	if err != nil {
 		errs = multierror.Append(errs, err)
 	}
+	err = s.objs.Stash.Close()
+	if err != nil {
+		errs = multierror.Append(errs, err)
+	}
+	err = s.objs.Sampling.Close()
+	if err != nil {
+		errs = multierror.Append(errs, err)
+	}
+	for _, m := range []*ebpf.Map{s.objs.FilterPorts, s.objs.FilterCIDRs, s.objs.FilterCGroups} {
+		if err = m.Close(); err != nil {
+			errs = multierror.Append(errs, err)
+		}
+	}
 	err = s.pkts.Close()
 	if err != nil {
 		errs = multierror.Append(errs, err)
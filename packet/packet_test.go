@@ -0,0 +1,194 @@
+package packet
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+	"unsafe"
+
+	"github.com/cilium/ebpf/perf"
+	"github.com/nrwiersma/ebpf/bpf"
+)
+
+func rawSample(e bpf.PktEntry) []byte {
+	b := make([]byte, unsafe.Sizeof(e))
+	copy(b, (*[unsafe.Sizeof(bpf.PktEntry{})]byte)(unsafe.Pointer(&e))[:])
+	return b
+}
+
+func TestDecodePacket(t *testing.T) {
+	e := bpf.PktEntry{Ts: 10, SrcPort: 80, DestPort: 1234, Len: 100, RTT: 5, Protocol: ProtoTCP, Flags: FlagOut, SampleRate: 4}
+	e.SrcIP[15], e.DestIP[15] = 1, 2
+
+	tests := []struct {
+		name    string
+		raw     []byte
+		want    Packet
+		wantErr bool
+	}{
+		{
+			name: "packet",
+			raw:  rawSample(e),
+			want: Packet{
+				Timestamp: 10, SrcIP: e.SrcIP, DestIP: e.DestIP, SrcPort: 80, DestPort: 1234,
+				Len: 100, RTT: 5, Proto: ProtoTCP, Flags: FlagOut, SampleRate: 4,
+			},
+		},
+		{
+			name: "padded sample",
+			raw:  append(rawSample(e), 0, 0, 0, 0),
+			want: Packet{
+				Timestamp: 10, SrcIP: e.SrcIP, DestIP: e.DestIP, SrcPort: 80, DestPort: 1234,
+				Len: 100, RTT: 5, Proto: ProtoTCP, Flags: FlagOut, SampleRate: 4,
+			},
+		},
+		{
+			name:    "short sample",
+			raw:     rawSample(e)[:10],
+			wantErr: true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, err := decodePacket(test.raw)
+
+			if test.wantErr {
+				if err == nil {
+					t.Fatal("expected an error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if got != test.want {
+				t.Errorf("got %+v, want %+v", got, test.want)
+			}
+		})
+	}
+}
+
+// fakeReader returns a number of records round robin over the CPUs.
+type fakeReader struct {
+	raw  []byte
+	cpus int
+	n    int
+}
+
+func (r *fakeReader) Read() (perf.Record, error) {
+	if r.n == 0 {
+		return perf.Record{}, errors.New("closed")
+	}
+	r.n--
+
+	return perf.Record{CPU: r.n % r.cpus, RawSample: r.raw}, nil
+}
+
+func (r *fakeReader) Close() error { return nil }
+
+func TestCGroup_Watch(t *testing.T) {
+	const cpus = 4
+
+	var (
+		mu   sync.Mutex
+		last = map[uint16]uint64{}
+		got  int
+		lost uint64
+	)
+
+	s := &CGroup{workers: 2, queueSize: 8}
+	s.pkts = &seqReader{cpus: cpus, n: 1000}
+	s.Watch(func(pkt Packet) {
+		mu.Lock()
+		defer mu.Unlock()
+
+		// The packets of a CPU must be handled in the order they were read.
+		if pkt.Timestamp <= last[pkt.SrcPort] {
+			t.Errorf("packet %d of cpu %d handled after %d", pkt.Timestamp, pkt.SrcPort, last[pkt.SrcPort])
+		}
+		last[pkt.SrcPort] = pkt.Timestamp
+		got++
+	}, func(cnt uint64) {
+		lost += cnt
+	})
+
+	if got != 1000 {
+		t.Errorf("expected 1000 packets, got %d", got)
+	}
+	if lost != 0 {
+		t.Errorf("expected no lost packets, got %d", lost)
+	}
+}
+
+// seqReader returns packets numbered per CPU, with the CPU as source port.
+type seqReader struct {
+	cpus int
+	n    int
+	i    int
+}
+
+func (r *seqReader) Read() (perf.Record, error) {
+	if r.i == r.n {
+		return perf.Record{}, errors.New("closed")
+	}
+	cpu := r.i % r.cpus
+	e := bpf.PktEntry{Ts: uint64(r.i/r.cpus + 1), SrcPort: uint16(cpu)}
+	r.i++
+
+	return perf.Record{CPU: cpu, RawSample: rawSample(e)}, nil
+}
+
+func (r *seqReader) Close() error { return nil }
+
+func BenchmarkDecode(b *testing.B) {
+	raw := rawSample(bpf.PktEntry{Ts: 10, SrcPort: 80, DestPort: 1234, Len: 100, Protocol: ProtoTCP, Flags: FlagOut})
+
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		if _, err := decodePacket(raw); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// BenchmarkWatch measures the packets handled per second per worker,
+// with a handler that costs about as much as the aggregation of a packet.
+func BenchmarkWatch(b *testing.B) {
+	raw := rawSample(bpf.PktEntry{Ts: 10, SrcPort: 80, DestPort: 1234, Len: 100, Protocol: ProtoTCP, Flags: FlagOut})
+
+	for _, workers := range []int{1, 2, 4, 8} {
+		b.Run(fmt.Sprintf("workers=%d", workers), func(b *testing.B) {
+			s := &CGroup{workers: workers, queueSize: 4096}
+			s.pkts = &fakeReader{raw: raw, cpus: 8, n: b.N}
+
+			var handled uint64
+			b.ReportAllocs()
+			b.ResetTimer()
+
+			start := time.Now()
+			s.Watch(func(pkt Packet) {
+				var h uint64
+				for i := 0; i < 64; i++ {
+					h = h*31 + uint64(pkt.SrcIP[i%16]) + uint64(pkt.Len)
+				}
+				if h != 0 {
+					atomic.AddUint64(&handled, 1)
+				}
+			}, func(uint64) {})
+
+			b.StopTimer()
+			if got := atomic.LoadUint64(&handled); got != uint64(b.N) {
+				b.Fatalf("expected %d packets, got %d", b.N, got)
+			}
+			perSec := float64(b.N) / time.Since(start).Seconds()
+			b.ReportMetric(perSec/float64(workers), "pkts/s/worker")
+			b.ReportMetric(perSec, "pkts/s")
+		})
+	}
+}
@@ -0,0 +1,187 @@
+package pcap
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+
+	"github.com/nrwiersma/ebpf/packet"
+)
+
+const (
+	etherTypeIPv4 = 0x0800
+	etherTypeIPv6 = 0x86dd
+	etherTypeVLAN = 0x8100
+	etherTypeQinQ = 0x88a8
+
+	protoTCP = 6
+	protoUDP = 17
+
+	tcpFin = 0x01
+	tcpSyn = 0x02
+	tcpAck = 0x10
+)
+
+// errSkip is returned for frames that are not IPv4 or IPv6 TCP or UDP.
+var errSkip = errors.New("skipped frame")
+
+// segment is a decoded TCP or UDP segment.
+type segment struct {
+	pkt packet.Packet
+
+	flags uint8
+	seq   uint32
+	ack   uint32
+}
+
+// decode decodes the IP packet of a frame of the link type.
+func decode(link uint16, data []byte) (segment, error) {
+	var etherType uint16
+	switch link {
+	case linkEthernet:
+		if len(data) < 14 {
+			return segment{}, errors.New("truncated ethernet header")
+		}
+		etherType, data = binary.BigEndian.Uint16(data[12:]), data[14:]
+		for etherType == etherTypeVLAN || etherType == etherTypeQinQ {
+			if len(data) < 4 {
+				return segment{}, errors.New("truncated vlan header")
+			}
+			etherType, data = binary.BigEndian.Uint16(data[2:]), data[4:]
+		}
+	case linkSLL:
+		if len(data) < 16 {
+			return segment{}, errors.New("truncated linux cooked header")
+		}
+		etherType, data = binary.BigEndian.Uint16(data[14:]), data[16:]
+	case linkSLL2:
+		if len(data) < 20 {
+			return segment{}, errors.New("truncated linux cooked header")
+		}
+		etherType, data = binary.BigEndian.Uint16(data[0:]), data[20:]
+	case linkNull, linkLoop:
+		// The address family is in the byte order of the capturing host,
+		// so the IP version is taken from the packet instead.
+		if len(data) < 4 {
+			return segment{}, errors.New("truncated loopback header")
+		}
+		data = data[4:]
+	case linkRaw, linkIPv4, linkIPv6:
+	default:
+		return segment{}, fmt.Errorf("unsupported link type %d", link)
+	}
+
+	if etherType == 0 && len(data) > 0 {
+		switch data[0] >> 4 {
+		case 4:
+			etherType = etherTypeIPv4
+		case 6:
+			etherType = etherTypeIPv6
+		}
+	}
+
+	switch etherType {
+	case etherTypeIPv4:
+		return decodeIPv4(data)
+	case etherTypeIPv6:
+		return decodeIPv6(data)
+	default:
+		return segment{}, errSkip
+	}
+}
+
+func decodeIPv4(data []byte) (segment, error) {
+	if len(data) < 20 {
+		return segment{}, errors.New("truncated ipv4 header")
+	}
+	hdrLen := int(data[0]&0x0f) << 2
+	total := int(binary.BigEndian.Uint16(data[2:]))
+	if hdrLen < 20 || total < hdrLen || len(data) < hdrLen {
+		return segment{}, errors.New("invalid ipv4 header")
+	}
+	// Only the first fragment carries the transport header.
+	if binary.BigEndian.Uint16(data[6:])&0x1fff != 0 {
+		return segment{}, errSkip
+	}
+
+	var seg segment
+	// Addresses are IPv4-mapped, as the programs store them.
+	seg.pkt.SrcIP[10], seg.pkt.SrcIP[11] = 0xff, 0xff
+	seg.pkt.DestIP[10], seg.pkt.DestIP[11] = 0xff, 0xff
+	copy(seg.pkt.SrcIP[12:], data[12:16])
+	copy(seg.pkt.DestIP[12:], data[16:20])
+
+	return decodeTransport(seg, data[9], data[hdrLen:], total-hdrLen)
+}
+
+func decodeIPv6(data []byte) (segment, error) {
+	if len(data) < 40 {
+		return segment{}, errors.New("truncated ipv6 header")
+	}
+
+	var seg segment
+	copy(seg.pkt.SrcIP[:], data[8:24])
+	copy(seg.pkt.DestIP[:], data[24:40])
+
+	next, length := data[6], int(binary.BigEndian.Uint16(data[4:]))
+	data = data[40:]
+
+	// Walk the extension headers to the transport header.
+	for {
+		switch next {
+		case 0, 43, 60:
+			if len(data) < 8 {
+				return segment{}, errors.New("truncated ipv6 extension header")
+			}
+			n := (int(data[1]) + 1) << 3
+			if len(data) < n || length < n {
+				return segment{}, errors.New("truncated ipv6 extension header")
+			}
+			next, data, length = data[0], data[n:], length-n
+			continue
+		case 44:
+			if len(data) < 8 || length < 8 {
+				return segment{}, errors.New("truncated ipv6 fragment header")
+			}
+			if binary.BigEndian.Uint16(data[2:])&0xfff8 != 0 {
+				return segment{}, errSkip
+			}
+			next, data, length = data[0], data[8:], length-8
+			continue
+		}
+		return decodeTransport(seg, next, data, length)
+	}
+}
+
+// decodeTransport decodes the TCP or UDP header. The payload length is
+// taken from the IP header, as captures may be truncated.
+func decodeTransport(seg segment, proto uint8, data []byte, length int) (segment, error) {
+	switch proto {
+	case protoTCP:
+		if len(data) < 20 {
+			return segment{}, errors.New("truncated tcp header")
+		}
+		hdrLen := int(data[12]>>4) << 2
+		if hdrLen < 20 || length < hdrLen {
+			return segment{}, errors.New("invalid tcp header")
+		}
+		seg.pkt.Proto = packet.ProtoTCP
+		seg.pkt.SrcPort = binary.BigEndian.Uint16(data[0:])
+		seg.pkt.DestPort = binary.BigEndian.Uint16(data[2:])
+		seg.pkt.Len = uint32(length - hdrLen)
+		seg.seq = binary.BigEndian.Uint32(data[4:])
+		seg.ack = binary.BigEndian.Uint32(data[8:])
+		seg.flags = data[13]
+	case protoUDP:
+		if len(data) < 8 || length < 8 {
+			return segment{}, errors.New("truncated udp header")
+		}
+		seg.pkt.Proto = packet.ProtoUDP
+		seg.pkt.SrcPort = binary.BigEndian.Uint16(data[0:])
+		seg.pkt.DestPort = binary.BigEndian.Uint16(data[2:])
+		seg.pkt.Len = uint32(length - 8)
+	default:
+		return segment{}, errSkip
+	}
+	return seg, nil
+}
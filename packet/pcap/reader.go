@@ -0,0 +1,278 @@
+package pcap
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+)
+
+// Link types of the frames in a capture.
+const (
+	linkNull     = 0
+	linkEthernet = 1
+	linkRaw      = 101
+	linkLoop     = 108
+	linkSLL      = 113
+	linkIPv4     = 228
+	linkIPv6     = 229
+	linkSLL2     = 276
+)
+
+const (
+	pcapMagicMicro = 0xa1b2c3d4
+	pcapMagicNano  = 0xa1b23c4d
+
+	ngSectionHeader   = 0x0a0d0d0a
+	ngInterfaceDesc   = 0x00000001
+	ngEnhancedPacket  = 0x00000006
+	ngByteOrderMagic  = 0x1a2b3c4d
+	ngOptEnd          = 0
+	ngOptIfTSResol    = 9
+	ngDefaultTSResol  = 6
+	maxBlockSize      = 16 << 20
+	maxCapturedLength = 256 << 10
+)
+
+// frame is a captured frame.
+type frame struct {
+	ts   time.Time
+	link uint16
+	data []byte
+}
+
+// reader reads the frames of a capture.
+type reader interface {
+	next() (frame, error)
+}
+
+// newReader returns a reader of a pcap or pcapng capture,
+// detected from its magic.
+func newReader(r io.Reader) (reader, error) {
+	br := bufio.NewReader(r)
+	b, err := br.Peek(4)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read capture header: %w", err)
+	}
+
+	switch {
+	case binary.BigEndian.Uint32(b) == ngSectionHeader:
+		return &ngReader{r: br}, nil
+	case binary.LittleEndian.Uint32(b) == pcapMagicMicro, binary.LittleEndian.Uint32(b) == pcapMagicNano:
+		return newPcapReader(br, binary.LittleEndian)
+	case binary.BigEndian.Uint32(b) == pcapMagicMicro, binary.BigEndian.Uint32(b) == pcapMagicNano:
+		return newPcapReader(br, binary.BigEndian)
+	default:
+		return nil, errors.New("unknown capture format, expected pcap or pcapng")
+	}
+}
+
+// pcapReader reads the classic pcap format.
+type pcapReader struct {
+	r    io.Reader
+	bo   binary.ByteOrder
+	nano bool
+	link uint16
+}
+
+func newPcapReader(r io.Reader, bo binary.ByteOrder) (*pcapReader, error) {
+	hdr := make([]byte, 24)
+	if _, err := io.ReadFull(r, hdr); err != nil {
+		return nil, fmt.Errorf("unable to read pcap header: %w", err)
+	}
+
+	return &pcapReader{
+		r:    r,
+		bo:   bo,
+		nano: bo.Uint32(hdr[0:]) == pcapMagicNano,
+		link: uint16(bo.Uint32(hdr[20:])),
+	}, nil
+}
+
+func (r *pcapReader) next() (frame, error) {
+	hdr := make([]byte, 16)
+	if _, err := io.ReadFull(r.r, hdr); err != nil {
+		if errors.Is(err, io.ErrUnexpectedEOF) {
+			return frame{}, errors.New("truncated pcap record header")
+		}
+		return frame{}, err
+	}
+
+	sec, frac := int64(r.bo.Uint32(hdr[0:])), int64(r.bo.Uint32(hdr[4:]))
+	if !r.nano {
+		frac *= int64(time.Microsecond)
+	}
+	n := r.bo.Uint32(hdr[8:])
+	if n > maxCapturedLength {
+		return frame{}, fmt.Errorf("pcap record of %d bytes is too large", n)
+	}
+
+	data := make([]byte, n)
+	if _, err := io.ReadFull(r.r, data); err != nil {
+		return frame{}, fmt.Errorf("truncated pcap record: %w", err)
+	}
+	return frame{ts: time.Unix(sec, frac), link: r.link, data: data}, nil
+}
+
+// ngInterface is an interface of a pcapng section.
+type ngInterface struct {
+	link uint16
+	// Timestamps are in units of 10^-exp seconds,
+	// or 2^-exp seconds in base 2.
+	base2 bool
+	exp   uint
+}
+
+// time returns the time of the timestamp ticks.
+func (i ngInterface) time(ticks uint64) time.Time {
+	if i.base2 {
+		sec, frac := ticks>>i.exp, ticks&(1<<i.exp-1)
+		return time.Unix(int64(sec), int64(float64(frac)/float64(uint64(1)<<i.exp)*1e9))
+	}
+
+	div := pow10(i.exp)
+	sec, frac := ticks/div, ticks%div
+	if i.exp <= 9 {
+		frac *= pow10(9 - i.exp)
+	} else {
+		frac /= pow10(i.exp - 9)
+	}
+	return time.Unix(int64(sec), int64(frac))
+}
+
+func pow10(n uint) uint64 {
+	v := uint64(1)
+	for ; n > 0; n-- {
+		v *= 10
+	}
+	return v
+}
+
+// ngReader reads the pcapng format. Blocks other than the section
+// header, interface description and enhanced packet are skipped.
+type ngReader struct {
+	r      io.Reader
+	bo     binary.ByteOrder
+	ifaces []ngInterface
+}
+
+func (r *ngReader) next() (frame, error) {
+	for {
+		typ, body, err := r.block()
+		if err != nil {
+			return frame{}, err
+		}
+
+		switch typ {
+		case ngSectionHeader:
+			// Interfaces are scoped to their section.
+			r.ifaces = r.ifaces[:0]
+		case ngInterfaceDesc:
+			if len(body) < 8 {
+				return frame{}, errors.New("truncated pcapng interface description")
+			}
+			iface := ngInterface{
+				link: r.bo.Uint16(body[0:]),
+				exp:  ngDefaultTSResol,
+			}
+			if resol, ok := r.option(body[8:], ngOptIfTSResol); ok && len(resol) > 0 {
+				iface.base2 = resol[0]&0x80 != 0
+				iface.exp = uint(resol[0] & 0x7f)
+			}
+			if (iface.base2 && iface.exp > 63) || (!iface.base2 && iface.exp > 19) {
+				return frame{}, fmt.Errorf("unsupported pcapng timestamp resolution %#x", iface.exp)
+			}
+			r.ifaces = append(r.ifaces, iface)
+		case ngEnhancedPacket:
+			if len(body) < 20 {
+				return frame{}, errors.New("truncated pcapng packet")
+			}
+			id := r.bo.Uint32(body[0:])
+			if int(id) >= len(r.ifaces) {
+				return frame{}, fmt.Errorf("pcapng packet of unknown interface %d", id)
+			}
+			iface := r.ifaces[id]
+
+			ticks := uint64(r.bo.Uint32(body[4:]))<<32 | uint64(r.bo.Uint32(body[8:]))
+			n := r.bo.Uint32(body[12:])
+			if int(n) > len(body)-20 {
+				return frame{}, errors.New("truncated pcapng packet data")
+			}
+
+			return frame{
+				ts:   iface.time(ticks),
+				link: iface.link,
+				data: body[20 : 20+n],
+			}, nil
+		}
+	}
+}
+
+// block reads the next block, returning its type and body.
+func (r *ngReader) block() (uint32, []byte, error) {
+	hdr := make([]byte, 8)
+	if _, err := io.ReadFull(r.r, hdr); err != nil {
+		if errors.Is(err, io.ErrUnexpectedEOF) {
+			return 0, nil, errors.New("truncated pcapng block header")
+		}
+		return 0, nil, err
+	}
+
+	// The section header determines the byte order of its blocks,
+	// including its own length.
+	typ := binary.BigEndian.Uint32(hdr)
+	if typ == ngSectionHeader {
+		magic := make([]byte, 4)
+		if _, err := io.ReadFull(r.r, magic); err != nil {
+			return 0, nil, errors.New("truncated pcapng section header")
+		}
+		switch {
+		case binary.LittleEndian.Uint32(magic) == ngByteOrderMagic:
+			r.bo = binary.LittleEndian
+		case binary.BigEndian.Uint32(magic) == ngByteOrderMagic:
+			r.bo = binary.BigEndian
+		default:
+			return 0, nil, errors.New("invalid pcapng byte order magic")
+		}
+		hdr = append(hdr, magic...)
+	} else if r.bo == nil {
+		return 0, nil, errors.New("pcapng block before section header")
+	} else {
+		typ = r.bo.Uint32(hdr)
+	}
+
+	size := r.bo.Uint32(hdr[4:])
+	if size < uint32(len(hdr))+4 || size%4 != 0 || size > maxBlockSize {
+		return 0, nil, fmt.Errorf("invalid pcapng block size %d", size)
+	}
+	rest := make([]byte, int(size)-len(hdr))
+	if _, err := io.ReadFull(r.r, rest); err != nil {
+		return 0, nil, fmt.Errorf("truncated pcapng block: %w", err)
+	}
+
+	// The body excludes the trailing length.
+	return typ, rest[:len(rest)-4], nil
+}
+
+// option returns the value of the option with the code.
+func (r *ngReader) option(opts []byte, code uint16) ([]byte, bool) {
+	for len(opts) >= 4 {
+		c, n := r.bo.Uint16(opts[0:]), int(r.bo.Uint16(opts[2:]))
+		if c == ngOptEnd || 4+n > len(opts) {
+			return nil, false
+		}
+		if c == code {
+			return opts[4 : 4+n], true
+		}
+
+		// Values are padded to 32 bits.
+		n = (n + 3) &^ 3
+		if 4+n > len(opts) {
+			return nil, false
+		}
+		opts = opts[4+n:]
+	}
+	return nil, false
+}
@@ -0,0 +1,337 @@
+// Package pcap implements a packet source replaying pcap and pcapng
+// captures, to run the application without root or BPF.
+package pcap
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/nrwiersma/ebpf/packet"
+)
+
+// OptsFunc represents a configuration function for the replay.
+type OptsFunc func(r *Replay)
+
+// WithSpeed configures the speed the capture is replayed at, relative
+// to the time it was captured in. It defaults to real-time. Zero or
+// less replays as fast as the packets can be handled.
+//
+// Metrics are aggregated over intervals of the wall clock, not of the
+// capture, so only real-time replays give accurate rates and intervals.
+// At other speeds, totals and RTTs are accurate, but the traffic of an
+// interval is compressed or stretched by the speed.
+func WithSpeed(speed float64) OptsFunc {
+	return func(r *Replay) {
+		r.speed = speed
+	}
+}
+
+// WithStashSize configures the number of sent packets that can wait for
+// their ACK, like the stash map of the programs. When full, the oldest
+// packet is evicted. It defaults to 4096.
+func WithStashSize(n int) OptsFunc {
+	return func(r *Replay) {
+		r.stashSize = n
+	}
+}
+
+// stashKey is the key of a stashed packet, as the programs key them.
+type stashKey struct {
+	ip   [16]byte
+	port uint16
+	seq  uint32
+}
+
+// stashed is a stashed packet. The generation tells a packet apart
+// from one stashed earlier under the same key and since acked.
+type stashed struct {
+	pkt packet.Packet
+	gen uint64
+}
+
+// stashRef is a stashed packet in the eviction order.
+type stashRef struct {
+	key stashKey
+	gen uint64
+}
+
+// Replay replays the TCP and UDP packets of a capture as the programs
+// would report them on the hosts with the local addresses. Packets from
+// a local address are sent, packets to a local address are received.
+// Packets between local addresses are both.
+type Replay struct {
+	path      string
+	local     map[[16]byte]bool
+	speed     float64
+	stashSize int
+
+	stash map[stashKey]stashed
+	order []stashRef
+	gen   uint64
+
+	mu   sync.Mutex
+	atch map[string]string
+	err  error
+
+	doneCh chan struct{}
+	closed chan struct{}
+	once   sync.Once
+}
+
+// New returns a replay of the capture at the path.
+func New(path string, local []net.IP, opts ...OptsFunc) (*Replay, error) {
+	r := &Replay{
+		path:      path,
+		local:     make(map[[16]byte]bool, len(local)),
+		speed:     1,
+		stashSize: 4096,
+		stash:     map[stashKey]stashed{},
+		atch:      map[string]string{},
+		doneCh:    make(chan struct{}),
+		closed:    make(chan struct{}),
+	}
+
+	for _, opt := range opts {
+		opt(r)
+	}
+
+	if len(local) == 0 {
+		return nil, errors.New("at least one local address is required")
+	}
+	for _, ip := range local {
+		var b [16]byte
+		if copy(b[:], ip.To16()) != net.IPv6len {
+			return nil, fmt.Errorf("invalid local address %q", ip)
+		}
+		r.local[b] = true
+	}
+	if r.stashSize < 1 {
+		return nil, errors.New("stash size must be positive")
+	}
+
+	// Fail early on files that are not captures.
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("unable to open capture: %w", err)
+	}
+	defer func() { _ = f.Close() }()
+	if _, err = newReader(f); err != nil {
+		return nil, err
+	}
+
+	return r, nil
+}
+
+// AttachContainer records the container as attached.
+func (r *Replay) AttachContainer(name, path string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.atch[name] = path
+	return nil
+}
+
+// DetachContainer records the container as detached.
+func (r *Replay) DetachContainer(name string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	delete(r.atch, name)
+	return nil
+}
+
+// Attached returns the number of attached containers.
+func (r *Replay) Attached() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return len(r.atch)
+}
+
+// Watch replays the capture until it ends or the replay is closed.
+// Packets are replayed in order on the calling goroutine. Nothing
+// is lost in a replay, so lostFn is never called.
+func (r *Replay) Watch(pktFn func(pkt packet.Packet), lostFn func(cnt uint64)) {
+	defer close(r.doneCh)
+
+	if err := r.replay(pktFn); err != nil {
+		r.mu.Lock()
+		r.err = err
+		r.mu.Unlock()
+	}
+}
+
+// Done returns a channel that is closed when the replay has ended.
+func (r *Replay) Done() <-chan struct{} {
+	return r.doneCh
+}
+
+// Err returns the error the replay ended with, if any.
+func (r *Replay) Err() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return r.err
+}
+
+func (r *Replay) replay(pktFn func(pkt packet.Packet)) error {
+	f, err := os.Open(r.path)
+	if err != nil {
+		return fmt.Errorf("unable to open capture: %w", err)
+	}
+	defer func() { _ = f.Close() }()
+
+	rd, err := newReader(f)
+	if err != nil {
+		return err
+	}
+
+	var (
+		first time.Time
+		start time.Time
+	)
+	timer := time.NewTimer(0)
+	defer timer.Stop()
+
+	for {
+		fr, err := rd.next()
+		if err != nil {
+			if errors.Is(err, io.EOF) {
+				return nil
+			}
+			return err
+		}
+
+		seg, err := decode(fr.link, fr.data)
+		if err != nil {
+			// Frames that do not decode are not seen by the programs either.
+			continue
+		}
+
+		if r.speed > 0 {
+			if first.IsZero() {
+				first, start = fr.ts, time.Now()
+			}
+			wait := time.Until(start.Add(time.Duration(float64(fr.ts.Sub(first)) / r.speed)))
+			if wait > 0 {
+				if !timer.Stop() {
+					select {
+					case <-timer.C:
+					default:
+					}
+				}
+				timer.Reset(wait)
+				select {
+				case <-r.closed:
+					return nil
+				case <-timer.C:
+				}
+			}
+		}
+
+		select {
+		case <-r.closed:
+			return nil
+		default:
+		}
+
+		seg.pkt.Timestamp = uint64(fr.ts.UnixNano())
+		seg.pkt.SampleRate = 1
+		if r.local[seg.pkt.SrcIP] {
+			r.process(seg, packet.FlagOut, pktFn)
+		}
+		if r.local[seg.pkt.DestIP] {
+			r.process(seg, packet.FlagIn, pktFn)
+		}
+	}
+}
+
+// process reports the segment as the programs would in the direction.
+// Sent packets are stashed until the received ACK of their sequence,
+// from which the RTT is computed.
+func (r *Replay) process(seg segment, dir uint16, pktFn func(pkt packet.Packet)) {
+	pkt := seg.pkt
+	pkt.Flags = dir
+
+	if pkt.Proto == packet.ProtoUDP {
+		if pkt.Len != 0 {
+			pktFn(pkt)
+		}
+		return
+	}
+
+	if seg.flags&(tcpSyn|tcpFin) != 0 {
+		return
+	}
+
+	if pkt.Len != 0 {
+		switch dir {
+		case packet.FlagOut:
+			r.put(stashKey{ip: pkt.SrcIP, port: pkt.SrcPort, seq: seg.ack}, pkt)
+		case packet.FlagIn:
+			pktFn(pkt)
+		}
+	}
+
+	if dir == packet.FlagIn && seg.flags&tcpAck != 0 {
+		key := stashKey{ip: pkt.DestIP, port: pkt.DestPort, seq: seg.seq}
+		if e, ok := r.stash[key]; ok {
+			delete(r.stash, key)
+
+			found := e.pkt
+			found.RTT = uint32(pkt.Timestamp - found.Timestamp)
+			found.Timestamp = pkt.Timestamp
+			pktFn(found)
+		}
+	}
+}
+
+// put stashes the packet, evicting the oldest packets when full.
+func (r *Replay) put(key stashKey, pkt packet.Packet) {
+	if e, ok := r.stash[key]; ok {
+		e.pkt = pkt
+		r.stash[key] = e
+		return
+	}
+
+	for len(r.stash) >= r.stashSize && len(r.order) > 0 {
+		ref := r.order[0]
+		r.order = r.order[1:]
+		if r.current(ref) {
+			delete(r.stash, ref.key)
+		}
+	}
+	r.gen++
+	r.stash[key] = stashed{pkt: pkt, gen: r.gen}
+	r.order = append(r.order, stashRef{key: key, gen: r.gen})
+
+	// Drop the refs of acked packets, so the order does not grow unbounded.
+	if len(r.order) > 2*r.stashSize {
+		order := make([]stashRef, 0, len(r.stash))
+		for _, ref := range r.order {
+			if r.current(ref) {
+				order = append(order, ref)
+			}
+		}
+		r.order = order
+	}
+}
+
+// current reports if the ref is to the packet stashed under its key,
+// rather than to one that was acked since.
+func (r *Replay) current(ref stashRef) bool {
+	e, ok := r.stash[ref.key]
+	return ok && e.gen == ref.gen
+}
+
+// Close stops the replay.
+func (r *Replay) Close() error {
+	r.once.Do(func() { close(r.closed) })
+
+	return nil
+}
@@ -0,0 +1,164 @@
+package pcap
+
+import (
+	"flag"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/nrwiersma/ebpf/packet"
+)
+
+var update = flag.Bool("update", false, "Update the golden files.")
+
+func TestReplay_Golden(t *testing.T) {
+	tests := []struct {
+		name    string
+		file    string
+		local   []string
+		wantErr string
+	}{
+		{
+			name:  "vlan tagged ethernet",
+			file:  "vlan.pcap",
+			local: []string{"10.0.0.1"},
+		},
+		{
+			name:  "linux cooked v2",
+			file:  "sll2.pcapng",
+			local: []string{"10.0.0.1"},
+		},
+		{
+			name:  "ipv6 extension headers",
+			file:  "ipv6-ext.pcapng",
+			local: []string{"fd00::1"},
+		},
+		{
+			name:    "truncated block",
+			file:    "truncated.pcapng",
+			local:   []string{"10.0.0.1"},
+			wantErr: "truncated pcapng block",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var local []net.IP
+			for _, ip := range test.local {
+				local = append(local, net.ParseIP(ip))
+			}
+
+			r, err := New(filepath.Join("testdata", test.file), local, WithSpeed(0))
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			defer func() { _ = r.Close() }()
+
+			var sb strings.Builder
+			r.Watch(func(pkt packet.Packet) {
+				sb.WriteString(formatPacket(pkt))
+				sb.WriteByte('\n')
+			}, func(uint64) {
+				t.Error("unexpected lost packets")
+			})
+
+			err = r.Err()
+			if test.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), test.wantErr) {
+					t.Errorf("expected error containing %q, got %v", test.wantErr, err)
+				}
+			} else if err != nil {
+				t.Errorf("unexpected error: %v", err)
+			}
+
+			golden := filepath.Join("testdata", test.file+".golden")
+			if *update {
+				if err = os.WriteFile(golden, []byte(sb.String()), 0644); err != nil {
+					t.Fatalf("unable to update golden file: %v", err)
+				}
+			}
+			want, err := os.ReadFile(golden)
+			if err != nil {
+				t.Fatalf("unable to read golden file: %v", err)
+			}
+			if got := sb.String(); got != string(want) {
+				t.Errorf("unexpected packets:\ngot:\n%s\nwant:\n%s", got, want)
+			}
+		})
+	}
+}
+
+func TestReplay_StashEvictsOldest(t *testing.T) {
+	r := &Replay{stashSize: 2, stash: map[stashKey]stashed{}}
+
+	for seq := uint32(1); seq <= 3; seq++ {
+		r.put(stashKey{port: 80, seq: seq}, packet.Packet{Len: seq})
+	}
+
+	if len(r.stash) != 2 {
+		t.Fatalf("expected 2 stashed packets, got %d", len(r.stash))
+	}
+	if _, ok := r.stash[stashKey{port: 80, seq: 1}]; ok {
+		t.Error("expected the oldest packet to be evicted")
+	}
+}
+
+func TestReplay_StashKeepsRestashedPackets(t *testing.T) {
+	r := &Replay{stashSize: 2, stash: map[stashKey]stashed{}}
+	key := func(seq uint32) stashKey { return stashKey{port: 80, seq: seq} }
+
+	r.put(key(1), packet.Packet{Len: 1})
+	r.put(key(2), packet.Packet{Len: 2})
+	// The first packet is acked, and a new packet is stashed under its key.
+	delete(r.stash, key(1))
+	r.put(key(1), packet.Packet{Len: 10})
+
+	r.put(key(3), packet.Packet{Len: 3})
+
+	if _, ok := r.stash[key(2)]; ok {
+		t.Error("expected the oldest packet to be evicted")
+	}
+	if e, ok := r.stash[key(1)]; !ok || e.pkt.Len != 10 {
+		t.Errorf("expected the restashed packet to be kept, got %+v and %t", e.pkt, ok)
+	}
+	if len(r.stash) != 2 {
+		t.Errorf("expected 2 stashed packets, got %d", len(r.stash))
+	}
+}
+
+func TestNew_RejectsUnknownFormat(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "capture")
+	if err := os.WriteFile(path, []byte("not a capture"), 0644); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	_, err := New(path, []net.IP{net.ParseIP("10.0.0.1")})
+
+	if err == nil {
+		t.Fatal("expected an error")
+	}
+}
+
+// formatPacket formats the packet as a line of a golden file.
+func formatPacket(pkt packet.Packet) string {
+	dir := "in"
+	if pkt.Flags == packet.FlagOut {
+		dir = "out"
+	}
+	proto := "udp"
+	if pkt.Proto == packet.ProtoTCP {
+		proto = "tcp"
+	}
+	ts := time.Unix(0, int64(pkt.Timestamp)).UTC().Format(time.RFC3339Nano)
+
+	return fmt.Sprintf("%s %s %s %s -> %s len=%d rtt=%s rate=%d",
+		ts, dir, proto,
+		net.JoinHostPort(net.IP(pkt.SrcIP[:]).String(), fmt.Sprint(pkt.SrcPort)),
+		net.JoinHostPort(net.IP(pkt.DestIP[:]).String(), fmt.Sprint(pkt.DestPort)),
+		pkt.Len, time.Duration(pkt.RTT), pkt.SampleRate,
+	)
+}
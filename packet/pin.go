@@ -0,0 +1,236 @@
+package packet
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/cilium/ebpf"
+	"github.com/cilium/ebpf/link"
+	"github.com/hashicorp/go-multierror"
+	"golang.org/x/sys/unix"
+)
+
+const (
+	// bpfFSMagic is the magic of the bpf filesystem.
+	bpfFSMagic = 0xcafe4a11
+
+	linksDir   = "links"
+	ingressExt = ".ingress"
+	egressExt  = ".egress"
+)
+
+// WithPinPath configures a directory on a bpffs the maps and container
+// links are pinned in. Pinned links and maps outlive the process, so
+// closing does not detach the containers. A new process re-adopts the
+// maps and the links of the containers it attaches to.
+//
+// Pinning requires bpf_link support, available since Linux 5.7.
+func WithPinPath(dir string) OptsFunc {
+	return func(s *CGroup) {
+		s.pinPath = dir
+	}
+}
+
+// preparePinning pins the maps of the spec by name, so
+// existing pinned maps are used instead of new ones.
+func preparePinning(dir string, spec *ebpf.CollectionSpec) error {
+	if err := checkBPFFS(dir); err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Join(dir, linksDir), 0700); err != nil {
+		return fmt.Errorf("unable to create pin directory: %w", err)
+	}
+
+	cpus, err := possibleCPUs()
+	if err != nil {
+		return err
+	}
+	for _, ms := range spec.Maps {
+		ms.Pinning = ebpf.PinByName
+		// The size of the perf array is determined on creation, which
+		// a pinned map is compared against.
+		if ms.Type == ebpf.PerfEventArray && ms.MaxEntries == 0 {
+			ms.MaxEntries = uint32(cpus)
+		}
+	}
+	return nil
+}
+
+// loadPinnedLinks loads the pinned links of the containers by name.
+// Incomplete pairs of links are removed.
+func loadPinnedLinks(dir string) (map[string][]link.Link, error) {
+	dir = filepath.Join(dir, linksDir)
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read pinned links: %w", err)
+	}
+
+	names := map[string]int{}
+	for _, e := range entries {
+		name := strings.TrimSuffix(strings.TrimSuffix(e.Name(), ingressExt), egressExt)
+		names[name]++
+	}
+
+	pinned := make(map[string][]link.Link, len(names))
+	for escaped, n := range names {
+		name, err := url.PathUnescape(escaped)
+		if n != 2 || err != nil {
+			_ = os.Remove(filepath.Join(dir, escaped+ingressExt))
+			_ = os.Remove(filepath.Join(dir, escaped+egressExt))
+			continue
+		}
+
+		in, err := link.LoadPinnedCgroup(filepath.Join(dir, escaped+ingressExt))
+		if err != nil {
+			closeLinks(pinned)
+			return nil, fmt.Errorf("unable to load pinned link of %s: %w", name, err)
+		}
+		out, err := link.LoadPinnedCgroup(filepath.Join(dir, escaped+egressExt))
+		if err != nil {
+			_ = in.Close()
+			closeLinks(pinned)
+			return nil, fmt.Errorf("unable to load pinned link of %s: %w", name, err)
+		}
+		pinned[name] = []link.Link{in, out}
+	}
+	return pinned, nil
+}
+
+func closeLinks(links map[string][]link.Link) {
+	for _, ls := range links {
+		for _, l := range ls {
+			_ = l.Close()
+		}
+	}
+}
+
+// linkPaths returns the pin paths of the ingress and egress links of the container.
+func (s *CGroup) linkPaths(name string) [2]string {
+	base := filepath.Join(s.pinPath, linksDir, url.PathEscape(name))
+	return [2]string{base + ingressExt, base + egressExt}
+}
+
+// adopt takes over the pinned links of the container, updating
+// them to the loaded programs. It must be called with the lock held.
+func (s *CGroup) adopt(name string) bool {
+	links, ok := s.pinned[name]
+	if !ok {
+		return false
+	}
+	delete(s.pinned, name)
+
+	progs := []*ebpf.Program{s.objs.Ingress, s.objs.Egress}
+	for i, l := range links {
+		if err := l.Update(progs[i]); err != nil {
+			// The links are replaced by new attachments.
+			_ = s.unpin(name, links)
+			return false
+		}
+	}
+	s.atch[name] = links
+	return true
+}
+
+// unpin removes the pins of the links and closes them, detaching them.
+func (s *CGroup) unpin(name string, links []link.Link) error {
+	var errs error
+	for i, path := range s.linkPaths(name) {
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			errs = multierror.Append(errs, fmt.Errorf("unpin container %s: %w", name, err))
+		}
+		if i < len(links) {
+			if err := links[i].Close(); err != nil {
+				errs = multierror.Append(errs, fmt.Errorf("detach to container %s: %w", name, err))
+			}
+		}
+	}
+	return errs
+}
+
+// PruneUnadopted detaches the pinned containers that have not been
+// attached to since the module was loaded, e.g. as they were removed
+// while no agent was running. It returns the number of detached containers.
+func (s *CGroup) PruneUnadopted() (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var (
+		n    int
+		errs error
+	)
+	for name, links := range s.pinned {
+		delete(s.pinned, name)
+		if err := s.unpin(name, links); err != nil {
+			errs = multierror.Append(errs, err)
+			continue
+		}
+		n++
+	}
+	return n, errs
+}
+
+// Cleanup removes the pinned maps and links in the directory,
+// detaching all pinned containers. It is used to uninstall,
+// and must not be called while an agent is running.
+func Cleanup(dir string) error {
+	if _, err := os.Stat(dir); os.IsNotExist(err) {
+		return nil
+	}
+	if err := checkBPFFS(dir); err != nil {
+		return err
+	}
+
+	// Links are detached when their last reference, the pin, is removed.
+	if err := os.RemoveAll(dir); err != nil {
+		return fmt.Errorf("unable to remove pinned objects: %w", err)
+	}
+	return nil
+}
+
+// checkBPFFS checks that the directory, or its closest
+// existing parent, is on a bpf filesystem.
+func checkBPFFS(dir string) error {
+	path := dir
+	for {
+		var st unix.Statfs_t
+		err := unix.Statfs(path, &st)
+		if err == nil {
+			if uint32(st.Type) != bpfFSMagic {
+				return fmt.Errorf("pin path %q is not on a bpf filesystem", dir)
+			}
+			return nil
+		}
+		if !errors.Is(err, unix.ENOENT) || path == filepath.Dir(path) {
+			return fmt.Errorf("unable to stat pin path %q: %w", dir, err)
+		}
+		path = filepath.Dir(path)
+	}
+}
+
+// possibleCPUs returns the number of possible CPUs.
+func possibleCPUs() (int, error) {
+	b, err := os.ReadFile("/sys/devices/system/cpu/possible")
+	if err != nil {
+		return 0, fmt.Errorf("unable to read possible cpus: %w", err)
+	}
+
+	// The format is a list of ranges, e.g. "0-7", of which
+	// the last contains the highest possible cpu.
+	str := strings.TrimSpace(string(b))
+	if idx := strings.LastIndexByte(str, ','); idx != -1 {
+		str = str[idx+1:]
+	}
+	if idx := strings.IndexByte(str, '-'); idx != -1 {
+		str = str[idx+1:]
+	}
+	last, err := strconv.Atoi(str)
+	if err != nil {
+		return 0, fmt.Errorf("unable to parse possible cpus %q: %w", string(b), err)
+	}
+	return last + 1, nil
+}
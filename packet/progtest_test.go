@@ -0,0 +1,586 @@
+package packet
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+	"unsafe"
+
+	"github.com/cilium/ebpf"
+	"github.com/nrwiersma/ebpf/bpf"
+	"golang.org/x/sys/unix"
+)
+
+// TCP flags of test packets.
+const (
+	tcpFlagFin = 1 << iota
+	tcpFlagSyn
+	tcpFlagRst
+	tcpFlagPsh
+	tcpFlagAck
+)
+
+// keep is the verdict of the programs letting a packet pass.
+const keep = 1
+
+// outputWait is how long the output of a case is collected for.
+const outputWait = 100 * time.Millisecond
+
+var (
+	testLocal = net.ParseIP("10.0.0.1")
+	testPeer  = net.ParseIP("10.0.0.2")
+)
+
+const (
+	testLocalPort = 8080
+	testPeerPort  = 40000
+)
+
+func TestPrograms(t *testing.T) {
+	pt := newProgTest(t)
+
+	tests := []struct {
+		name   string
+		filter Filter
+		steps  []progStep
+
+		// stash are the expected stashed packets after the steps.
+		stash []stashEntry
+		// output are the expected output packets, in order.
+		output []Packet
+	}{
+		{
+			name:  "egress data is stashed until acked",
+			steps: []progStep{tcpStep(FlagOut, tcpFlagAck|tcpFlagPsh, 1000, 5000, 100)},
+			stash: []stashEntry{{
+				IP:     mappedIP(testLocal),
+				Port:   testLocalPort,
+				Seq:    5000,
+				Packet: tcpOutput(FlagOut, 100, false),
+			}},
+		},
+		{
+			name: "ack outputs stashed packet with rtt",
+			steps: []progStep{
+				tcpStep(FlagOut, tcpFlagAck|tcpFlagPsh, 1000, 5000, 100),
+				tcpStep(FlagIn, tcpFlagAck, 5000, 1100, 0),
+			},
+			output: []Packet{tcpOutput(FlagOut, 100, true)},
+		},
+		{
+			name:  "unmatched ack outputs nothing",
+			steps: []progStep{tcpStep(FlagIn, tcpFlagAck, 9000, 1100, 0)},
+		},
+		{
+			name:   "ingress data is output",
+			steps:  []progStep{tcpStep(FlagIn, tcpFlagAck|tcpFlagPsh, 7000, 1, 50)},
+			output: []Packet{tcpOutput(FlagIn, 50, false)},
+		},
+		{
+			name: "ingress data acking stashed packet outputs both",
+			steps: []progStep{
+				tcpStep(FlagOut, tcpFlagAck|tcpFlagPsh, 1000, 5000, 100),
+				tcpStep(FlagIn, tcpFlagAck|tcpFlagPsh, 5000, 1100, 50),
+			},
+			output: []Packet{tcpOutput(FlagIn, 50, false), tcpOutput(FlagOut, 100, true)},
+		},
+		{
+			name:  "egress without payload is not stashed",
+			steps: []progStep{tcpStep(FlagOut, tcpFlagAck, 1000, 5000, 0)},
+		},
+		{
+			name: "syn and fin are ignored",
+			steps: []progStep{
+				tcpStep(FlagIn, tcpFlagSyn, 7000, 0, 10),
+				tcpStep(FlagOut, tcpFlagFin|tcpFlagAck, 1000, 5000, 10),
+				tcpStep(FlagIn, tcpFlagFin|tcpFlagAck, 5000, 1010, 10),
+			},
+		},
+		{
+			name: "udp is ignored",
+			steps: []progStep{{dir: FlagIn, frame: testFrame{
+				Src:      testPeer,
+				Dest:     testLocal,
+				SrcPort:  testPeerPort,
+				DestPort: testLocalPort,
+				Proto:    ProtoUDP,
+				Payload:  50,
+			}}},
+		},
+		{
+			name: "ipv6 is ignored",
+			steps: []progStep{{dir: FlagIn, frame: testFrame{
+				Src:      net.ParseIP("fd00::2"),
+				Dest:     net.ParseIP("fd00::1"),
+				SrcPort:  testPeerPort,
+				DestPort: testLocalPort,
+				Proto:    ProtoTCP,
+				TCPFlags: tcpFlagAck | tcpFlagPsh,
+				Payload:  50,
+			}}},
+		},
+		{
+			name:   "filtered port is ignored",
+			filter: Filter{Ports: []uint16{testLocalPort}},
+			steps: []progStep{
+				tcpStep(FlagOut, tcpFlagAck|tcpFlagPsh, 1000, 5000, 100),
+				tcpStep(FlagIn, tcpFlagAck|tcpFlagPsh, 7000, 1, 50),
+			},
+		},
+		{
+			name:   "filtered cidr is ignored",
+			filter: Filter{CIDRs: []*net.IPNet{{IP: testPeer.To4(), Mask: net.CIDRMask(24, 32)}}},
+			steps: []progStep{
+				tcpStep(FlagOut, tcpFlagAck|tcpFlagPsh, 1000, 5000, 100),
+				tcpStep(FlagIn, tcpFlagAck|tcpFlagPsh, 7000, 1, 50),
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			pt.Reset(t)
+			if err := pt.s.SetFilter(test.filter); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			for i, step := range test.steps {
+				if err := pt.Run(step.dir, step.frame); err != nil {
+					t.Fatalf("step %d: %v", i, err)
+				}
+			}
+
+			out, err := pt.Output(outputWait)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if len(out) != len(test.output) {
+				t.Fatalf("expected %d output packets, got %d", len(test.output), len(out))
+			}
+			for i := range out {
+				if err = comparePacket(test.output[i], out[i]); err != nil {
+					t.Errorf("output packet %d: %v", i, err)
+				}
+			}
+
+			stash, err := pt.Stash()
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if len(stash) != len(test.stash) {
+				t.Fatalf("expected %d stashed packets, got %d", len(test.stash), len(stash))
+			}
+			// The stash is a hash map, so the entries are matched by their key.
+			for _, want := range test.stash {
+				found := false
+				for _, got := range stash {
+					if got.IP != want.IP || got.Port != want.Port || got.Seq != want.Seq {
+						continue
+					}
+					found = true
+					if err = comparePacket(want.Packet, got.Packet); err != nil {
+						t.Errorf("stashed packet %v:%d/%d: %v", net.IP(want.IP[:]), want.Port, want.Seq, err)
+					}
+				}
+				if !found {
+					t.Errorf("expected stashed packet %v:%d/%d", net.IP(want.IP[:]), want.Port, want.Seq)
+				}
+			}
+		})
+	}
+}
+
+// progStep runs the program of the direction on a frame.
+type progStep struct {
+	dir   uint16
+	frame testFrame
+}
+
+// tcpStep returns a TCP step between the local and peer address.
+func tcpStep(dir uint16, flags uint8, seq, ack uint32, payload int) progStep {
+	f := testFrame{
+		Src:      testLocal,
+		Dest:     testPeer,
+		SrcPort:  testLocalPort,
+		DestPort: testPeerPort,
+		Proto:    ProtoTCP,
+		TCPFlags: flags,
+		Seq:      seq,
+		Ack:      ack,
+		Payload:  payload,
+	}
+	if dir == FlagIn {
+		f.Src, f.Dest = f.Dest, f.Src
+		f.SrcPort, f.DestPort = f.DestPort, f.SrcPort
+	}
+	return progStep{dir: dir, frame: f}
+}
+
+// tcpOutput returns the packet the programs output for a TCP step.
+func tcpOutput(dir uint16, payload uint32, rtt bool) Packet {
+	pkt := Packet{
+		SrcIP:      mappedIP(testLocal),
+		DestIP:     mappedIP(testPeer),
+		SrcPort:    testLocalPort,
+		DestPort:   testPeerPort,
+		Len:        payload,
+		Proto:      ProtoTCP,
+		Flags:      dir,
+		SampleRate: 1,
+	}
+	if dir == FlagIn {
+		pkt.SrcIP, pkt.DestIP = pkt.DestIP, pkt.SrcIP
+		pkt.SrcPort, pkt.DestPort = pkt.DestPort, pkt.SrcPort
+	}
+	if rtt {
+		pkt.RTT = 1
+	}
+	return pkt
+}
+
+// mappedIP returns the IPv4-mapped address, as the programs store them.
+func mappedIP(ip net.IP) [16]byte {
+	var b [16]byte
+	copy(b[:], ip.To16())
+	return b
+}
+
+// comparePacket compares the packets, checking the timestamp
+// is set and the rtt is set only if expected. Timestamps and
+// RTTs differ between runs.
+func comparePacket(want, got Packet) error {
+	if got.Timestamp == 0 {
+		return fmt.Errorf("expected timestamp, got none in %+v", got)
+	}
+	if (want.RTT != 0) != (got.RTT != 0) {
+		return fmt.Errorf("expected rtt to be set %t, got %d", want.RTT != 0, got.RTT)
+	}
+	got.Timestamp, want.Timestamp = 0, 0
+	got.RTT, want.RTT = 0, 0
+
+	if !reflect.DeepEqual(want, got) {
+		return fmt.Errorf("expected %+v, got %+v", want, got)
+	}
+	return nil
+}
+
+// testFrame is a synthetic packet the programs are run on.
+type testFrame struct {
+	// Src and Dest are both IPv4 or both IPv6 addresses.
+	Src      net.IP
+	Dest     net.IP
+	SrcPort  uint16
+	DestPort uint16
+	// Proto is either ProtoTCP or ProtoUDP.
+	Proto uint16
+
+	// TCPFlags, Seq and Ack are set on TCP packets.
+	TCPFlags uint8
+	Seq      uint32
+	Ack      uint32
+
+	// Payload is the number of payload bytes.
+	Payload int
+}
+
+// Marshal returns the packet as an ethernet frame, as taken by
+// BPF_PROG_TEST_RUN. Checksums other than of the IPv4 header
+// are not set, as they are not verified.
+func (p testFrame) Marshal() ([]byte, error) {
+	var (
+		l4    []byte
+		proto uint8
+	)
+	switch p.Proto {
+	case ProtoTCP:
+		proto = 6
+		l4 = make([]byte, 20+p.Payload)
+		binary.BigEndian.PutUint16(l4[0:], p.SrcPort)
+		binary.BigEndian.PutUint16(l4[2:], p.DestPort)
+		binary.BigEndian.PutUint32(l4[4:], p.Seq)
+		binary.BigEndian.PutUint32(l4[8:], p.Ack)
+		l4[12] = 5 << 4
+		l4[13] = p.TCPFlags
+		binary.BigEndian.PutUint16(l4[14:], 0xffff)
+	case ProtoUDP:
+		proto = 17
+		l4 = make([]byte, 8+p.Payload)
+		binary.BigEndian.PutUint16(l4[0:], p.SrcPort)
+		binary.BigEndian.PutUint16(l4[2:], p.DestPort)
+		binary.BigEndian.PutUint16(l4[4:], uint16(len(l4)))
+	default:
+		return nil, fmt.Errorf("unknown protocol %d", p.Proto)
+	}
+
+	var (
+		ethType uint16
+		l3      []byte
+	)
+	src4, dest4 := p.Src.To4(), p.Dest.To4()
+	switch {
+	case src4 != nil && dest4 != nil:
+		ethType = 0x0800
+		l3 = make([]byte, 20)
+		l3[0] = 4<<4 | 5
+		binary.BigEndian.PutUint16(l3[2:], uint16(len(l3)+len(l4)))
+		l3[8] = 64
+		l3[9] = proto
+		copy(l3[12:], src4)
+		copy(l3[16:], dest4)
+		binary.BigEndian.PutUint16(l3[10:], ipChecksum(l3))
+	case src4 == nil && dest4 == nil && len(p.Src) == net.IPv6len && len(p.Dest) == net.IPv6len:
+		ethType = 0x86dd
+		l3 = make([]byte, 40)
+		l3[0] = 6 << 4
+		binary.BigEndian.PutUint16(l3[4:], uint16(len(l4)))
+		l3[6] = proto
+		l3[7] = 64
+		copy(l3[8:], p.Src)
+		copy(l3[24:], p.Dest)
+	default:
+		return nil, fmt.Errorf("addresses %s and %s are not of the same family", p.Src, p.Dest)
+	}
+
+	frame := make([]byte, 14, 14+len(l3)+len(l4))
+	binary.BigEndian.PutUint16(frame[12:], ethType)
+	return append(append(frame, l3...), l4...), nil
+}
+
+func ipChecksum(hdr []byte) uint16 {
+	var sum uint32
+	for i := 0; i < len(hdr); i += 2 {
+		sum += uint32(binary.BigEndian.Uint16(hdr[i:]))
+	}
+	for sum > 0xffff {
+		sum = sum>>16 + sum&0xffff
+	}
+	return ^uint16(sum)
+}
+
+// stashEntry is a packet stashed until its ACK is received.
+type stashEntry struct {
+	IP     [16]byte
+	Port   uint16
+	Seq    uint32
+	Packet Packet
+}
+
+// progTest runs the programs of the module on synthetic packets with
+// BPF_PROG_TEST_RUN, without attaching them, exposing what ends up in
+// the stash and the perf output.
+type progTest struct {
+	s    *CGroup
+	out  chan Packet
+	lost uint64
+}
+
+// newProgTest loads the module to run its programs on test packets.
+// The test is skipped without the privileges to load BPF programs,
+// or when the programs are not built.
+func newProgTest(t *testing.T) *progTest {
+	t.Helper()
+
+	if len(bpf.MetricsSock) == 0 || len(bpf.MetricsSockCompat) == 0 {
+		t.Skip("program objects are not built")
+	}
+	if !canLoadBPF() {
+		t.Skip("requires root or CAP_BPF")
+	}
+
+	memlockLimit := &unix.Rlimit{Cur: unix.RLIM_INFINITY, Max: unix.RLIM_INFINITY}
+	if err := unix.Setrlimit(unix.RLIMIT_MEMLOCK, memlockLimit); err != nil {
+		t.Fatalf("unable to raise memlock limit: %v", err)
+	}
+
+	// Packets are output in the order the programs emit them.
+	s, err := NewCGroup(WithWorkers(1))
+	if err != nil {
+		t.Fatalf("unable to load module: %v", err)
+	}
+	t.Logf("detected kernel features: %v", s.Features().Fields())
+
+	pt := &progTest{
+		s:   s,
+		out: make(chan Packet, 1024),
+	}
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+
+		s.Watch(func(pkt Packet) {
+			pt.out <- pkt
+		}, func(cnt uint64) {
+			atomic.AddUint64(&pt.lost, cnt)
+		})
+	}()
+	t.Cleanup(func() {
+		_ = s.Close()
+		<-done
+	})
+
+	return pt
+}
+
+// Run runs the program of the direction, either FlagIn or
+// FlagOut, on the frame, failing if it is not kept.
+func (t *progTest) Run(dir uint16, f testFrame) error {
+	var prog *ebpf.Program
+	switch dir {
+	case FlagIn:
+		prog = t.s.objs.Ingress
+	case FlagOut:
+		prog = t.s.objs.Egress
+	default:
+		return fmt.Errorf("unknown direction %d", dir)
+	}
+
+	data, err := f.Marshal()
+	if err != nil {
+		return err
+	}
+	ret, _, err := prog.Test(data)
+	if err != nil {
+		return err
+	}
+	if ret != keep {
+		return fmt.Errorf("program returned %d, packets must be kept", ret)
+	}
+	return nil
+}
+
+// Output returns the packets output by the programs within the wait.
+func (t *progTest) Output(wait time.Duration) ([]Packet, error) {
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+
+	var pkts []Packet
+	for {
+		select {
+		case pkt := <-t.out:
+			pkts = append(pkts, pkt)
+		case <-timer.C:
+			// Take the packets that were output in time, but not yet received.
+			for len(t.out) > 0 {
+				pkts = append(pkts, <-t.out)
+			}
+			if lost := atomic.SwapUint64(&t.lost, 0); lost > 0 {
+				return pkts, fmt.Errorf("lost %d samples", lost)
+			}
+			return pkts, nil
+		}
+	}
+}
+
+// Stash returns the packets stashed until their ACK is received.
+func (t *progTest) Stash() ([]stashEntry, error) {
+	var (
+		entries []stashEntry
+		key     []byte
+	)
+	for {
+		next, err := t.s.objs.Stash.NextKeyBytes(key)
+		if err != nil {
+			return nil, fmt.Errorf("unable to iterate stash: %w", err)
+		}
+		if next == nil {
+			return entries, nil
+		}
+		key = next
+
+		val, err := t.s.objs.Stash.LookupBytes(key)
+		if err != nil {
+			return nil, fmt.Errorf("unable to read stash: %w", err)
+		}
+		if len(key) != int(unsafe.Sizeof(bpf.StashTuple{})) || val == nil {
+			return nil, errors.New("unexpected stash entry")
+		}
+
+		var tuple bpf.StashTuple
+		copy((*[unsafe.Sizeof(bpf.StashTuple{})]byte)(unsafe.Pointer(&tuple))[:], key)
+		pkt, err := decodePacket(val)
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, stashEntry{
+			IP:     tuple.IP,
+			Port:   tuple.Port,
+			Seq:    tuple.Seq,
+			Packet: pkt,
+		})
+	}
+}
+
+// Reset empties the stash, filter and output, and resets the
+// sample rates, so cases do not depend on previous cases.
+func (t *progTest) Reset(tb testing.TB) {
+	tb.Helper()
+
+	for {
+		key, err := t.s.objs.Stash.NextKeyBytes(nil)
+		if err != nil {
+			tb.Fatalf("unable to iterate stash: %v", err)
+		}
+		if key == nil {
+			break
+		}
+		if err = t.s.objs.Stash.Delete(key); err != nil && !errors.Is(err, ebpf.ErrKeyNotExist) {
+			tb.Fatalf("unable to empty stash: %v", err)
+		}
+	}
+
+	if err := t.s.SetFilter(Filter{}); err != nil {
+		tb.Fatalf("unexpected error: %v", err)
+	}
+	for _, dir := range []uint16{FlagIn, FlagOut} {
+		if err := t.s.SetSampleRate(dir, 1); err != nil {
+			tb.Fatalf("unexpected error: %v", err)
+		}
+	}
+
+	if _, err := t.Output(0); err != nil {
+		tb.Fatalf("unexpected error: %v", err)
+	}
+}
+
+// canLoadBPF reports if the process has the effective capabilities
+// to load BPF programs, CAP_BPF or CAP_SYS_ADMIN.
+func canLoadBPF() bool {
+	const (
+		capSysAdmin = 21
+		capBPF      = 39
+	)
+
+	if os.Geteuid() == 0 {
+		return true
+	}
+
+	f, err := os.Open("/proc/self/status")
+	if err != nil {
+		return false
+	}
+	defer func() { _ = f.Close() }()
+
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		line := sc.Text()
+		if !strings.HasPrefix(line, "CapEff:") {
+			continue
+		}
+		caps, err := strconv.ParseUint(strings.TrimSpace(strings.TrimPrefix(line, "CapEff:")), 16, 64)
+		if err != nil {
+			return false
+		}
+		return caps&(1<<capBPF) != 0 || caps&(1<<capSysAdmin) != 0
+	}
+	return false
+}
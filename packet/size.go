@@ -0,0 +1,75 @@
+package packet
+
+import (
+	"os"
+	"runtime"
+
+	"golang.org/x/sys/unix"
+)
+
+const (
+	// stashEntrySize is the approximate kernel memory of a stash
+	// entry: the key, the value and the hash table overhead.
+	stashEntrySize = 160
+
+	minStashEntries = 4 * 1024
+	maxStashEntries = 1024 * 1024
+
+	minPerfPages = 2
+	maxPerfPages = 256
+)
+
+// AutoSize returns the stash map entries and the per-CPU perf buffer
+// pages sized for the CPUs and memory of the machine.
+//
+// The stash grows with the CPUs, as each CPU stashes packets, up to 1%
+// of memory. The perf buffers take up to 0.1% of memory in total.
+func AutoSize() (stashEntries uint32, perfPages int) {
+	var mem uint64
+	var info unix.Sysinfo_t
+	if err := unix.Sysinfo(&info); err == nil {
+		mem = uint64(info.Totalram) * uint64(info.Unit)
+	}
+
+	return autoSize(runtime.NumCPU(), mem, os.Getpagesize())
+}
+
+// autoSize sizes the stash and perf buffers for the CPUs and the
+// memory in bytes. An unknown memory size of zero is not limited.
+func autoSize(cpus int, mem uint64, pageSize int) (uint32, int) {
+	stash := uint64(minStashEntries * cpus)
+	if limit := mem / 100 / stashEntrySize; mem > 0 && stash > limit {
+		stash = limit
+	}
+	stash = clamp(stash, minStashEntries, maxStashEntries)
+
+	pages := uint64(minPerfPages)
+	if mem > 0 {
+		pages = mem / 1000 / uint64(cpus) / uint64(pageSize)
+	}
+	// The kernel requires a power of two number of pages.
+	pages = clamp(floorPow2(pages), minPerfPages, maxPerfPages)
+
+	return uint32(stash), int(pages)
+}
+
+func clamp(v, lo, hi uint64) uint64 {
+	if v < lo {
+		return lo
+	}
+	if v > hi {
+		return hi
+	}
+	return v
+}
+
+func floorPow2(v uint64) uint64 {
+	if v == 0 {
+		return 0
+	}
+	p := uint64(1)
+	for p*2 <= v {
+		p *= 2
+	}
+	return p
+}
@@ -0,0 +1,60 @@
+package packet
+
+import "testing"
+
+func TestAutoSize(t *testing.T) {
+	const (
+		mib = 1 << 20
+		gib = 1 << 30
+	)
+
+	tests := []struct {
+		name      string
+		cpus      int
+		mem       uint64
+		wantStash uint32
+		wantPages int
+	}{
+		{name: "small machine", cpus: 1, mem: 512 * mib, wantStash: 4096, wantPages: 128},
+		{name: "stash grows with cpus", cpus: 4, mem: 16 * gib, wantStash: 16384, wantPages: 256},
+		{name: "stash limited by memory", cpus: 64, mem: gib, wantStash: 67108, wantPages: 4},
+		{name: "stash clamped to min", cpus: 2, mem: 32 * mib, wantStash: minStashEntries, wantPages: 4},
+		{name: "stash clamped to max", cpus: 512, mem: 4096 * gib, wantStash: maxStashEntries, wantPages: maxPerfPages},
+		{name: "pages clamped to min", cpus: 256, mem: gib, wantStash: 67108, wantPages: minPerfPages},
+		{name: "pages rounded down to a power of two", cpus: 4, mem: 3 * gib, wantStash: 16384, wantPages: 128},
+		{name: "unknown memory", cpus: 8, wantStash: 32768, wantPages: minPerfPages},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			stash, pages := autoSize(test.cpus, test.mem, 4096)
+
+			if stash != test.wantStash {
+				t.Errorf("expected %d stash entries, got %d", test.wantStash, stash)
+			}
+			if pages != test.wantPages {
+				t.Errorf("expected %d perf pages, got %d", test.wantPages, pages)
+			}
+		})
+	}
+}
+
+func TestFloorPow2(t *testing.T) {
+	tests := []struct {
+		v    uint64
+		want uint64
+	}{
+		{v: 0, want: 0},
+		{v: 1, want: 1},
+		{v: 2, want: 2},
+		{v: 3, want: 2},
+		{v: 1000, want: 512},
+		{v: 1024, want: 1024},
+	}
+
+	for _, test := range tests {
+		if got := floorPow2(test.v); got != test.want {
+			t.Errorf("floorPow2(%d): expected %d, got %d", test.v, test.want, got)
+		}
+	}
+}
@@ -0,0 +1,77 @@
+package query
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+)
+
+// ServeHTTP serves flow queries.
+//
+// The subject, remote, namespace and port query parameters filter
+// the flows, exact matches the subject and remote exactly, windows
+// selects the number of recent windows, sort one of "bytes", "packets",
+// "rate" or "rtt", limit the maximum number of flows returned and
+// distribution includes the RTT distribution of each flow.
+func (r *Ring) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet {
+		rw.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	v := req.URL.Query()
+	q := Query{
+		Subject:   v.Get("subject"),
+		Remote:    v.Get("remote"),
+		Namespace: v.Get("namespace"),
+		Sort:      v.Get("sort"),
+		Windows:   1,
+		Limit:     20,
+	}
+	for _, p := range []struct {
+		name string
+		val  *bool
+	}{{"exact", &q.Exact}, {"distribution", &q.Distribution}} {
+		if str := v.Get(p.name); str != "" {
+			b, err := strconv.ParseBool(str)
+			if err != nil {
+				http.Error(rw, "invalid "+p.name, http.StatusBadRequest)
+				return
+			}
+			*p.val = b
+		}
+	}
+	if str := v.Get("port"); str != "" {
+		port, err := strconv.ParseUint(str, 10, 16)
+		if err != nil {
+			http.Error(rw, "invalid port", http.StatusBadRequest)
+			return
+		}
+		q.Port = uint16(port)
+	}
+	if str := v.Get("windows"); str != "" {
+		n, err := strconv.Atoi(str)
+		if err != nil || n < 0 {
+			http.Error(rw, "invalid windows", http.StatusBadRequest)
+			return
+		}
+		q.Windows = n
+	}
+	if str := v.Get("limit"); str != "" {
+		n, err := strconv.Atoi(str)
+		if err != nil || n < 0 {
+			http.Error(rw, "invalid limit", http.StatusBadRequest)
+			return
+		}
+		q.Limit = n
+	}
+
+	res, err := r.Query(q)
+	if err != nil {
+		http.Error(rw, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	rw.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(rw).Encode(res)
+}
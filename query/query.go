@@ -0,0 +1,278 @@
+// Package query implements live queries over the most
+// recently flushed metrics.
+package query
+
+import (
+	"errors"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/nrwiersma/ebpf/flow"
+)
+
+// Sort orders.
+const (
+	SortBytes   = "bytes"
+	SortPackets = "packets"
+	SortRate    = "rate"
+	SortRTT     = "rtt"
+)
+
+// Query is a flow query.
+type Query struct {
+	// Subject and Remote match flows containing them,
+	// or equal to them if Exact is set.
+	Subject string
+	Remote  string
+	Exact   bool
+	// Namespace matches flows with either end in the namespace.
+	Namespace string
+	Port      uint16
+
+	// Windows is the number of most recent windows to query.
+	Windows int
+	// Sort is the sort order, descending.
+	Sort  string
+	Limit int
+
+	// Distribution includes the RTT distribution of the flows.
+	Distribution bool
+}
+
+// Flow is a flow in a query result.
+type Flow struct {
+	Node        string         `json:"node,omitempty"`
+	Subject     string         `json:"subject,omitempty"`
+	Namespace   string         `json:"namespace,omitempty"`
+	Workload    string         `json:"workload,omitempty"`
+	Remote      string         `json:"remote,omitempty"`
+	Port        uint16         `json:"port,omitempty"`
+	Protocol    string         `json:"protocol,omitempty"`
+	Direction   string         `json:"direction,omitempty"`
+	BytesIn     uint64         `json:"bytesIn"`
+	BytesOut    uint64         `json:"bytesOut"`
+	PacketsIn   uint64         `json:"packetsIn"`
+	PacketsOut  uint64         `json:"packetsOut"`
+	BytesRate   float64        `json:"bytesRate"`
+	PacketsRate float64        `json:"packetsRate"`
+	RTT         flow.Quantiles `json:"rtt"`
+
+	RTTDistribution []Quantile `json:"rttDistribution,omitempty"`
+}
+
+// Quantile is the value of a quantile of a distribution.
+type Quantile struct {
+	Q     float64 `json:"q"`
+	Value float64 `json:"value"`
+}
+
+// distQuantiles are the quantiles of a distribution in a query result.
+var distQuantiles = []float64{0.01, 0.05, 0.1, 0.25, 0.5, 0.75, 0.9, 0.95, 0.99, 0.999}
+
+// Result is the result of a query.
+type Result struct {
+	// From and To are the timestamps of the oldest
+	// and newest queried windows.
+	From  int64  `json:"from"`
+	To    int64  `json:"to"`
+	Flows []Flow `json:"flows"`
+}
+
+type batch struct {
+	ts int64
+	ms []flow.Metric
+}
+
+// Ring keeps the metrics of the last windows in memory.
+//
+// It implements a metrics sink, and should receive the
+// metrics of every interval.
+type Ring struct {
+	mu      sync.Mutex
+	batches []batch
+	next    int
+	full    bool
+}
+
+// New returns a ring of the given number of windows.
+func New(size int) *Ring {
+	if size < 1 {
+		size = 1
+	}
+
+	return &Ring{
+		batches: make([]batch, size),
+	}
+}
+
+// Write adds the metrics of a window to the ring, replacing the oldest window.
+func (r *Ring) Write(ms []flow.Metric) error {
+	if len(ms) == 0 {
+		return nil
+	}
+
+	// The digests are copied, as reading them is not safe
+	// while other sinks are using them.
+	b := batch{
+		ts: ms[0].Timestamp,
+		ms: make([]flow.Metric, len(ms)),
+	}
+	for i, m := range ms {
+		b.ms[i] = m.Clone()
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.batches[r.next] = b
+	r.next = (r.next + 1) % len(r.batches)
+	if r.next == 0 {
+		r.full = true
+	}
+	return nil
+}
+
+// Query runs a query over the most recent windows.
+func (r *Ring) Query(q Query) (Result, error) {
+	var less func(a, b *flow.Metric) bool
+	switch q.Sort {
+	case "", SortBytes:
+		less = func(a, b *flow.Metric) bool { return a.BytesIn+a.BytesOut > b.BytesIn+b.BytesOut }
+	case SortPackets:
+		less = func(a, b *flow.Metric) bool { return a.PacketsIn+a.PacketsOut > b.PacketsIn+b.PacketsOut }
+	case SortRate:
+		less = func(a, b *flow.Metric) bool { return a.BytesRate > b.BytesRate }
+	case SortRTT:
+		less = func(a, b *flow.Metric) bool { return rttP99(a) > rttP99(b) }
+	case "retransmits":
+		return Result{}, errors.New("retransmits are not collected")
+	default:
+		return Result{}, errors.New("unknown sort " + q.Sort)
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	windows := r.recent(q.Windows)
+	if len(windows) == 0 {
+		return Result{Flows: []Flow{}}, nil
+	}
+
+	agg := map[flow.Key]*flow.Metric{}
+	var keys []flow.Key
+	for _, b := range windows {
+		for _, m := range b.ms {
+			if !q.Matches(m) {
+				continue
+			}
+
+			k := m.Key()
+			if _, ok := agg[k]; !ok {
+				keys = append(keys, k)
+			}
+			a := flow.MergeInto(agg, 0, m)
+			// A flow missing from a window had no traffic in it,
+			// so the rate over the windows is the mean of the rates.
+			a.BytesRate += m.BytesRate / float64(len(windows))
+			a.PacketsRate += m.PacketsRate / float64(len(windows))
+		}
+	}
+
+	ms := make([]*flow.Metric, 0, len(keys))
+	for _, k := range keys {
+		ms = append(ms, agg[k])
+	}
+	sort.SliceStable(ms, func(i, j int) bool {
+		return less(ms[i], ms[j])
+	})
+	if q.Limit > 0 && len(ms) > q.Limit {
+		ms = ms[:q.Limit]
+	}
+
+	res := Result{
+		From:  windows[0].ts,
+		To:    windows[len(windows)-1].ts,
+		Flows: make([]Flow, 0, len(ms)),
+	}
+	for _, m := range ms {
+		var dist []Quantile
+		if q.Distribution && m.RTT.Count() > 0 {
+			dist = make([]Quantile, 0, len(distQuantiles))
+			for _, dq := range distQuantiles {
+				dist = append(dist, Quantile{Q: dq, Value: m.RTT.Quantile(dq)})
+			}
+		}
+
+		res.Flows = append(res.Flows, Flow{
+			Node:            m.Node,
+			Subject:         m.Subject,
+			Namespace:       m.Namespace,
+			Workload:        m.Workload,
+			Remote:          m.Remote,
+			Port:            m.Port,
+			Protocol:        m.Protocol,
+			Direction:       m.Direction,
+			BytesIn:         m.BytesIn,
+			BytesOut:        m.BytesOut,
+			PacketsIn:       m.PacketsIn,
+			PacketsOut:      m.PacketsOut,
+			BytesRate:       m.BytesRate,
+			PacketsRate:     m.PacketsRate,
+			RTT:             flow.NewQuantiles(m.RTT),
+			RTTDistribution: dist,
+		})
+	}
+	return res, nil
+}
+
+// recent returns the n most recent windows, oldest first.
+// It must be called with the lock held.
+func (r *Ring) recent(n int) []batch {
+	size := r.next
+	if r.full {
+		size = len(r.batches)
+	}
+	if n <= 0 || n > size {
+		n = size
+	}
+
+	out := make([]batch, 0, n)
+	for i := n; i > 0; i-- {
+		idx := (r.next - i + len(r.batches)) % len(r.batches)
+		out = append(out, r.batches[idx])
+	}
+	return out
+}
+
+// Matches determines if the metric matches the filters of the query.
+func (q Query) Matches(m flow.Metric) bool {
+	if q.Subject != "" && !q.match(m.Subject, q.Subject) {
+		return false
+	}
+	if q.Remote != "" && !q.match(m.Remote, q.Remote) {
+		return false
+	}
+	if q.Namespace != "" {
+		prefix := q.Namespace + "/"
+		if m.Namespace != q.Namespace && !strings.HasPrefix(m.Subject, prefix) && !strings.HasPrefix(m.Remote, prefix) {
+			return false
+		}
+	}
+	if q.Port != 0 && m.Port != q.Port {
+		return false
+	}
+	return true
+}
+
+func (q Query) match(s, substr string) bool {
+	if q.Exact {
+		return s == substr
+	}
+	return strings.Contains(s, substr)
+}
+
+func rttP99(m *flow.Metric) float64 {
+	v, _ := flow.Quantile(m.RTT, 0.99)
+	return v
+}
@@ -0,0 +1,63 @@
+package ebpf
+
+import (
+	"time"
+
+	"github.com/nrwiersma/ebpf/flow"
+)
+
+// rollup merges interval metrics into coarser windows
+// aligned to wall-clock boundaries.
+type rollup struct {
+	res time.Duration
+
+	start time.Time
+	agg   map[flow.Key]*flow.Metric
+}
+
+func newRollup(res time.Duration) *rollup {
+	return &rollup{res: res}
+}
+
+// Add merges the metrics of the interval ending at end into
+// their window. Completed windows are passed to emit, with
+// the timestamp set to the end of the window.
+func (r *rollup) Add(end time.Time, inter time.Duration, ms []flow.Metric, emit func([]flow.Metric)) {
+	start := end.Add(-inter).Truncate(r.res)
+	if r.agg != nil && !start.Equal(r.start) {
+		// The interval belongs to a new window, which
+		// only happens if intervals were skipped.
+		emit(r.take())
+	}
+	if r.agg == nil {
+		r.start = start
+		r.agg = map[flow.Key]*flow.Metric{}
+	}
+
+	for _, m := range ms {
+		k := m.Key()
+		agg, ok := r.agg[k]
+		if !ok {
+			agg = newMetric(k)
+			r.agg[k] = agg
+		}
+		agg.Merge(m)
+	}
+
+	if !end.Before(r.start.Add(r.res)) {
+		emit(r.take())
+	}
+}
+
+func (r *rollup) take() []flow.Metric {
+	ts := r.start.Add(r.res).Unix()
+	ms := make([]flow.Metric, 0, len(r.agg))
+	for _, m := range r.agg {
+		m.Timestamp = ts
+		m.UpdateRates(r.res)
+		ms = append(ms, *m)
+	}
+
+	r.agg = nil
+	return ms
+}
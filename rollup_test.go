@@ -0,0 +1,125 @@
+package ebpf
+
+import (
+	"testing"
+	"time"
+
+	"github.com/influxdata/tdigest"
+	"github.com/nrwiersma/ebpf/flow"
+)
+
+func TestRollup_AlignsWindows(t *testing.T) {
+	base := time.Date(2020, 9, 13, 12, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		name  string
+		ends  []time.Duration
+		inter time.Duration
+		want  []time.Duration
+	}{
+		{
+			name:  "aligned intervals",
+			ends:  []time.Duration{20 * time.Second, 40 * time.Second, time.Minute, 80 * time.Second},
+			inter: 20 * time.Second,
+			want:  []time.Duration{time.Minute},
+		},
+		{
+			name:  "unaligned intervals",
+			ends:  []time.Duration{25 * time.Second, 45 * time.Second, 65 * time.Second},
+			inter: 20 * time.Second,
+			want:  []time.Duration{time.Minute},
+		},
+		{
+			name:  "interval ending on the boundary",
+			ends:  []time.Duration{time.Minute, 2 * time.Minute},
+			inter: time.Minute,
+			want:  []time.Duration{time.Minute, 2 * time.Minute},
+		},
+		{
+			name:  "skipped intervals",
+			ends:  []time.Duration{20 * time.Second, 140 * time.Second},
+			inter: 20 * time.Second,
+			want:  []time.Duration{time.Minute},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			r := newRollup(time.Minute)
+
+			var got []int64
+			for _, end := range test.ends {
+				r.Add(base.Add(end), test.inter, []flow.Metric{{Subject: "a", BytesOut: 1}}, func(ms []flow.Metric) {
+					for _, m := range ms {
+						got = append(got, m.Timestamp)
+					}
+				})
+			}
+
+			if len(got) != len(test.want) {
+				t.Fatalf("expected %d windows, got %d", len(test.want), len(got))
+			}
+			for i, want := range test.want {
+				if ts := base.Add(want).Unix(); got[i] != ts {
+					t.Errorf("expected window %d to end at %d, got %d", i, ts, got[i])
+				}
+			}
+		})
+	}
+}
+
+func TestRollup_MergesWindows(t *testing.T) {
+	base := time.Date(2020, 9, 13, 12, 0, 0, 0, time.UTC)
+	r := newRollup(time.Minute)
+
+	digest := func(vs ...float64) *tdigest.TDigest {
+		td := tdigest.New()
+		for _, v := range vs {
+			td.Add(v, 1)
+		}
+		return td
+	}
+
+	var windows [][]flow.Metric
+	emit := func(ms []flow.Metric) {
+		windows = append(windows, ms)
+	}
+
+	first := flow.Metric{Subject: "a", BytesOut: 10, PacketsOut: 1, RTT: digest(100)}
+	r.Add(base.Add(30*time.Second), 30*time.Second, []flow.Metric{first}, emit)
+	r.Add(base.Add(time.Minute), 30*time.Second, []flow.Metric{{Subject: "a", BytesOut: 20, PacketsOut: 2, RTT: digest(200, 300)}}, emit)
+	r.Add(base.Add(90*time.Second), 30*time.Second, []flow.Metric{{Subject: "a", BytesOut: 30, RTT: digest(1000)}}, emit)
+	r.Add(base.Add(2*time.Minute), 30*time.Second, nil, emit)
+
+	if len(windows) != 2 || len(windows[0]) != 1 || len(windows[1]) != 1 {
+		t.Fatalf("expected 2 windows of 1 metric, got %v", windows)
+	}
+
+	m := windows[0][0]
+	if m.BytesOut != 30 || m.PacketsOut != 3 {
+		t.Errorf("expected 30 bytes and 3 packets, got %d and %d", m.BytesOut, m.PacketsOut)
+	}
+	if m.BytesRate != 0.5 || m.PacketsRate != 0.05 {
+		t.Errorf("expected rates over the window, got %v and %v", m.BytesRate, m.PacketsRate)
+	}
+	if got := m.RTT.Count(); got != 3 {
+		t.Errorf("expected 3 rtt samples, got %v", got)
+	}
+	if got := m.RTT.Quantile(0.99); got > 300 {
+		t.Errorf("expected the rtt of the first window only, got p99 %v", got)
+	}
+	if first.RTT.Count() != 1 {
+		t.Error("expected the input digest not to be modified")
+	}
+
+	m = windows[1][0]
+	if m.BytesOut != 30 {
+		t.Errorf("expected 30 bytes, got %d", m.BytesOut)
+	}
+	if got := m.RTT.Count(); got != 1 {
+		t.Errorf("expected 1 rtt sample, got %v", got)
+	}
+	if got := m.RTT.Quantile(0.5); got != 1000 {
+		t.Errorf("expected rtt p50 1000, got %v", got)
+	}
+}
@@ -0,0 +1,95 @@
+package ebpf
+
+import (
+	"github.com/nrwiersma/ebpf/packet"
+)
+
+// calmIntervals is the number of consecutive intervals without
+// lost samples before the sampling rate is lowered again.
+const calmIntervals = 3
+
+// packetSampler is implemented by packet sources
+// that sample packets in the kernel.
+type packetSampler interface {
+	SetSampleRate(dir uint16, rate uint32) error
+}
+
+// sampling controls the in-kernel sampling rate from the
+// samples read and lost in each interval.
+//
+// Loss raises the rate at least twofold, or enough to fit the
+// samples of the interval. The rate is halved again once no
+// samples have been lost for a few intervals.
+type sampling struct {
+	maxRate uint32
+	rate    uint32
+	calm    int
+}
+
+func newSampling(maxRate uint32) *sampling {
+	return &sampling{
+		maxRate: maxRate,
+		rate:    1,
+	}
+}
+
+// update returns the rate for the next interval,
+// and if it changed.
+func (s *sampling) update(read, lost uint64) (uint32, bool) {
+	prev := s.rate
+
+	switch {
+	case lost > 0:
+		s.calm = 0
+
+		next := uint64(s.rate) * 2
+		if read > 0 {
+			// The rate at which the samples of the interval would have fit.
+			if fit := (uint64(s.rate)*(read+lost) + read - 1) / read; fit > next {
+				next = fit
+			}
+		}
+		if next > uint64(s.maxRate) {
+			next = uint64(s.maxRate)
+		}
+		s.rate = uint32(next)
+	case s.rate > 1:
+		s.calm++
+		if s.calm < calmIntervals {
+			break
+		}
+		s.calm = 0
+
+		s.rate /= 2
+	}
+
+	return s.rate, s.rate != prev
+}
+
+// adjustSampling updates the sampling rate from the samples
+// of the interval, returning the rate in effect.
+func (a *App) adjustSampling(read, lost uint64) uint32 {
+	prev := a.smpl.rate
+	rate, changed := a.smpl.update(read, lost)
+	if !changed {
+		return rate
+	}
+
+	if err := a.setSampleRate(rate); err != nil {
+		a.log.Error("Unable to set sample rate", "error", err)
+		a.smpl.rate = prev
+		return prev
+	}
+	a.log.Info("Changed sample rate", "rate", rate, "previous", prev, "read", read, "lost", lost)
+	return rate
+}
+
+func (a *App) setSampleRate(rate uint32) error {
+	ps := a.pkts.(packetSampler)
+	for _, dir := range []uint16{packet.FlagIn, packet.FlagOut} {
+		if err := ps.SetSampleRate(dir, rate); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,103 @@
+package ebpf
+
+import "testing"
+
+func TestSampling_Update(t *testing.T) {
+	type step struct {
+		read, lost uint64
+		rate       uint32
+		changed    bool
+	}
+
+	tests := []struct {
+		name    string
+		maxRate uint32
+		steps   []step
+	}{
+		{
+			name:    "no loss",
+			maxRate: 64,
+			steps: []step{
+				{read: 100, rate: 1},
+				{read: 100, rate: 1},
+				{read: 100, rate: 1},
+				{read: 100, rate: 1},
+			},
+		},
+		{
+			name:    "doubles under loss",
+			maxRate: 64,
+			steps: []step{
+				{read: 100, lost: 10, rate: 2, changed: true},
+				{read: 100, lost: 10, rate: 4, changed: true},
+				{read: 100, lost: 10, rate: 8, changed: true},
+			},
+		},
+		{
+			name:    "fits the samples of the interval",
+			maxRate: 64,
+			steps: []step{
+				{read: 100, lost: 300, rate: 4, changed: true},
+				{read: 100, lost: 250, rate: 14, changed: true},
+			},
+		},
+		{
+			name:    "loss without reads",
+			maxRate: 64,
+			steps: []step{
+				{lost: 50, rate: 2, changed: true},
+			},
+		},
+		{
+			name:    "clamps to the max rate",
+			maxRate: 8,
+			steps: []step{
+				{read: 10, lost: 1000, rate: 8, changed: true},
+				{read: 10, lost: 1000, rate: 8},
+			},
+		},
+		{
+			name:    "decays back to one",
+			maxRate: 64,
+			steps: []step{
+				{read: 100, lost: 300, rate: 4, changed: true},
+				{read: 100, rate: 4},
+				{read: 100, rate: 4},
+				{read: 100, rate: 2, changed: true},
+				{read: 100, rate: 2},
+				{read: 100, rate: 2},
+				{read: 100, rate: 1, changed: true},
+				{read: 100, rate: 1},
+				{read: 100, rate: 1},
+				{read: 100, rate: 1},
+			},
+		},
+		{
+			name:    "loss restarts the decay",
+			maxRate: 64,
+			steps: []step{
+				{read: 100, lost: 300, rate: 4, changed: true},
+				{read: 100, rate: 4},
+				{read: 100, rate: 4},
+				{read: 100, lost: 1, rate: 8, changed: true},
+				{read: 100, rate: 8},
+				{read: 100, rate: 8},
+				{read: 100, rate: 4, changed: true},
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			s := newSampling(test.maxRate)
+
+			for i, st := range test.steps {
+				rate, changed := s.update(st.read, st.lost)
+
+				if rate != st.rate || changed != st.changed {
+					t.Fatalf("step %d: expected rate %d and changed %t, got %d and %t", i, st.rate, st.changed, rate, changed)
+				}
+			}
+		})
+	}
+}
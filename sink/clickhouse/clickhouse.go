@@ -0,0 +1,372 @@
+// Package clickhouse implements a metrics sink that inserts
+// metrics into ClickHouse through its HTTP interface.
+package clickhouse
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/influxdata/tdigest"
+	"github.com/nrwiersma/ebpf/flow"
+	"github.com/nrwiersma/ebpf/stats"
+)
+
+type columnDef struct {
+	Name string
+	Type string
+}
+
+// columns is the managed table schema.
+//
+// Columns are only ever added, never changed, so
+// existing tables can be migrated in place.
+var columns = []columnDef{
+	{Name: "timestamp", Type: "DateTime('UTC')"},
+	{Name: "subject", Type: "LowCardinality(String)"},
+	{Name: "remote", Type: "LowCardinality(String)"},
+	{Name: "port", Type: "UInt16"},
+	{Name: "protocol", Type: "LowCardinality(String)"},
+	{Name: "bytes_in", Type: "UInt64"},
+	{Name: "bytes_out", Type: "UInt64"},
+	{Name: "rtt_p50", Type: "Nullable(Float64)"},
+	{Name: "rtt_p90", Type: "Nullable(Float64)"},
+	{Name: "rtt_p95", Type: "Nullable(Float64)"},
+	{Name: "rtt_p99", Type: "Nullable(Float64)"},
+	{Name: "node", Type: "LowCardinality(String)"},
+	{Name: "namespace", Type: "LowCardinality(String)"},
+	{Name: "workload", Type: "LowCardinality(String)"},
+	{Name: "direction", Type: "LowCardinality(String)"},
+	{Name: "packets_in", Type: "UInt64"},
+	{Name: "packets_out", Type: "UInt64"},
+	{Name: "bytes_rate", Type: "Float64"},
+	{Name: "packets_rate", Type: "Float64"},
+	{Name: "size_p50", Type: "Nullable(Float64)"},
+	{Name: "size_p90", Type: "Nullable(Float64)"},
+	{Name: "size_p99", Type: "Nullable(Float64)"},
+}
+
+// statsColumns is the managed schema of the agent stats table.
+var statsColumns = []columnDef{
+	{Name: "timestamp", Type: "DateTime('UTC')"},
+	{Name: "node", Type: "LowCardinality(String)"},
+	{Name: "read_samples", Type: "UInt64"},
+	{Name: "lost_samples", Type: "UInt64"},
+	{Name: "read_rate", Type: "Float64"},
+	{Name: "records", Type: "UInt64"},
+	{Name: "series", Type: "UInt32"},
+	{Name: "flush_duration", Type: "Float64"},
+	{Name: "attaches", Type: "UInt64"},
+	{Name: "attach_failures", Type: "UInt64"},
+	{Name: "detaches", Type: "UInt64"},
+	{Name: "detach_failures", Type: "UInt64"},
+	{Name: "attached", Type: "Int32"},
+	{Name: "event_queue", Type: "Int32"},
+	{Name: "stash_entries", Type: "Int32"},
+	{Name: "stash_capacity", Type: "Int32"},
+	{Name: "sample_rate", Type: "UInt32"},
+}
+
+// OptsFunc represents a configuration function for the sink.
+type OptsFunc func(s *Sink)
+
+// WithDatabase configures the database of the table.
+func WithDatabase(db string) OptsFunc {
+	return func(s *Sink) {
+		s.db = db
+	}
+}
+
+// WithCredentials configures the user and password used to connect.
+func WithCredentials(user, pass string) OptsFunc {
+	return func(s *Sink) {
+		s.user = user
+		s.pass = pass
+	}
+}
+
+// WithTTL configures the retention of the tables. It is applied to
+// existing tables as well. A zero TTL leaves the table TTL untouched.
+func WithTTL(ttl time.Duration) OptsFunc {
+	return func(s *Sink) {
+		s.ttl = ttl
+	}
+}
+
+// WithStatsTable configures the table the internal metrics of the
+// agent are inserted into. It defaults to the table with an "_agent" suffix.
+func WithStatsTable(table string) OptsFunc {
+	return func(s *Sink) {
+		s.statsTable = table
+	}
+}
+
+// WithTimeout configures the request timeout.
+func WithTimeout(d time.Duration) OptsFunc {
+	return func(s *Sink) {
+		s.client.Timeout = d
+	}
+}
+
+// Sink inserts metrics into a ClickHouse table.
+type Sink struct {
+	url   string
+	db    string
+	table string
+	user  string
+	pass  string
+	ttl   time.Duration
+
+	statsTable string
+
+	client *http.Client
+}
+
+// New returns a ClickHouse sink, creating or migrating the
+// table if needed.
+func New(uri, table string, opts ...OptsFunc) (*Sink, error) {
+	s := &Sink{
+		url:    uri,
+		db:     "default",
+		table:  table,
+		client: &http.Client{Timeout: 10 * time.Second},
+	}
+
+	for _, opt := range opts {
+		opt(s)
+	}
+	if s.statsTable == "" {
+		s.statsTable = table + "_agent"
+	}
+
+	if err := s.migrate(s.table, columns, "subject, remote, port, timestamp"); err != nil {
+		return nil, err
+	}
+	if err := s.migrate(s.statsTable, statsColumns, "node, timestamp"); err != nil {
+		return nil, err
+	}
+
+	return s, nil
+}
+
+func (s *Sink) migrate(table string, cols []columnDef, orderBy string) error {
+	defs := make([]string, 0, len(cols))
+	for _, col := range cols {
+		defs = append(defs, quoteIdent(col.Name)+" "+col.Type)
+	}
+
+	create := fmt.Sprintf(
+		"CREATE TABLE IF NOT EXISTS %s (%s) ENGINE = MergeTree() PARTITION BY toYYYYMM(timestamp) ORDER BY (%s)",
+		s.tableName(table),
+		strings.Join(defs, ", "),
+		orderBy,
+	)
+	if err := s.exec(create, nil); err != nil {
+		return fmt.Errorf("unable to create table: %w", err)
+	}
+
+	for _, col := range cols {
+		alter := fmt.Sprintf("ALTER TABLE %s ADD COLUMN IF NOT EXISTS %s %s", s.tableName(table), quoteIdent(col.Name), col.Type)
+		if err := s.exec(alter, nil); err != nil {
+			return fmt.Errorf("unable to migrate table: %w", err)
+		}
+	}
+
+	// The TTL is altered rather than created, so tables created
+	// before it was configured or changed get it too.
+	if s.ttl > 0 {
+		alter := fmt.Sprintf("ALTER TABLE %s MODIFY TTL timestamp + INTERVAL %d SECOND", s.tableName(table), int64(s.ttl/time.Second))
+		if err := s.exec(alter, nil); err != nil {
+			return fmt.Errorf("unable to set table ttl: %w", err)
+		}
+	}
+	return nil
+}
+
+// Write inserts the metrics into the table.
+func (s *Sink) Write(ms []flow.Metric) error {
+	if len(ms) == 0 {
+		return nil
+	}
+
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	for _, m := range ms {
+		r := row{
+			Timestamp:   time.Unix(m.Timestamp, 0).UTC().Format("2006-01-02 15:04:05"),
+			Subject:     m.Subject,
+			Remote:      m.Remote,
+			Port:        m.Port,
+			Protocol:    m.Protocol,
+			BytesIn:     m.BytesIn,
+			BytesOut:    m.BytesOut,
+			Node:        m.Node,
+			Namespace:   m.Namespace,
+			Workload:    m.Workload,
+			Direction:   m.Direction,
+			PacketsIn:   m.PacketsIn,
+			PacketsOut:  m.PacketsOut,
+			BytesRate:   m.BytesRate,
+			PacketsRate: m.PacketsRate,
+			RTTP50:      quantile(m.RTT, 0.5),
+			RTTP90:      quantile(m.RTT, 0.9),
+			RTTP95:      quantile(m.RTT, 0.95),
+			RTTP99:      quantile(m.RTT, 0.99),
+			SizeP50:     quantile(m.Size, 0.5),
+			SizeP90:     quantile(m.Size, 0.9),
+			SizeP99:     quantile(m.Size, 0.99),
+		}
+		if err := enc.Encode(r); err != nil {
+			return fmt.Errorf("unable to encode metrics: %w", err)
+		}
+	}
+
+	query := fmt.Sprintf("INSERT INTO %s FORMAT JSONEachRow", s.tableName(s.table))
+	if err := s.exec(query, &buf); err != nil {
+		return fmt.Errorf("unable to insert metrics: %w", err)
+	}
+	return nil
+}
+
+// WriteStats inserts the internal metrics of the agent into the stats table.
+func (s *Sink) WriteStats(st stats.Stats) error {
+	b, err := json.Marshal(statsRow{
+		Timestamp:      time.Unix(st.Timestamp, 0).UTC().Format("2006-01-02 15:04:05"),
+		Node:           st.Node,
+		ReadSamples:    st.ReadSamples,
+		LostSamples:    st.LostSamples,
+		ReadRate:       st.ReadRate,
+		Records:        st.Records,
+		Series:         st.Series,
+		FlushDuration:  st.FlushDuration,
+		Attaches:       st.Attaches,
+		AttachFailures: st.AttachFailures,
+		Detaches:       st.Detaches,
+		DetachFailures: st.DetachFailures,
+		Attached:       st.Attached,
+		EventQueue:     st.EventQueue,
+		StashEntries:   st.StashEntries,
+		StashCapacity:  st.StashCapacity,
+		SampleRate:     st.SampleRate,
+	})
+	if err != nil {
+		return fmt.Errorf("unable to encode stats: %w", err)
+	}
+
+	query := fmt.Sprintf("INSERT INTO %s FORMAT JSONEachRow", s.tableName(s.statsTable))
+	if err = s.exec(query, bytes.NewReader(b)); err != nil {
+		return fmt.Errorf("unable to insert stats: %w", err)
+	}
+	return nil
+}
+
+func (s *Sink) exec(query string, body io.Reader) error {
+	u, err := url.Parse(s.url)
+	if err != nil {
+		return err
+	}
+	q := u.Query()
+	q.Set("database", s.db)
+
+	if body == nil {
+		body = strings.NewReader(query)
+	} else {
+		q.Set("query", query)
+	}
+	u.RawQuery = q.Encode()
+
+	req, err := http.NewRequest(http.MethodPost, u.String(), body)
+	if err != nil {
+		return err
+	}
+	if s.user != "" {
+		req.Header.Set("X-ClickHouse-User", s.user)
+		req.Header.Set("X-ClickHouse-Key", s.pass)
+	}
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = resp.Body.Close() }()
+
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("unexpected status code %d: %s", resp.StatusCode, strings.TrimSpace(string(msg)))
+	}
+	_, _ = io.Copy(io.Discard, resp.Body)
+	return nil
+}
+
+func (s *Sink) tableName(table string) string {
+	return quoteIdent(s.db) + "." + quoteIdent(table)
+}
+
+// Close closes the sink.
+func (s *Sink) Close() error {
+	s.client.CloseIdleConnections()
+
+	return nil
+}
+
+type row struct {
+	Timestamp   string   `json:"timestamp"`
+	Subject     string   `json:"subject"`
+	Remote      string   `json:"remote"`
+	Port        uint16   `json:"port"`
+	Protocol    string   `json:"protocol"`
+	BytesIn     uint64   `json:"bytes_in"`
+	BytesOut    uint64   `json:"bytes_out"`
+	RTTP50      *float64 `json:"rtt_p50"`
+	RTTP90      *float64 `json:"rtt_p90"`
+	RTTP95      *float64 `json:"rtt_p95"`
+	RTTP99      *float64 `json:"rtt_p99"`
+	Node        string   `json:"node"`
+	Namespace   string   `json:"namespace"`
+	Workload    string   `json:"workload"`
+	Direction   string   `json:"direction"`
+	PacketsIn   uint64   `json:"packets_in"`
+	PacketsOut  uint64   `json:"packets_out"`
+	BytesRate   float64  `json:"bytes_rate"`
+	PacketsRate float64  `json:"packets_rate"`
+	SizeP50     *float64 `json:"size_p50"`
+	SizeP90     *float64 `json:"size_p90"`
+	SizeP99     *float64 `json:"size_p99"`
+}
+
+type statsRow struct {
+	Timestamp      string  `json:"timestamp"`
+	Node           string  `json:"node"`
+	ReadSamples    uint64  `json:"read_samples"`
+	LostSamples    uint64  `json:"lost_samples"`
+	ReadRate       float64 `json:"read_rate"`
+	Records        uint64  `json:"records"`
+	Series         int     `json:"series"`
+	FlushDuration  float64 `json:"flush_duration"`
+	Attaches       uint64  `json:"attaches"`
+	AttachFailures uint64  `json:"attach_failures"`
+	Detaches       uint64  `json:"detaches"`
+	DetachFailures uint64  `json:"detach_failures"`
+	Attached       int     `json:"attached"`
+	EventQueue     int     `json:"event_queue"`
+	StashEntries   int     `json:"stash_entries"`
+	StashCapacity  int     `json:"stash_capacity"`
+	SampleRate     uint32  `json:"sample_rate"`
+}
+
+func quantile(td *tdigest.TDigest, q float64) *float64 {
+	v, ok := flow.Quantile(td, q)
+	if !ok {
+		return nil
+	}
+	return &v
+}
+
+func quoteIdent(s string) string {
+	return "`" + strings.ReplaceAll(s, "`", "\\`") + "`"
+}
@@ -0,0 +1,219 @@
+package clickhouse
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/influxdata/tdigest"
+	"github.com/nrwiersma/ebpf/flow"
+	"github.com/nrwiersma/ebpf/stats"
+)
+
+type request struct {
+	query string
+	body  string
+	user  string
+}
+
+type server struct {
+	*httptest.Server
+
+	mu   sync.Mutex
+	reqs []request
+}
+
+func newServer(t *testing.T) *server {
+	t.Helper()
+
+	srv := &server{}
+	srv.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := io.ReadAll(r.Body)
+
+		srv.mu.Lock()
+		defer srv.mu.Unlock()
+		srv.reqs = append(srv.reqs, request{
+			query: r.URL.Query().Get("query"),
+			body:  string(b),
+			user:  r.Header.Get("X-ClickHouse-User"),
+		})
+		if r.URL.Query().Get("database") != "db" {
+			w.WriteHeader(http.StatusBadRequest)
+		}
+	}))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func (s *server) requests() []request {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return append([]request(nil), s.reqs...)
+}
+
+func TestNew_MigratesTables(t *testing.T) {
+	srv := newServer(t)
+
+	s, err := New(srv.URL, "flows", WithDatabase("db"), WithCredentials("user", "pass"), WithTTL(24*time.Hour))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer func() { _ = s.Close() }()
+
+	reqs := srv.requests()
+	// A create, an alter per column and a ttl alter for both tables.
+	if want := 2*2 + len(columns) + len(statsColumns); len(reqs) != want {
+		t.Fatalf("expected %d requests, got %d", want, len(reqs))
+	}
+
+	create := reqs[0].body
+	if !strings.HasPrefix(create, "CREATE TABLE IF NOT EXISTS `db`.`flows` (`timestamp` DateTime('UTC'), `subject` LowCardinality(String),") {
+		t.Errorf("unexpected create statement %q", create)
+	}
+	if !strings.HasSuffix(create, "ENGINE = MergeTree() PARTITION BY toYYYYMM(timestamp) ORDER BY (subject, remote, port, timestamp)") {
+		t.Errorf("unexpected create statement %q", create)
+	}
+	if want := "ALTER TABLE `db`.`flows` ADD COLUMN IF NOT EXISTS `size_p99` Nullable(Float64)"; reqs[len(columns)].body != want {
+		t.Errorf("expected %q, got %q", want, reqs[len(columns)].body)
+	}
+	if want := "ALTER TABLE `db`.`flows` MODIFY TTL timestamp + INTERVAL 86400 SECOND"; reqs[len(columns)+1].body != want {
+		t.Errorf("expected %q, got %q", want, reqs[len(columns)+1].body)
+	}
+
+	agent := reqs[len(columns)+2].body
+	if !strings.HasPrefix(agent, "CREATE TABLE IF NOT EXISTS `db`.`flows_agent` (") || !strings.HasSuffix(agent, "ORDER BY (node, timestamp)") {
+		t.Errorf("unexpected stats create statement %q", agent)
+	}
+	if want := "ALTER TABLE `db`.`flows_agent` MODIFY TTL timestamp + INTERVAL 86400 SECOND"; reqs[len(reqs)-1].body != want {
+		t.Errorf("expected %q, got %q", want, reqs[len(reqs)-1].body)
+	}
+
+	for _, r := range reqs {
+		if r.user != "user" {
+			t.Errorf("expected user %q, got %q", "user", r.user)
+		}
+	}
+}
+
+func TestNew_DoesNotAlterTTLWhenUnset(t *testing.T) {
+	srv := newServer(t)
+
+	s, err := New(srv.URL, "flows", WithDatabase("db"))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer func() { _ = s.Close() }()
+
+	for _, r := range srv.requests() {
+		if strings.Contains(r.body, "TTL") {
+			t.Errorf("unexpected ttl in %q", r.body)
+		}
+	}
+}
+
+func TestNew_HandlesErrors(t *testing.T) {
+	srv := newServer(t)
+
+	_, err := New(srv.URL, "flows", WithDatabase("other"))
+	if err == nil {
+		t.Fatal("expected error, got none")
+	}
+}
+
+func TestSink_Write(t *testing.T) {
+	srv := newServer(t)
+
+	s, err := New(srv.URL, "flows", WithDatabase("db"))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer func() { _ = s.Close() }()
+	n := len(srv.requests())
+
+	rtt := tdigest.New()
+	rtt.Add(1000, 1)
+	err = s.Write([]flow.Metric{
+		{Timestamp: 1600000000, Subject: "default/a", Remote: "default/b", Port: 8080, Protocol: "tcp", BytesIn: 10, PacketsIn: 2, BytesRate: 1, PacketsRate: 0.2, RTT: rtt},
+		{Timestamp: 1600000000, Subject: "default/b", Remote: "default/a", Port: 8080, Protocol: "tcp", BytesOut: 10},
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	reqs := srv.requests()[n:]
+	if len(reqs) != 1 {
+		t.Fatalf("expected 1 request, got %d", len(reqs))
+	}
+	if want := "INSERT INTO `db`.`flows` FORMAT JSONEachRow"; reqs[0].query != want {
+		t.Errorf("expected query %q, got %q", want, reqs[0].query)
+	}
+
+	lines := strings.Split(strings.TrimSpace(reqs[0].body), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("expected 2 rows, got %d", len(lines))
+	}
+	var got []map[string]interface{}
+	for _, l := range lines {
+		var r map[string]interface{}
+		if err = json.Unmarshal([]byte(l), &r); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		got = append(got, r)
+	}
+	if got[0]["timestamp"] != "2020-09-13 12:26:40" {
+		t.Errorf("unexpected timestamp %v", got[0]["timestamp"])
+	}
+	if got[0]["subject"] != "default/a" || got[0]["port"] != float64(8080) || got[0]["bytes_in"] != float64(10) {
+		t.Errorf("unexpected row %v", got[0])
+	}
+	if got[0]["packets_in"] != float64(2) || got[0]["bytes_rate"] != float64(1) || got[0]["packets_rate"] != 0.2 {
+		t.Errorf("unexpected packets and rates in row %v", got[0])
+	}
+	if got[0]["rtt_p50"] != float64(1000) {
+		t.Errorf("expected rtt p50 1000, got %v", got[0]["rtt_p50"])
+	}
+	if v, ok := got[1]["rtt_p50"]; !ok || v != nil {
+		t.Errorf("expected a null rtt p50, got %v", v)
+	}
+	for _, col := range columns {
+		if _, ok := got[0][col.Name]; !ok {
+			t.Errorf("expected column %q in row", col.Name)
+		}
+	}
+}
+
+func TestSink_WriteStats(t *testing.T) {
+	srv := newServer(t)
+
+	s, err := New(srv.URL, "flows", WithDatabase("db"), WithStatsTable("agent"))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer func() { _ = s.Close() }()
+	n := len(srv.requests())
+
+	if err = s.WriteStats(stats.Stats{Timestamp: 1600000000, Node: "node", Series: 2}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	reqs := srv.requests()[n:]
+	if len(reqs) != 1 {
+		t.Fatalf("expected 1 request, got %d", len(reqs))
+	}
+	if want := "INSERT INTO `db`.`agent` FORMAT JSONEachRow"; reqs[0].query != want {
+		t.Errorf("expected query %q, got %q", want, reqs[0].query)
+	}
+	var got map[string]interface{}
+	if err = json.Unmarshal([]byte(reqs[0].body), &got); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if got["node"] != "node" || got["series"] != float64(2) {
+		t.Errorf("unexpected row %v", got)
+	}
+}
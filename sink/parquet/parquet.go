@@ -0,0 +1,358 @@
+// Package parquet implements a metrics sink that writes
+// hourly parquet files to a local directory.
+package parquet
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/influxdata/tdigest"
+	"github.com/nrwiersma/ebpf/flow"
+	"github.com/nrwiersma/ebpf/stats"
+)
+
+const (
+	fileTimeFormat = "20060102T15"
+
+	// tmpExt is the extension of the files of the current hour.
+	tmpExt = ".tmp"
+)
+
+// schema is the stable parquet schema of the flow files.
+var schema = []column{
+	{name: "timestamp", typ: typeInt64, converted: convertedTimestampMillis},
+	{name: "subject", typ: typeByteArray, converted: convertedUTF8},
+	{name: "remote", typ: typeByteArray, converted: convertedUTF8},
+	{name: "port", typ: typeInt32, converted: convertedUint16},
+	{name: "protocol", typ: typeByteArray, converted: convertedUTF8},
+	{name: "bytes_in", typ: typeInt64, converted: convertedUint64},
+	{name: "bytes_out", typ: typeInt64, converted: convertedUint64},
+	{name: "rtt_p50", typ: typeDouble, converted: convertedNone, optional: true},
+	{name: "rtt_p90", typ: typeDouble, converted: convertedNone, optional: true},
+	{name: "rtt_p95", typ: typeDouble, converted: convertedNone, optional: true},
+	{name: "rtt_p99", typ: typeDouble, converted: convertedNone, optional: true},
+	{name: "node", typ: typeByteArray, converted: convertedUTF8},
+	{name: "namespace", typ: typeByteArray, converted: convertedUTF8},
+	{name: "workload", typ: typeByteArray, converted: convertedUTF8},
+	{name: "direction", typ: typeByteArray, converted: convertedUTF8},
+	{name: "packets_in", typ: typeInt64, converted: convertedUint64},
+	{name: "packets_out", typ: typeInt64, converted: convertedUint64},
+	{name: "bytes_rate", typ: typeDouble, converted: convertedNone},
+	{name: "packets_rate", typ: typeDouble, converted: convertedNone},
+	{name: "size_p50", typ: typeDouble, converted: convertedNone, optional: true},
+	{name: "size_p90", typ: typeDouble, converted: convertedNone, optional: true},
+	{name: "size_p99", typ: typeDouble, converted: convertedNone, optional: true},
+}
+
+// statsSchema is the stable parquet schema of the agent stats files.
+var statsSchema = []column{
+	{name: "timestamp", typ: typeInt64, converted: convertedTimestampMillis},
+	{name: "node", typ: typeByteArray, converted: convertedUTF8},
+	{name: "read_samples", typ: typeInt64, converted: convertedUint64},
+	{name: "lost_samples", typ: typeInt64, converted: convertedUint64},
+	{name: "read_rate", typ: typeDouble, converted: convertedNone},
+	{name: "records", typ: typeInt64, converted: convertedUint64},
+	{name: "series", typ: typeInt32, converted: convertedNone},
+	{name: "flush_duration", typ: typeDouble, converted: convertedNone},
+	{name: "attaches", typ: typeInt64, converted: convertedUint64},
+	{name: "attach_failures", typ: typeInt64, converted: convertedUint64},
+	{name: "detaches", typ: typeInt64, converted: convertedUint64},
+	{name: "detach_failures", typ: typeInt64, converted: convertedUint64},
+	{name: "attached", typ: typeInt32, converted: convertedNone},
+	{name: "event_queue", typ: typeInt32, converted: convertedNone},
+	{name: "stash_entries", typ: typeInt32, converted: convertedNone},
+	{name: "stash_capacity", typ: typeInt32, converted: convertedNone},
+	{name: "sample_rate", typ: typeInt32, converted: convertedNone},
+}
+
+var (
+	rttQuantiles  = []float64{0.5, 0.9, 0.95, 0.99}
+	sizeQuantiles = []float64{0.5, 0.9, 0.99}
+)
+
+// Sink writes metrics into hourly parquet files.
+//
+// Each write is stored as a row group in the file of the current
+// hour. Files are written with a ".tmp" suffix and renamed once the
+// hour has passed or the sink is closed. The footer is rewritten
+// after every row group, so the file of the current hour is complete
+// on disk, and a crash loses at most the write in progress. The
+// internal metrics of the agent are written to separate "agent-"
+// files, as they have their own schema.
+type Sink struct {
+	mu    sync.Mutex
+	flows *hourlyFile
+	agent *hourlyFile
+}
+
+// New returns a parquet sink writing to the given directory.
+// Files of an hour left behind by a crash are committed, if they
+// are complete, and removed otherwise.
+func New(dir string) (*Sink, error) {
+	if err := os.MkdirAll(dir, 0750); err != nil {
+		return nil, fmt.Errorf("unable to create parquet directory: %w", err)
+	}
+	if err := recoverFiles(dir); err != nil {
+		return nil, err
+	}
+
+	return &Sink{
+		flows: newHourlyFile(dir, "flows-", schema),
+		agent: newHourlyFile(dir, "agent-", statsSchema),
+	}, nil
+}
+
+// Write writes the metrics as a row group to the current hourly file.
+func (s *Sink) Write(ms []flow.Metric) error {
+	if len(ms) == 0 {
+		return nil
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.flows.WriteRowGroup(ms[0].Timestamp, func(cols []*columnBuffer) {
+		for _, m := range ms {
+			cols[0].Int64(m.Timestamp * 1000)
+			cols[1].String(m.Subject)
+			cols[2].String(m.Remote)
+			cols[3].Int32(int32(m.Port))
+			cols[4].String(m.Protocol)
+			cols[5].Int64(int64(m.BytesIn))
+			cols[6].Int64(int64(m.BytesOut))
+			writeQuantiles(cols[7:11], m.RTT, rttQuantiles)
+			cols[11].String(m.Node)
+			cols[12].String(m.Namespace)
+			cols[13].String(m.Workload)
+			cols[14].String(m.Direction)
+			cols[15].Int64(int64(m.PacketsIn))
+			cols[16].Int64(int64(m.PacketsOut))
+			cols[17].Double(m.BytesRate)
+			cols[18].Double(m.PacketsRate)
+			writeQuantiles(cols[19:22], m.Size, sizeQuantiles)
+		}
+	})
+}
+
+// WriteStats writes the internal metrics of the agent as a
+// row group to the current hourly agent file.
+func (s *Sink) WriteStats(st stats.Stats) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.agent.WriteRowGroup(st.Timestamp, func(cols []*columnBuffer) {
+		cols[0].Int64(st.Timestamp * 1000)
+		cols[1].String(st.Node)
+		cols[2].Int64(int64(st.ReadSamples))
+		cols[3].Int64(int64(st.LostSamples))
+		cols[4].Double(st.ReadRate)
+		cols[5].Int64(int64(st.Records))
+		cols[6].Int32(int32(st.Series))
+		cols[7].Double(st.FlushDuration)
+		cols[8].Int64(int64(st.Attaches))
+		cols[9].Int64(int64(st.AttachFailures))
+		cols[10].Int64(int64(st.Detaches))
+		cols[11].Int64(int64(st.DetachFailures))
+		cols[12].Int32(int32(st.Attached))
+		cols[13].Int32(int32(st.EventQueue))
+		cols[14].Int32(int32(st.StashEntries))
+		cols[15].Int32(int32(st.StashCapacity))
+		cols[16].Int32(int32(st.SampleRate))
+	})
+}
+
+func writeQuantiles(cols []*columnBuffer, td *tdigest.TDigest, qs []float64) {
+	for i, q := range qs {
+		v, ok := flow.Quantile(td, q)
+		if !ok {
+			cols[i].Null()
+			continue
+		}
+		cols[i].Double(v)
+	}
+}
+
+// Close finishes the current files.
+func (s *Sink) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	err := s.flows.finish()
+	if aerr := s.agent.finish(); err == nil {
+		err = aerr
+	}
+	return err
+}
+
+// recoverFiles commits the complete files in the directory that were
+// not finished, and removes the files torn by a crash mid write.
+func recoverFiles(dir string) error {
+	paths, err := filepath.Glob(filepath.Join(dir, "*.parquet"+tmpExt))
+	if err != nil {
+		return fmt.Errorf("unable to list parquet files: %w", err)
+	}
+
+	for _, path := range paths {
+		if !isComplete(path) {
+			if err = os.Remove(path); err != nil {
+				return fmt.Errorf("unable to remove torn parquet file: %w", err)
+			}
+			continue
+		}
+		if err = os.Rename(path, strings.TrimSuffix(path, tmpExt)); err != nil {
+			return fmt.Errorf("unable to commit parquet file: %w", err)
+		}
+	}
+	return nil
+}
+
+// isComplete reports if the file ends with a footer.
+func isComplete(path string) bool {
+	f, err := os.Open(path)
+	if err != nil {
+		return false
+	}
+	defer func() { _ = f.Close() }()
+
+	b := make([]byte, len(magic))
+	info, err := f.Stat()
+	if err != nil || info.Size() < int64(2*len(magic)+4) {
+		return false
+	}
+	if _, err = f.ReadAt(b, info.Size()-int64(len(magic))); err != nil {
+		return false
+	}
+	return bytes.Equal(b, []byte(magic))
+}
+
+// hourlyFile writes row groups of a schema into hourly files.
+type hourlyFile struct {
+	dir    string
+	prefix string
+	schema []column
+
+	hour time.Time
+	file *os.File
+	buf  *bufio.Writer
+	fw   *fileWriter
+	path string
+	cols []*columnBuffer
+}
+
+func newHourlyFile(dir, prefix string, schema []column) *hourlyFile {
+	cols := make([]*columnBuffer, len(schema))
+	for i, col := range schema {
+		cols[i] = &columnBuffer{col: col}
+	}
+
+	return &hourlyFile{
+		dir:    dir,
+		prefix: prefix,
+		schema: schema,
+		cols:   cols,
+	}
+}
+
+// WriteRowGroup writes the rows added by fn as a row group to the
+// file of the hour of the timestamp, over the footer of the previous
+// row group. The file is synced to disk with its new footer.
+func (h *hourlyFile) WriteRowGroup(ts int64, fn func(cols []*columnBuffer)) error {
+	hour := time.Unix(ts, 0).UTC().Truncate(time.Hour)
+	if h.fw == nil || !hour.Equal(h.hour) {
+		if err := h.rotate(hour); err != nil {
+			return err
+		}
+	}
+
+	for _, c := range h.cols {
+		c.Reset()
+	}
+	fn(h.cols)
+
+	// The footer only grows with the row groups, so it is
+	// always overwritten completely.
+	if err := h.buf.Flush(); err != nil {
+		return fmt.Errorf("unable to write parquet header: %w", err)
+	}
+	if _, err := h.file.Seek(h.fw.off, io.SeekStart); err != nil {
+		return fmt.Errorf("unable to write row group: %w", err)
+	}
+	if err := h.fw.WriteRowGroup(h.cols); err != nil {
+		return fmt.Errorf("unable to write row group: %w", err)
+	}
+	if _, err := h.buf.Write(h.fw.Footer()); err != nil {
+		return fmt.Errorf("unable to write parquet footer: %w", err)
+	}
+	if err := h.buf.Flush(); err != nil {
+		return fmt.Errorf("unable to write row group: %w", err)
+	}
+	if err := h.file.Sync(); err != nil {
+		return fmt.Errorf("unable to sync parquet file: %w", err)
+	}
+	return nil
+}
+
+func (h *hourlyFile) rotate(hour time.Time) error {
+	if err := h.finish(); err != nil {
+		return err
+	}
+
+	path := h.filename(hour)
+	f, err := os.OpenFile(path+tmpExt, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0640)
+	if err != nil {
+		return fmt.Errorf("unable to create parquet file: %w", err)
+	}
+	buf := bufio.NewWriter(f)
+
+	fw, err := newFileWriter(buf, h.schema)
+	if err != nil {
+		_ = f.Close()
+		return fmt.Errorf("unable to write parquet header: %w", err)
+	}
+
+	h.hour = hour
+	h.file = f
+	h.buf = buf
+	h.fw = fw
+	h.path = path
+	return nil
+}
+
+// filename returns a file path for the hour that does not exist yet.
+// This avoids overwriting the file of an earlier run in the same hour.
+func (h *hourlyFile) filename(hour time.Time) string {
+	base := filepath.Join(h.dir, h.prefix+hour.Format(fileTimeFormat))
+	path := base + ".parquet"
+	for i := 1; ; i++ {
+		if _, err := os.Stat(path); os.IsNotExist(err) {
+			return path
+		}
+		path = fmt.Sprintf("%s-%d.parquet", base, i)
+	}
+}
+
+// finish commits the current file. Its footer was
+// written with its last row group.
+func (h *hourlyFile) finish() error {
+	if h.fw == nil {
+		return nil
+	}
+
+	f, path := h.file, h.path
+	h.fw, h.file, h.buf, h.path = nil, nil, nil, ""
+
+	if err := f.Close(); err != nil {
+		return fmt.Errorf("unable to close parquet file: %w", err)
+	}
+	if err := os.Rename(path+tmpExt, path); err != nil {
+		return fmt.Errorf("unable to commit parquet file: %w", err)
+	}
+	return nil
+}
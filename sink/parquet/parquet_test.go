@@ -0,0 +1,382 @@
+package parquet
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/influxdata/tdigest"
+	"github.com/nrwiersma/ebpf/flow"
+	"github.com/nrwiersma/ebpf/stats"
+)
+
+func TestSink_RoundTrip(t *testing.T) {
+	dir := t.TempDir()
+
+	s, err := New(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rtt := tdigest.New()
+	rtt.Add(1000, 1)
+	ms := []flow.Metric{
+		{Timestamp: 1600000000, Subject: "default/a", Remote: "default/b", Port: 8080, Protocol: "tcp", BytesIn: 10, BytesOut: 20, PacketsOut: 4, BytesRate: 3, PacketsRate: 0.4, RTT: rtt},
+		{Timestamp: 1600000000, Subject: "default/b", Remote: "default/a", Port: 8080, Protocol: "tcp", BytesIn: 20, BytesOut: 10},
+	}
+	if err = s.Write(ms); err != nil {
+		t.Fatal(err)
+	}
+	// A second write in the same hour is a row group of the same file.
+	if err = s.Write([]flow.Metric{{Timestamp: 1600000060, Subject: "default/c", Remote: "default/a", Port: 8080, Protocol: "tcp", BytesOut: 5}}); err != nil {
+		t.Fatal(err)
+	}
+	if err = s.WriteStats(stats.Stats{Timestamp: 1600000000, Node: "node", Series: 2}); err != nil {
+		t.Fatal(err)
+	}
+
+	// The file of the current hour is complete before it is committed.
+	f := readFile(t, filepath.Join(dir, "flows-20200913T12.parquet.tmp"))
+	if f.rows != 3 || len(f.groups) != 2 {
+		t.Fatalf("expected 3 rows in 2 row groups, got %d in %d", f.rows, len(f.groups))
+	}
+
+	// The next hour commits the file of the previous hour.
+	if err = s.Write([]flow.Metric{{Timestamp: 1600003600, Subject: "default/a", Remote: "default/b", Port: 8080, Protocol: "tcp", BytesIn: 1}}); err != nil {
+		t.Fatal(err)
+	}
+	if err = s.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	files, err := filepath.Glob(filepath.Join(dir, "*"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"agent-20200913T12.parquet", "flows-20200913T12.parquet", "flows-20200913T13.parquet"}
+	if len(files) != len(want) {
+		t.Fatalf("expected files %v, got %v", want, files)
+	}
+	for i, f := range files {
+		if filepath.Base(f) != want[i] {
+			t.Fatalf("expected files %v, got %v", want, files)
+		}
+	}
+
+	f = readFile(t, filepath.Join(dir, "flows-20200913T12.parquet"))
+	if f.rows != 3 {
+		t.Fatalf("expected 3 rows, got %d", f.rows)
+	}
+	if got := f.column(t, "subject"); fmt.Sprint(got) != "[default/a default/b default/c]" {
+		t.Errorf("unexpected subjects %v", got)
+	}
+	if got := f.column(t, "port"); fmt.Sprint(got) != "[8080 8080 8080]" {
+		t.Errorf("unexpected ports %v", got)
+	}
+	if got := f.column(t, "bytes_out"); fmt.Sprint(got) != "[20 10 5]" {
+		t.Errorf("unexpected bytes out %v", got)
+	}
+	if got := f.column(t, "timestamp"); fmt.Sprint(got) != "[1600000000000 1600000000000 1600000060000]" {
+		t.Errorf("unexpected timestamps %v", got)
+	}
+	if got := f.column(t, "packets_out"); fmt.Sprint(got) != "[4 0 0]" {
+		t.Errorf("unexpected packets out %v", got)
+	}
+	if got := f.column(t, "bytes_rate"); fmt.Sprint(got) != "[3 0 0]" {
+		t.Errorf("unexpected bytes rate %v", got)
+	}
+	if got := f.column(t, "packets_rate"); fmt.Sprint(got) != "[0.4 0 0]" {
+		t.Errorf("unexpected packets rate %v", got)
+	}
+	if got := f.column(t, "rtt_p50"); fmt.Sprint(got) != "[1000 <nil> <nil>]" {
+		t.Errorf("unexpected rtt p50 %v", got)
+	}
+
+	f = readFile(t, filepath.Join(dir, "flows-20200913T13.parquet"))
+	if f.rows != 1 {
+		t.Fatalf("expected 1 row, got %d", f.rows)
+	}
+
+	f = readFile(t, filepath.Join(dir, "agent-20200913T12.parquet"))
+	if f.rows != 1 {
+		t.Fatalf("expected 1 row, got %d", f.rows)
+	}
+	if got := f.column(t, "node"); fmt.Sprint(got) != "[node]" {
+		t.Errorf("unexpected nodes %v", got)
+	}
+	if got := f.column(t, "series"); fmt.Sprint(got) != "[2]" {
+		t.Errorf("unexpected series %v", got)
+	}
+}
+
+func TestNew_RecoversUnfinishedFiles(t *testing.T) {
+	dir := t.TempDir()
+
+	s, err := New(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = s.Write([]flow.Metric{{Timestamp: 1600000000, Subject: "a"}}); err != nil {
+		t.Fatal(err)
+	}
+	// The sink is not closed, as if the process crashed.
+	torn := filepath.Join(dir, "agent-20200913T12.parquet.tmp")
+	if err = os.WriteFile(torn, []byte(magic+"partial row group"), 0640); err != nil {
+		t.Fatal(err)
+	}
+
+	s, err = New(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = s.Close() }()
+
+	f := readFile(t, filepath.Join(dir, "flows-20200913T12.parquet"))
+	if got := f.column(t, "subject"); fmt.Sprint(got) != "[a]" {
+		t.Errorf("unexpected subjects %v", got)
+	}
+	if _, err = os.Stat(torn); !os.IsNotExist(err) {
+		t.Errorf("expected the torn file to be removed, got %v", err)
+	}
+
+	// Writes of the same hour go to a new file.
+	if err = s.Write([]flow.Metric{{Timestamp: 1600000060, Subject: "b"}}); err != nil {
+		t.Fatal(err)
+	}
+	if err = s.Close(); err != nil {
+		t.Fatal(err)
+	}
+	f = readFile(t, filepath.Join(dir, "flows-20200913T12-1.parquet"))
+	if got := f.column(t, "subject"); fmt.Sprint(got) != "[b]" {
+		t.Errorf("unexpected subjects %v", got)
+	}
+}
+
+// parquetFile is a parquet file as written by the file writer.
+type parquetFile struct {
+	data   []byte
+	cols   []column
+	rows   int64
+	groups []rowGroup
+}
+
+// rowGroup is the number of rows and the column chunk offsets of a row group.
+type rowGroup struct {
+	rows   int
+	chunks []int64
+}
+
+func readFile(t *testing.T, path string) parquetFile {
+	t.Helper()
+
+	b, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(b) < 12 || string(b[:4]) != magic || string(b[len(b)-4:]) != magic {
+		t.Fatalf("%s: missing parquet magic", path)
+	}
+	n := int(binary.LittleEndian.Uint32(b[len(b)-8:]))
+	r := &thriftReader{b: b[len(b)-8-n : len(b)-8]}
+	meta := r.Struct()
+
+	f := parquetFile{data: b, rows: meta[3].(int64)}
+	for _, el := range meta[2].([]interface{})[1:] {
+		el := el.(map[int16]interface{})
+		f.cols = append(f.cols, column{
+			name:     string(el[4].([]byte)),
+			typ:      el[1].(int32),
+			optional: el[3].(int32) == 1,
+		})
+	}
+	for _, g := range meta[4].([]interface{}) {
+		g := g.(map[int16]interface{})
+		grp := rowGroup{rows: int(g[3].(int64))}
+		for _, c := range g[1].([]interface{}) {
+			md := c.(map[int16]interface{})[3].(map[int16]interface{})
+			grp.chunks = append(grp.chunks, md[9].(int64))
+		}
+		f.groups = append(f.groups, grp)
+	}
+	return f
+}
+
+// column returns the values of the named column.
+func (f parquetFile) column(t *testing.T, name string) []interface{} {
+	t.Helper()
+
+	idx := -1
+	for i, c := range f.cols {
+		if c.name == name {
+			idx = i
+		}
+	}
+	if idx < 0 {
+		t.Fatalf("column %q not found", name)
+	}
+	col := f.cols[idx]
+
+	var vals []interface{}
+	for _, grp := range f.groups {
+		vals = append(vals, f.chunk(grp.chunks[idx], col)...)
+	}
+	return vals
+}
+
+// chunk returns the values of the column chunk at the offset.
+func (f parquetFile) chunk(off int64, col column) []interface{} {
+	r := &thriftReader{b: f.data[off:]}
+	hdr := r.Struct()
+	n := int(hdr[5].(map[int16]interface{})[1].(int32))
+	data := r.b[:hdr[3].(int32)]
+
+	defs := make([]bool, n)
+	for i := range defs {
+		defs[i] = true
+	}
+	if col.optional {
+		l := int(binary.LittleEndian.Uint32(data))
+		defs = decodeLevels(data[4:4+l], n)
+		data = data[4+l:]
+	}
+
+	vals := make([]interface{}, 0, n)
+	for _, def := range defs {
+		if !def {
+			vals = append(vals, nil)
+			continue
+		}
+		switch col.typ {
+		case typeInt32:
+			vals = append(vals, int32(binary.LittleEndian.Uint32(data)))
+			data = data[4:]
+		case typeInt64:
+			vals = append(vals, int64(binary.LittleEndian.Uint64(data)))
+			data = data[8:]
+		case typeDouble:
+			vals = append(vals, math.Float64frombits(binary.LittleEndian.Uint64(data)))
+			data = data[8:]
+		case typeByteArray:
+			l := binary.LittleEndian.Uint32(data)
+			vals = append(vals, string(data[4:4+l]))
+			data = data[4+l:]
+		}
+	}
+	return vals
+}
+
+func decodeLevels(b []byte, n int) []bool {
+	defs := make([]bool, 0, n)
+	for len(defs) < n {
+		hdr, l := binary.Uvarint(b)
+		run := int(hdr >> 1)
+		v := b[l] == 1
+		b = b[l+1:]
+		for i := 0; i < run; i++ {
+			defs = append(defs, v)
+		}
+	}
+	return defs
+}
+
+// thriftReader decodes the thrift compact protocol into maps
+// of field ids, covering the types written by the thrift writer.
+type thriftReader struct {
+	b []byte
+}
+
+func (r *thriftReader) Struct() map[int16]interface{} {
+	m := map[int16]interface{}{}
+	var id int16
+	for {
+		h := r.byte()
+		if h == 0 {
+			return m
+		}
+		if delta := int16(h >> 4); delta != 0 {
+			id += delta
+		} else {
+			id = int16(r.varint())
+		}
+		m[id] = r.value(h & 0x0f)
+	}
+}
+
+func (r *thriftReader) value(typ byte) interface{} {
+	switch typ {
+	case tI32:
+		return int32(r.varint())
+	case tI64:
+		return r.varint()
+	case tBinary:
+		n := r.uvarint()
+		v := r.b[:n]
+		r.b = r.b[n:]
+		return v
+	case tList:
+		h := r.byte()
+		n := int(h >> 4)
+		if n == 15 {
+			n = int(r.uvarint())
+		}
+		l := make([]interface{}, n)
+		for i := range l {
+			l[i] = r.value(h & 0x0f)
+		}
+		return l
+	case tStruct:
+		return r.Struct()
+	default:
+		panic(fmt.Sprintf("unexpected thrift type %d", typ))
+	}
+}
+
+func (r *thriftReader) byte() byte {
+	b := r.b[0]
+	r.b = r.b[1:]
+	return b
+}
+
+func (r *thriftReader) varint() int64 {
+	v, n := binary.Varint(r.b)
+	r.b = r.b[n:]
+	return v
+}
+
+func (r *thriftReader) uvarint() uint64 {
+	v, n := binary.Uvarint(r.b)
+	r.b = r.b[n:]
+	return v
+}
+
+func TestSink_LeavesNoTempFiles(t *testing.T) {
+	dir := t.TempDir()
+
+	s, err := New(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = s.Write([]flow.Metric{{Timestamp: 1600000000, Subject: "a"}}); err != nil {
+		t.Fatal(err)
+	}
+	if err = s.WriteStats(stats.Stats{Timestamp: 1600000000}); err != nil {
+		t.Fatal(err)
+	}
+	if err = s.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, e := range entries {
+		if strings.HasSuffix(e.Name(), tmpExt) {
+			t.Errorf("unexpected temporary file %s", e.Name())
+		}
+	}
+}
@@ -0,0 +1,102 @@
+package parquet
+
+import (
+	"bytes"
+	"encoding/binary"
+)
+
+// Thrift compact protocol types.
+const (
+	tI32    = 5
+	tI64    = 6
+	tBinary = 8
+	tList   = 9
+	tStruct = 12
+)
+
+// thriftWriter is a minimal thrift compact protocol encoder,
+// covering the subset of types used by the parquet metadata.
+type thriftWriter struct {
+	buf    bytes.Buffer
+	lastID []int16
+}
+
+func (w *thriftWriter) fieldHeader(id int16, typ byte) {
+	last := int16(0)
+	if n := len(w.lastID); n > 0 {
+		last = w.lastID[n-1]
+		w.lastID[n-1] = id
+	}
+
+	if delta := id - last; delta > 0 && delta <= 15 {
+		w.buf.WriteByte(byte(delta<<4) | typ)
+		return
+	}
+	w.buf.WriteByte(typ)
+	w.varint(int64(id))
+}
+
+func (w *thriftWriter) varint(v int64) {
+	var b [binary.MaxVarintLen64]byte
+	n := binary.PutVarint(b[:], v)
+	w.buf.Write(b[:n])
+}
+
+func (w *thriftWriter) uvarint(v uint64) {
+	var b [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(b[:], v)
+	w.buf.Write(b[:n])
+}
+
+func (w *thriftWriter) I32(id int16, v int32) {
+	w.fieldHeader(id, tI32)
+	w.varint(int64(v))
+}
+
+func (w *thriftWriter) I64(id int16, v int64) {
+	w.fieldHeader(id, tI64)
+	w.varint(v)
+}
+
+func (w *thriftWriter) String(id int16, v string) {
+	w.fieldHeader(id, tBinary)
+	w.uvarint(uint64(len(v)))
+	w.buf.WriteString(v)
+}
+
+func (w *thriftWriter) ListBegin(id int16, elemType byte, size int) {
+	w.fieldHeader(id, tList)
+	if size < 15 {
+		w.buf.WriteByte(byte(size<<4) | elemType)
+		return
+	}
+	w.buf.WriteByte(0xf0 | elemType)
+	w.uvarint(uint64(size))
+}
+
+func (w *thriftWriter) ListI32(v int32) {
+	w.varint(int64(v))
+}
+
+func (w *thriftWriter) ListString(v string) {
+	w.uvarint(uint64(len(v)))
+	w.buf.WriteString(v)
+}
+
+// StructBegin begins a struct field. An id of zero begins a
+// struct as a list element or the top level struct.
+func (w *thriftWriter) StructBegin(id int16) {
+	if id != 0 {
+		w.fieldHeader(id, tStruct)
+	}
+	w.lastID = append(w.lastID, 0)
+}
+
+func (w *thriftWriter) StructEnd() {
+	w.buf.WriteByte(0)
+	w.lastID = w.lastID[:len(w.lastID)-1]
+}
+
+func (w *thriftWriter) Bytes() []byte {
+	return w.buf.Bytes()
+}
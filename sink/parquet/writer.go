@@ -0,0 +1,290 @@
+package parquet
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"math"
+)
+
+const magic = "PAR1"
+
+// Parquet physical types.
+const (
+	typeInt32     = 1
+	typeInt64     = 2
+	typeDouble    = 5
+	typeByteArray = 6
+)
+
+// Parquet converted types.
+const (
+	convertedNone            = -1
+	convertedUTF8            = 0
+	convertedTimestampMillis = 9
+	convertedUint16          = 12
+	convertedUint64          = 14
+)
+
+// Parquet encodings.
+const (
+	encodingPlain = 0
+	encodingRLE   = 3
+)
+
+// column describes a flat parquet column.
+type column struct {
+	name      string
+	typ       int32
+	converted int32
+	optional  bool
+}
+
+// columnBuffer accumulates the values of a column for a row group.
+type columnBuffer struct {
+	col  column
+	vals bytes.Buffer
+	defs []bool
+	n    int
+}
+
+func (b *columnBuffer) Int32(v int32) {
+	var p [4]byte
+	binary.LittleEndian.PutUint32(p[:], uint32(v))
+	b.vals.Write(p[:])
+	b.value()
+}
+
+func (b *columnBuffer) Int64(v int64) {
+	var p [8]byte
+	binary.LittleEndian.PutUint64(p[:], uint64(v))
+	b.vals.Write(p[:])
+	b.value()
+}
+
+func (b *columnBuffer) Double(v float64) {
+	var p [8]byte
+	binary.LittleEndian.PutUint64(p[:], math.Float64bits(v))
+	b.vals.Write(p[:])
+	b.value()
+}
+
+func (b *columnBuffer) String(v string) {
+	var p [4]byte
+	binary.LittleEndian.PutUint32(p[:], uint32(len(v)))
+	b.vals.Write(p[:])
+	b.vals.WriteString(v)
+	b.value()
+}
+
+// Null adds a null value. Only valid for optional columns.
+func (b *columnBuffer) Null() {
+	b.defs = append(b.defs, false)
+	b.n++
+}
+
+func (b *columnBuffer) value() {
+	if b.col.optional {
+		b.defs = append(b.defs, true)
+	}
+	b.n++
+}
+
+func (b *columnBuffer) Reset() {
+	b.vals.Reset()
+	b.defs = b.defs[:0]
+	b.n = 0
+}
+
+// page encodes the buffer as a data page.
+func (b *columnBuffer) page() []byte {
+	var data bytes.Buffer
+	if b.col.optional {
+		levels := encodeLevels(b.defs)
+		var p [4]byte
+		binary.LittleEndian.PutUint32(p[:], uint32(len(levels)))
+		data.Write(p[:])
+		data.Write(levels)
+	}
+	data.Write(b.vals.Bytes())
+
+	var hdr thriftWriter
+	hdr.StructBegin(0)
+	hdr.I32(1, 0) // DATA_PAGE
+	hdr.I32(2, int32(data.Len()))
+	hdr.I32(3, int32(data.Len()))
+	hdr.StructBegin(5)
+	hdr.I32(1, int32(b.n))
+	hdr.I32(2, encodingPlain)
+	hdr.I32(3, encodingRLE)
+	hdr.I32(4, encodingRLE)
+	hdr.StructEnd()
+	hdr.StructEnd()
+
+	return append(hdr.Bytes(), data.Bytes()...)
+}
+
+// encodeLevels encodes definition levels with a bit width of 1
+// using the run length encoding of the RLE/bit-packing hybrid.
+func encodeLevels(defs []bool) []byte {
+	var buf bytes.Buffer
+	var tmp [binary.MaxVarintLen64]byte
+	for i := 0; i < len(defs); {
+		j := i
+		for j < len(defs) && defs[j] == defs[i] {
+			j++
+		}
+
+		n := binary.PutUvarint(tmp[:], uint64(j-i)<<1)
+		buf.Write(tmp[:n])
+		if defs[i] {
+			buf.WriteByte(1)
+		} else {
+			buf.WriteByte(0)
+		}
+		i = j
+	}
+	return buf.Bytes()
+}
+
+type chunkMeta struct {
+	offset int64
+	size   int64
+	values int64
+}
+
+type rowGroupMeta struct {
+	chunks []chunkMeta
+	rows   int64
+	size   int64
+}
+
+// fileWriter writes a parquet file with flat, uncompressed,
+// plain encoded columns.
+type fileWriter struct {
+	w    io.Writer
+	cols []column
+	off  int64
+
+	groups []rowGroupMeta
+	rows   int64
+}
+
+func newFileWriter(w io.Writer, cols []column) (*fileWriter, error) {
+	fw := &fileWriter{w: w, cols: cols}
+	if err := fw.write([]byte(magic)); err != nil {
+		return nil, err
+	}
+	return fw, nil
+}
+
+// WriteRowGroup writes the column buffers as a row group.
+// The buffers must be in the same order as the columns.
+func (fw *fileWriter) WriteRowGroup(bufs []*columnBuffer) error {
+	if len(bufs) == 0 || bufs[0].n == 0 {
+		return nil
+	}
+
+	grp := rowGroupMeta{
+		chunks: make([]chunkMeta, 0, len(bufs)),
+		rows:   int64(bufs[0].n),
+	}
+	for _, b := range bufs {
+		page := b.page()
+		chunk := chunkMeta{
+			offset: fw.off,
+			size:   int64(len(page)),
+			values: int64(b.n),
+		}
+		if err := fw.write(page); err != nil {
+			return err
+		}
+
+		grp.chunks = append(grp.chunks, chunk)
+		grp.size += chunk.size
+	}
+
+	fw.groups = append(fw.groups, grp)
+	fw.rows += grp.rows
+	return nil
+}
+
+// Close writes the file footer. It does not close the underlying writer.
+func (fw *fileWriter) Close() error {
+	return fw.write(fw.Footer())
+}
+
+// Footer returns the file footer of the row groups written so far.
+// Writing it after the row groups makes a complete file, without
+// closing the writer, so more row groups can be written over it.
+func (fw *fileWriter) Footer() []byte {
+	var meta thriftWriter
+	meta.StructBegin(0)
+	meta.I32(1, 1)
+
+	meta.ListBegin(2, tStruct, len(fw.cols)+1)
+	meta.StructBegin(0)
+	meta.String(4, "schema")
+	meta.I32(5, int32(len(fw.cols)))
+	meta.StructEnd()
+	for _, col := range fw.cols {
+		meta.StructBegin(0)
+		meta.I32(1, col.typ)
+		if col.optional {
+			meta.I32(3, 1)
+		} else {
+			meta.I32(3, 0)
+		}
+		meta.String(4, col.name)
+		if col.converted != convertedNone {
+			meta.I32(6, col.converted)
+		}
+		meta.StructEnd()
+	}
+
+	meta.I64(3, fw.rows)
+
+	meta.ListBegin(4, tStruct, len(fw.groups))
+	for _, grp := range fw.groups {
+		meta.StructBegin(0)
+		meta.ListBegin(1, tStruct, len(grp.chunks))
+		for i, chunk := range grp.chunks {
+			col := fw.cols[i]
+
+			meta.StructBegin(0)
+			meta.I64(2, chunk.offset)
+			meta.StructBegin(3)
+			meta.I32(1, col.typ)
+			meta.ListBegin(2, tI32, 2)
+			meta.ListI32(encodingPlain)
+			meta.ListI32(encodingRLE)
+			meta.ListBegin(3, tBinary, 1)
+			meta.ListString(col.name)
+			meta.I32(4, 0) // UNCOMPRESSED
+			meta.I64(5, chunk.values)
+			meta.I64(6, chunk.size)
+			meta.I64(7, chunk.size)
+			meta.I64(9, chunk.offset)
+			meta.StructEnd()
+			meta.StructEnd()
+		}
+		meta.I64(2, grp.size)
+		meta.I64(3, grp.rows)
+		meta.StructEnd()
+	}
+
+	meta.String(6, "github.com/nrwiersma/ebpf")
+	meta.StructEnd()
+
+	footer := meta.Bytes()
+	var p [4]byte
+	binary.LittleEndian.PutUint32(p[:], uint32(len(footer)))
+
+	return append(append(footer, p[:]...), magic...)
+}
+
+func (fw *fileWriter) write(b []byte) error {
+	n, err := fw.w.Write(b)
+	fw.off += int64(n)
+	return err
+}
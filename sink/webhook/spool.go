@@ -0,0 +1,172 @@
+package webhook
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const (
+	spoolExt = ".batch"
+	tmpExt   = ".tmp"
+)
+
+type spoolFile struct {
+	seq  uint64
+	size int64
+}
+
+// spool is an on-disk, size capped, ordered queue of batches.
+//
+// Each batch is stored in its own file named after its sequence
+// number, which keeps the order stable across restarts.
+type spool struct {
+	dir     string
+	maxSize int64
+
+	mu    sync.Mutex
+	files []spoolFile
+	size  int64
+	seq   uint64
+}
+
+func newSpool(dir string, maxSize int64) (*spool, error) {
+	if err := os.MkdirAll(dir, 0750); err != nil {
+		return nil, fmt.Errorf("unable to create spool directory: %w", err)
+	}
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read spool directory: %w", err)
+	}
+
+	s := &spool{
+		dir:     dir,
+		maxSize: maxSize,
+	}
+	for _, e := range entries {
+		name := e.Name()
+		if !e.IsDir() && strings.HasSuffix(name, spoolExt+tmpExt) {
+			// Batches that were being written when the process stopped are incomplete.
+			if err = os.Remove(filepath.Join(dir, name)); err != nil && !os.IsNotExist(err) {
+				return nil, fmt.Errorf("unable to remove spool file %q: %w", name, err)
+			}
+			continue
+		}
+		if e.IsDir() || !strings.HasSuffix(name, spoolExt) {
+			continue
+		}
+
+		seq, err := strconv.ParseUint(strings.TrimSuffix(name, spoolExt), 10, 64)
+		if err != nil {
+			continue
+		}
+		info, err := e.Info()
+		if err != nil {
+			return nil, fmt.Errorf("unable to stat spool file %q: %w", name, err)
+		}
+
+		s.files = append(s.files, spoolFile{seq: seq, size: info.Size()})
+		s.size += info.Size()
+		if seq > s.seq {
+			s.seq = seq
+		}
+	}
+	sort.Slice(s.files, func(i, j int) bool {
+		return s.files[i].seq < s.files[j].seq
+	})
+
+	return s, nil
+}
+
+// Push appends a batch to the end of the spool. If the spool
+// exceeds its maximum size, the oldest batches are dropped.
+// The number of dropped batches is returned.
+func (s *spool) Push(b []byte) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	seq := s.seq + 1
+	path := s.path(seq)
+	tmp := path + tmpExt
+	if err := os.WriteFile(tmp, b, 0640); err != nil {
+		return 0, fmt.Errorf("unable to write spool file: %w", err)
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		_ = os.Remove(tmp)
+		return 0, fmt.Errorf("unable to commit spool file: %w", err)
+	}
+
+	s.seq = seq
+	s.files = append(s.files, spoolFile{seq: seq, size: int64(len(b))})
+	s.size += int64(len(b))
+
+	var dropped int
+	for s.maxSize > 0 && s.size > s.maxSize && len(s.files) > 1 {
+		if err := s.remove(0); err != nil {
+			return dropped, err
+		}
+		dropped++
+	}
+
+	return dropped, nil
+}
+
+// Peek returns the oldest batch in the spool and its sequence number.
+func (s *spool) Peek() (uint64, []byte, bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if len(s.files) == 0 {
+		return 0, nil, false, nil
+	}
+
+	seq := s.files[0].seq
+	b, err := os.ReadFile(s.path(seq))
+	if err != nil {
+		return seq, nil, false, fmt.Errorf("unable to read spool file: %w", err)
+	}
+	return seq, b, true, nil
+}
+
+// Pop removes the batch with the sequence number from the spool.
+// The batch may have been dropped by Push since it was peeked,
+// in which case nothing is removed.
+func (s *spool) Pop(seq uint64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for i, f := range s.files {
+		if f.seq == seq {
+			return s.remove(i)
+		}
+	}
+	return nil
+}
+
+// Len returns the number of batches in the spool.
+func (s *spool) Len() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return len(s.files)
+}
+
+func (s *spool) remove(i int) error {
+	f := s.files[i]
+	if err := os.Remove(s.path(f.seq)); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("unable to remove spool file: %w", err)
+	}
+
+	s.files = append(s.files[:i], s.files[i+1:]...)
+	s.size -= f.size
+	return nil
+}
+
+func (s *spool) path(seq uint64) string {
+	return filepath.Join(s.dir, fmt.Sprintf("%020d%s", seq, spoolExt))
+}
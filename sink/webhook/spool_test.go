@@ -0,0 +1,108 @@
+package webhook
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestSpool_PopRemovesOnlyPeekedBatch(t *testing.T) {
+	s, err := newSpool(t.TempDir(), 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err = s.Push([]byte("first")); err != nil {
+		t.Fatal(err)
+	}
+	seq, b, ok, err := s.Peek()
+	if err != nil || !ok {
+		t.Fatalf("expected a batch, got %v, %v", ok, err)
+	}
+	if !bytes.Equal(b, []byte("first")) {
+		t.Fatalf("expected first batch, got %q", b)
+	}
+
+	// The peeked batch is dropped by the overflow.
+	dropped, err := s.Push([]byte("second"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if dropped != 1 {
+		t.Fatalf("expected 1 dropped batch, got %d", dropped)
+	}
+
+	if err = s.Pop(seq); err != nil {
+		t.Fatal(err)
+	}
+
+	if s.Len() != 1 {
+		t.Fatalf("expected 1 batch, got %d", s.Len())
+	}
+	_, b, _, err = s.Peek()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(b, []byte("second")) {
+		t.Fatalf("expected second batch, got %q", b)
+	}
+}
+
+func TestSpool_ReloadsInOrder(t *testing.T) {
+	dir := t.TempDir()
+
+	s, err := newSpool(dir, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, b := range []string{"a", "b", "c"} {
+		if _, err = s.Push([]byte(b)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	s, err = newSpool(dir, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for {
+		seq, b, ok, err := s.Peek()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !ok {
+			break
+		}
+		got = append(got, string(b))
+		if err = s.Pop(seq); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if want := []string{"a", "b", "c"}; len(got) != len(want) || got[0] != want[0] || got[1] != want[1] || got[2] != want[2] {
+		t.Fatalf("expected %v, got %v", want, got)
+	}
+}
+
+func TestSpool_RemovesIncompleteFiles(t *testing.T) {
+	dir := t.TempDir()
+	tmp := filepath.Join(dir, fmt.Sprintf("%020d%s%s", 1, spoolExt, tmpExt))
+	if err := os.WriteFile(tmp, []byte("partial"), 0640); err != nil {
+		t.Fatal(err)
+	}
+
+	s, err := newSpool(dir, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if s.Len() != 0 {
+		t.Errorf("expected an empty spool, got %d batches", s.Len())
+	}
+	if _, err = os.Stat(tmp); !os.IsNotExist(err) {
+		t.Errorf("expected the incomplete file to be removed, got %v", err)
+	}
+}
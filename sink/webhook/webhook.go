@@ -0,0 +1,441 @@
+// Package webhook implements a metrics sink that pushes
+// metric batches to a HTTP endpoint.
+//
+// Flow metrics and the internal metrics of the agent are posted
+// to the same endpoint. The "type" field of the default payloads
+// tells them apart: it is "metrics" for a batch of flow metrics,
+// and "stats" for the internal metrics of the agent.
+package webhook
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/hamba/logger"
+	"github.com/influxdata/tdigest"
+	"github.com/nrwiersma/ebpf/flow"
+	"github.com/nrwiersma/ebpf/stats"
+)
+
+// DefaultMaxSpoolSize is the default maximum size of the spool in bytes.
+const DefaultMaxSpoolSize = 64 << 20
+
+// Payload types, sent in the "type" field of the default payloads.
+const (
+	TypeMetrics = "metrics"
+	TypeStats   = "stats"
+)
+
+// OptsFunc represents a configuration function for the sink.
+type OptsFunc func(s *Sink)
+
+// WithHeader configures a header to be sent with each request.
+func WithHeader(key, value string) OptsFunc {
+	return func(s *Sink) {
+		s.headers.Add(key, value)
+	}
+}
+
+// WithBasicAuth configures the sink to use basic authentication.
+func WithBasicAuth(user, pass string) OptsFunc {
+	return func(s *Sink) {
+		s.user = user
+		s.pass = pass
+	}
+}
+
+// WithBearerToken configures the sink to use bearer token authentication.
+func WithBearerToken(token string) OptsFunc {
+	return func(s *Sink) {
+		s.headers.Set("Authorization", "Bearer "+token)
+	}
+}
+
+// WithTimeout configures the request timeout.
+func WithTimeout(d time.Duration) OptsFunc {
+	return func(s *Sink) {
+		s.client.Timeout = d
+	}
+}
+
+// WithRetryInterval configures the initial interval between retries
+// when the endpoint is unavailable. The interval doubles on each
+// consecutive failure up to a minute.
+// Batches written while waiting to retry do not cut the wait short.
+// Batches the endpoint rejects with a client error, other than a
+// timeout or rate limit, are dropped instead of retried.
+func WithRetryInterval(d time.Duration) OptsFunc {
+	return func(s *Sink) {
+		s.retry = d
+	}
+}
+
+// WithMaxSpoolSize configures the maximum size of the spool in bytes.
+// When exceeded, the oldest batches are dropped.
+func WithMaxSpoolSize(size int64) OptsFunc {
+	return func(s *Sink) {
+		s.maxSize = size
+	}
+}
+
+// WithEncoder configures the function used to encode a batch
+// of metrics into a request body.
+func WithEncoder(fn func(ms []flow.Metric) ([]byte, error)) OptsFunc {
+	return func(s *Sink) {
+		s.enc = fn
+	}
+}
+
+// WithStatsEncoder configures the function used to encode the
+// internal metrics of the agent into a request body. A nil
+// function disables sending them.
+func WithStatsEncoder(fn func(st stats.Stats) ([]byte, error)) OptsFunc {
+	return func(s *Sink) {
+		s.statsEnc = fn
+	}
+}
+
+// WithLogger configures the logger of the sink.
+func WithLogger(log logger.Logger) OptsFunc {
+	return func(s *Sink) {
+		s.log = log
+	}
+}
+
+// Sink pushes metric batches as JSON to a HTTP endpoint.
+//
+// Batches are first written to an on-disk spool, and sent
+// to the endpoint in order. When the endpoint is unavailable,
+// batches remain in the spool until they can be delivered.
+type Sink struct {
+	url     string
+	headers http.Header
+	user    string
+	pass    string
+	client  *http.Client
+	retry   time.Duration
+	maxSize int64
+	enc     func(ms []flow.Metric) ([]byte, error)
+
+	statsEnc func(st stats.Stats) ([]byte, error)
+
+	spool *spool
+
+	notifyCh chan struct{}
+	ctx      context.Context
+	cancel   context.CancelFunc
+	stopped  chan struct{}
+
+	log logger.Logger
+}
+
+// New returns a webhook sink that posts to the given url, spooling
+// batches in the given directory.
+func New(url, dir string, opts ...OptsFunc) (*Sink, error) {
+	s := &Sink{
+		url:      url,
+		headers:  http.Header{},
+		client:   &http.Client{Timeout: 10 * time.Second},
+		retry:    time.Second,
+		maxSize:  DefaultMaxSpoolSize,
+		enc:      encode,
+		statsEnc: encodeStats,
+		notifyCh: make(chan struct{}, 1),
+		stopped:  make(chan struct{}),
+		log:      logger.New(logger.DiscardHandler()),
+	}
+
+	for _, opt := range opts {
+		opt(s)
+	}
+
+	spool, err := newSpool(dir, s.maxSize)
+	if err != nil {
+		return nil, err
+	}
+	s.spool = spool
+
+	s.ctx, s.cancel = context.WithCancel(context.Background())
+	go s.runSend()
+
+	return s, nil
+}
+
+// Write queues the metrics to be sent to the endpoint.
+func (s *Sink) Write(ms []flow.Metric) error {
+	if len(ms) == 0 {
+		return nil
+	}
+
+	b, err := s.enc(ms)
+	if err != nil {
+		return fmt.Errorf("unable to encode metrics: %w", err)
+	}
+
+	return s.push(b)
+}
+
+// WriteStats queues the internal metrics of the agent to be sent to the endpoint.
+func (s *Sink) WriteStats(st stats.Stats) error {
+	if s.statsEnc == nil {
+		return nil
+	}
+
+	b, err := s.statsEnc(st)
+	if err != nil {
+		return fmt.Errorf("unable to encode stats: %w", err)
+	}
+
+	return s.push(b)
+}
+
+// WriteBody queues an encoded request body to be sent to the endpoint.
+// It allows other payloads to be delivered with the same spooling
+// and retries as metrics.
+func (s *Sink) WriteBody(b []byte) error {
+	return s.push(b)
+}
+
+func (s *Sink) push(b []byte) error {
+	dropped, err := s.spool.Push(b)
+	if dropped > 0 {
+		s.log.Error("Spool full, dropped oldest batches", "count", dropped)
+	}
+	if err != nil {
+		return err
+	}
+
+	select {
+	case s.notifyCh <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+func (s *Sink) runSend() {
+	defer close(s.stopped)
+
+	const maxBackoff = time.Minute
+
+	backoff := s.retry
+	timer := time.NewTimer(0)
+	defer timer.Stop()
+
+	var retrying bool
+	for {
+		select {
+		case <-s.ctx.Done():
+			return
+		case <-s.notifyCh:
+			// New batches wait for the pending retry, so a failing
+			// endpoint is not retried at the rate batches are written.
+			if retrying {
+				continue
+			}
+		case <-timer.C:
+			retrying = false
+		}
+
+		for {
+			seq, b, ok, err := s.spool.Peek()
+			if err != nil {
+				s.log.Error("Unable to read spooled batch, dropping it", "error", err)
+				if err = s.spool.Pop(seq); err != nil {
+					s.log.Error("Unable to remove spooled batch", "error", err)
+					break
+				}
+				continue
+			}
+			if !ok {
+				break
+			}
+
+			if err = s.send(b); err != nil && !retryable(err) {
+				// The endpoint will not accept the batch, however often it is sent.
+				s.log.Error("Endpoint rejected batch, dropping it", "error", err)
+				if err = s.spool.Pop(seq); err != nil {
+					s.log.Error("Unable to remove spooled batch", "error", err)
+					break
+				}
+				continue
+			}
+			if err != nil {
+				s.log.Error("Unable to send batch", "error", err, "spooled", s.spool.Len(), "retry", backoff)
+
+				if !timer.Stop() {
+					select {
+					case <-timer.C:
+					default:
+					}
+				}
+				timer.Reset(backoff)
+				retrying = true
+				backoff *= 2
+				if backoff > maxBackoff {
+					backoff = maxBackoff
+				}
+				break
+			}
+			backoff = s.retry
+
+			// The batch may have been dropped while it was sent, when the
+			// spool overflowed. Only the sent batch is removed.
+			if err = s.spool.Pop(seq); err != nil {
+				s.log.Error("Unable to remove spooled batch", "error", err)
+				break
+			}
+
+			if s.ctx.Err() != nil {
+				return
+			}
+		}
+	}
+}
+
+func (s *Sink) send(b []byte) error {
+	req, err := http.NewRequestWithContext(s.ctx, http.MethodPost, s.url, bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	for k, v := range s.headers {
+		req.Header[k] = v
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if s.user != "" || s.pass != "" {
+		req.SetBasicAuth(s.user, s.pass)
+	}
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = resp.Body.Close() }()
+	_, _ = io.Copy(io.Discard, resp.Body)
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return statusError{code: resp.StatusCode}
+	}
+	return nil
+}
+
+// statusError is returned when the endpoint responds with an unexpected status.
+type statusError struct {
+	code int
+}
+
+func (e statusError) Error() string {
+	return fmt.Sprintf("unexpected status code %d", e.code)
+}
+
+// retryable determines if sending a batch that failed with the error
+// may succeed later. Client errors other than timeouts and rate limits
+// fail again, as the endpoint rejected the batch itself.
+func retryable(err error) bool {
+	var se statusError
+	if !errors.As(err, &se) {
+		return true
+	}
+	switch {
+	case se.code == http.StatusRequestTimeout, se.code == http.StatusTooManyRequests:
+		return true
+	case se.code >= 400 && se.code < 500:
+		return false
+	default:
+		return true
+	}
+}
+
+// Close stops sending batches. Batches that have not been
+// sent remain in the spool and are sent once a new sink is
+// created on the same directory.
+func (s *Sink) Close() error {
+	s.cancel()
+	<-s.stopped
+
+	return nil
+}
+
+type payload struct {
+	Type    string   `json:"type"`
+	Metrics []metric `json:"metrics"`
+}
+
+type metric struct {
+	Timestamp   int64      `json:"timestamp"`
+	Node        string     `json:"node,omitempty"`
+	Subject     string     `json:"subject,omitempty"`
+	Namespace   string     `json:"namespace,omitempty"`
+	Workload    string     `json:"workload,omitempty"`
+	Remote      string     `json:"remote,omitempty"`
+	Port        uint16     `json:"port,omitempty"`
+	Protocol    string     `json:"protocol,omitempty"`
+	Direction   string     `json:"direction,omitempty"`
+	BytesIn     uint64     `json:"bytesIn"`
+	BytesOut    uint64     `json:"bytesOut"`
+	PacketsIn   uint64     `json:"packetsIn"`
+	PacketsOut  uint64     `json:"packetsOut"`
+	BytesRate   float64    `json:"bytesRate"`
+	PacketsRate float64    `json:"packetsRate"`
+	RTT         *quantiles `json:"rtt,omitempty"`
+	Size        *quantiles `json:"size,omitempty"`
+	Start       int64      `json:"start,omitempty"`
+}
+
+type quantiles struct {
+	flow.Quantiles
+
+	P95 float64 `json:"p95"`
+}
+
+func encode(ms []flow.Metric) ([]byte, error) {
+	return json.Marshal(newPayload(ms))
+}
+
+func encodeStats(st stats.Stats) ([]byte, error) {
+	return json.Marshal(struct {
+		Type  string      `json:"type"`
+		Stats stats.Stats `json:"stats"`
+	}{Type: TypeStats, Stats: st})
+}
+
+func newPayload(ms []flow.Metric) payload {
+	p := payload{Type: TypeMetrics, Metrics: make([]metric, 0, len(ms))}
+	for _, m := range ms {
+		pm := metric{
+			Timestamp:   m.Timestamp,
+			Node:        m.Node,
+			Subject:     m.Subject,
+			Namespace:   m.Namespace,
+			Workload:    m.Workload,
+			Remote:      m.Remote,
+			Port:        m.Port,
+			Protocol:    m.Protocol,
+			Direction:   m.Direction,
+			BytesIn:     m.BytesIn,
+			BytesOut:    m.BytesOut,
+			PacketsIn:   m.PacketsIn,
+			PacketsOut:  m.PacketsOut,
+			BytesRate:   m.BytesRate,
+			PacketsRate: m.PacketsRate,
+			RTT:         newQuantiles(m.RTT),
+			Size:        newQuantiles(m.Size),
+			Start:       m.Start,
+		}
+		p.Metrics = append(p.Metrics, pm)
+	}
+	return p
+}
+
+func newQuantiles(td *tdigest.TDigest) *quantiles {
+	p95, ok := flow.Quantile(td, 0.95)
+	if !ok {
+		return nil
+	}
+	return &quantiles{Quantiles: flow.NewQuantiles(td), P95: p95}
+}
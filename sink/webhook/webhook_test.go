@@ -0,0 +1,254 @@
+package webhook
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/nrwiersma/ebpf/flow"
+	"github.com/nrwiersma/ebpf/stats"
+)
+
+func TestSink_OverflowDuringSend(t *testing.T) {
+	var (
+		mu     sync.Mutex
+		bodies []string
+	)
+	inFlight := make(chan struct{})
+	release := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := io.ReadAll(r.Body)
+
+		mu.Lock()
+		bodies = append(bodies, string(b))
+		n := len(bodies)
+		mu.Unlock()
+
+		if n == 1 {
+			close(inFlight)
+			<-release
+		}
+	}))
+	defer srv.Close()
+
+	s, err := New(srv.URL, t.TempDir(),
+		WithMaxSpoolSize(1),
+		WithEncoder(func(ms []flow.Metric) ([]byte, error) {
+			return []byte(ms[0].Subject), nil
+		}),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = s.Close() }()
+
+	if err = s.Write([]flow.Metric{{Subject: "first"}}); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-inFlight:
+	case <-time.After(5 * time.Second):
+		t.Fatal("first batch was not sent")
+	}
+
+	// The spool only fits one batch, so the batch being sent is dropped.
+	if err = s.Write([]flow.Metric{{Subject: "second"}}); err != nil {
+		t.Fatal(err)
+	}
+	close(release)
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		mu.Lock()
+		got := append([]string(nil), bodies...)
+		mu.Unlock()
+
+		// The spool is emptied once the sent batch is popped.
+		if len(got) == 2 && s.spool.Len() == 0 {
+			if got[0] != "first" || got[1] != "second" {
+				t.Fatalf("expected [first second], got %v", got)
+			}
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("expected the second batch to be sent, got %v with %d spooled", got, s.spool.Len())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestSink_PayloadTypes(t *testing.T) {
+	bodies := make(chan []byte, 2)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := io.ReadAll(r.Body)
+		bodies <- b
+	}))
+	defer srv.Close()
+
+	s, err := New(srv.URL, t.TempDir())
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer func() { _ = s.Close() }()
+
+	if err = s.Write([]flow.Metric{{Timestamp: 1, Subject: "api"}}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err = s.WriteStats(stats.Stats{Timestamp: 1, Node: "node"}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	var got []string
+	for i := 0; i < 2; i++ {
+		select {
+		case b := <-bodies:
+			var p struct {
+				Type string `json:"type"`
+			}
+			if err = json.Unmarshal(b, &p); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			got = append(got, p.Type)
+		case <-time.After(5 * time.Second):
+			t.Fatal("payload was not delivered")
+		}
+	}
+
+	if len(got) != 2 || got[0] != TypeMetrics || got[1] != TypeStats {
+		t.Errorf("unexpected payload types %v", got)
+	}
+}
+
+func TestSink_WritesDoNotCutBackoffShort(t *testing.T) {
+	var calls int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer srv.Close()
+
+	s, err := New(srv.URL, t.TempDir(), WithRetryInterval(time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = s.Close() }()
+
+	if err = s.Write([]flow.Metric{{Subject: "first"}}); err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for atomic.LoadInt32(&calls) == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("first batch was not sent")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	for i := 0; i < 5; i++ {
+		if err = s.Write([]flow.Metric{{Subject: "next"}}); err != nil {
+			t.Fatal(err)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+
+	if got := atomic.LoadInt32(&calls); got != 1 {
+		t.Errorf("expected 1 request while backing off, got %d", got)
+	}
+	if got := s.spool.Len(); got != 6 {
+		t.Errorf("expected 6 spooled batches, got %d", got)
+	}
+}
+
+func TestSink_DropsRejectedBatches(t *testing.T) {
+	bodies := make(chan string, 4)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := io.ReadAll(r.Body)
+		bodies <- string(b)
+		if string(b) == "bad" {
+			w.WriteHeader(http.StatusBadRequest)
+		}
+	}))
+	defer srv.Close()
+
+	s, err := New(srv.URL, t.TempDir(),
+		WithRetryInterval(time.Hour),
+		WithEncoder(func(ms []flow.Metric) ([]byte, error) {
+			return []byte(ms[0].Subject), nil
+		}),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = s.Close() }()
+
+	for _, sub := range []string{"bad", "good"} {
+		if err = s.Write([]flow.Metric{{Subject: sub}}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var got []string
+	for len(got) < 2 {
+		select {
+		case b := <-bodies:
+			got = append(got, b)
+		case <-time.After(5 * time.Second):
+			t.Fatalf("expected the batch after the rejected batch to be sent, got %v", got)
+		}
+	}
+	if got[0] != "bad" || got[1] != "good" {
+		t.Errorf("expected [bad good], got %v", got)
+	}
+}
+
+func TestRetryable(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{name: "connection error", err: io.ErrUnexpectedEOF, want: true},
+		{name: "server error", err: statusError{code: http.StatusBadGateway}, want: true},
+		{name: "timeout", err: statusError{code: http.StatusRequestTimeout}, want: true},
+		{name: "rate limit", err: statusError{code: http.StatusTooManyRequests}, want: true},
+		{name: "bad request", err: statusError{code: http.StatusBadRequest}, want: false},
+		{name: "unauthorized", err: statusError{code: http.StatusUnauthorized}, want: false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := retryable(test.err); got != test.want {
+				t.Errorf("expected %t, got %t", test.want, got)
+			}
+		})
+	}
+}
+
+func TestEncode_IncludesRates(t *testing.T) {
+	b, err := encode([]flow.Metric{{Subject: "api", BytesIn: 10, PacketsIn: 2, PacketsOut: 3, BytesRate: 1, PacketsRate: 0.5}})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	var p struct {
+		Metrics []map[string]interface{} `json:"metrics"`
+	}
+	if err = json.Unmarshal(b, &p); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(p.Metrics) != 1 {
+		t.Fatalf("expected 1 metric, got %d", len(p.Metrics))
+	}
+	m := p.Metrics[0]
+	if m["packetsIn"] != float64(2) || m["packetsOut"] != float64(3) {
+		t.Errorf("unexpected packets in %v", m)
+	}
+	if m["bytesRate"] != float64(1) || m["packetsRate"] != 0.5 {
+		t.Errorf("unexpected rates in %v", m)
+	}
+}
@@ -0,0 +1,89 @@
+package ebpf
+
+import (
+	"sync/atomic"
+	"time"
+
+	"github.com/nrwiersma/ebpf/stats"
+)
+
+// StatsSink represents a sink of the internal metrics of the
+// application. Sinks that implement it receive the stats of
+// every interval, regardless of their resolution.
+type StatsSink interface {
+	WriteStats(s stats.Stats) error
+}
+
+// packetStats is implemented by packet sources
+// that report their internal state.
+type packetStats interface {
+	Attached() int
+	StashUsage() (entries, capacity int, err error)
+}
+
+// counters are the internal counters of the application.
+// They are reset at every interval.
+type counters struct {
+	read           uint64
+	lost           uint64
+	attaches       uint64
+	attachFailures uint64
+	detaches       uint64
+	detachFailures uint64
+}
+
+func (a *App) writeStats(series int) {
+	s := stats.Stats{
+		Timestamp:      time.Now().Truncate(a.inter).Unix(),
+		Node:           a.node,
+		ReadSamples:    atomic.SwapUint64(&a.cntrs.read, 0),
+		LostSamples:    atomic.SwapUint64(&a.cntrs.lost, 0),
+		Records:        a.mtrs.records,
+		Series:         series,
+		FlushDuration:  a.mtrs.flushDur.Seconds(),
+		Attaches:       atomic.SwapUint64(&a.cntrs.attaches, 0),
+		AttachFailures: atomic.SwapUint64(&a.cntrs.attachFailures, 0),
+		Detaches:       atomic.SwapUint64(&a.cntrs.detaches, 0),
+		DetachFailures: atomic.SwapUint64(&a.cntrs.detachFailures, 0),
+		Attached:       -1,
+		EventQueue:     len(a.ctrs.Events()),
+		StashEntries:   -1,
+		StashCapacity:  -1,
+	}
+	s.ReadRate = float64(s.ReadSamples) / a.inter.Seconds()
+
+	s.SampleRate = 1
+	if a.smpl != nil {
+		s.SampleRate = a.adjustSampling(s.ReadSamples, s.LostSamples)
+	}
+
+	if ps, ok := a.pkts.(packetStats); ok {
+		s.Attached = ps.Attached()
+
+		n, capacity, err := ps.StashUsage()
+		if err != nil {
+			a.log.Error("Unable to get stash usage", "error", err)
+		} else {
+			s.StashEntries, s.StashCapacity = n, capacity
+		}
+	}
+
+	if s.LostSamples > 0 {
+		a.log.Error("Lost events", "count", s.LostSamples, "read", s.ReadSamples)
+	}
+
+	seen := map[StatsSink]bool{}
+	for _, sinks := range a.sinks {
+		for _, sink := range sinks {
+			ss, ok := sink.(StatsSink)
+			if !ok || seen[ss] {
+				continue
+			}
+			seen[ss] = true
+
+			if err := ss.WriteStats(s); err != nil {
+				a.log.Error("Unable to write stats to sink", "error", err)
+			}
+		}
+	}
+}
@@ -0,0 +1,45 @@
+// Package stats contains the self-observability metrics of the agent.
+package stats
+
+// Stats contains the internal metrics of an agent over an interval.
+//
+// Counters are the deltas of the interval, gauges are
+// sampled at the end of the interval.
+type Stats struct {
+	Timestamp int64  `json:"timestamp"`
+	Node      string `json:"node,omitempty"`
+
+	// ReadSamples and LostSamples count the perf samples read
+	// and lost, ReadRate is the per second rate of read samples.
+	ReadSamples uint64  `json:"readSamples"`
+	LostSamples uint64  `json:"lostSamples"`
+	ReadRate    float64 `json:"readRate"`
+	// SampleRate is the 1 in N rate packets are sampled at
+	// in the kernel from the next interval on.
+	SampleRate uint32 `json:"sampleRate"`
+
+	// Records is the number of records aggregated in the
+	// flushed interval, Series the number of flushed series
+	// and FlushDuration the time the flush took in seconds.
+	Records       uint64  `json:"records"`
+	Series        int     `json:"series"`
+	FlushDuration float64 `json:"flushDuration"`
+
+	// Attaches and Detaches count the container attaches and
+	// detaches, and their failures. Attached is the number of
+	// containers currently attached.
+	Attaches       uint64 `json:"attaches"`
+	AttachFailures uint64 `json:"attachFailures"`
+	Detaches       uint64 `json:"detaches"`
+	DetachFailures uint64 `json:"detachFailures"`
+	Attached       int    `json:"attached"`
+
+	// EventQueue is the number of container events waiting to be handled.
+	EventQueue int `json:"eventQueue"`
+
+	// StashEntries and StashCapacity are the occupancy of the
+	// BPF map stashing packets awaiting their ACK. They are
+	// negative when unknown.
+	StashEntries  int `json:"stashEntries"`
+	StashCapacity int `json:"stashCapacity"`
+}
@@ -0,0 +1,128 @@
+package store
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/nrwiersma/ebpf/flow"
+)
+
+type jsonSeries struct {
+	Series
+	Points []point `json:"points"`
+}
+
+type point struct {
+	Timestamp   int64          `json:"timestamp"`
+	BytesIn     uint64         `json:"bytesIn"`
+	BytesOut    uint64         `json:"bytesOut"`
+	PacketsIn   uint64         `json:"packetsIn"`
+	PacketsOut  uint64         `json:"packetsOut"`
+	BytesRate   float64        `json:"bytesRate"`
+	PacketsRate float64        `json:"packetsRate"`
+	RTT         flow.Quantiles `json:"rtt"`
+	Size        flow.Quantiles `json:"size"`
+}
+
+func newPoint(m flow.Metric) point {
+	return point{
+		Timestamp:   m.Timestamp,
+		BytesIn:     m.BytesIn,
+		BytesOut:    m.BytesOut,
+		PacketsIn:   m.PacketsIn,
+		PacketsOut:  m.PacketsOut,
+		BytesRate:   m.BytesRate,
+		PacketsRate: m.PacketsRate,
+		RTT:         flow.NewQuantiles(m.RTT),
+		Size:        flow.NewQuantiles(m.Size),
+	}
+}
+
+// ServeHTTP serves range queries.
+//
+// The from and to query parameters are RFC 3339 times or unix
+// timestamps, defaulting to the last hour. The subject, remote,
+// namespace and port query parameters filter the edges, and
+// step merges the points into windows of the given duration.
+func (s *Store) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet {
+		rw.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	v := req.URL.Query()
+	q := Query{
+		To:        time.Now(),
+		Subject:   v.Get("subject"),
+		Remote:    v.Get("remote"),
+		Namespace: v.Get("namespace"),
+	}
+	var err error
+	if str := v.Get("to"); str != "" {
+		if q.To, err = parseTime(str); err != nil {
+			http.Error(rw, "invalid to", http.StatusBadRequest)
+			return
+		}
+	}
+	q.From = q.To.Add(-time.Hour)
+	if str := v.Get("from"); str != "" {
+		if q.From, err = parseTime(str); err != nil {
+			http.Error(rw, "invalid from", http.StatusBadRequest)
+			return
+		}
+	}
+	if str := v.Get("port"); str != "" {
+		port, err := strconv.ParseUint(str, 10, 16)
+		if err != nil {
+			http.Error(rw, "invalid port", http.StatusBadRequest)
+			return
+		}
+		q.Port = uint16(port)
+	}
+	if str := v.Get("step"); str != "" {
+		if q.Step, err = time.ParseDuration(str); err != nil {
+			http.Error(rw, "invalid step", http.StatusBadRequest)
+			return
+		}
+	}
+
+	series, err := s.Query(q)
+	if err != nil {
+		http.Error(rw, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	out := make([]jsonSeries, 0, len(series))
+	for _, ser := range series {
+		js := jsonSeries{Series: ser, Points: make([]point, 0, len(ser.Points))}
+		for _, m := range ser.Points {
+			js.Points = append(js.Points, newPoint(m))
+		}
+		out = append(out, js)
+	}
+
+	rw.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(rw).Encode(struct {
+		From   int64        `json:"from"`
+		To     int64        `json:"to"`
+		Series []jsonSeries `json:"series"`
+	}{
+		From:   q.From.Unix(),
+		To:     q.To.Unix(),
+		Series: out,
+	})
+}
+
+func parseTime(str string) (time.Time, error) {
+	if secs, err := strconv.ParseInt(str, 10, 64); err == nil {
+		return time.Unix(secs, 0), nil
+	}
+	t, err := time.Parse(time.RFC3339, str)
+	if err != nil {
+		return time.Time{}, errors.New("invalid time")
+	}
+	return t, nil
+}
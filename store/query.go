@@ -0,0 +1,177 @@
+package store
+
+import (
+	"errors"
+	"os"
+	"sort"
+	"time"
+
+	"github.com/nrwiersma/ebpf/flow"
+	"github.com/nrwiersma/ebpf/query"
+)
+
+// Query is a range query.
+type Query struct {
+	From time.Time
+	To   time.Time
+
+	// Subject and Remote match edges containing them.
+	Subject string
+	Remote  string
+	// Namespace matches edges with either end in the namespace.
+	Namespace string
+	Port      uint16
+
+	// Step merges the metrics into windows of the step.
+	// A zero step returns the metrics at their stored resolution.
+	Step time.Duration
+}
+
+// Series is the metrics of an edge over time.
+type Series struct {
+	Node      string        `json:"node,omitempty"`
+	Subject   string        `json:"subject,omitempty"`
+	Namespace string        `json:"namespace,omitempty"`
+	Workload  string        `json:"workload,omitempty"`
+	Remote    string        `json:"remote,omitempty"`
+	Port      uint16        `json:"port,omitempty"`
+	Protocol  string        `json:"protocol,omitempty"`
+	Direction string        `json:"direction,omitempty"`
+	Points    []flow.Metric `json:"-"`
+}
+
+// Query returns the series of the edges matching the query.
+func (s *Store) Query(q Query) ([]Series, error) {
+	if !q.From.Before(q.To) {
+		return nil, errors.New("from must be before to")
+	}
+	if q.Step < 0 || (q.Step > 0 && q.Step%time.Second != 0) {
+		return nil, errors.New("step must be a positive number of seconds")
+	}
+	from, to := q.From.Unix(), q.To.Unix()
+	step := int64(q.Step / time.Second)
+
+	filter := q.filter()
+	windows := map[int64]map[flow.Key]*flow.Metric{}
+	add := func(b batch) {
+		if b.Timestamp <= from || b.Timestamp > to {
+			return
+		}
+		ts := b.Timestamp
+		if step > 0 {
+			ts = (ts + step - 1) / step * step
+		}
+
+		w, ok := windows[ts]
+		if !ok {
+			w = map[flow.Key]*flow.Metric{}
+			windows[ts] = w
+		}
+		for _, m := range b.Metrics {
+			if !filter.Matches(m) {
+				continue
+			}
+			a := flow.MergeInto(w, ts, m)
+			if step == 0 {
+				a.BytesRate += m.BytesRate
+				a.PacketsRate += m.PacketsRate
+			}
+		}
+	}
+
+	// Only the listing is done under the lock, so writes are
+	// not blocked while the segments are read.
+	s.mu.Lock()
+	segs, err := s.segments()
+	s.mu.Unlock()
+	if err != nil {
+		return nil, err
+	}
+	for _, seg := range segs {
+		// Segments contain windows ending in their hour, and compaction
+		// can move the last windows to the next hour.
+		if seg.hour.Unix() > to || seg.hour.Add(time.Hour).Unix() < from-int64(s.compaction/time.Second) {
+			continue
+		}
+		if err = s.readListed(seg, add); err != nil {
+			return nil, err
+		}
+	}
+
+	series := map[flow.Key]*Series{}
+	for _, w := range windows {
+		for k, m := range w {
+			if step > 0 {
+				m.UpdateRates(q.Step)
+			}
+
+			ser, ok := series[k]
+			if !ok {
+				ser = &Series{
+					Node:      k.Node,
+					Subject:   k.Subject,
+					Namespace: k.Namespace,
+					Workload:  k.Workload,
+					Remote:    k.Remote,
+					Port:      k.Port,
+					Protocol:  k.Protocol,
+					Direction: k.Direction,
+				}
+				series[k] = ser
+			}
+			ser.Points = append(ser.Points, *m)
+		}
+	}
+
+	out := make([]Series, 0, len(series))
+	for _, ser := range series {
+		sort.Slice(ser.Points, func(i, j int) bool {
+			return ser.Points[i].Timestamp < ser.Points[j].Timestamp
+		})
+		out = append(out, *ser)
+	}
+	sort.Slice(out, func(i, j int) bool {
+		a, b := out[i], out[j]
+		if a.Subject != b.Subject {
+			return a.Subject < b.Subject
+		}
+		if a.Remote != b.Remote {
+			return a.Remote < b.Remote
+		}
+		if a.Port != b.Port {
+			return a.Port < b.Port
+		}
+		if a.Protocol != b.Protocol {
+			return a.Protocol < b.Protocol
+		}
+		if a.Direction != b.Direction {
+			return a.Direction < b.Direction
+		}
+		return a.Node < b.Node
+	})
+	return out, nil
+}
+
+// readListed reads a listed segment, which may have been compacted
+// or removed since it was listed. A compacted raw segment is read
+// from its compacted segment, a removed segment is skipped.
+func (s *Store) readListed(seg segment, fn func(b batch)) error {
+	err := readSegment(seg.path, fn)
+	if err != nil && errors.Is(err, os.ErrNotExist) && seg.raw {
+		err = readSegment(s.segmentPath(seg.hour, segExt), fn)
+	}
+	if err != nil && errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	return err
+}
+
+// filter returns the live query matching the same edges.
+func (q Query) filter() query.Query {
+	return query.Query{
+		Subject:   q.Subject,
+		Remote:    q.Remote,
+		Namespace: q.Namespace,
+		Port:      q.Port,
+	}
+}
@@ -0,0 +1,101 @@
+package store
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/nrwiersma/ebpf/flow"
+)
+
+func TestStore_QueryReadsCompactedSegment(t *testing.T) {
+	s, err := New(t.TempDir(), WithRetention(100*24*time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = s.Close() }()
+
+	hour := time.Date(2021, 3, 1, 10, 0, 0, 0, time.UTC)
+	for i := int64(1); i <= 3; i++ {
+		ts := hour.Unix() + i*10
+		if err = s.Write([]flow.Metric{{Timestamp: ts, Subject: "default/a", Remote: "default/b", BytesOut: 1}}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	s.mu.Lock()
+	segs, err := s.segments()
+	s.mu.Unlock()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(segs) != 1 || !segs[0].raw {
+		t.Fatalf("expected 1 raw segment, got %+v", segs)
+	}
+
+	// The segment is compacted after it was listed.
+	s.wg.Wait()
+	if err = s.compact(segs[0]); err != nil {
+		t.Fatal(err)
+	}
+
+	var bytes uint64
+	err = s.readListed(segs[0], func(b batch) {
+		for _, m := range b.Metrics {
+			bytes += m.BytesOut
+		}
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes != 3 {
+		t.Errorf("expected 3 bytes, got %d", bytes)
+	}
+}
+
+func TestStore_QueryDuringWrites(t *testing.T) {
+	s, err := New(t.TempDir(), WithRetention(100*24*time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = s.Close() }()
+
+	start := time.Date(2021, 3, 1, 10, 0, 0, 0, time.UTC).Unix()
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+
+		for i := int64(1); i <= 200; i++ {
+			err := s.Write([]flow.Metric{{Timestamp: start + i*60, Subject: "default/a", Remote: "default/b", BytesOut: 1}})
+			if err != nil {
+				t.Error(err)
+				return
+			}
+		}
+	}()
+
+	q := Query{From: time.Unix(start, 0), To: time.Unix(start+201*60, 0)}
+	for i := 0; i < 50; i++ {
+		if _, err = s.Query(q); err != nil {
+			t.Fatal(err)
+		}
+	}
+	wg.Wait()
+
+	series, err := s.Query(q)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(series) != 1 {
+		t.Fatalf("expected 1 series, got %d", len(series))
+	}
+	var bytes uint64
+	for _, p := range series[0].Points {
+		bytes += p.BytesOut
+	}
+	if bytes != 200 {
+		t.Errorf("expected 200 bytes, got %d", bytes)
+	}
+}
@@ -0,0 +1,360 @@
+// Package store implements an embedded store that keeps
+// per-edge metrics on local disk for a retention window.
+//
+// Metrics are appended to hourly segments. Once an hour
+// has passed, its segment is compacted by merging the
+// metrics and digests of each edge into coarser windows.
+package store
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/hamba/logger"
+	"github.com/nrwiersma/ebpf/flow"
+)
+
+const (
+	segmentLayout = "20060102T15"
+
+	// rawExt is the extension of segments being appended to.
+	rawExt = ".log"
+	// segExt is the extension of compacted segments.
+	segExt = ".seg"
+)
+
+// OptsFunc represents a configuration function for the store.
+type OptsFunc func(s *Store)
+
+// WithRetention configures how long metrics are kept.
+func WithRetention(d time.Duration) OptsFunc {
+	return func(s *Store) {
+		s.retention = d
+	}
+}
+
+// WithCompaction configures the window metrics are
+// merged into once their segment is compacted.
+func WithCompaction(d time.Duration) OptsFunc {
+	return func(s *Store) {
+		s.compaction = d
+	}
+}
+
+// WithLogger configures the logger of the store.
+func WithLogger(log logger.Logger) OptsFunc {
+	return func(s *Store) {
+		s.log = log
+	}
+}
+
+// batch is the metrics of a window as stored on disk.
+type batch struct {
+	Timestamp int64         `json:"timestamp"`
+	Metrics   []flow.Metric `json:"metrics"`
+}
+
+// Store keeps metrics in hourly segments on local disk.
+//
+// It implements a metrics sink, and should receive the
+// metrics of every interval.
+type Store struct {
+	dir        string
+	retention  time.Duration
+	compaction time.Duration
+
+	mu    sync.Mutex
+	hour  time.Time
+	file  *os.File
+	wg    sync.WaitGroup
+	busy  bool
+	next  time.Time
+	close bool
+
+	log logger.Logger
+}
+
+// New returns a store in the given directory.
+func New(dir string, opts ...OptsFunc) (*Store, error) {
+	if err := os.MkdirAll(dir, 0750); err != nil {
+		return nil, fmt.Errorf("unable to create store directory: %w", err)
+	}
+
+	s := &Store{
+		dir:        dir,
+		retention:  24 * time.Hour,
+		compaction: time.Minute,
+		log:        logger.New(logger.DiscardHandler()),
+	}
+
+	for _, opt := range opts {
+		opt(s)
+	}
+
+	return s, nil
+}
+
+// Write appends the metrics of a window to the store.
+func (s *Store) Write(ms []flow.Metric) error {
+	if len(ms) == 0 {
+		return nil
+	}
+
+	ts := ms[0].Timestamp
+	b, err := json.Marshal(batch{Timestamp: ts, Metrics: ms})
+	if err != nil {
+		return fmt.Errorf("unable to encode metrics: %w", err)
+	}
+	b = append(b, '\n')
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.close {
+		return nil
+	}
+
+	hour := time.Unix(ts, 0).UTC().Truncate(time.Hour)
+	if s.file == nil || !hour.Equal(s.hour) {
+		if err = s.rotate(hour); err != nil {
+			return err
+		}
+	}
+
+	if _, err = s.file.Write(b); err != nil {
+		return fmt.Errorf("unable to write segment: %w", err)
+	}
+	return nil
+}
+
+// rotate switches to the segment of the hour and starts maintenance
+// of the older segments. It must be called with the lock held.
+func (s *Store) rotate(hour time.Time) error {
+	if s.file != nil {
+		if err := s.file.Close(); err != nil {
+			s.log.Error("Unable to close segment", "error", err)
+		}
+		s.file = nil
+	}
+
+	f, err := os.OpenFile(s.segmentPath(hour, rawExt), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0640)
+	if err != nil {
+		return fmt.Errorf("unable to open segment: %w", err)
+	}
+	s.file = f
+	s.hour = hour
+
+	s.next = hour
+	if !s.busy {
+		s.busy = true
+		s.wg.Add(1)
+		go s.runMaintenance()
+	}
+	return nil
+}
+
+// runMaintenance maintains the segments until there
+// is no newer hour to maintain them for.
+func (s *Store) runMaintenance() {
+	defer s.wg.Done()
+
+	var last time.Time
+	for {
+		s.mu.Lock()
+		hour := s.next
+		if hour.Equal(last) || s.close {
+			s.busy = false
+			s.mu.Unlock()
+			return
+		}
+		s.mu.Unlock()
+
+		s.maintain(hour)
+		last = hour
+	}
+}
+
+// maintain removes segments past the retention and
+// compacts the segments before the given hour.
+func (s *Store) maintain(current time.Time) {
+	segs, err := s.segments()
+	if err != nil {
+		s.log.Error("Unable to list segments", "error", err)
+		return
+	}
+
+	cutoff := current.Add(-s.retention)
+	for _, seg := range segs {
+		switch {
+		case seg.hour.Add(time.Hour).Before(cutoff) || seg.hour.Add(time.Hour).Equal(cutoff):
+			s.mu.Lock()
+			err = os.Remove(seg.path)
+			s.mu.Unlock()
+			if err != nil && !os.IsNotExist(err) {
+				s.log.Error("Unable to remove segment", "path", seg.path, "error", err)
+			}
+		case seg.raw && seg.hour.Before(current):
+			if err = s.compact(seg); err != nil {
+				s.log.Error("Unable to compact segment", "path", seg.path, "error", err)
+			}
+		}
+	}
+}
+
+// compact merges the metrics of a raw segment into compaction windows.
+func (s *Store) compact(seg segment) error {
+	step := int64(s.compaction / time.Second)
+
+	windows := map[int64]map[flow.Key]*flow.Metric{}
+	err := readSegment(seg.path, func(b batch) {
+		ts := b.Timestamp
+		if step > 1 {
+			// Windows are labelled by their end, like flushed metrics.
+			ts = (ts + step - 1) / step * step
+		}
+
+		w, ok := windows[ts]
+		if !ok {
+			w = map[flow.Key]*flow.Metric{}
+			windows[ts] = w
+		}
+		for _, m := range b.Metrics {
+			flow.MergeInto(w, ts, m)
+		}
+	})
+	if err != nil {
+		return err
+	}
+
+	tss := make([]int64, 0, len(windows))
+	for ts := range windows {
+		tss = append(tss, ts)
+	}
+	sort.Slice(tss, func(i, j int) bool { return tss[i] < tss[j] })
+
+	tmp := strings.TrimSuffix(seg.path, rawExt) + segExt + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return fmt.Errorf("unable to create segment: %w", err)
+	}
+	w := bufio.NewWriter(f)
+	enc := json.NewEncoder(w)
+	for _, ts := range tss {
+		ms := make([]flow.Metric, 0, len(windows[ts]))
+		for _, m := range windows[ts] {
+			if step > 1 {
+				m.UpdateRates(s.compaction)
+			}
+			ms = append(ms, *m)
+		}
+		if err = enc.Encode(batch{Timestamp: ts, Metrics: ms}); err != nil {
+			_ = f.Close()
+			_ = os.Remove(tmp)
+			return fmt.Errorf("unable to write segment: %w", err)
+		}
+	}
+	if err = w.Flush(); err != nil {
+		_ = f.Close()
+		_ = os.Remove(tmp)
+		return fmt.Errorf("unable to write segment: %w", err)
+	}
+	if err = f.Close(); err != nil {
+		_ = os.Remove(tmp)
+		return fmt.Errorf("unable to write segment: %w", err)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err = os.Rename(tmp, strings.TrimSuffix(seg.path, rawExt)+segExt); err != nil {
+		return fmt.Errorf("unable to commit segment: %w", err)
+	}
+	return os.Remove(seg.path)
+}
+
+// Close closes the store.
+func (s *Store) Close() error {
+	s.mu.Lock()
+	s.close = true
+	var err error
+	if s.file != nil {
+		err = s.file.Close()
+		s.file = nil
+	}
+	s.mu.Unlock()
+
+	s.wg.Wait()
+	return err
+}
+
+type segment struct {
+	path string
+	hour time.Time
+	raw  bool
+}
+
+// segments returns the segments in the store, oldest first.
+func (s *Store) segments() ([]segment, error) {
+	entries, err := os.ReadDir(s.dir)
+	if err != nil {
+		return nil, err
+	}
+
+	var segs []segment
+	for _, e := range entries {
+		name := e.Name()
+		ext := filepath.Ext(name)
+		if e.IsDir() || (ext != rawExt && ext != segExt) || !strings.HasPrefix(name, "flows-") {
+			continue
+		}
+		hour, err := time.Parse(segmentLayout, strings.TrimSuffix(strings.TrimPrefix(name, "flows-"), ext))
+		if err != nil {
+			continue
+		}
+		segs = append(segs, segment{
+			path: filepath.Join(s.dir, name),
+			hour: hour,
+			raw:  ext == rawExt,
+		})
+	}
+	sort.Slice(segs, func(i, j int) bool {
+		return segs[i].hour.Before(segs[j].hour)
+	})
+	return segs, nil
+}
+
+func (s *Store) segmentPath(hour time.Time, ext string) string {
+	return filepath.Join(s.dir, "flows-"+hour.Format(segmentLayout)+ext)
+}
+
+// readSegment calls fn for each batch in the segment. A partially
+// written last batch, left by a crash, is ignored.
+func readSegment(path string, fn func(b batch)) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("unable to open segment: %w", err)
+	}
+	defer func() { _ = f.Close() }()
+
+	r := bufio.NewReaderSize(f, 1<<20)
+	for {
+		line, err := r.ReadBytes('\n')
+		if err != nil {
+			// A line without a newline was not completely written.
+			return nil
+		}
+
+		var b batch
+		if err = json.Unmarshal(line, &b); err != nil {
+			return fmt.Errorf("unable to decode segment %s: %w", filepath.Base(path), err)
+		}
+		fn(b)
+	}
+}
@@ -0,0 +1,141 @@
+package ebpf
+
+import (
+	"container/heap"
+	"sort"
+
+	"github.com/nrwiersma/ebpf/flow"
+)
+
+// topK tracks the heavy hitters of a stream of keyed values
+// in constant space.
+//
+// In sum mode it implements the space-saving algorithm: when
+// a new key arrives and the summary is full, it replaces the
+// smallest key and inherits its count. In max mode it
+// keeps the keys with the largest single value, which is exact.
+type topK struct {
+	k   int
+	sum bool
+
+	items map[flow.Key]*topKItem
+	heap  topKHeap
+}
+
+type topKItem struct {
+	key flow.Key
+	val float64
+	idx int
+}
+
+func newTopK(k int, sum bool) *topK {
+	return &topK{
+		k:     k,
+		sum:   sum,
+		items: make(map[flow.Key]*topKItem, k),
+		heap:  make(topKHeap, 0, k),
+	}
+}
+
+// Add adds a value for the key. If another key is evicted
+// to make room for it, the evicted key is returned.
+func (t *topK) Add(key flow.Key, v float64) (flow.Key, bool) {
+	if it, ok := t.items[key]; ok {
+		switch {
+		case t.sum:
+			it.val += v
+		case v > it.val:
+			it.val = v
+		default:
+			return flow.Key{}, false
+		}
+		heap.Fix(&t.heap, it.idx)
+		return flow.Key{}, false
+	}
+
+	if len(t.heap) < t.k {
+		it := &topKItem{key: key, val: v}
+		t.items[key] = it
+		heap.Push(&t.heap, it)
+		return flow.Key{}, false
+	}
+
+	it := t.heap[0]
+	if !t.sum && v <= it.val {
+		return flow.Key{}, false
+	}
+
+	evicted := it.key
+	delete(t.items, it.key)
+	it.key = key
+	if t.sum {
+		it.val += v
+	} else {
+		it.val = v
+	}
+	t.items[key] = it
+	heap.Fix(&t.heap, 0)
+	return evicted, true
+}
+
+// Has determines if the key is tracked.
+func (t *topK) Has(key flow.Key) bool {
+	_, ok := t.items[key]
+	return ok
+}
+
+// Items returns the tracked items.
+func (t *topK) Items() []topKItem {
+	items := make([]topKItem, 0, len(t.heap))
+	for _, it := range t.heap {
+		items = append(items, *it)
+	}
+	return items
+}
+
+// Reset removes all tracked items.
+func (t *topK) Reset() {
+	for k := range t.items {
+		delete(t.items, k)
+	}
+	t.heap = t.heap[:0]
+}
+
+// topKeys returns the keys of the n largest items.
+func topKeys(items []topKItem, n int) []flow.Key {
+	sort.Slice(items, func(i, j int) bool {
+		return items[i].val > items[j].val
+	})
+	if len(items) > n {
+		items = items[:n]
+	}
+
+	keys := make([]flow.Key, 0, len(items))
+	for _, it := range items {
+		keys = append(keys, it.key)
+	}
+	return keys
+}
+
+type topKHeap []*topKItem
+
+func (h topKHeap) Len() int           { return len(h) }
+func (h topKHeap) Less(i, j int) bool { return h[i].val < h[j].val }
+func (h topKHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].idx = i
+	h[j].idx = j
+}
+
+func (h *topKHeap) Push(x interface{}) {
+	it := x.(*topKItem)
+	it.idx = len(*h)
+	*h = append(*h, it)
+}
+
+func (h *topKHeap) Pop() interface{} {
+	old := *h
+	it := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return it
+}